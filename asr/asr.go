@@ -0,0 +1,97 @@
+package asr
+
+import (
+	"golang.org/x/net/context"
+)
+
+/*
+Recognizer Interface
+--------------------
+
+The Recognizer interface describes a speech to text
+backend. It takes raw audio along with a description of
+how that audio is encoded and returns the possible
+transcripts ranked from most to least likely.
+
+Backends live in their own packages (see gcp) so the
+voice service never depends on a specific vendor.
+*/
+
+type Encoding int
+
+const (
+	// LINEAR16 is uncompressed 16-bit signed little-endian samples.
+	LINEAR16 Encoding = iota
+	FLAC
+	MULAW
+)
+
+type Format struct {
+	Encoding   Encoding
+	SampleRate uint32
+
+	// Language is the BCP-47 code of the spoken language, eg.
+	// "en-US". Backends use their own default when it's empty.
+	Language string
+
+	// Phrases are words and phrases the speaker is likely to say.
+	// Backends that support it bias recognition towards them.
+	Phrases []string
+
+	// Alternatives is how many transcripts to ask for. Backends may
+	// return fewer, and only confidence score the most likely one.
+	Alternatives int
+}
+
+type Transcript struct {
+	Text       string  `json:"text"`
+	Confidence float32 `json:"confidence"`
+}
+
+type Recognizer interface {
+	Recognize(ctx context.Context, audio []byte, format Format) ([]Transcript, error)
+}
+
+// StreamResult is a partial recognition of streamed audio.
+// Once Final is set its transcripts will not change.
+type StreamResult struct {
+	Transcripts []Transcript `json:"transcripts"`
+	Final       bool         `json:"final"`
+}
+
+// Stream is a single streaming recognition. Recv returns
+// io.EOF once the backend has sent its last result.
+type Stream interface {
+	Send(audio []byte) error
+	CloseSend() error
+	Recv() (*StreamResult, error)
+}
+
+// StreamingRecognizer is a Recognizer that can recognize
+// audio while it is still being recorded.
+type StreamingRecognizer interface {
+	Recognizer
+	StreamRecognize(ctx context.Context, format Format) (Stream, error)
+}
+
+// LongRecognizer is a Recognizer that can also recognize audio
+// too long for a single request. LongRecognize blocks until the
+// whole clip is recognized, which can take minutes.
+type LongRecognizer interface {
+	Recognizer
+	LongRecognize(ctx context.Context, audio []byte, format Format) ([]Transcript, error)
+}
+
+// SampleRater is implemented by recognizers that work best at
+// a particular sample rate. Audio is resampled to it before
+// being recognized.
+type SampleRater interface {
+	SampleRate() uint32
+}
+
+// AudioLimiter is implemented by recognizers that take at most
+// MaxAudioSize bytes of audio in a single recognition, long
+// recognitions included.
+type AudioLimiter interface {
+	MaxAudioSize() int
+}
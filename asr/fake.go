@@ -0,0 +1,40 @@
+package asr
+
+import (
+	"golang.org/x/net/context"
+)
+
+/*
+FakeRecognizer
+--------------
+
+FakeRecognizer impliments the Recognizer interface without
+talking to any speech backend. It ignores the audio and
+always returns the same transcripts in the order they were
+given, which makes it useful for tests and for running vchd
+without cloud credentials.
+*/
+
+type FakeRecognizer struct {
+	transcripts []Transcript
+}
+
+func NewFakeRecognizer(texts ...string) Recognizer {
+	transcripts := []Transcript{}
+	for i, text := range texts {
+		confidence := 1 - float32(i)*0.1
+		if confidence < 0 {
+			confidence = 0
+		}
+		transcripts = append(transcripts, Transcript{
+			Text:       text,
+			Confidence: confidence,
+		})
+	}
+
+	return FakeRecognizer{transcripts}
+}
+
+func (f FakeRecognizer) Recognize(_ context.Context, _ []byte, _ Format) ([]Transcript, error) {
+	return f.transcripts, nil
+}
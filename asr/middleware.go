@@ -0,0 +1,206 @@
+package asr
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+)
+
+type Middleware func(Recognizer) Recognizer
+
+// recognizerMiddleware wraps every method a recognizer may have.
+// StreamRecognize and LongRecognize are only called when the wrapped
+// recognizer has them.
+type recognizerMiddleware interface {
+	Recognizer
+	StreamRecognize(ctx context.Context, format Format) (Stream, error)
+	LongRecognize(ctx context.Context, audio []byte, format Format) ([]Transcript, error)
+}
+
+type streamOnly struct{ mw recognizerMiddleware }
+
+func (s streamOnly) StreamRecognize(ctx context.Context, format Format) (Stream, error) {
+	return s.mw.StreamRecognize(ctx, format)
+}
+
+type longOnly struct{ mw recognizerMiddleware }
+
+func (l longOnly) LongRecognize(ctx context.Context, audio []byte, format Format) ([]Transcript, error) {
+	return l.mw.LongRecognize(ctx, audio, format)
+}
+
+type recognizeOnly struct{ mw recognizerMiddleware }
+
+func (r recognizeOnly) Recognize(ctx context.Context, audio []byte, format Format) ([]Transcript, error) {
+	return r.mw.Recognize(ctx, audio, format)
+}
+
+// wrap returns mw with only the optional interfaces of next, so the
+// voice service still finds its sample rate, streaming and long running
+// recognition.
+func wrap(next Recognizer, mw recognizerMiddleware) Recognizer {
+	rater, isRater := next.(SampleRater)
+	_, isStreaming := next.(StreamingRecognizer)
+	_, isLong := next.(LongRecognizer)
+	r, s, l := recognizeOnly{mw}, streamOnly{mw}, longOnly{mw}
+
+	switch {
+	case isRater && isStreaming && isLong:
+		return struct {
+			recognizeOnly
+			SampleRater
+			streamOnly
+			longOnly
+		}{r, rater, s, l}
+	case isRater && isStreaming:
+		return struct {
+			recognizeOnly
+			SampleRater
+			streamOnly
+		}{r, rater, s}
+	case isRater && isLong:
+		return struct {
+			recognizeOnly
+			SampleRater
+			longOnly
+		}{r, rater, l}
+	case isStreaming && isLong:
+		return struct {
+			recognizeOnly
+			streamOnly
+			longOnly
+		}{r, s, l}
+	case isRater:
+		return struct {
+			recognizeOnly
+			SampleRater
+		}{r, rater}
+	case isStreaming:
+		return struct {
+			recognizeOnly
+			streamOnly
+		}{r, s}
+	case isLong:
+		return struct {
+			recognizeOnly
+			longOnly
+		}{r, l}
+	}
+	return r
+}
+
+// InstrumentingMiddleware counts recognitions and measures how long they
+// take, labeled by whether they failed. Streaming recognitions are passed
+// through as they last as long as the speaker talks.
+func InstrumentingMiddleware(requests metrics.Counter, latency metrics.Histogram) Middleware {
+	return func(next Recognizer) Recognizer {
+		return wrap(next, instrumentingMiddleware{requests, latency, next})
+	}
+}
+
+type instrumentingMiddleware struct {
+	requests metrics.Counter
+	latency  metrics.Histogram
+	next     Recognizer
+}
+
+func (mw instrumentingMiddleware) observe(begin time.Time, err error) {
+	lvs := []string{"error", fmt.Sprint(err != nil)}
+	mw.requests.With(lvs...).Add(1)
+	mw.latency.With(lvs...).Observe(time.Since(begin).Seconds())
+}
+
+func (mw instrumentingMiddleware) Recognize(ctx context.Context, audio []byte, format Format) (t []Transcript, err error) {
+	defer func(begin time.Time) {
+		mw.observe(begin, err)
+	}(time.Now())
+	return mw.next.Recognize(ctx, audio, format)
+}
+
+func (mw instrumentingMiddleware) StreamRecognize(ctx context.Context, format Format) (Stream, error) {
+	return mw.next.(StreamingRecognizer).StreamRecognize(ctx, format)
+}
+
+func (mw instrumentingMiddleware) LongRecognize(ctx context.Context, audio []byte, format Format) (t []Transcript, err error) {
+	defer func(begin time.Time) {
+		mw.observe(begin, err)
+	}(time.Now())
+	return mw.next.(LongRecognizer).LongRecognize(ctx, audio, format)
+}
+
+// TracingMiddleware traces recognitions. Streaming recognitions are
+// traced until the last result is received.
+func TracingMiddleware(tracer trace.Tracer) Middleware {
+	return func(next Recognizer) Recognizer {
+		return wrap(next, tracingMiddleware{tracer, next})
+	}
+}
+
+type tracingMiddleware struct {
+	tracer trace.Tracer
+	next   Recognizer
+}
+
+func (mw tracingMiddleware) start(ctx context.Context, name string, audio []byte, format Format) (context.Context, trace.Span) {
+	return mw.tracer.Start(ctx, name, trace.WithAttributes(
+		attribute.Int("vch.audio_bytes", len(audio)),
+		attribute.Int64("vch.sample_rate", int64(format.SampleRate)),
+		attribute.String("vch.language", format.Language),
+	))
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (mw tracingMiddleware) Recognize(ctx context.Context, audio []byte, format Format) (t []Transcript, err error) {
+	ctx, span := mw.start(ctx, "asr.Recognize", audio, format)
+	defer func() {
+		endSpan(span, err)
+	}()
+	return mw.next.Recognize(ctx, audio, format)
+}
+
+func (mw tracingMiddleware) StreamRecognize(ctx context.Context, format Format) (Stream, error) {
+	ctx, span := mw.start(ctx, "asr.StreamRecognize", nil, format)
+	stream, err := mw.next.(StreamingRecognizer).StreamRecognize(ctx, format)
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+	return &tracingStream{Stream: stream, span: span}, nil
+}
+
+func (mw tracingMiddleware) LongRecognize(ctx context.Context, audio []byte, format Format) (t []Transcript, err error) {
+	ctx, span := mw.start(ctx, "asr.LongRecognize", audio, format)
+	defer func() {
+		endSpan(span, err)
+	}()
+	return mw.next.(LongRecognizer).LongRecognize(ctx, audio, format)
+}
+
+// tracingStream ends its span once Recv returns an error, io.EOF included.
+type tracingStream struct {
+	Stream
+	span trace.Span
+}
+
+func (s *tracingStream) Recv() (*StreamResult, error) {
+	result, err := s.Stream.Recv()
+	if err == io.EOF {
+		s.span.End()
+	} else if err != nil {
+		endSpan(s.span, err)
+	}
+	return result, err
+}
@@ -0,0 +1,75 @@
+package audio
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+/*
+Audio Decoding
+--------------
+
+Clients upload audio in whatever container their platform
+records to. Decode sniffs the format from the data itself,
+decodes it and downmixes it to a single channel of 16-bit
+samples, which is what every recognizer backend accepts.
+
+Supported formats are WAV (PCM of any bit depth, IEEE float
+and µ-law), FLAC, Ogg/Opus and Sun/NeXT .au files. Headerless
+µ-law can be decoded with DecodeMulaw.
+*/
+
+var ErrUnsupportedFormat = errors.New("unsupported audio format")
+
+// Clip is a decoded mono recording.
+type Clip struct {
+	Samples    []int16
+	SampleRate uint32
+}
+
+// MalformedError is returned when audio is in a supported format but
+// can't be decoded.
+type MalformedError struct {
+	Format string
+	Reason string
+}
+
+func (e *MalformedError) Error() string {
+	return fmt.Sprintf("malformed %s audio: %s", e.Format, e.Reason)
+}
+
+func malformed(format, reason string, args ...interface{}) error {
+	return &MalformedError{format, fmt.Sprintf(reason, args...)}
+}
+
+func Decode(data []byte) (*Clip, error) {
+	switch {
+	case len(data) >= 12 && bytes.Equal(data[0:4], []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WAVE")):
+		return decodeWAV(data)
+	case bytes.HasPrefix(data, []byte("fLaC")):
+		return decodeFLAC(data)
+	case bytes.HasPrefix(data, []byte("OggS")):
+		return decodeOggOpus(data)
+	case bytes.HasPrefix(data, []byte(".snd")):
+		return decodeAU(data)
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+}
+
+// Duration returns the length of the clip in seconds.
+func (c *Clip) Duration() float64 {
+	if c.SampleRate == 0 {
+		return 0
+	}
+	return float64(len(c.Samples)) / float64(c.SampleRate)
+}
+
+// Resample returns the clip converted to the given sample rate.
+func (c *Clip) Resample(rate uint32) *Clip {
+	return &Clip{
+		Samples:    Resample(c.Samples, c.SampleRate, rate),
+		SampleRate: rate,
+	}
+}
@@ -0,0 +1,106 @@
+package audio
+
+import (
+	"math"
+	"testing"
+)
+
+// sine returns n samples of a tone of freq Hz at rate.
+func sine(n int, freq, rate, amplitude float64) []int16 {
+	samples := make([]int16, n)
+	for i := range samples {
+		samples[i] = int16(amplitude * math.Sin(2*math.Pi*freq*float64(i)/rate))
+	}
+	return samples
+}
+
+// rms returns the RMS level of samples, as a fraction of full scale.
+func rms(samples []int16) float64 {
+	var sum float64
+	for _, s := range samples {
+		v := float64(s) / math.MaxInt16
+		sum += v * v
+	}
+	return math.Sqrt(sum / float64(len(samples)))
+}
+
+func equalSamples(t *testing.T, got, want []int16) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d samples, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("sample %d = %d, want %d\ngot  %v\nwant %v", i, got[i], want[i], got, want)
+		}
+	}
+}
+
+func TestDecodeRejects(t *testing.T) {
+	valid := flacFile(t, []int32{0, 100, 200, 300}, 1, 16000, 16, 2)
+
+	for _, tc := range []struct {
+		name      string
+		data      []byte
+		malformed bool
+	}{
+		{"empty", nil, false},
+		{"unknown format", []byte("ID3\x03\x00\x00\x00\x00\x00\x00 not really an mp3"), false},
+		{"truncated RIFF header", []byte("RIFF\x00\x00\x00\x00WAV"), false},
+
+		{"WAV without fmt chunk", wavFile(riffChunk("data", le16(1, 2))), true},
+		{"WAV without data chunk", wavFile(fmtChunk(wavPCM, 1, 16000, 16)), true},
+		{"WAV truncated fmt chunk", wavFile(riffChunk("fmt ", make([]byte, 10)), riffChunk("data", le16(1))), true},
+		{"WAV truncated extensible fmt chunk", wavFile(riffChunk("fmt ", fmtChunk(wavExtensible, 1, 16000, 16)[8:]), riffChunk("data", le16(1))), true},
+		{"WAV chunk past the end", wavFile(fmtChunk(wavPCM, 1, 16000, 16), riffChunk("LIST", make([]byte, 8))[:12]), true},
+		{"WAV without channels", wavFile(fmtChunk(wavPCM, 0, 16000, 16), riffChunk("data", le16(1))), true},
+		{"WAV without sample rate", wavFile(fmtChunk(wavPCM, 1, 0, 16), riffChunk("data", le16(1))), true},
+		{"WAV 40-bit", wavFile(fmtChunk(wavPCM, 1, 16000, 40), riffChunk("data", make([]byte, 10))), true},
+		{"WAV 16-bit float", wavFile(fmtChunk(wavFloat, 1, 16000, 16), riffChunk("data", le16(1))), true},
+		{"WAV MP3", wavFile(fmtChunk(0x0055, 1, 16000, 0), riffChunk("data", []byte{0xff, 0xfb})), false},
+
+		{"FLAC truncated header", valid[:20], true},
+		{"FLAC truncated frame", valid[:len(valid)-3], true},
+		{"FLAC corrupt frame", corrupt(valid, len(valid)-4), true},
+
+		{"Ogg truncated page", oggOpusFile(t, 1, 312, sine(4800, 440, 48000, 8000))[:100], true},
+		{"Ogg bad page", append(oggOpusFile(t, 1, 312, sine(960, 440, 48000, 8000)), "OggS\x00garbage"...), true},
+		{"Ogg Vorbis", oggFile(1, [][]byte{[]byte("\x01vorbis\x00\x00\x00\x00\x01"), []byte("\x03vorbis")}), false},
+
+		{"AU truncated header", []byte(".snd\x00\x00\x00\x18"), true},
+		{"AU data past the end", auFile(100, auLinear16, 8000, 1, nil)[:24], true},
+		{"AU ADPCM", auFile(24, 23, 8000, 1, []byte{1, 2, 3}), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clip, err := Decode(tc.data)
+			if err == nil {
+				t.Fatalf("decoded %d samples, want an error", len(clip.Samples))
+			}
+
+			_, malformed := err.(*MalformedError)
+			switch {
+			case tc.malformed && !malformed:
+				t.Errorf("err = %v, want a MalformedError", err)
+			case !tc.malformed && err != ErrUnsupportedFormat:
+				t.Errorf("err = %v, want ErrUnsupportedFormat", err)
+			}
+		})
+	}
+}
+
+// corrupt returns a copy of data with the byte at i flipped.
+func corrupt(data []byte, i int) []byte {
+	c := append([]byte(nil), data...)
+	c[i] ^= 0xff
+	return c
+}
+
+func TestClipDuration(t *testing.T) {
+	clip := &Clip{Samples: make([]int16, 8000), SampleRate: 16000}
+	if d := clip.Duration(); d != 0.5 {
+		t.Errorf("duration = %v, want 0.5", d)
+	}
+	if d := (&Clip{Samples: make([]int16, 10)}).Duration(); d != 0 {
+		t.Errorf("duration without a sample rate = %v, want 0", d)
+	}
+}
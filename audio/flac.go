@@ -0,0 +1,64 @@
+package audio
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/mewkiz/flac"
+)
+
+func decodeFLAC(data []byte) (*Clip, error) {
+	stream, err := flac.New(bytes.NewReader(data))
+	if err != nil {
+		return nil, malformed("FLAC", "%v", err)
+	}
+	defer stream.Close()
+
+	info := stream.Info
+	if info.SampleRate == 0 || info.NChannels == 0 {
+		return nil, malformed("FLAC", "invalid stream info")
+	}
+
+	// shift samples of any bit depth to 16 bits
+	shift := int(info.BitsPerSample) - 16
+
+	samples := make([]int16, 0, info.NSamples)
+	for {
+		frame, err := stream.ParseNext()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, malformed("FLAC", "%v", err)
+		}
+
+		channels := len(frame.Subframes)
+		if channels == 0 {
+			return nil, malformed("FLAC", "frame without subframes")
+		}
+		for _, subframe := range frame.Subframes {
+			if len(subframe.Samples) < int(frame.BlockSize) {
+				return nil, malformed("FLAC", "short subframe")
+			}
+		}
+
+		for i := 0; i < int(frame.BlockSize); i++ {
+			var sum int64
+			for _, subframe := range frame.Subframes {
+				sum += int64(subframe.Samples[i])
+			}
+			sample := sum / int64(channels)
+			if shift > 0 {
+				sample >>= uint(shift)
+			} else {
+				sample <<= uint(-shift)
+			}
+			samples = append(samples, int16(sample))
+		}
+	}
+
+	return &Clip{
+		Samples:    samples,
+		SampleRate: info.SampleRate,
+	}, nil
+}
@@ -0,0 +1,148 @@
+package audio
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// flacFile encodes interleaved samples as a FLAC stream of verbatim
+// subframes, which is all the decoder needs to be exercised.
+func flacFile(t *testing.T, samples []int32, channels, rate, bits, blockSize int) []byte {
+	t.Helper()
+
+	sizeCodes := map[int]byte{8: 1, 16: 4, 24: 6}
+	sizeCode, ok := sizeCodes[bits]
+	if !ok {
+		t.Fatalf("can't encode %d-bit FLAC", bits)
+	}
+	n := len(samples) / channels
+
+	// STREAMINFO can't declare blocks of less than 16 samples, frames
+	// aren't held to it
+	info := make([]byte, 34)
+	binary.BigEndian.PutUint16(info[0:], 16)
+	binary.BigEndian.PutUint16(info[2:], 16)
+	binary.BigEndian.PutUint64(info[10:], uint64(rate)<<44|uint64(channels-1)<<41|uint64(bits-1)<<36|uint64(n))
+	b := append([]byte("fLaC\x80\x00\x00\x22"), info...)
+
+	for frame := 0; frame*blockSize < n; frame++ {
+		size := blockSize
+		if rest := n - frame*blockSize; rest < size {
+			size = rest
+		}
+
+		// the block size is in the header, the sample rate comes from STREAMINFO
+		header := []byte{0xff, 0xf8, 0x70, byte(channels-1)<<4 | sizeCode<<1, byte(frame), 0, 0}
+		binary.BigEndian.PutUint16(header[5:], uint16(size-1))
+		header = append(header, crc8(header))
+
+		body := header
+		for c := 0; c < channels; c++ {
+			body = append(body, 0x02)
+			for i := 0; i < size; i++ {
+				s := samples[(frame*blockSize+i)*channels+c]
+				for shift := bits - 8; shift >= 0; shift -= 8 {
+					body = append(body, byte(s>>uint(shift)))
+				}
+			}
+		}
+		crc := crc16(body)
+		b = append(b, body...)
+		b = append(b, byte(crc>>8), byte(crc))
+	}
+	return b
+}
+
+func crc8(data []byte) byte {
+	crc := byte(0)
+	for _, d := range data {
+		crc ^= d
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func crc16(data []byte) uint16 {
+	crc := uint16(0)
+	for _, d := range data {
+		crc ^= uint16(d) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x8005
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func TestDecodeFLAC(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		samples  []int32
+		channels int
+		rate     int
+		bits     int
+		want     []int16
+	}{
+		{
+			name:     "8-bit",
+			samples:  []int32{0, 1, -1, 127, -128},
+			channels: 1,
+			rate:     8000,
+			bits:     8,
+			want:     []int16{0, 256, -256, 32512, -32768},
+		},
+		{
+			name:     "16-bit",
+			samples:  []int32{0, 1000, -1000, 32767, -32768, 12},
+			channels: 1,
+			rate:     16000,
+			bits:     16,
+			want:     []int16{0, 1000, -1000, 32767, -32768, 12},
+		},
+		{
+			name:     "24-bit",
+			samples:  []int32{0, 0x123456, -0x123456, 0x7fffff, -0x800000},
+			channels: 1,
+			rate:     48000,
+			bits:     24,
+			want:     []int16{0, 0x1234, -0x1235, 0x7fff, -0x8000},
+		},
+		{
+			name:     "stereo",
+			samples:  []int32{100, 300, -200, 0, 32767, 32767, -32768, -32768},
+			channels: 2,
+			rate:     44100,
+			bits:     16,
+			want:     []int16{200, -100, 32767, -32768},
+		},
+		{
+			name:     "4 channel 24-bit",
+			samples:  []int32{0x010000, 0x020000, 0x030000, 0x060000, -0x040000, 0, 0, 0},
+			channels: 4,
+			rate:     96000,
+			bits:     24,
+			want:     []int16{0x0300, -0x0100},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// a block size of 2 spreads the samples over several frames
+			clip, err := Decode(flacFile(t, tc.samples, tc.channels, tc.rate, tc.bits, 2))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if clip.SampleRate != uint32(tc.rate) {
+				t.Errorf("sample rate = %d, want %d", clip.SampleRate, tc.rate)
+			}
+			equalSamples(t, clip.Samples, tc.want)
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package audio
+
+import (
+	"encoding/binary"
+)
+
+// mulawSample expands a single G.711 µ-law byte.
+func mulawSample(b byte) int16 {
+	b = ^b
+	sign := b & 0x80
+	exponent := (b >> 4) & 0x07
+	mantissa := b & 0x0f
+	sample := (int16(mantissa)<<3 + 0x84) << exponent
+	sample -= 0x84
+	if sign != 0 {
+		return -sample
+	}
+	return sample
+}
+
+func decodeMulaw(data []byte) []int16 {
+	samples := make([]int16, len(data))
+	for i, b := range data {
+		samples[i] = mulawSample(b)
+	}
+	return samples
+}
+
+// DecodeMulaw decodes headerless µ-law audio, eg. an audio/basic upload.
+func DecodeMulaw(data []byte, sampleRate uint32, channels int) *Clip {
+	return &Clip{
+		Samples:    Downmix(decodeMulaw(data), channels),
+		SampleRate: sampleRate,
+	}
+}
+
+// Sun/NeXT .au encodings
+const (
+	auMulaw    = 1
+	auLinear8  = 2
+	auLinear16 = 3
+)
+
+func decodeAU(data []byte) (*Clip, error) {
+	if len(data) < 24 {
+		return nil, malformed("AU", "header is truncated")
+	}
+
+	// .au is big-endian throughout
+	offset := binary.BigEndian.Uint32(data[4:8])
+	size := binary.BigEndian.Uint32(data[8:12])
+	encoding := binary.BigEndian.Uint32(data[12:16])
+	rate := binary.BigEndian.Uint32(data[16:20])
+	channels := int(binary.BigEndian.Uint32(data[20:24]))
+
+	if offset < 24 || int(offset) > len(data) {
+		return nil, malformed("AU", "data offset %d is out of range", offset)
+	}
+	if rate == 0 || channels < 1 {
+		return nil, malformed("AU", "invalid sample rate or channel count")
+	}
+
+	body := data[offset:]
+	// 0xffffffff means the size is unknown
+	if size != 0xffffffff && int(size) < len(body) {
+		body = body[:size]
+	}
+
+	var samples []int16
+	switch encoding {
+	case auMulaw:
+		samples = decodeMulaw(body)
+	case auLinear8:
+		samples = make([]int16, len(body))
+		for i, b := range body {
+			samples[i] = int16(int8(b)) << 8
+		}
+	case auLinear16:
+		samples = make([]int16, len(body)/2)
+		for i := range samples {
+			samples[i] = int16(binary.BigEndian.Uint16(body[i*2:]))
+		}
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+
+	return &Clip{
+		Samples:    Downmix(samples, channels),
+		SampleRate: rate,
+	}, nil
+}
@@ -0,0 +1,120 @@
+package audio
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func auFile(offset uint32, encoding uint32, rate uint32, channels uint32, body []byte) []byte {
+	header := make([]byte, 24)
+	copy(header, ".snd")
+	binary.BigEndian.PutUint32(header[4:], offset)
+	binary.BigEndian.PutUint32(header[8:], uint32(len(body)))
+	binary.BigEndian.PutUint32(header[12:], encoding)
+	binary.BigEndian.PutUint32(header[16:], rate)
+	binary.BigEndian.PutUint32(header[20:], channels)
+	// anything between the header and the data offset is annotation
+	for len(header) < int(offset) {
+		header = append(header, 0)
+	}
+	return append(header, body...)
+}
+
+func TestMulawSample(t *testing.T) {
+	for _, tc := range []struct {
+		in   byte
+		want int16
+	}{
+		{0xff, 0},
+		{0x7f, 0},
+		{0xfe, 8},
+		{0x7e, -8},
+		{0xf0, 120},
+		{0xef, 132},
+		{0x80, 32124},
+		{0x00, -32124},
+	} {
+		if got := mulawSample(tc.in); got != tc.want {
+			t.Errorf("mulawSample(%#02x) = %d, want %d", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestDecodeMulaw(t *testing.T) {
+	clip := DecodeMulaw([]byte{0x80, 0x00, 0xfe, 0xfe}, 8000, 2)
+	if clip.SampleRate != 8000 {
+		t.Errorf("sample rate = %d, want 8000", clip.SampleRate)
+	}
+	equalSamples(t, clip.Samples, []int16{0, 8})
+}
+
+func TestDecodeAU(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		file []byte
+		rate uint32
+		want []int16
+	}{
+		{
+			name: "µ-law",
+			file: auFile(24, auMulaw, 8000, 1, []byte{0xff, 0x80, 0x00}),
+			rate: 8000,
+			want: []int16{0, 32124, -32124},
+		},
+		{
+			name: "8-bit",
+			file: auFile(24, auLinear8, 11025, 1, []byte{0, 1, 0x7f, 0x80, 0xff}),
+			rate: 11025,
+			want: []int16{0, 256, 32512, -32768, -256},
+		},
+		{
+			name: "16-bit",
+			file: auFile(24, auLinear16, 16000, 1, []byte{0x00, 0x01, 0x12, 0x34, 0xff, 0xff}),
+			rate: 16000,
+			want: []int16{1, 0x1234, -1},
+		},
+		{
+			name: "stereo",
+			file: auFile(24, auLinear16, 16000, 2, []byte{0x00, 0x64, 0x01, 0x2c, 0xff, 0x38, 0x00, 0x00}),
+			rate: 16000,
+			want: []int16{200, -100},
+		},
+		{
+			name: "annotation",
+			file: auFile(32, auMulaw, 8000, 1, []byte{0xfe}),
+			rate: 8000,
+			want: []int16{8},
+		},
+		{
+			name: "trailing bytes after the data size",
+			file: func() []byte {
+				f := auFile(24, auMulaw, 8000, 1, []byte{0xfe, 0xfe})
+				binary.BigEndian.PutUint32(f[8:], 1)
+				return f
+			}(),
+			rate: 8000,
+			want: []int16{8},
+		},
+		{
+			name: "unknown data size",
+			file: func() []byte {
+				f := auFile(24, auMulaw, 8000, 1, []byte{0xfe, 0x7e})
+				binary.BigEndian.PutUint32(f[8:], 0xffffffff)
+				return f
+			}(),
+			rate: 8000,
+			want: []int16{8, -8},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clip, err := Decode(tc.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if clip.SampleRate != tc.rate {
+				t.Errorf("sample rate = %d, want %d", clip.SampleRate, tc.rate)
+			}
+			equalSamples(t, clip.Samples, tc.want)
+		})
+	}
+}
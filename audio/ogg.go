@@ -0,0 +1,104 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Opus is always decoded at 48kHz, whatever rate the encoder was fed.
+const opusSampleRate = 48000
+
+// oggPackets splits the packets of the first logical stream out of an
+// Ogg bitstream.
+func oggPackets(data []byte) ([][]byte, error) {
+	var packets [][]byte
+	var packet []byte
+	serial := uint32(0)
+	first := true
+
+	for pos := 0; pos < len(data); {
+		if len(data)-pos < 27 || !bytes.Equal(data[pos:pos+4], []byte("OggS")) {
+			return nil, malformed("Ogg", "bad page header at offset %d", pos)
+		}
+
+		header := data[pos : pos+27]
+		pageSerial := binary.LittleEndian.Uint32(header[14:18])
+		segments := int(header[26])
+		if len(data)-pos < 27+segments {
+			return nil, malformed("Ogg", "truncated segment table at offset %d", pos)
+		}
+		table := data[pos+27 : pos+27+segments]
+
+		bodySize := 0
+		for _, lacing := range table {
+			bodySize += int(lacing)
+		}
+		body := pos + 27 + segments
+		if len(data)-body < bodySize {
+			return nil, malformed("Ogg", "truncated page at offset %d", pos)
+		}
+		pos = body + bodySize
+
+		if first {
+			serial = pageSerial
+			first = false
+		}
+		if pageSerial != serial {
+			continue
+		}
+
+		// a packet ends on the first lacing value below 255
+		for _, lacing := range table {
+			packet = append(packet, data[body:body+int(lacing)]...)
+			body += int(lacing)
+			if lacing < 255 {
+				packets = append(packets, packet)
+				packet = nil
+			}
+		}
+	}
+
+	return packets, nil
+}
+
+func decodeOggOpus(data []byte) (*Clip, error) {
+	packets, err := oggPackets(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// the first packet is the OpusHead header, the second holds tags
+	if len(packets) < 2 || len(packets[0]) < 19 || !bytes.HasPrefix(packets[0], []byte("OpusHead")) {
+		return nil, ErrUnsupportedFormat
+	}
+	head := packets[0]
+	channels := int(head[9])
+	preSkip := int(binary.LittleEndian.Uint16(head[10:12]))
+	if channels < 1 || channels > 2 {
+		return nil, malformed("Opus", "unsupported channel count %d", channels)
+	}
+
+	decoder, err := NewOpusDecoder(opusSampleRate, channels)
+	if err != nil {
+		return nil, err
+	}
+
+	var samples []int16
+	for _, packet := range packets[2:] {
+		pcm, err := decoder.Decode(packet)
+		if err != nil {
+			return nil, malformed("Opus", "%v", err)
+		}
+		samples = append(samples, pcm...)
+	}
+
+	// the pre-skip is priming output from the encoder
+	if preSkip > len(samples) {
+		preSkip = len(samples)
+	}
+
+	return &Clip{
+		Samples:    samples[preSkip:],
+		SampleRate: opusSampleRate,
+	}, nil
+}
@@ -0,0 +1,160 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"gopkg.in/hraban/opus.v2"
+)
+
+// oggFile puts each packet on a page of its own.
+func oggFile(serial uint32, packets [][]byte) []byte {
+	var b []byte
+	for i, packet := range packets {
+		header := make([]byte, 27)
+		copy(header, "OggS")
+		switch {
+		case i == 0:
+			header[5] = 0x02
+		case i == len(packets)-1:
+			header[5] = 0x04
+		}
+		binary.LittleEndian.PutUint32(header[14:], serial)
+		binary.LittleEndian.PutUint32(header[18:], uint32(i))
+
+		// packets of 255 or more bytes continue over several lacing values
+		var table []byte
+		for n := len(packet); ; n -= 255 {
+			if n < 255 {
+				table = append(table, byte(n))
+				break
+			}
+			table = append(table, 255)
+		}
+		header[26] = byte(len(table))
+
+		page := append(append(header, table...), packet...)
+		binary.LittleEndian.PutUint32(page[22:], oggCRC(page))
+		b = append(b, page...)
+	}
+	return b
+}
+
+func oggCRC(page []byte) uint32 {
+	crc := uint32(0)
+	for _, d := range page {
+		crc ^= uint32(d) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// oggOpusFile encodes interleaved 48kHz samples as 20ms Opus packets.
+func oggOpusFile(t *testing.T, channels int, preSkip int, samples []int16) []byte {
+	t.Helper()
+
+	encoder, err := opus.NewEncoder(opusSampleRate, channels, opus.AppAudio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a high bitrate makes packets longer than a single lacing value
+	if err := encoder.SetBitrate(128000 * channels); err != nil {
+		t.Fatal(err)
+	}
+
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8] = 1
+	head[9] = byte(channels)
+	binary.LittleEndian.PutUint16(head[10:], uint16(preSkip))
+	binary.LittleEndian.PutUint32(head[12:], opusSampleRate)
+	packets := [][]byte{head, []byte("OpusTags\x03\x00\x00\x00vch\x00\x00\x00\x00")}
+
+	frame := 960 * channels
+	for i := 0; i < len(samples); i += frame {
+		pcm := make([]int16, frame)
+		copy(pcm, samples[i:])
+		packet := make([]byte, 4000)
+		n, err := encoder.Encode(pcm, packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, packet[:n])
+	}
+	return oggFile(0x5ec, packets)
+}
+
+// interleave repeats each sample on every channel.
+func interleave(samples []int16, channels int) []int16 {
+	out := make([]int16, 0, len(samples)*channels)
+	for _, s := range samples {
+		for c := 0; c < channels; c++ {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func TestDecodeOggOpus(t *testing.T) {
+	tone := sine(48000, 440, 48000, 8000)
+
+	for _, tc := range []struct {
+		name     string
+		channels int
+		preSkip  int
+	}{
+		{"mono", 1, 312},
+		{"stereo", 2, 312},
+		{"no pre-skip", 1, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clip, err := Decode(oggOpusFile(t, tc.channels, tc.preSkip, interleave(tone, tc.channels)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if clip.SampleRate != opusSampleRate {
+				t.Errorf("sample rate = %d, want %d", clip.SampleRate, opusSampleRate)
+			}
+			if want := len(tone) - tc.preSkip; len(clip.Samples) != want {
+				t.Errorf("got %d samples, want %d", len(clip.Samples), want)
+			}
+
+			// Opus is lossy, the level of the tone should survive it
+			if got, want := rms(clip.Samples), rms(tone); math.Abs(got-want) > want/10 {
+				t.Errorf("RMS = %.3f, want %.3f", got, want)
+			}
+		})
+	}
+}
+
+func TestOggPackets(t *testing.T) {
+	long := bytes.Repeat([]byte{1}, 600)
+	exact := bytes.Repeat([]byte{2}, 255)
+
+	// pages of a second logical stream are skipped
+	data := append(oggFile(1, [][]byte{long, exact}), oggFile(2, [][]byte{[]byte("other")})...)
+	data = append(data, oggFile(1, [][]byte{{}, {3}})...)
+
+	packets, err := oggPackets(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]byte{long, exact, {}, {3}}
+	if len(packets) != len(want) {
+		t.Fatalf("got %d packets, want %d", len(packets), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(packets[i], want[i]) {
+			t.Errorf("packet %d is %d bytes, want %d", i, len(packets[i]), len(want[i]))
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package audio
+
+import (
+	"fmt"
+
+	"gopkg.in/hraban/opus.v2"
+)
+
+// maxOpusFrame is the longest Opus frame, 120ms at 48kHz.
+const maxOpusFrame = 5760
+
+// OpusDecoder decodes a sequence of raw Opus packets into mono PCM.
+type OpusDecoder struct {
+	decoder  *opus.Decoder
+	channels int
+	pcm      []int16
+}
+
+func NewOpusDecoder(sampleRate uint32, channels int) (*OpusDecoder, error) {
+	if channels < 1 {
+		channels = 1
+	}
+
+	decoder, err := opus.NewDecoder(int(sampleRate), channels)
+	if err != nil {
+		return nil, fmt.Errorf("Opus Error: %v", err)
+	}
+
+	return &OpusDecoder{
+		decoder:  decoder,
+		channels: channels,
+		pcm:      make([]int16, maxOpusFrame*channels),
+	}, nil
+}
+
+// Decode decodes a single Opus packet. Packets must be passed in the
+// order they were encoded.
+func (d *OpusDecoder) Decode(packet []byte) ([]int16, error) {
+	n, err := d.decoder.Decode(packet, d.pcm)
+	if err != nil {
+		return nil, fmt.Errorf("Opus Error: %v", err)
+	}
+
+	samples := make([]int16, n*d.channels)
+	copy(samples, d.pcm)
+	return Downmix(samples, d.channels), nil
+}
@@ -0,0 +1,41 @@
+package audio
+
+import (
+	"encoding/binary"
+)
+
+// Linear16 encodes samples as 16-bit signed little-endian PCM.
+func Linear16(samples []int16) []byte {
+	b := make([]byte, len(samples)*2)
+	for i, s := range samples {
+		binary.LittleEndian.PutUint16(b[i*2:], uint16(s))
+	}
+	return b
+}
+
+// Samples decodes 16-bit signed little-endian PCM. A trailing odd
+// byte is ignored.
+func Samples(b []byte) []int16 {
+	samples := make([]int16, len(b)/2)
+	for i := range samples {
+		samples[i] = int16(binary.LittleEndian.Uint16(b[i*2:]))
+	}
+	return samples
+}
+
+// Downmix averages interleaved channels down to a single channel.
+func Downmix(samples []int16, channels int) []int16 {
+	if channels <= 1 {
+		return samples
+	}
+
+	mono := make([]int16, len(samples)/channels)
+	for i := range mono {
+		var sum int
+		for c := 0; c < channels; c++ {
+			sum += int(samples[i*channels+c])
+		}
+		mono[i] = int16(sum / channels)
+	}
+	return mono
+}
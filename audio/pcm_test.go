@@ -0,0 +1,39 @@
+package audio
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLinear16(t *testing.T) {
+	samples := []int16{0, 1, -1, 32767, -32768}
+	b := Linear16(samples)
+	if want := []byte{0, 0, 1, 0, 0xff, 0xff, 0xff, 0x7f, 0, 0x80}; !bytes.Equal(b, want) {
+		t.Errorf("Linear16 = %v, want %v", b, want)
+	}
+	equalSamples(t, Samples(b), samples)
+
+	// a trailing odd byte is ignored
+	equalSamples(t, Samples(append(b, 7)), samples)
+}
+
+func TestDownmix(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		samples  []int16
+		channels int
+		want     []int16
+	}{
+		{"mono", []int16{1, 2, 3}, 1, []int16{1, 2, 3}},
+		{"no channels", []int16{1, 2, 3}, 0, []int16{1, 2, 3}},
+		{"stereo", []int16{100, 300, -200, 0}, 2, []int16{200, -100}},
+		{"full scale does not overflow", []int16{32767, 32767, -32768, -32768}, 2, []int16{32767, -32768}},
+		{"rounds toward zero", []int16{1, 2, -1, -2}, 2, []int16{1, -1}},
+		{"three channels", []int16{3, 6, 9, 0, 0, 30}, 3, []int16{6, 10}},
+		{"partial frame is dropped", []int16{2, 4, 6}, 2, []int16{3}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			equalSamples(t, Downmix(tc.samples, tc.channels), tc.want)
+		})
+	}
+}
@@ -0,0 +1,24 @@
+package audio
+
+// Resample converts mono samples between sample rates using linear
+// interpolation. That is plenty for speech going to a recognizer.
+func Resample(samples []int16, from, to uint32) []int16 {
+	if from == to || from == 0 || to == 0 || len(samples) == 0 {
+		return samples
+	}
+
+	n := int(uint64(len(samples)) * uint64(to) / uint64(from))
+	out := make([]int16, n)
+	step := float64(from) / float64(to)
+	for i := range out {
+		pos := float64(i) * step
+		j := int(pos)
+		if j >= len(samples)-1 {
+			out[i] = samples[len(samples)-1]
+			continue
+		}
+		frac := pos - float64(j)
+		out[i] = int16(float64(samples[j])*(1-frac) + float64(samples[j+1])*frac)
+	}
+	return out
+}
@@ -0,0 +1,46 @@
+package audio
+
+import (
+	"math"
+	"testing"
+)
+
+func TestResample(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		samples  []int16
+		from, to uint32
+		want     []int16
+	}{
+		{"same rate", []int16{1, 2, 3}, 16000, 16000, []int16{1, 2, 3}},
+		{"unknown rate", []int16{1, 2, 3}, 0, 16000, []int16{1, 2, 3}},
+		{"empty", []int16{}, 8000, 16000, []int16{}},
+		{"upsample", []int16{0, 100, 200, -200}, 8000, 16000, []int16{0, 50, 100, 150, 200, 0, -200, -200}},
+		{"downsample", []int16{0, 10, 20, 30, 40, 50}, 48000, 16000, []int16{0, 30}},
+		{"fractional", []int16{0, 300, 600, 900}, 16000, 12000, []int16{0, 400, 800}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			equalSamples(t, Resample(tc.samples, tc.from, tc.to), tc.want)
+		})
+	}
+}
+
+func TestResampleTone(t *testing.T) {
+	// a tone well below both Nyquist frequencies keeps its pitch and level
+	tone := sine(44100, 440, 44100, 16000)
+	clip := (&Clip{Samples: tone, SampleRate: 44100}).Resample(16000)
+
+	if clip.SampleRate != 16000 {
+		t.Errorf("sample rate = %d, want 16000", clip.SampleRate)
+	}
+	if len(clip.Samples) != 16000 {
+		t.Fatalf("got %d samples, want 16000", len(clip.Samples))
+	}
+
+	want := sine(16000, 440, 16000, 16000)
+	for i := range want {
+		if d := math.Abs(float64(clip.Samples[i]) - float64(want[i])); d > 16000*0.01 {
+			t.Fatalf("sample %d = %d, want %d", i, clip.Samples[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package audio
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// VAD is an energy based voice activity detector. A frame is speech
+// when it is louder than Threshold and louder than the clip's noise
+// floor by at least Margin.
+type VAD struct {
+	// Frame is the length of audio each decision is made over.
+	Frame time.Duration
+
+	// Threshold is the quietest a speech frame can be, in dBFS.
+	Threshold float64
+
+	// Margin is how far above the noise floor speech must be, in dB.
+	Margin float64
+
+	// Ceiling caps the noise floor threshold, in dBFS, so a clip
+	// with no pauses at all isn't mistaken for noise.
+	Ceiling float64
+
+	// MinSpeech is the least speech a clip must contain.
+	MinSpeech time.Duration
+
+	// Padding is kept around the speech so words aren't clipped.
+	Padding time.Duration
+}
+
+// DefaultVAD is tuned for push-to-talk clips recorded in a quiet room.
+var DefaultVAD = VAD{
+	Frame:     20 * time.Millisecond,
+	Threshold: -50,
+	Margin:    10,
+	Ceiling:   -30,
+	MinSpeech: 100 * time.Millisecond,
+	Padding:   200 * time.Millisecond,
+}
+
+// frameEnergy returns the RMS level of samples in dBFS.
+func frameEnergy(samples []int16) float64 {
+	var sum float64
+	for _, s := range samples {
+		v := float64(s) / math.MaxInt16
+		sum += v * v
+	}
+	rms := math.Sqrt(sum / float64(len(samples)))
+	if rms == 0 {
+		return math.Inf(-1)
+	}
+	return 20 * math.Log10(rms)
+}
+
+// samplesFor converts a duration to a number of samples at rate.
+func samplesFor(d time.Duration, rate uint32) int {
+	return int(d * time.Duration(rate) / time.Second)
+}
+
+// Trim cuts leading and trailing silence from the clip. It reports
+// false when the clip doesn't contain enough speech to be worth
+// recognizing.
+func (v VAD) Trim(c *Clip) (*Clip, bool) {
+	size := samplesFor(v.Frame, c.SampleRate)
+	if size < 1 || len(c.Samples) < size {
+		return c, false
+	}
+
+	frames := len(c.Samples) / size
+	energies := make([]float64, frames)
+	for i := range energies {
+		energies[i] = frameEnergy(c.Samples[i*size : (i+1)*size])
+	}
+
+	// the quietest tenth of the clip is taken as background noise
+	sorted := append([]float64(nil), energies...)
+	sort.Float64s(sorted)
+	floor := sorted[frames/10]
+
+	threshold := math.Max(v.Threshold, math.Min(floor+v.Margin, v.Ceiling))
+	first, last, speech := -1, -1, 0
+	for i, e := range energies {
+		if e < threshold {
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		last = i
+		speech++
+	}
+
+	if first < 0 || speech*size < samplesFor(v.MinSpeech, c.SampleRate) {
+		return c, false
+	}
+
+	padding := samplesFor(v.Padding, c.SampleRate)
+	start := first*size - padding
+	if start < 0 {
+		start = 0
+	}
+	end := (last+1)*size + padding
+	if end > len(c.Samples) {
+		end = len(c.Samples)
+	}
+
+	return &Clip{
+		Samples:    c.Samples[start:end],
+		SampleRate: c.SampleRate,
+	}, true
+}
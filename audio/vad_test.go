@@ -0,0 +1,68 @@
+package audio
+
+import (
+	"testing"
+)
+
+// concat joins pieces of a recording.
+func concat(pieces ...[]int16) []int16 {
+	var samples []int16
+	for _, p := range pieces {
+		samples = append(samples, p...)
+	}
+	return samples
+}
+
+func TestVADTrim(t *testing.T) {
+	// 20ms frames and 200ms of padding are 320 and 3200 samples at 16kHz
+	speech := sine(8000, 300, 16000, 8000)
+	silence := make([]int16, 16000)
+	noise := sine(16000, 50, 16000, 300)
+
+	for _, tc := range []struct {
+		name       string
+		samples    []int16
+		start, end int
+	}{
+		{"silence around speech", concat(silence, speech, silence), 12800, 27200},
+		{"noise around speech", concat(noise, speech, noise), 12800, 27200},
+		{"speech at the start", concat(speech, silence), 0, 11200},
+		{"speech at the end", concat(silence, speech), 12800, 24000},
+		{"speech without pauses", speech, 0, 8000},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clip, ok := DefaultVAD.Trim(&Clip{Samples: tc.samples, SampleRate: 16000})
+			if !ok {
+				t.Fatal("Trim found no speech")
+			}
+			if clip.SampleRate != 16000 {
+				t.Errorf("sample rate = %d, want 16000", clip.SampleRate)
+			}
+			equalSamples(t, clip.Samples, tc.samples[tc.start:tc.end])
+		})
+	}
+}
+
+func TestVADRejects(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		clip *Clip
+	}{
+		{"silence", &Clip{Samples: make([]int16, 16000), SampleRate: 16000}},
+		{"noise", &Clip{Samples: sine(16000, 50, 16000, 50), SampleRate: 16000}},
+		{"too little speech", &Clip{Samples: concat(make([]int16, 8000), sine(960, 300, 16000, 8000), make([]int16, 8000)), SampleRate: 16000}},
+		{"shorter than a frame", &Clip{Samples: sine(100, 300, 16000, 8000), SampleRate: 16000}},
+		{"no sample rate", &Clip{Samples: sine(16000, 300, 16000, 8000)}},
+		{"empty", &Clip{SampleRate: 16000}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clip, ok := DefaultVAD.Trim(tc.clip)
+			if ok {
+				t.Fatalf("Trim kept %d samples, want the clip rejected", len(clip.Samples))
+			}
+			if clip != tc.clip {
+				t.Error("Trim changed a rejected clip")
+			}
+		})
+	}
+}
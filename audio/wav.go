@@ -0,0 +1,164 @@
+package audio
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// WAV format tags
+const (
+	wavPCM        = 0x0001
+	wavFloat      = 0x0003
+	wavMulaw      = 0x0007
+	wavExtensible = 0xfffe
+)
+
+type wavFormat struct {
+	tag           uint16
+	channels      int
+	sampleRate    uint32
+	bitsPerSample int
+}
+
+func decodeWAV(data []byte) (*Clip, error) {
+	var format *wavFormat
+	var body []byte
+
+	// walk the chunks after the RIFF header
+	for pos := 12; pos+8 <= len(data); {
+		id := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		pos += 8
+
+		end := pos + size
+		if size < 0 || end > len(data) {
+			// recorders that stream the file often leave the data size unset
+			if id != "data" {
+				return nil, malformed("WAV", "%s chunk runs past the end of the file", id)
+			}
+			end = len(data)
+		}
+
+		switch id {
+		case "fmt ":
+			f, err := parseWAVFormat(data[pos:end])
+			if err != nil {
+				return nil, err
+			}
+			format = f
+		case "data":
+			body = data[pos:end]
+		}
+
+		// chunks are padded to an even size
+		pos = end + size%2
+	}
+
+	if format == nil {
+		return nil, malformed("WAV", "missing fmt chunk")
+	}
+	if body == nil {
+		return nil, malformed("WAV", "missing data chunk")
+	}
+
+	samples, err := wavSamples(format, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Clip{
+		Samples:    Downmix(samples, format.channels),
+		SampleRate: format.sampleRate,
+	}, nil
+}
+
+func parseWAVFormat(chunk []byte) (*wavFormat, error) {
+	if len(chunk) < 16 {
+		return nil, malformed("WAV", "fmt chunk is truncated")
+	}
+
+	f := &wavFormat{
+		tag:           binary.LittleEndian.Uint16(chunk[0:2]),
+		channels:      int(binary.LittleEndian.Uint16(chunk[2:4])),
+		sampleRate:    binary.LittleEndian.Uint32(chunk[4:8]),
+		bitsPerSample: int(binary.LittleEndian.Uint16(chunk[14:16])),
+	}
+
+	// the real format of an extensible file is the start of its sub format GUID
+	if f.tag == wavExtensible {
+		if len(chunk) < 26 {
+			return nil, malformed("WAV", "extensible fmt chunk is truncated")
+		}
+		f.tag = binary.LittleEndian.Uint16(chunk[24:26])
+	}
+
+	if f.channels < 1 {
+		return nil, malformed("WAV", "invalid channel count %d", f.channels)
+	}
+	if f.sampleRate == 0 {
+		return nil, malformed("WAV", "invalid sample rate")
+	}
+
+	return f, nil
+}
+
+func wavSamples(f *wavFormat, body []byte) ([]int16, error) {
+	switch f.tag {
+	case wavMulaw:
+		return decodeMulaw(body), nil
+
+	case wavPCM:
+		width := (f.bitsPerSample + 7) / 8
+		if width < 1 || width > 4 {
+			return nil, malformed("WAV", "unsupported bit depth %d", f.bitsPerSample)
+		}
+
+		samples := make([]int16, len(body)/width)
+		for i := range samples {
+			b := body[i*width : (i+1)*width]
+			switch width {
+			case 1:
+				// 8-bit WAV is unsigned
+				samples[i] = int16(int(b[0])-128) << 8
+			case 2:
+				samples[i] = int16(binary.LittleEndian.Uint16(b))
+			case 3:
+				samples[i] = int16(uint16(b[1]) | uint16(b[2])<<8)
+			case 4:
+				samples[i] = int16(binary.LittleEndian.Uint32(b) >> 16)
+			}
+		}
+		return samples, nil
+
+	case wavFloat:
+		width := f.bitsPerSample / 8
+		if width != 4 && width != 8 {
+			return nil, malformed("WAV", "unsupported float bit depth %d", f.bitsPerSample)
+		}
+
+		samples := make([]int16, len(body)/width)
+		for i := range samples {
+			var v float64
+			if width == 4 {
+				v = float64(math.Float32frombits(binary.LittleEndian.Uint32(body[i*4:])))
+			} else {
+				v = math.Float64frombits(binary.LittleEndian.Uint64(body[i*8:]))
+			}
+			samples[i] = floatSample(v)
+		}
+		return samples, nil
+
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+}
+
+// floatSample converts a [-1, 1] sample, clipping anything outside.
+func floatSample(v float64) int16 {
+	if v > 1 {
+		v = 1
+	} else if v < -1 {
+		v = -1
+	}
+	return int16(v * math.MaxInt16)
+}
@@ -0,0 +1,198 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// riffChunk is a chunk of a RIFF file, padded to an even size.
+func riffChunk(id string, body []byte) []byte {
+	b := make([]byte, 8, 8+len(body)+1)
+	copy(b, id)
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(body)))
+	b = append(b, body...)
+	if len(body)%2 == 1 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func fmtChunk(tag uint16, channels int, rate uint32, bits int) []byte {
+	body := make([]byte, 16)
+	binary.LittleEndian.PutUint16(body[0:], tag)
+	binary.LittleEndian.PutUint16(body[2:], uint16(channels))
+	binary.LittleEndian.PutUint32(body[4:], rate)
+	binary.LittleEndian.PutUint32(body[8:], rate*uint32(channels*bits/8))
+	binary.LittleEndian.PutUint16(body[12:], uint16(channels*bits/8))
+	binary.LittleEndian.PutUint16(body[14:], uint16(bits))
+	return riffChunk("fmt ", body)
+}
+
+// extensibleFmtChunk wraps the format tag in a WAVE_FORMAT_EXTENSIBLE
+// sub format GUID.
+func extensibleFmtChunk(tag uint16, channels int, rate uint32, bits int) []byte {
+	body := fmtChunk(wavExtensible, channels, rate, bits)[8:]
+	ext := make([]byte, 24)
+	binary.LittleEndian.PutUint16(ext[0:], 22)
+	binary.LittleEndian.PutUint16(ext[2:], uint16(bits))
+	binary.LittleEndian.PutUint16(ext[8:], tag)
+	copy(ext[10:], "\x00\x00\x00\x00\x10\x00\x80\x00\x00\xaa\x00\x38\x9b\x71")
+	return riffChunk("fmt ", append(body, ext...))
+}
+
+func wavFile(chunks ...[]byte) []byte {
+	body := bytes.Join(chunks, nil)
+	b := make([]byte, 12, 12+len(body))
+	copy(b, "RIFF")
+	binary.LittleEndian.PutUint32(b[4:], uint32(4+len(body)))
+	copy(b[8:], "WAVE")
+	return append(b, body...)
+}
+
+func le16(samples ...int16) []byte {
+	b := make([]byte, 2*len(samples))
+	for i, s := range samples {
+		binary.LittleEndian.PutUint16(b[2*i:], uint16(s))
+	}
+	return b
+}
+
+func le24(samples ...int32) []byte {
+	b := []byte{}
+	for _, s := range samples {
+		b = append(b, byte(s), byte(s>>8), byte(s>>16))
+	}
+	return b
+}
+
+func le32(samples ...int32) []byte {
+	b := make([]byte, 4*len(samples))
+	for i, s := range samples {
+		binary.LittleEndian.PutUint32(b[4*i:], uint32(s))
+	}
+	return b
+}
+
+func float32s(samples ...float32) []byte {
+	b := make([]byte, 4*len(samples))
+	for i, s := range samples {
+		binary.LittleEndian.PutUint32(b[4*i:], math.Float32bits(s))
+	}
+	return b
+}
+
+func float64s(samples ...float64) []byte {
+	b := make([]byte, 8*len(samples))
+	for i, s := range samples {
+		binary.LittleEndian.PutUint64(b[8*i:], math.Float64bits(s))
+	}
+	return b
+}
+
+func TestDecodeWAV(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		file []byte
+		rate uint32
+		want []int16
+	}{
+		{
+			name: "8-bit",
+			file: wavFile(fmtChunk(wavPCM, 1, 8000, 8), riffChunk("data", []byte{128, 255, 0, 192})),
+			rate: 8000,
+			want: []int16{0, 32512, -32768, 16384},
+		},
+		{
+			name: "16-bit",
+			file: wavFile(fmtChunk(wavPCM, 1, 16000, 16), riffChunk("data", le16(0, 1000, -1000, 32767, -32768))),
+			rate: 16000,
+			want: []int16{0, 1000, -1000, 32767, -32768},
+		},
+		{
+			name: "24-bit",
+			file: wavFile(fmtChunk(wavPCM, 1, 44100, 24), riffChunk("data", le24(0, 0x123456, -0x123456, 0x7fffff, -1))),
+			rate: 44100,
+			want: []int16{0, 0x1234, -0x1235, 0x7fff, -1},
+		},
+		{
+			name: "32-bit",
+			file: wavFile(fmtChunk(wavPCM, 1, 48000, 32), riffChunk("data", le32(0, 0x12345678, -0x12345678, -1))),
+			rate: 48000,
+			want: []int16{0, 0x1234, -0x1235, -1},
+		},
+		{
+			name: "32-bit float",
+			file: wavFile(fmtChunk(wavFloat, 1, 16000, 32), riffChunk("data", float32s(0, 0.5, -1, 2, -2))),
+			rate: 16000,
+			want: []int16{0, 16383, -32767, 32767, -32767},
+		},
+		{
+			name: "64-bit float",
+			file: wavFile(fmtChunk(wavFloat, 1, 16000, 64), riffChunk("data", float64s(0, -0.5, 1))),
+			rate: 16000,
+			want: []int16{0, -16383, 32767},
+		},
+		{
+			name: "µ-law",
+			file: wavFile(fmtChunk(wavMulaw, 1, 8000, 8), riffChunk("data", []byte{0xff, 0x80, 0x00, 0x7f})),
+			rate: 8000,
+			want: []int16{0, 32124, -32124, 0},
+		},
+		{
+			name: "extensible",
+			file: wavFile(extensibleFmtChunk(wavPCM, 1, 16000, 16), riffChunk("data", le16(1, 2, 3))),
+			rate: 16000,
+			want: []int16{1, 2, 3},
+		},
+		{
+			name: "stereo",
+			file: wavFile(fmtChunk(wavPCM, 2, 16000, 16), riffChunk("data", le16(100, 300, -200, 0, 32767, 32767))),
+			rate: 16000,
+			want: []int16{200, -100, 32767},
+		},
+		{
+			name: "5.1 24-bit",
+			file: wavFile(fmtChunk(wavPCM, 6, 48000, 24), riffChunk("data", le24(
+				0x010000, 0x020000, 0x030000, 0x040000, 0x050000, 0x060000,
+				-0x060000, 0, 0, 0, 0, 0,
+			))),
+			rate: 48000,
+			want: []int16{0x0380, -0x0100},
+		},
+		{
+			name: "chunks before fmt and odd sized chunks",
+			file: wavFile(riffChunk("LIST", []byte("odd")), fmtChunk(wavPCM, 1, 16000, 16), riffChunk("fact", []byte{1}), riffChunk("data", le16(7, 8))),
+			rate: 16000,
+			want: []int16{7, 8},
+		},
+		{
+			name: "data size left unset",
+			file: func() []byte {
+				f := wavFile(fmtChunk(wavPCM, 1, 16000, 16), riffChunk("data", le16(1, 2, 3, 4)))
+				binary.LittleEndian.PutUint32(f[len(f)-12:], 0xffffffff)
+				return f
+			}(),
+			rate: 16000,
+			want: []int16{1, 2, 3, 4},
+		},
+		{
+			name: "trailing partial sample",
+			file: wavFile(fmtChunk(wavPCM, 1, 16000, 16), riffChunk("data", append(le16(5, 6), 0x7f))),
+			rate: 16000,
+			want: []int16{5, 6},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clip, err := Decode(tc.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if clip.SampleRate != tc.rate {
+				t.Errorf("sample rate = %d, want %d", clip.SampleRate, tc.rate)
+			}
+			equalSamples(t, clip.Samples, tc.want)
+		})
+	}
+}
@@ -0,0 +1,407 @@
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/begizi/vch-server/tunnel"
+)
+
+/*
+Config
+------
+
+Config holds every setting of vchd. Settings are loaded in
+order, each overriding the one before:
+
+	defaults     DefaultConfig
+	file         JSON, from -config or CONFIG_FILE
+	environment  eg. REDIS_ADDR
+	flags        eg. -redis-addr
+
+Secrets can be read from a file instead, eg. a mounted
+kubernetes secret, by setting LUIS_KEY_FILE, -luis-key-file
+or "luisKeyFile" in place of the secret itself.
+
+Run vchd -h for the list of settings.
+*/
+
+type Config struct {
+	Port      string `json:"port"`
+	GRPCPort  string `json:"grpcPort"`
+	RedisAddr string `json:"redisAddr"`
+
+	Queue      QueueConfig      `json:"queue"`
+	Tunnel     TunnelConfig     `json:"tunnel"`
+	Mailbox    MailboxConfig    `json:"mailbox"`
+	JobStore   string           `json:"jobStore"`
+	Recognizer RecognizerConfig `json:"recognizer"`
+	NLU        NLUConfig        `json:"nlu"`
+	Voice      VoiceConfig      `json:"voice"`
+	Tracing    TracingConfig    `json:"tracing"`
+}
+
+type QueueConfig struct {
+	// Backend is redis, redis-streams or inmem.
+	Backend string `json:"backend"`
+
+	// Group and MaxLen are only used by redis-streams.
+	Group  string `json:"group"`
+	MaxLen int    `json:"maxLen"`
+}
+
+type TunnelConfig struct {
+	QueueSize int    `json:"queueSize"`
+	Overflow  string `json:"overflow"`
+}
+
+type MailboxConfig struct {
+	// Backend is redis, inmem or none.
+	Backend string   `json:"backend"`
+	TTL     Duration `json:"ttl"`
+}
+
+type RecognizerConfig struct {
+	// Backend is gcp or fake.
+	Backend         string `json:"backend"`
+	CredentialsFile string `json:"credentialsFile"`
+	FakeTranscript  string `json:"fakeTranscript"`
+}
+
+type NLUConfig struct {
+	// Backend is luis or grammar.
+	Backend     string `json:"backend"`
+	GrammarFile string `json:"grammarFile"`
+
+	LUISAppID   string `json:"luisAppId"`
+	LUISKey     string `json:"luisKey"`
+	LUISKeyFile string `json:"luisKeyFile"`
+}
+
+type VoiceConfig struct {
+	MinConfidence   float64 `json:"minConfidence"`
+	DefaultLocale   string  `json:"defaultLocale"`
+	MaxAlternatives int     `json:"maxAlternatives"`
+}
+
+type TracingConfig struct {
+	// Exporter is otlp, stdout or none.
+	Exporter string `json:"exporter"`
+
+	// Endpoint is the OTLP collector, host:port or a URL, the exporter's
+	// own default when it's empty.
+	Endpoint    string `json:"endpoint"`
+	ServiceName string `json:"serviceName"`
+}
+
+var DefaultConfig = Config{
+	Port:      "8080",
+	GRPCPort:  "9001",
+	RedisAddr: ":6379",
+	Queue: QueueConfig{
+		Backend: "redis",
+		MaxLen:  10000,
+	},
+	Tunnel: TunnelConfig{
+		QueueSize: tunnel.DefaultConfig.QueueSize,
+		Overflow:  string(tunnel.DefaultConfig.Overflow),
+	},
+	Mailbox: MailboxConfig{
+		Backend: "redis",
+		TTL:     Duration(24 * time.Hour),
+	},
+	JobStore: "redis",
+	Recognizer: RecognizerConfig{
+		Backend:         "gcp",
+		CredentialsFile: "./credentials-key.json",
+	},
+	NLU: NLUConfig{
+		Backend: "luis",
+	},
+	Voice: VoiceConfig{
+		MinConfidence:   0.5,
+		DefaultLocale:   "en-US",
+		MaxAlternatives: 3,
+	},
+	Tracing: TracingConfig{
+		Exporter:    "none",
+		ServiceName: "vch-server",
+	},
+}
+
+// Duration is a time.Duration written as a string, eg. "24h".
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	return d.Set(s)
+}
+
+// flags registers a flag for every setting, along with the environment
+// variables it is read from.
+func (c *Config) flags(fs *flag.FlagSet) map[string][]string {
+	env := map[string][]string{}
+	str := func(p *string, name, usage string, vars ...string) {
+		fs.StringVar(p, name, *p, usage)
+		env[name] = vars
+	}
+	integer := func(p *int, name, usage string, vars ...string) {
+		fs.IntVar(p, name, *p, usage)
+		env[name] = vars
+	}
+
+	str(&c.Port, "port", "HTTP port", "PORT")
+	str(&c.GRPCPort, "grpc-port", "gRPC port", "GRPC_PORT")
+	// the deploy manifests used to set REDIS_URL
+	str(&c.RedisAddr, "redis-addr", "redis address, host:port", "REDIS_ADDR", "REDIS_URL")
+
+	str(&c.Queue.Backend, "queue", "queue backend: redis, redis-streams or inmem", "QUEUE")
+	str(&c.Queue.Group, "queue-group", "redis-streams consumer group, unique to the process and stable across restarts", "QUEUE_GROUP")
+	integer(&c.Queue.MaxLen, "queue-maxlen", "redis-streams messages retained", "QUEUE_MAXLEN")
+
+	integer(&c.Tunnel.QueueSize, "tunnel-queue-size", "responses queued per tunnel session", "TUNNEL_QUEUE_SIZE")
+	str(&c.Tunnel.Overflow, "tunnel-overflow", "full session queues: drop-oldest, drop-newest or disconnect", "TUNNEL_OVERFLOW")
+
+	str(&c.Mailbox.Backend, "mailbox", "mailbox for offline devices: redis, inmem or none", "MAILBOX")
+	fs.Var(&c.Mailbox.TTL, "mailbox-ttl", "how long mailboxes keep messages")
+	env["mailbox-ttl"] = []string{"MAILBOX_TTL"}
+
+	str(&c.JobStore, "job-store", "recognition job store: redis or inmem", "JOB_STORE")
+
+	str(&c.Recognizer.Backend, "recognizer", "speech recognizer: gcp or fake", "RECOGNIZER")
+	str(&c.Recognizer.CredentialsFile, "gcp-credentials-file", "GCP service account key", "GCP_CREDENTIALS_FILE")
+	str(&c.Recognizer.FakeTranscript, "fake-transcript", "transcript of the fake recognizer", "FAKE_TRANSCRIPT")
+
+	str(&c.NLU.Backend, "nlu", "NLU backend: luis or grammar", "NLU")
+	str(&c.NLU.GrammarFile, "grammar-file", "grammar, also used for recognition hints (default grammar.json for the grammar backend)", "GRAMMAR_FILE")
+	str(&c.NLU.LUISAppID, "luis-app-id", "LUIS app ID", "LUIS_APP_ID")
+	str(&c.NLU.LUISKey, "luis-key", "LUIS subscription key", "LUIS_KEY")
+	str(&c.NLU.LUISKeyFile, "luis-key-file", "file holding the LUIS subscription key", "LUIS_KEY_FILE")
+
+	fs.Float64Var(&c.Voice.MinConfidence, "min-confidence", c.Voice.MinConfidence, "least confidence a transcript is acted on with")
+	env["min-confidence"] = []string{"MIN_CONFIDENCE"}
+	str(&c.Voice.DefaultLocale, "default-locale", "language of requests without one", "DEFAULT_LOCALE")
+	integer(&c.Voice.MaxAlternatives, "max-alternatives", "transcripts asked of the recognizer, runner ups are tried when the best isn't understood", "MAX_ALTERNATIVES")
+
+	str(&c.Tracing.Exporter, "trace-exporter", "trace exporter: otlp, stdout or none", "TRACE_EXPORTER")
+	str(&c.Tracing.Endpoint, "otlp-endpoint", "OTLP collector, host:port or an http:// URL for plaintext (default localhost:4317)", "OTEL_EXPORTER_OTLP_ENDPOINT")
+	str(&c.Tracing.ServiceName, "trace-service-name", "service name traces are exported under", "OTEL_SERVICE_NAME")
+
+	return env
+}
+
+// Load reads the config from the file, environment and flags, in that
+// order, and validates it. It returns flag.ErrHelp when asked for usage.
+func Load(args []string, getenv func(string) string) (*Config, error) {
+	c := DefaultConfig
+
+	fs := flag.NewFlagSet("vchd", flag.ContinueOnError)
+	path := fs.String("config", getenv("CONFIG_FILE"), "JSON config file")
+	env := c.flags(fs)
+
+	// the file is named by a flag, so the flags are parsed twice, once
+	// for the file and again to override it
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if *path != "" {
+		level := c.luisKeyLevel()
+		if err := c.loadFile(*path); err != nil {
+			return nil, err
+		}
+		if err := level(); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	level := c.luisKeyLevel()
+	fs.VisitAll(func(f *flag.Flag) {
+		for _, name := range env[f.Name] {
+			value := getenv(name)
+			if value == "" || err != nil {
+				continue
+			}
+			if setErr := f.Value.Set(value); setErr != nil {
+				err = fmt.Errorf("Config Error: %s: %v", name, setErr)
+			}
+			break
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := level(); err != nil {
+		return nil, err
+	}
+
+	level = c.luisKeyLevel()
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if err := level(); err != nil {
+		return nil, err
+	}
+
+	if err := c.resolve(); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Config Error: %v", err)
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("Config Error: %s: %v", path, err)
+	}
+	return nil
+}
+
+// luisKeyLevel is called before a level of the config is loaded, and
+// the function it returns after. The LUIS key and its file are one
+// setting, so whichever is set at the higher level wins and setting both
+// at the same level is an error.
+func (c *Config) luisKeyLevel() func() error {
+	key, file := c.NLU.LUISKey, c.NLU.LUISKeyFile
+	return func() error {
+		keySet, fileSet := c.NLU.LUISKey != key, c.NLU.LUISKeyFile != file
+		switch {
+		case keySet && fileSet:
+			return fmt.Errorf("Config Error: luis-key and luis-key-file can't both be set")
+		case keySet:
+			c.NLU.LUISKeyFile = ""
+		case fileSet:
+			c.NLU.LUISKey = ""
+		}
+		return nil
+	}
+}
+
+// resolve fills in the settings that depend on others and reads secrets
+// from their files.
+func (c *Config) resolve() error {
+	c.RedisAddr = redisAddr(c.RedisAddr)
+
+	if c.NLU.Backend == "grammar" && c.NLU.GrammarFile == "" {
+		c.NLU.GrammarFile = "grammar.json"
+	}
+
+	if c.NLU.LUISKeyFile != "" {
+		key, err := ioutil.ReadFile(c.NLU.LUISKeyFile)
+		if err != nil {
+			return fmt.Errorf("Config Error: %v", err)
+		}
+		c.NLU.LUISKey = strings.TrimSpace(string(key))
+	}
+	return nil
+}
+
+// redisAddr accepts redis://host:port URLs and hosts without a port.
+func redisAddr(addr string) string {
+	addr = strings.TrimPrefix(addr, "redis://")
+	addr = strings.TrimSuffix(addr, "/")
+	if addr != "" && !strings.Contains(addr, ":") {
+		addr += ":6379"
+	}
+	return addr
+}
+
+// Validate reports every setting that is missing or out of range.
+func (c *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	oneOf := func(setting, value string, values ...string) {
+		for _, v := range values {
+			if value == v {
+				return
+			}
+		}
+		problems = append(problems, fmt.Sprintf("%s must be one of %s, not %q", setting, strings.Join(values, ", "), value))
+	}
+	port := func(setting, value string) {
+		p, err := strconv.Atoi(value)
+		check(err == nil && p > 0 && p < 65536, "%s %q is not a port", setting, value)
+	}
+
+	port("port", c.Port)
+	port("grpc-port", c.GRPCPort)
+
+	usesRedis := c.Queue.Backend == "redis" || c.Queue.Backend == "redis-streams" ||
+		c.Mailbox.Backend == "redis" || c.JobStore == "redis"
+	check(!usesRedis || c.RedisAddr != "", "redis-addr is required")
+
+	oneOf("queue", c.Queue.Backend, "redis", "redis-streams", "inmem")
+	check(c.Queue.Backend != "redis-streams" || c.Queue.Group != "", "queue-group is required for redis-streams")
+	check(c.Queue.MaxLen > 0, "queue-maxlen must be positive")
+
+	check(c.Tunnel.QueueSize > 0, "tunnel-queue-size must be positive")
+	if _, err := tunnel.ParseOverflowPolicy(c.Tunnel.Overflow); err != nil {
+		problems = append(problems, fmt.Sprintf("tunnel-overflow: %v", err))
+	}
+
+	oneOf("mailbox", c.Mailbox.Backend, "redis", "inmem", "none")
+	check(c.Mailbox.TTL > 0, "mailbox-ttl must be positive")
+
+	oneOf("job-store", c.JobStore, "redis", "inmem")
+
+	oneOf("recognizer", c.Recognizer.Backend, "gcp", "fake")
+	check(c.Recognizer.Backend != "gcp" || c.Recognizer.CredentialsFile != "", "gcp-credentials-file is required")
+
+	oneOf("nlu", c.NLU.Backend, "luis", "grammar")
+	if c.NLU.Backend == "luis" {
+		check(c.NLU.LUISAppID != "", "luis-app-id is required")
+		check(c.NLU.LUISKey != "", "luis-key or luis-key-file is required")
+	}
+
+	check(c.Voice.MinConfidence >= 0 && c.Voice.MinConfidence <= 1, "min-confidence must be between 0 and 1")
+	check(c.Voice.DefaultLocale != "", "default-locale is required")
+	check(c.Voice.MaxAlternatives > 0, "max-alternatives must be positive")
+
+	oneOf("trace-exporter", c.Tracing.Exporter, "otlp", "stdout", "none")
+	check(c.Tracing.Exporter == "none" || c.Tracing.ServiceName != "", "trace-service-name is required")
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Config Error: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// env is the environment Load reads, with the settings required by the
+// defaults.
+func env(vars ...string) func(string) string {
+	m := map[string]string{
+		"LUIS_APP_ID": "app",
+		"LUIS_KEY":    "key",
+	}
+	for i := 0; i+1 < len(vars); i += 2 {
+		m[vars[i]] = vars[i+1]
+	}
+	return func(name string) string {
+		return m[name]
+	}
+}
+
+func writeFile(t *testing.T, name, data string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadDefaults(t *testing.T) {
+	c, err := Load(nil, env())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := DefaultConfig
+	want.NLU.LUISAppID = "app"
+	want.NLU.LUISKey = "key"
+	if *c != want {
+		t.Errorf("got %+v, want the defaults", *c)
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := writeFile(t, "vchd.json", `{
+		"port": "1000",
+		"queue": {"backend": "inmem"},
+		"mailbox": {"ttl": "1h"}
+	}`)
+
+	for _, tc := range []struct {
+		name string
+		args []string
+		env  func(string) string
+		port string
+	}{
+		{"defaults", nil, env(), "8080"},
+		{"file", []string{"-config", file}, env(), "1000"},
+		{"file from the environment", nil, env("CONFIG_FILE", file), "1000"},
+		{"environment over file", []string{"-config", file}, env("PORT", "2000"), "2000"},
+		{"flag over environment", []string{"-config", file, "-port", "3000"}, env("PORT", "2000"), "3000"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := Load(tc.args, tc.env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Port != tc.port {
+				t.Errorf("port = %q, want %q", c.Port, tc.port)
+			}
+		})
+	}
+
+	// the settings the file doesn't override are kept
+	c, err := Load([]string{"-config", file, "-mailbox-ttl", "2h"}, env("QUEUE", "redis"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Queue.Backend != "redis" || c.Queue.MaxLen != DefaultConfig.Queue.MaxLen || time.Duration(c.Mailbox.TTL) != 2*time.Hour {
+		t.Errorf("got %+v and %+v, want the file overridden and the defaults kept", c.Queue, c.Mailbox)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		file string
+		args []string
+		env  func(string) string
+		want string
+	}{
+		{name: "unknown file setting", file: `{"prot": "1000"}`, env: env(), want: "prot"},
+		{name: "malformed file", file: `{"port": 1000}`, env: env(), want: "port"},
+		{name: "missing file", args: []string{"-config", "missing.json"}, env: env(), want: "missing.json"},
+		{name: "malformed environment", env: env("MIN_CONFIDENCE", "high"), want: "MIN_CONFIDENCE"},
+		{name: "malformed flag", args: []string{"-mailbox-ttl", "a day"}, env: env(), want: "mailbox-ttl"},
+		{name: "invalid", env: env("QUEUE", "kafka"), want: "queue must be one of"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			args := tc.args
+			if tc.file != "" {
+				args = []string{"-config", writeFile(t, "vchd.json", tc.file)}
+			}
+			_, err := Load(args, tc.env)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("err = %v, want it to mention %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestLUISKeyFile(t *testing.T) {
+	key := writeFile(t, "luis-key", "secret\n")
+
+	c, err := Load(nil, env("LUIS_KEY", "", "LUIS_KEY_FILE", key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.NLU.LUISKey != "secret" {
+		t.Errorf("key = %q, want it read from the file", c.NLU.LUISKey)
+	}
+
+	if _, err := Load(nil, env("LUIS_KEY", "", "LUIS_KEY_FILE", "missing")); err == nil {
+		t.Error("loaded a missing key file")
+	}
+}
+
+func TestLUISKeyPrecedence(t *testing.T) {
+	key := writeFile(t, "luis-key", "secret\n")
+	file := writeFile(t, "config.json", `{"nlu": {"luisKeyFile": "`+key+`"}}`)
+	keyConfig := writeFile(t, "key.json", `{"nlu": {"luisKey": "from-file"}}`)
+
+	for _, tc := range []struct {
+		name string
+		args []string
+		env  func(string) string
+		want string
+	}{
+		{"key file flag over key env", []string{"-luis-key-file", key}, env("LUIS_KEY", "other"), "secret"},
+		{"key flag over key file env", []string{"-luis-key", "flag"}, env("LUIS_KEY", "", "LUIS_KEY_FILE", key), "flag"},
+		{"key env over key file in the config file", []string{"-config", file}, env("LUIS_KEY", "env"), "env"},
+		{"key file env over key in the config file", []string{"-config", keyConfig}, env("LUIS_KEY", "", "LUIS_KEY_FILE", key), "secret"},
+		{"key flag over key file in the config file", []string{"-config", file, "-luis-key", "flag"}, env("LUIS_KEY", ""), "flag"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := Load(tc.args, tc.env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.NLU.LUISKey != tc.want {
+				t.Errorf("key = %q, want %q", c.NLU.LUISKey, tc.want)
+			}
+		})
+	}
+
+	for _, tc := range []struct {
+		name string
+		args []string
+		env  func(string) string
+	}{
+		{"both in the environment", nil, env("LUIS_KEY_FILE", key)},
+		{"both as flags", []string{"-luis-key", "flag", "-luis-key-file", key}, env()},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := Load(tc.args, tc.env); err == nil || !strings.Contains(err.Error(), "luis-key-file") {
+				t.Errorf("err = %v, want the key and its file rejected", err)
+			}
+		})
+	}
+}
+
+func TestRedisAddr(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		env  func(string) string
+		want string
+	}{
+		{"default", env(), ":6379"},
+		{"address", env("REDIS_ADDR", "cache:6380"), "cache:6380"},
+		{"URL alias", env("REDIS_URL", "redis://cache:6380/"), "cache:6380"},
+		{"address over URL", env("REDIS_ADDR", "cache:6380", "REDIS_URL", "redis://other:6380"), "cache:6380"},
+		{"host without a port", env("REDIS_URL", "redis://cache"), "cache:6379"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := Load(nil, tc.env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.RedisAddr != tc.want {
+				t.Errorf("redis address = %q, want %q", c.RedisAddr, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		want   string
+		change func(c *Config)
+	}{
+		{`port "http" is not a port`, func(c *Config) { c.Port = "http" }},
+		{`grpc-port "0" is not a port`, func(c *Config) { c.GRPCPort = "0" }},
+		{"redis-addr is required", func(c *Config) { c.RedisAddr = "" }},
+		{"queue must be one of", func(c *Config) { c.Queue.Backend = "kafka" }},
+		{"queue-group is required", func(c *Config) { c.Queue.Backend = "redis-streams" }},
+		{"queue-maxlen must be positive", func(c *Config) { c.Queue.MaxLen = 0 }},
+		{"tunnel-queue-size must be positive", func(c *Config) { c.Tunnel.QueueSize = 0 }},
+		{"tunnel-overflow", func(c *Config) { c.Tunnel.Overflow = "block" }},
+		{"mailbox must be one of", func(c *Config) { c.Mailbox.Backend = "postgres" }},
+		{"mailbox-ttl must be positive", func(c *Config) { c.Mailbox.TTL = 0 }},
+		{"job-store must be one of", func(c *Config) { c.JobStore = "postgres" }},
+		{"recognizer must be one of", func(c *Config) { c.Recognizer.Backend = "azure" }},
+		{"gcp-credentials-file is required", func(c *Config) { c.Recognizer.CredentialsFile = "" }},
+		{"nlu must be one of", func(c *Config) { c.NLU.Backend = "wit" }},
+		{"luis-app-id is required", func(c *Config) { c.NLU.LUISAppID = "" }},
+		{"luis-key or luis-key-file is required", func(c *Config) { c.NLU.LUISKey = "" }},
+		{"min-confidence must be between 0 and 1", func(c *Config) { c.Voice.MinConfidence = -0.1 }},
+		{"min-confidence must be between 0 and 1", func(c *Config) { c.Voice.MinConfidence = 1.1 }},
+		{"default-locale is required", func(c *Config) { c.Voice.DefaultLocale = "" }},
+		{"max-alternatives must be positive", func(c *Config) { c.Voice.MaxAlternatives = 0 }},
+		{"trace-exporter must be one of", func(c *Config) { c.Tracing.Exporter = "jaeger" }},
+		{"trace-service-name is required", func(c *Config) { c.Tracing.Exporter = "otlp"; c.Tracing.ServiceName = "" }},
+	} {
+		c := DefaultConfig
+		c.NLU.LUISAppID = "app"
+		c.NLU.LUISKey = "key"
+		tc.change(&c)
+
+		err := c.Validate()
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("err = %v, want %q", err, tc.want)
+		}
+	}
+
+	// settings only required by backends that aren't used
+	c := DefaultConfig
+	c.RedisAddr = ""
+	c.Queue.Backend, c.Mailbox.Backend, c.JobStore = "inmem", "inmem", "inmem"
+	c.Recognizer.Backend, c.Recognizer.CredentialsFile = "fake", ""
+	c.NLU.Backend = "grammar"
+	c.Tracing.ServiceName = ""
+	if err := c.Validate(); err != nil {
+		t.Errorf("err = %v, want the unused settings ignored", err)
+	}
+
+	// every problem is reported at once
+	c = DefaultConfig
+	c.Port = ""
+	c.Voice.DefaultLocale = ""
+	err := c.Validate()
+	if err == nil || !strings.Contains(err.Error(), "port") || !strings.Contains(err.Error(), "default-locale") {
+		t.Errorf("err = %v, want every problem", err)
+	}
+}
@@ -2,69 +2,307 @@ package gcp
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
 
 	"google.golang.org/api/option"
 	"google.golang.org/api/transport"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
 
+	"github.com/begizi/vch-server/asr"
+	"github.com/golang/protobuf/ptypes"
 	gcontext "golang.org/x/net/context"
 	speech "google.golang.org/genproto/googleapis/cloud/speech/v1beta1"
+	"google.golang.org/genproto/googleapis/longrunning"
 )
 
+// operationPollInterval is how often a long running recognition is
+// checked on.
+const operationPollInterval = 5 * time.Second
+
+// GCPSpeechConv impliments asr.Recognizer on top of the
+// Google Cloud Speech API.
 type GCPSpeechConv struct {
-	ctx  gcontext.Context
 	conn *grpc.ClientConn
 
 	client speech.SpeechClient
+
+	operations longrunning.OperationsClient
 }
 
-func NewGCPSpeechConv() (*GCPSpeechConv, error) {
+// NewGCPSpeechConv connects to the Speech API with the service account key
+// in credentialsFile.
+func NewGCPSpeechConv(credentialsFile string) (*GCPSpeechConv, error) {
 	ctx := context.Background()
 	conn, err := transport.DialGRPC(ctx,
 		option.WithEndpoint("speech.googleapis.com:443"),
 		option.WithScopes("https://www.googleapis.com/auth/cloud-platform"),
-		option.WithServiceAccountFile("./credentials-key.json"),
+		option.WithServiceAccountFile(credentialsFile),
 	)
 	if err != nil {
 		return nil, err
 	}
 
 	client := speech.NewSpeechClient(conn)
+	operations := longrunning.NewOperationsClient(conn)
+
+	return &GCPSpeechConv{conn, client, operations}, nil
+}
+
+// Health reports why the Speech API can't be reached, or nil when it can.
+// An idle connection is woken up and counted as reachable.
+func (gcp *GCPSpeechConv) Health() error {
+	switch state := gcp.conn.GetState(); state {
+	case connectivity.TransientFailure, connectivity.Shutdown:
+		return fmt.Errorf("GCP Speech Error: connection is %v", state)
+	case connectivity.Idle:
+		gcp.conn.Connect()
+	}
+	return nil
+}
+
+// maxContentSize is the most audio the API accepts inline, about 5
+// minutes of 16kHz LINEAR16. Longer audio has to be uploaded to
+// Cloud Storage first, which vchd doesn't do.
+const maxContentSize = 10 << 20
+
+// MaxAudioSize is the most audio that can be sent in a request.
+func (gcp *GCPSpeechConv) MaxAudioSize() int {
+	return maxContentSize
+}
 
-	return &GCPSpeechConv{ctx, conn, client}, nil
+// SampleRate is the rate Google recommends for speech recognition.
+func (gcp *GCPSpeechConv) SampleRate() uint32 {
+	return 16000
 }
 
-func (gcp *GCPSpeechConv) Convert(data []byte, sampleRate uint32) (string, error) {
-	resp, err := gcp.recognize(data, sampleRate)
+func (gcp *GCPSpeechConv) Recognize(ctx gcontext.Context, data []byte, format asr.Format) ([]asr.Transcript, error) {
+	resp, err := gcp.recognize(ctx, data, format)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	var best *speech.SpeechRecognitionAlternative
+	return joinResults(resp.Results), nil
+}
 
-	for _, result := range resp.Results {
-		for _, alt := range result.Alternatives {
-			if best == nil || alt.Confidence > best.Confidence {
-				best = alt
-			}
-		}
+// rank orders transcripts with the most confident first.
+func rank(transcripts []asr.Transcript) []asr.Transcript {
+	sort.SliceStable(transcripts, func(i, j int) bool {
+		return transcripts[i].Confidence > transcripts[j].Confidence
+	})
+	return transcripts
+}
+
+func encoding(e asr.Encoding) speech.RecognitionConfig_AudioEncoding {
+	switch e {
+	case asr.FLAC:
+		return speech.RecognitionConfig_FLAC
+	case asr.MULAW:
+		return speech.RecognitionConfig_MULAW
+	default:
+		return speech.RecognitionConfig_LINEAR16
+	}
+}
+
+// Limits the API puts on speech context phrases and alternatives.
+const (
+	maxPhrases      = 500
+	maxPhraseLength = 100
+	maxAlternatives = 30
+)
+
+func config(format asr.Format) *speech.RecognitionConfig {
+	c := &speech.RecognitionConfig{
+		Encoding:     encoding(format.Encoding),
+		SampleRate:   int32(format.SampleRate),
+		LanguageCode: format.Language,
+	}
+
+	if format.Alternatives > maxAlternatives {
+		c.MaxAlternatives = maxAlternatives
+	} else {
+		c.MaxAlternatives = int32(format.Alternatives)
 	}
 
-	if best == nil {
-		return "", nil
+	phrases := []string{}
+	for _, phrase := range format.Phrases {
+		if len(phrases) == maxPhrases {
+			break
+		}
+		if len(phrase) <= maxPhraseLength {
+			phrases = append(phrases, phrase)
+		}
+	}
+	if len(phrases) > 0 {
+		c.SpeechContext = &speech.SpeechContext{Phrases: phrases}
 	}
 
-	return best.Transcript, nil
+	return c
 }
 
-func (gcp *GCPSpeechConv) recognize(data []byte, sampleRate uint32) (*speech.SyncRecognizeResponse, error) {
-	return gcp.client.SyncRecognize(gcp.ctx, &speech.SyncRecognizeRequest{
-		Config: &speech.RecognitionConfig{
-			Encoding:   speech.RecognitionConfig_LINEAR16,
-			SampleRate: int32(sampleRate),
+func (gcp *GCPSpeechConv) recognize(ctx gcontext.Context, data []byte, format asr.Format) (*speech.SyncRecognizeResponse, error) {
+	return gcp.client.SyncRecognize(ctx, &speech.SyncRecognizeRequest{
+		Config: config(format),
+		Audio: &speech.RecognitionAudio{
+			AudioSource: &speech.RecognitionAudio_Content{Content: data},
 		},
+	})
+}
+
+// LongRecognize recognizes audio of up to MaxAudioSize with an
+// asynchronous recognition.
+func (gcp *GCPSpeechConv) LongRecognize(ctx gcontext.Context, data []byte, format asr.Format) ([]asr.Transcript, error) {
+	if len(data) > maxContentSize {
+		return nil, fmt.Errorf("Speech Error: %d bytes of audio is over the %d byte limit", len(data), maxContentSize)
+	}
+
+	op, err := gcp.client.AsyncRecognize(ctx, &speech.AsyncRecognizeRequest{
+		Config: config(format),
 		Audio: &speech.RecognitionAudio{
 			AudioSource: &speech.RecognitionAudio_Content{Content: data},
 		},
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	for !op.Done {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(operationPollInterval):
+		}
+
+		op, err = gcp.operations.GetOperation(ctx, &longrunning.GetOperationRequest{Name: op.Name})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if status := op.GetError(); status != nil {
+		return nil, fmt.Errorf("Speech Error: %s", status.Message)
+	}
+
+	resp := &speech.AsyncRecognizeResponse{}
+	if err := ptypes.UnmarshalAny(op.GetResponse(), resp); err != nil {
+		return nil, fmt.Errorf("Speech Error: %v", err)
+	}
+
+	return joinResults(resp.Results), nil
+}
+
+// joinResults combines the results of a recognition. Every result is a
+// consecutive part of the audio with its own alternatives, so a single
+// result is returned ranked and several are joined into one transcript
+// of their best alternatives, only as confident as the least confident.
+func joinResults(results []*speech.SpeechRecognitionResult) []asr.Transcript {
+	parts := [][]asr.Transcript{}
+	for _, result := range results {
+		if len(result.Alternatives) > 0 {
+			parts = append(parts, rank(alternatives(result.Alternatives)))
+		}
+	}
+
+	switch len(parts) {
+	case 0:
+		return []asr.Transcript{}
+	case 1:
+		return parts[0]
+	}
+
+	texts := []string{}
+	confidence := parts[0][0].Confidence
+	for _, part := range parts {
+		texts = append(texts, part[0].Text)
+		if part[0].Confidence < confidence {
+			confidence = part[0].Confidence
+		}
+	}
+
+	return []asr.Transcript{{
+		Text:       strings.Join(texts, " "),
+		Confidence: confidence,
+	}}
+}
+
+func alternatives(alts []*speech.SpeechRecognitionAlternative) []asr.Transcript {
+	transcripts := []asr.Transcript{}
+	for _, alt := range alts {
+		transcripts = append(transcripts, asr.Transcript{
+			Text:       alt.Transcript,
+			Confidence: alt.Confidence,
+		})
+	}
+	return transcripts
+}
+
+func (gcp *GCPSpeechConv) StreamRecognize(ctx gcontext.Context, format asr.Format) (asr.Stream, error) {
+	stream, err := gcp.client.StreamingRecognize(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// the first request only carries the config
+	err = stream.Send(&speech.StreamingRecognizeRequest{
+		StreamingRequest: &speech.StreamingRecognizeRequest_StreamingConfig{
+			StreamingConfig: &speech.StreamingRecognitionConfig{
+				Config:         config(format),
+				InterimResults: true,
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &gcpStream{stream}, nil
+}
+
+type gcpStream struct {
+	stream speech.Speech_StreamingRecognizeClient
+}
+
+func (s *gcpStream) Send(audio []byte) error {
+	return s.stream.Send(&speech.StreamingRecognizeRequest{
+		StreamingRequest: &speech.StreamingRecognizeRequest_AudioContent{
+			AudioContent: audio,
+		},
+	})
+}
+
+func (s *gcpStream) CloseSend() error {
+	return s.stream.CloseSend()
+}
+
+func (s *gcpStream) Recv() (*asr.StreamResult, error) {
+	resp, err := s.stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Error != nil && resp.Error.Code != 0 {
+		return nil, fmt.Errorf("Speech Error: %s", resp.Error.Message)
+	}
+
+	// a response holds at most one final result followed by the
+	// interim results for the audio after it
+	result := &asr.StreamResult{Transcripts: []asr.Transcript{}}
+	for _, r := range resp.Results {
+		if len(r.Alternatives) == 0 {
+			continue
+		}
+		if r.IsFinal || len(result.Transcripts) == 0 {
+			result.Transcripts = alternatives(r.Alternatives)
+			result.Final = r.IsFinal
+		}
+		if r.IsFinal {
+			break
+		}
+	}
+
+	result.Transcripts = rank(result.Transcripts)
+	return result, nil
 }
@@ -0,0 +1,212 @@
+package gcp
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/begizi/vch-server/asr"
+	speech "google.golang.org/genproto/googleapis/cloud/speech/v1beta1"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+)
+
+func transcript(text string, confidence float32) asr.Transcript {
+	return asr.Transcript{Text: text, Confidence: confidence}
+}
+
+func result(alts ...asr.Transcript) *speech.SpeechRecognitionResult {
+	r := &speech.SpeechRecognitionResult{}
+	for _, alt := range alts {
+		r.Alternatives = append(r.Alternatives, &speech.SpeechRecognitionAlternative{
+			Transcript: alt.Text,
+			Confidence: alt.Confidence,
+		})
+	}
+	return r
+}
+
+func TestJoinResults(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		results []*speech.SpeechRecognitionResult
+		want    []asr.Transcript
+	}{
+		{
+			name:    "no results",
+			results: nil,
+			want:    []asr.Transcript{},
+		},
+		{
+			name: "single result keeps its alternatives",
+			results: []*speech.SpeechRecognitionResult{
+				result(transcript("turn of the lights", 0.8), transcript("turn off the lights", 0), transcript("turn of the light", 0)),
+			},
+			want: []asr.Transcript{transcript("turn of the lights", 0.8), transcript("turn off the lights", 0), transcript("turn of the light", 0)},
+		},
+		{
+			name: "segments are joined",
+			results: []*speech.SpeechRecognitionResult{
+				result(transcript("turn on", 0.9), transcript("turn in", 0)),
+				result(),
+				result(transcript("the lights", 0.7), transcript("the light", 0)),
+			},
+			want: []asr.Transcript{transcript("turn on the lights", 0.7)},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := joinResults(tc.results); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("joinResults = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestConfigAlternatives(t *testing.T) {
+	for _, tc := range []struct {
+		alternatives int
+		want         int32
+	}{
+		{0, 0},
+		{3, 3},
+		{100, maxAlternatives},
+	} {
+		c := config(asr.Format{Alternatives: tc.alternatives})
+		if c.MaxAlternatives != tc.want {
+			t.Errorf("%d alternatives: MaxAlternatives = %d, want %d", tc.alternatives, c.MaxAlternatives, tc.want)
+		}
+	}
+}
+
+func TestConfigPhrases(t *testing.T) {
+	many := make([]string, maxPhrases+100)
+	for i := range many {
+		many[i] = "lamp"
+	}
+
+	for _, tc := range []struct {
+		name    string
+		phrases []string
+		want    []string
+	}{
+		{"none", nil, nil},
+		{"kept", []string{"lamp", "living room"}, []string{"lamp", "living room"}},
+		{"longest kept", []string{strings.Repeat("a", maxPhraseLength)}, []string{strings.Repeat("a", maxPhraseLength)}},
+		{"too long dropped", []string{"lamp", strings.Repeat("a", maxPhraseLength+1), "fan"}, []string{"lamp", "fan"}},
+		{"too many trimmed", many, many[:maxPhrases]},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := config(asr.Format{Phrases: tc.phrases})
+			if tc.want == nil {
+				if c.SpeechContext != nil {
+					t.Errorf("speech context = %v, want none", c.SpeechContext)
+				}
+				return
+			}
+			if c.SpeechContext == nil || !reflect.DeepEqual(c.SpeechContext.Phrases, tc.want) {
+				t.Errorf("speech context = %v, want %d phrases", c.SpeechContext, len(tc.want))
+			}
+		})
+	}
+}
+
+// fakeSpeech answers streaming recognitions with responses and records
+// the requests it was sent.
+type fakeSpeech struct {
+	speech.SpeechClient
+	responses []*speech.StreamingRecognizeResponse
+	requests  []*speech.StreamingRecognizeRequest
+}
+
+func (f *fakeSpeech) StreamingRecognize(_ context.Context, _ ...grpc.CallOption) (speech.Speech_StreamingRecognizeClient, error) {
+	return &fakeStream{speech: f}, nil
+}
+
+type fakeStream struct {
+	grpc.ClientStream
+	speech *fakeSpeech
+}
+
+func (s *fakeStream) Send(req *speech.StreamingRecognizeRequest) error {
+	s.speech.requests = append(s.speech.requests, req)
+	return nil
+}
+
+func (s *fakeStream) CloseSend() error {
+	return nil
+}
+
+func (s *fakeStream) Recv() (*speech.StreamingRecognizeResponse, error) {
+	if len(s.speech.responses) == 0 {
+		return nil, io.EOF
+	}
+	resp := s.speech.responses[0]
+	s.speech.responses = s.speech.responses[1:]
+	return resp, nil
+}
+
+func streamingResult(final bool, alts ...asr.Transcript) *speech.StreamingRecognitionResult {
+	return &speech.StreamingRecognitionResult{Alternatives: result(alts...).Alternatives, IsFinal: final}
+}
+
+func TestStreamRecognize(t *testing.T) {
+	client := &fakeSpeech{responses: []*speech.StreamingRecognizeResponse{
+		{Results: []*speech.StreamingRecognitionResult{streamingResult(false, transcript("turn on", 0))}},
+		{Results: []*speech.StreamingRecognitionResult{
+			streamingResult(true, transcript("turn of the lights", 0.6), transcript("turn off the lights", 0.8)),
+			streamingResult(false, transcript("and", 0)),
+		}},
+		{Error: &status.Status{Code: 3, Message: "audio too long"}},
+	}}
+	gcp := &GCPSpeechConv{client: client}
+
+	stream, err := gcp.StreamRecognize(context.Background(), asr.Format{Encoding: asr.LINEAR16, SampleRate: 16000, Language: "en-US"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chunk := range [][]byte{{1, 2}, {3, 4}} {
+		if err := stream.Send(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the config goes first and on its own, the audio after it
+	if len(client.requests) != 3 {
+		t.Fatalf("sent %d requests, want the config and 2 chunks", len(client.requests))
+	}
+	c, ok := client.requests[0].StreamingRequest.(*speech.StreamingRecognizeRequest_StreamingConfig)
+	if !ok {
+		t.Fatalf("first request is %T, want the config", client.requests[0].StreamingRequest)
+	}
+	if !c.StreamingConfig.InterimResults || c.StreamingConfig.Config.LanguageCode != "en-US" || c.StreamingConfig.Config.SampleRate != 16000 {
+		t.Errorf("config = %+v, want interim en-US results at 16kHz", c.StreamingConfig)
+	}
+	for i, req := range client.requests[1:] {
+		if _, ok := req.StreamingRequest.(*speech.StreamingRecognizeRequest_AudioContent); !ok {
+			t.Errorf("request %d is %T, want audio", i+1, req.StreamingRequest)
+		}
+	}
+
+	for _, want := range []*asr.StreamResult{
+		{Transcripts: []asr.Transcript{transcript("turn on", 0)}},
+		// the final result wins over the interim results after it
+		{Transcripts: []asr.Transcript{transcript("turn off the lights", 0.8), transcript("turn of the lights", 0.6)}, Final: true},
+	} {
+		got, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Recv = %+v, want %+v", got, want)
+		}
+	}
+
+	if _, err := stream.Recv(); err == nil || !strings.Contains(err.Error(), "audio too long") {
+		t.Errorf("err = %v, want the API's error", err)
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Errorf("err = %v, want io.EOF", err)
+	}
+}
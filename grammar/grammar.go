@@ -0,0 +1,222 @@
+package grammar
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+/*
+Grammar
+-------
+
+A Grammar describes an offline NLU engine as a set of
+intents, each with utterance templates, and a set of typed
+slot vocabularies. A grammar file is JSON:
+
+	{
+	  "slots": {
+	    "state": {"on": ["on", "enable"], "off": ["off", "disable"]},
+	    "room":  {"living room": ["living room", "lounge"]}
+	  },
+	  "intents": [
+	    {
+	      "name": "Lights",
+	      "utterances": [
+	        "turn {state} [the] lights",
+	        "turn {state} [all of the] lights in [the] {room}",
+	        "dim [the] lights to {level:number} [percent]"
+	      ]
+	    }
+	  ]
+	}
+
+Every slot type maps a canonical value to the synonyms that
+should resolve to it. Templates reference slots as {type}
+or {name:type} when the entity should be reported under a
+different name than its vocabulary. Words in [brackets] are
+optional, all of them or none. The builtin "number" type
+matches any run of digits.
+*/
+
+const NumberSlot = "number"
+
+// Vocabulary maps a canonical slot value to its synonyms.
+type Vocabulary map[string][]string
+
+type Intent struct {
+	Name       string   `json:"name"`
+	Utterances []string `json:"utterances"`
+}
+
+type Grammar struct {
+	Slots   map[string]Vocabulary `json:"slots"`
+	Intents []Intent              `json:"intents"`
+}
+
+func Load(path string) (*Grammar, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Decode(f)
+}
+
+func Decode(r io.Reader) (*Grammar, error) {
+	g := &Grammar{}
+	if err := json.NewDecoder(r).Decode(g); err != nil {
+		return nil, fmt.Errorf("Grammar Error: %v", err)
+	}
+	return g, nil
+}
+
+// Phrases returns every slot value and synonym in the grammar, eg. to
+// bias a speech recognizer towards them.
+func (g *Grammar) Phrases() []string {
+	seen := map[string]bool{}
+	phrases := []string{}
+	for _, vocabulary := range g.Slots {
+		for value, synonyms := range vocabulary {
+			for _, phrase := range append([]string{value}, synonyms...) {
+				phrase = strings.ToLower(strings.TrimSpace(phrase))
+				if phrase == "" || seen[phrase] {
+					continue
+				}
+				seen[phrase] = true
+				phrases = append(phrases, phrase)
+			}
+		}
+	}
+	sort.Strings(phrases)
+	return phrases
+}
+
+type tokenKind int
+
+const (
+	literalToken tokenKind = iota
+	optionalToken
+	slotToken
+)
+
+type token struct {
+	kind tokenKind
+
+	// word for literal tokens, words for optional ones
+	word  string
+	words []string
+
+	// name and vocabulary type for slot tokens
+	name     string
+	slotType string
+}
+
+type template struct {
+	intent   string
+	tokens   []token
+	literals int
+}
+
+// phrase is a tokenized synonym and the canonical value it resolves to.
+type phrase struct {
+	words []string
+	value string
+}
+
+func compileTemplate(intent, utterance string, slots map[string][]phrase) (*template, error) {
+	t := &template{intent: intent}
+	rest := strings.ToLower(utterance)
+	for rest != "" {
+		// literal words up to the next slot or optional
+		i := strings.IndexAny(rest, "{[")
+		if i < 0 {
+			i = len(rest)
+		}
+		for _, w := range words(rest[:i]) {
+			t.tokens = append(t.tokens, token{kind: literalToken, word: w.text})
+			t.literals++
+		}
+		rest = rest[i:]
+		if rest == "" {
+			break
+		}
+
+		closing := "}"
+		if rest[0] == '[' {
+			closing = "]"
+		}
+		end := strings.Index(rest, closing)
+		if end < 0 {
+			return nil, fmt.Errorf("Grammar Error: intent %s has an unclosed %q in %q", intent, rest[:1], utterance)
+		}
+		inner := rest[1:end]
+		rest = rest[end+1:]
+
+		if closing == "]" {
+			optional := token{kind: optionalToken}
+			for _, w := range words(inner) {
+				optional.words = append(optional.words, w.text)
+			}
+			if len(optional.words) > 0 {
+				t.tokens = append(t.tokens, optional)
+			}
+			continue
+		}
+
+		name := strings.TrimSpace(inner)
+		slotType := name
+		if i := strings.Index(name, ":"); i >= 0 {
+			name, slotType = strings.TrimSpace(name[:i]), strings.TrimSpace(name[i+1:])
+		}
+		if _, ok := slots[slotType]; !ok && slotType != NumberSlot {
+			return nil, fmt.Errorf("Grammar Error: intent %s uses unknown slot type %q", intent, slotType)
+		}
+		t.tokens = append(t.tokens, token{kind: slotToken, name: name, slotType: slotType})
+	}
+
+	if len(t.tokens) == 0 {
+		return nil, fmt.Errorf("Grammar Error: intent %s has an empty utterance", intent)
+	}
+	return t, nil
+}
+
+// word is a normalized word along with its byte offsets in the source text.
+type word struct {
+	text  string
+	start int
+	end   int
+}
+
+func isWordChar(r rune) bool {
+	return r == '\'' ||
+		('a' <= r && r <= 'z') ||
+		('A' <= r && r <= 'Z') ||
+		('0' <= r && r <= '9') ||
+		r > 127
+}
+
+func words(s string) []word {
+	var out []word
+	start := -1
+	for i, r := range s {
+		if isWordChar(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			out = append(out, word{strings.ToLower(s[start:i]), start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		out = append(out, word{strings.ToLower(s[start:]), start, len(s)})
+	}
+	return out
+}
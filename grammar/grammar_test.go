@@ -0,0 +1,280 @@
+package grammar
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+const testGrammar = `{
+  "slots": {
+    "state":  {"on": ["on", "enable"], "off": ["off", "disable"]},
+    "device": {"lights": ["lights", "lamp"], "fan": []},
+    "room":   {"living room": ["living room", "lounge"], "kitchen": []}
+  },
+  "intents": [
+    {
+      "name": "Power",
+      "utterances": [
+        "[please] turn {state} [the] {device}",
+        "[please] turn {state} [all of] [the] {device} in [the] {room}"
+      ]
+    },
+    {
+      "name": "Thermostat",
+      "utterances": [
+        "set [the] temperature to {temperature:number} [degrees]"
+      ]
+    }
+  ]
+}`
+
+func newTestParser(t *testing.T, grammar string) *Parser {
+	g, err := Decode(strings.NewReader(grammar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewParser(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestParse(t *testing.T) {
+	p := newTestParser(t, testGrammar)
+
+	for _, tc := range []struct {
+		name   string
+		query  string
+		intent string
+		slots  map[string]string
+	}{
+		{"slots", "turn on the lights", "Power", map[string]string{"state": "on", "device": "lights"}},
+		{"synonyms", "turn disable lamp", "Power", map[string]string{"state": "off", "device": "lights"}},
+		{"value without synonyms", "turn off the fan", "Power", map[string]string{"state": "off", "device": "fan"}},
+		{"multi word synonym", "turn on the lights in the living room", "Power", map[string]string{"state": "on", "device": "lights", "room": "living room"}},
+		{"optional present", "please turn on the lights", "Power", map[string]string{"state": "on", "device": "lights"}},
+		{"multi word optional present", "turn on all of the lamp in lounge", "Power", map[string]string{"state": "on", "device": "lights", "room": "living room"}},
+		{"multi word optional absent", "turn on lamp in the kitchen", "Power", map[string]string{"state": "on", "device": "lights", "room": "kitchen"}},
+		{"case and punctuation", "Turn ON the Lights!", "Power", map[string]string{"state": "on", "device": "lights"}},
+		{"number", "set the temperature to 21 degrees", "Thermostat", map[string]string{"temperature": "21"}},
+
+		{"part of an optional", "turn on all lamp in the kitchen", "", nil},
+		{"unknown slot value", "turn on the toaster", "", nil},
+		{"extra words", "turn on the lights now", "", nil},
+		{"not a number", "set the temperature to warm", "", nil},
+		{"no match", "make me a sandwich", "", nil},
+		{"empty", "", "", nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := p.Parse(context.Background(), tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Query != tc.query {
+				t.Errorf("query = %q, want %q", result.Query, tc.query)
+			}
+
+			if tc.intent == "" {
+				if result.TopIntent != nil {
+					t.Fatalf("matched %s, want no match", result.TopIntent.Name)
+				}
+				if len(result.Entities) != 0 || len(result.CompositeEntities) != 0 {
+					t.Errorf("got entities without a match: %v", result.Entities)
+				}
+				return
+			}
+
+			if result.TopIntent == nil {
+				t.Fatalf("no match, want %s", tc.intent)
+			}
+			if result.TopIntent.Name != tc.intent {
+				t.Errorf("intent = %s, want %s", result.TopIntent.Name, tc.intent)
+			}
+
+			slots := map[string]string{}
+			for _, e := range result.Entities {
+				slots[e.Type] = e.Value
+			}
+			if len(slots) != len(tc.slots) {
+				t.Errorf("slots = %v, want %v", slots, tc.slots)
+			}
+			for name, value := range tc.slots {
+				if slots[name] != value {
+					t.Errorf("slot %s = %q, want %q", name, slots[name], value)
+				}
+			}
+		})
+	}
+}
+
+// TestParseLikeLUIS checks the result has the shape the LUIS adapter
+// returns, which is what the tunnel and devices expect.
+func TestParseLikeLUIS(t *testing.T) {
+	p := newTestParser(t, testGrammar)
+
+	query := "Please turn on the lights in the Lounge"
+	result, err := p.Parse(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Intents) == 0 || result.Intents[0] != result.TopIntent {
+		t.Fatalf("top intent %v is not the first of %v", result.TopIntent, result.Intents)
+	}
+	if score := result.TopIntent.Score; score <= 0 || score > 1 {
+		t.Errorf("score %v is not in (0, 1]", score)
+	}
+
+	// entity offsets are an inclusive range of the query
+	for _, tc := range []struct {
+		slot, value, text string
+		start, end        int
+	}{
+		{"state", "on", "on", 12, 13},
+		{"device", "lights", "lights", 19, 24},
+		{"room", "living room", "Lounge", 33, 38},
+	} {
+		var found bool
+		for _, e := range result.Entities {
+			if e.Type != tc.slot {
+				continue
+			}
+			found = true
+			if e.Value != tc.value {
+				t.Errorf("%s = %q, want %q", tc.slot, e.Value, tc.value)
+			}
+			if e.StartIndex != tc.start || e.EndIndex != tc.end {
+				t.Errorf("%s at [%d, %d], want [%d, %d]", tc.slot, e.StartIndex, e.EndIndex, tc.start, tc.end)
+			}
+			if text := query[e.StartIndex : e.EndIndex+1]; text != tc.text {
+				t.Errorf("%s spans %q, want %q", tc.slot, text, tc.text)
+			}
+		}
+		if !found {
+			t.Errorf("no %s entity in %v", tc.slot, result.Entities)
+		}
+	}
+
+	if len(result.CompositeEntities) != 1 {
+		t.Fatalf("got %d composite entities, want 1", len(result.CompositeEntities))
+	}
+	composite := result.CompositeEntities[0]
+	if composite.Type != "Power" {
+		t.Errorf("composite type = %s, want Power", composite.Type)
+	}
+	if composite.Value != strings.ToLower(query) {
+		t.Errorf("composite value = %q, want %q", composite.Value, strings.ToLower(query))
+	}
+	if len(composite.Children) != len(result.Entities) {
+		t.Errorf("composite has %d children, want the %d entities", len(composite.Children), len(result.Entities))
+	}
+}
+
+func TestParsePrefersBestTemplate(t *testing.T) {
+	p := newTestParser(t, `{
+	  "slots": {"device": {"lights": []}},
+	  "intents": [
+	    {"name": "Anything", "utterances": ["{device} {thing:number}"]},
+	    {"name": "Dim", "utterances": ["dim [the] {device} to {level:number}"]}
+	  ]
+	}`)
+
+	result, err := p.Parse(context.Background(), "dim the lights to 40")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.TopIntent == nil || result.TopIntent.Name != "Dim" {
+		t.Fatalf("top intent = %v, want Dim", result.TopIntent)
+	}
+}
+
+func TestNewParser(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		grammar string
+		err     string
+	}{
+		{
+			name: "package example",
+			grammar: `{
+			  "slots": {
+			    "state": {"on": ["on", "enable"], "off": ["off", "disable"]},
+			    "room":  {"living room": ["living room", "lounge"]}
+			  },
+			  "intents": [
+			    {
+			      "name": "Lights",
+			      "utterances": [
+			        "turn {state} [the] lights",
+			        "turn {state} [all of the] lights in [the] {room}",
+			        "dim [the] lights to {level:number} [percent]"
+			      ]
+			    }
+			  ]
+			}`,
+		},
+		{
+			name:    "unknown slot type",
+			grammar: `{"intents": [{"name": "Lights", "utterances": ["turn on {device:light}"]}]}`,
+			err:     `unknown slot type "light"`,
+		},
+		{
+			name:    "unclosed optional",
+			grammar: `{"intents": [{"name": "Lights", "utterances": ["turn on [the lights"]}]}`,
+			err:     `unclosed "["`,
+		},
+		{
+			name:    "unclosed slot",
+			grammar: `{"slots": {"state": {"on": []}}, "intents": [{"name": "Lights", "utterances": ["turn {state lights"]}]}`,
+			err:     `unclosed "{"`,
+		},
+		{
+			name:    "builtin slot type",
+			grammar: `{"slots": {"number": {"one": ["1"]}}, "intents": []}`,
+			err:     "is builtin",
+		},
+		{
+			name:    "empty utterance",
+			grammar: `{"intents": [{"name": "Lights", "utterances": ["[ ]"]}]}`,
+			err:     "empty utterance",
+		},
+		{
+			name:    "intent without a name",
+			grammar: `{"intents": [{"utterances": ["lights"]}]}`,
+			err:     "without a name",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			g, err := Decode(strings.NewReader(tc.grammar))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = NewParser(g)
+			if tc.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("err = %v, want %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestPhrases(t *testing.T) {
+	g, err := Decode(strings.NewReader(testGrammar))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	phrases := g.Phrases()
+	want := []string{"disable", "enable", "fan", "kitchen", "lamp", "lights", "living room", "lounge", "off", "on"}
+	if strings.Join(phrases, ",") != strings.Join(want, ",") {
+		t.Errorf("phrases = %v, want %v", phrases, want)
+	}
+}
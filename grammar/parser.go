@@ -0,0 +1,222 @@
+package grammar
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/begizi/vch-server/nlu"
+	"golang.org/x/net/context"
+)
+
+// Parser impliments nlu.Parser by matching utterances against the
+// templates of a Grammar. It runs entirely in process.
+type Parser struct {
+	templates []*template
+	slots     map[string][]phrase
+}
+
+func NewParser(g *Grammar) (*Parser, error) {
+	p := &Parser{
+		slots: make(map[string][]phrase),
+	}
+
+	for slotType, vocabulary := range g.Slots {
+		if slotType == NumberSlot {
+			return nil, fmt.Errorf("Grammar Error: slot type %q is builtin", NumberSlot)
+		}
+		values := []string{}
+		for value := range vocabulary {
+			values = append(values, value)
+		}
+		sort.Strings(values)
+
+		for _, value := range values {
+			// the canonical value is always a synonym of itself
+			for _, synonym := range append([]string{value}, vocabulary[value]...) {
+				var ws []string
+				for _, w := range words(synonym) {
+					ws = append(ws, w.text)
+				}
+				if len(ws) == 0 {
+					continue
+				}
+				p.slots[slotType] = append(p.slots[slotType], phrase{ws, value})
+			}
+		}
+
+		// prefer the longest synonym so "living room" wins over "living"
+		phrases := p.slots[slotType]
+		sort.SliceStable(phrases, func(i, j int) bool {
+			return len(phrases[i].words) > len(phrases[j].words)
+		})
+	}
+
+	for _, intent := range g.Intents {
+		if intent.Name == "" {
+			return nil, fmt.Errorf("Grammar Error: intent without a name")
+		}
+		for _, utterance := range intent.Utterances {
+			t, err := compileTemplate(intent.Name, utterance, p.slots)
+			if err != nil {
+				return nil, err
+			}
+			p.templates = append(p.templates, t)
+		}
+	}
+
+	return p, nil
+}
+
+// binding is a slot filled from the words ws[start:end].
+type binding struct {
+	name  string
+	value string
+	start int
+	end   int
+}
+
+// match reports whether tokens consume exactly ws[pos:], collecting the
+// slots it filled along the way.
+func (p *Parser) match(tokens []token, ws []word, pos int, bindings []binding) ([]binding, bool) {
+	if len(tokens) == 0 {
+		return bindings, pos == len(ws)
+	}
+
+	t := tokens[0]
+	switch t.kind {
+	case literalToken:
+		if pos == len(ws) || ws[pos].text != t.word {
+			return nil, false
+		}
+		return p.match(tokens[1:], ws, pos+1, bindings)
+
+	case optionalToken:
+		if hasPrefix(ws[pos:], t.words) {
+			if b, ok := p.match(tokens[1:], ws, pos+len(t.words), bindings); ok {
+				return b, true
+			}
+		}
+		return p.match(tokens[1:], ws, pos, bindings)
+
+	default:
+		// cap the slice so sibling branches never share a backing array
+		filled := bindings[:len(bindings):len(bindings)]
+
+		if t.slotType == NumberSlot {
+			if pos == len(ws) || !isNumber(ws[pos].text) {
+				return nil, false
+			}
+			b := append(filled, binding{t.name, ws[pos].text, pos, pos + 1})
+			return p.match(tokens[1:], ws, pos+1, b)
+		}
+
+		for _, ph := range p.slots[t.slotType] {
+			if !hasPrefix(ws[pos:], ph.words) {
+				continue
+			}
+			end := pos + len(ph.words)
+			b := append(filled, binding{t.name, ph.value, pos, end})
+			if b, ok := p.match(tokens[1:], ws, end, b); ok {
+				return b, true
+			}
+		}
+		return nil, false
+	}
+}
+
+func hasPrefix(ws []word, prefix []string) bool {
+	if len(prefix) > len(ws) {
+		return false
+	}
+	for i, w := range prefix {
+		if ws[i].text != w {
+			return false
+		}
+	}
+	return true
+}
+
+func isNumber(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func (p *Parser) Parse(_ context.Context, query string) (*nlu.Result, error) {
+	ws := words(query)
+	result := &nlu.Result{Query: query}
+	if len(ws) == 0 {
+		return result, nil
+	}
+
+	type candidate struct {
+		template *template
+		bindings []binding
+		score    float64
+	}
+
+	// keep the best scoring template for every intent
+	best := map[string]*candidate{}
+	order := []string{}
+	for _, t := range p.templates {
+		bindings, ok := p.match(t.tokens, ws, 0, nil)
+		if !ok {
+			continue
+		}
+
+		score := 0.5 + 0.5*float64(t.literals)/float64(len(ws))
+		c, seen := best[t.intent]
+		if !seen {
+			order = append(order, t.intent)
+		}
+		if !seen || score > c.score {
+			best[t.intent] = &candidate{t, bindings, score}
+		}
+	}
+
+	candidates := []*candidate{}
+	for _, intent := range order {
+		candidates = append(candidates, best[intent])
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].score > candidates[j].score
+	})
+
+	for _, c := range candidates {
+		result.Intents = append(result.Intents, &nlu.Intent{
+			Name:  c.template.intent,
+			Score: c.score,
+		})
+	}
+
+	if len(candidates) == 0 {
+		return result, nil
+	}
+
+	top := candidates[0]
+	result.TopIntent = result.Intents[0]
+
+	composite := &nlu.CompositeEntity{
+		Type:  top.template.intent,
+		Value: strings.ToLower(query[ws[0].start:ws[len(ws)-1].end]),
+	}
+	for _, b := range top.bindings {
+		// offsets follow LUIS, an inclusive range of the query
+		entity := &nlu.Entity{
+			Type:       b.name,
+			Value:      b.value,
+			StartIndex: ws[b.start].start,
+			EndIndex:   ws[b.end-1].end - 1,
+			Score:      top.score,
+		}
+		result.Entities = append(result.Entities, entity)
+		composite.Children = append(composite.Children, entity)
+	}
+	result.CompositeEntities = []*nlu.CompositeEntity{composite}
+
+	return result, nil
+}
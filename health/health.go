@@ -0,0 +1,325 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+/*
+Health
+------
+
+Health checks the components vchd depends on and reports
+them at:
+
+	/healthz  liveness, ok while the process serves HTTP
+	/readyz   readiness, ok while every check passes
+
+and through the standard gRPC health service, where the
+server as a whole ("") and each of its services are
+SERVING while ready.
+
+Checks run every interval in the background rather than on
+every probe, so probes never load the backends. Checks that
+are too costly for that interval are wrapped in Every to run
+less often. Readiness lists every component along with the
+error of the failing ones and since when they have been
+failing.
+*/
+
+// Checker is implemented by components that can report their health.
+// Health returns why the component can't be used, or nil when it can.
+type Checker interface {
+	Health() error
+}
+
+// CheckerFunc adapts a function to the Checker interface.
+type CheckerFunc func() error
+
+func (f CheckerFunc) Health() error {
+	return f()
+}
+
+// Every runs checker at most once per interval and answers with its last
+// result in between, for checks that cost something to run, eg. a request
+// to a metered API.
+func Every(interval time.Duration, checker Checker) Checker {
+	return &cachedChecker{interval: interval, checker: checker}
+}
+
+type cachedChecker struct {
+	interval time.Duration
+	checker  Checker
+
+	mtx     sync.Mutex
+	checked time.Time
+	err     error
+}
+
+func (c *cachedChecker) Health() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.checked.IsZero() || time.Since(c.checked) >= c.interval {
+		c.err = c.checker.Health()
+		c.checked = time.Now()
+	}
+	return c.err
+}
+
+// Component is the result of a component's last check.
+type Component struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	// Since is when the component started failing.
+	Since *time.Time `json:"since,omitempty"`
+}
+
+// Report is the result of the last run of the checks.
+type Report struct {
+	Status     string      `json:"status"`
+	Checked    time.Time   `json:"checked"`
+	Components []Component `json:"components"`
+}
+
+const (
+	StatusOK      = "ok"
+	StatusFailing = "failing"
+)
+
+type check struct {
+	name    string
+	checker Checker
+}
+
+type Health struct {
+	interval time.Duration
+	services []string
+	grpc     *health.Server
+	logger   log.Logger
+
+	// recheck runs the checks before the interval is up
+	recheck chan struct{}
+
+	mtx      sync.Mutex
+	checks   []check
+	report   Report
+	shutdown bool
+}
+
+// NewHealth checks every interval. The gRPC health service reports the
+// named services along with the server as a whole.
+func NewHealth(interval time.Duration, logger log.Logger, services ...string) *Health {
+	h := &Health{
+		interval: interval,
+		services: append([]string{""}, services...),
+		grpc:     health.NewServer(),
+		logger:   logger,
+		recheck:  make(chan struct{}, 1),
+		report:   Report{Status: StatusFailing},
+	}
+	h.setServing(false)
+	return h
+}
+
+// Register adds a component to be checked, in the order it is reported.
+func (h *Health) Register(name string, checker Checker) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.checks = append(h.checks, check{name, checker})
+}
+
+// Run checks the components straight away and then every interval, or
+// as soon as a listener goes up or down, until ctx is done.
+func (h *Health) Run(ctx context.Context) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		h.Check()
+		select {
+		case <-ticker.C:
+		case <-h.recheck:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (h *Health) triggerRecheck() {
+	select {
+	case h.recheck <- struct{}{}:
+	default:
+	}
+}
+
+// Check runs every check and returns the new report.
+func (h *Health) Check() Report {
+	h.mtx.Lock()
+	checks := h.checks
+	previous := map[string]Component{}
+	for _, c := range h.report.Components {
+		previous[c.Name] = c
+	}
+	h.mtx.Unlock()
+
+	// a slow check holds up the report, not the other checks
+	errs := make([]error, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c check) {
+			defer wg.Done()
+			errs[i] = c.checker.Health()
+		}(i, c)
+	}
+	wg.Wait()
+
+	now := time.Now()
+	report := Report{Status: StatusOK, Checked: now, Components: []Component{}}
+	for i, c := range checks {
+		component := Component{Name: c.name, Status: StatusOK}
+		if err := errs[i]; err != nil {
+			since := now
+			if p, ok := previous[c.name]; ok && p.Since != nil {
+				since = *p.Since
+			}
+			component = Component{Name: c.name, Status: StatusFailing, Error: err.Error(), Since: &since}
+			report.Status = StatusFailing
+		}
+
+		if p, ok := previous[c.name]; !ok || p.Status != component.Status || p.Error != component.Error {
+			h.logger.Log("msg", "Health changed", "component", c.name, "status", component.Status, "err", errs[i])
+		}
+		report.Components = append(report.Components, component)
+	}
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if h.shutdown {
+		return h.report
+	}
+	h.report = report
+	h.setServing(report.Status == StatusOK)
+	return report
+}
+
+// Report returns the result of the last run of the checks.
+func (h *Health) Report() Report {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return h.report
+}
+
+// Shutdown reports the server as no longer ready, for load balancers to
+// stop sending it requests while it shuts down.
+func (h *Health) Shutdown() {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	h.shutdown = true
+	h.report.Status = StatusFailing
+	h.report.Components = append(h.report.Components, Component{
+		Name:   "server",
+		Status: StatusFailing,
+		Error:  "shutting down",
+	})
+	h.grpc.Shutdown()
+}
+
+func (h *Health) setServing(serving bool) {
+	status := healthpb.HealthCheckResponse_NOT_SERVING
+	if serving {
+		status = healthpb.HealthCheckResponse_SERVING
+	}
+	for _, service := range h.services {
+		h.grpc.SetServingStatus(service, status)
+	}
+}
+
+// GRPCServer is the standard gRPC health service.
+func (h *Health) GRPCServer() healthpb.HealthServer {
+	return h.grpc
+}
+
+// LiveHandler answers while the process can serve HTTP at all.
+func (h *Health) LiveHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": StatusOK})
+	})
+}
+
+// ReadyHandler answers with the last report, 503 Service Unavailable
+// while any component is failing.
+func (h *Health) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := h.Report()
+		code := http.StatusOK
+		if report.Status != StatusOK {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, report)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Listener is the Checker of a server's listener, failing until it is up.
+type Listener struct {
+	mtx sync.Mutex
+	err error
+
+	// changed is called once the listener goes up or down
+	changed func()
+}
+
+// NewListener registers a listener to be checked under name.
+func (h *Health) NewListener(name string) *Listener {
+	l := &Listener{
+		err:     errors.New("not listening yet"),
+		changed: h.triggerRecheck,
+	}
+	h.Register(name, l)
+	return l
+}
+
+// Up records that the server is listening.
+func (l *Listener) Up() {
+	l.set(nil)
+}
+
+// Down records why the server stopped listening.
+func (l *Listener) Down(err error) {
+	if err == nil {
+		err = errors.New("stopped listening")
+	}
+	l.set(err)
+}
+
+func (l *Listener) set(err error) {
+	l.mtx.Lock()
+	l.err = err
+	l.mtx.Unlock()
+	l.changed()
+}
+
+func (l *Listener) Health() error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.err
+}
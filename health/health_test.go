@@ -0,0 +1,196 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"golang.org/x/net/context"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// toggle is a Checker failing with err until it is set to nil.
+type toggle struct {
+	mtx   sync.Mutex
+	err   error
+	calls int
+}
+
+func (c *toggle) set(err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.err = err
+}
+
+func (c *toggle) Health() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.calls++
+	return c.err
+}
+
+func get(t *testing.T, h http.Handler) (int, Report) {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	var report Report
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, report
+}
+
+func grpcStatus(t *testing.T, h *Health, service string) healthpb.HealthCheckResponse_ServingStatus {
+	resp, err := h.GRPCServer().Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.Status
+}
+
+func TestReadiness(t *testing.T) {
+	h := NewHealth(time.Hour, log.NewNopLogger(), "pb.VCH")
+	queue := &toggle{err: errors.New("connection refused")}
+	h.Register("queue", queue)
+	h.Register("recognizer", &toggle{})
+
+	// nothing is ready before the first check
+	if code, _ := get(t, h.ReadyHandler()); code != http.StatusServiceUnavailable {
+		t.Errorf("unchecked /readyz = %d, want 503", code)
+	}
+
+	h.Check()
+	code, report := get(t, h.ReadyHandler())
+	if code != http.StatusServiceUnavailable || report.Status != StatusFailing {
+		t.Errorf("failing /readyz = %d %s, want 503 failing", code, report.Status)
+	}
+	if len(report.Components) != 2 {
+		t.Fatalf("got %d components, want 2", len(report.Components))
+	}
+	failing := report.Components[0]
+	if failing.Name != "queue" || failing.Error != "connection refused" || failing.Since == nil {
+		t.Errorf("queue = %+v, want failing since the check", failing)
+	}
+	if ok := report.Components[1]; ok.Status != StatusOK || ok.Since != nil {
+		t.Errorf("recognizer = %+v, want ok", ok)
+	}
+	for _, service := range []string{"", "pb.VCH"} {
+		if got := grpcStatus(t, h, service); got != healthpb.HealthCheckResponse_NOT_SERVING {
+			t.Errorf("gRPC status of %q = %v, want NOT_SERVING", service, got)
+		}
+	}
+
+	// a component keeps the time it started failing
+	since := *failing.Since
+	h.Check()
+	if _, report := get(t, h.ReadyHandler()); !report.Components[0].Since.Equal(since) {
+		t.Errorf("queue failing since %v, want %v", report.Components[0].Since, since)
+	}
+
+	queue.set(nil)
+	h.Check()
+	code, report = get(t, h.ReadyHandler())
+	if code != http.StatusOK || report.Status != StatusOK {
+		t.Errorf("/readyz = %d %s, want 200 ok", code, report.Status)
+	}
+	for _, service := range []string{"", "pb.VCH"} {
+		if got := grpcStatus(t, h, service); got != healthpb.HealthCheckResponse_SERVING {
+			t.Errorf("gRPC status of %q = %v, want SERVING", service, got)
+		}
+	}
+}
+
+func TestLiveness(t *testing.T) {
+	h := NewHealth(time.Hour, log.NewNopLogger())
+	h.Register("queue", &toggle{err: errors.New("connection refused")})
+	h.Check()
+
+	// failing dependencies are no reason to restart the process
+	if code, report := get(t, h.LiveHandler()); code != http.StatusOK || report.Status != StatusOK {
+		t.Errorf("/healthz = %d %s, want 200 ok", code, report.Status)
+	}
+	h.Shutdown()
+	if code, _ := get(t, h.LiveHandler()); code != http.StatusOK {
+		t.Errorf("/healthz after Shutdown = %d, want 200", code)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	h := NewHealth(time.Hour, log.NewNopLogger(), "pb.VCH")
+	h.Register("queue", &toggle{})
+	h.Check()
+
+	h.Shutdown()
+	code, report := get(t, h.ReadyHandler())
+	if code != http.StatusServiceUnavailable || report.Status != StatusFailing {
+		t.Errorf("/readyz = %d %s, want 503 failing", code, report.Status)
+	}
+	last := report.Components[len(report.Components)-1]
+	if last.Name != "server" || last.Error != "shutting down" {
+		t.Errorf("last component = %+v, want the server shutting down", last)
+	}
+	for _, service := range []string{"", "pb.VCH"} {
+		if got := grpcStatus(t, h, service); got != healthpb.HealthCheckResponse_NOT_SERVING {
+			t.Errorf("gRPC status of %q = %v, want NOT_SERVING", service, got)
+		}
+	}
+
+	// passing checks don't make it ready again
+	h.Check()
+	if code, _ := get(t, h.ReadyHandler()); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz after a check = %d, want 503", code)
+	}
+	if got := grpcStatus(t, h, ""); got != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("gRPC status after a check = %v, want NOT_SERVING", got)
+	}
+}
+
+func TestListenerRecheck(t *testing.T) {
+	h := NewHealth(time.Hour, log.NewNopLogger())
+	l := h.NewListener("http")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.Run(ctx)
+
+	// the listener going up is reported well before the interval
+	l.Up()
+	deadline := time.Now().Add(time.Second)
+	for h.Report().Status != StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatalf("report = %+v, want ok once the listener is up", h.Report())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestEvery(t *testing.T) {
+	c := &toggle{err: errors.New("unauthorized")}
+	checker := Every(50*time.Millisecond, c)
+
+	for i := 0; i < 3; i++ {
+		if err := checker.Health(); err == nil || err.Error() != "unauthorized" {
+			t.Errorf("err = %v, want the first result", err)
+		}
+	}
+	c.set(nil)
+	if err := checker.Health(); err == nil {
+		t.Error("result changed before the interval was up")
+	}
+	if c.calls != 1 {
+		t.Errorf("checked %d times, want once", c.calls)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if err := checker.Health(); err != nil {
+		t.Errorf("err = %v, want the new result", err)
+	}
+	if c.calls != 2 {
+		t.Errorf("checked %d times, want twice", c.calls)
+	}
+}
@@ -0,0 +1,64 @@
+package inmem
+
+import (
+	"sync"
+
+	"github.com/begizi/vch-server/voice"
+)
+
+/*
+InMemJobStore
+-------------
+
+InMemJobStore impliments the JobStore interface with a map
+in the memory of the process. Jobs are kept until the
+process exits.
+
+THIS DOES NOT SCALE. A job can only be polled from the
+vchd process that accepted it.
+*/
+
+type InMemJobStore struct {
+	mu   sync.RWMutex
+	jobs map[string]voice.Job
+}
+
+func NewInMemJobStore() voice.JobStore {
+	return &InMemJobStore{
+		jobs: make(map[string]voice.Job),
+	}
+}
+
+func (s *InMemJobStore) Save(job *voice.Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// store a copy so callers can keep changing theirs
+	s.jobs[job.ID] = *job
+	return nil
+}
+
+func (s *InMemJobStore) Get(id string) (*voice.Job, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, voice.ErrJobNotFound
+	}
+	return &job, nil
+}
+
+func (s *InMemJobStore) Unfinished() ([]*voice.Job, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	jobs := []*voice.Job{}
+	for _, job := range s.jobs {
+		if !job.Finished() {
+			job := job
+			jobs = append(jobs, &job)
+		}
+	}
+	return jobs, nil
+}
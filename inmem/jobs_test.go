@@ -0,0 +1,55 @@
+package inmem
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/begizi/vch-server/voice"
+)
+
+func TestInMemJobStore(t *testing.T) {
+	s := NewInMemJobStore()
+
+	if _, err := s.Get("missing"); err != voice.ErrJobNotFound {
+		t.Errorf("err = %v, want ErrJobNotFound", err)
+	}
+
+	now := time.Now()
+	for _, job := range []*voice.Job{
+		{ID: "pending", Status: voice.JobPending, Created: now, Lease: now},
+		{ID: "running", Status: voice.JobRunning, Created: now, Lease: now.Add(time.Minute)},
+		{ID: "done", Status: voice.JobDone, Created: now, Result: &voice.VoiceResponse{Transcript: "turn on the lights"}},
+		{ID: "failed", Status: voice.JobFailed, Created: now, Error: "no speech detected"},
+	} {
+		if err := s.Save(job); err != nil {
+			t.Fatal(err)
+		}
+		// the store keeps its own copy
+		job.Status = voice.JobFailed
+	}
+
+	job, err := s.Get("running")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != voice.JobRunning || !job.Lease.Equal(now.Add(time.Minute)) || !job.Created.Equal(now) {
+		t.Errorf("got %+v, want the running job", job)
+	}
+	if job, _ := s.Get("done"); job.Result == nil || job.Result.Transcript != "turn on the lights" {
+		t.Errorf("got %+v, want the result", job)
+	}
+
+	unfinished, err := s.Unfinished()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, job := range unfinished {
+		ids = append(ids, job.ID)
+	}
+	sort.Strings(ids)
+	if len(ids) != 2 || ids[0] != "pending" || ids[1] != "running" {
+		t.Errorf("unfinished = %v, want pending and running", ids)
+	}
+}
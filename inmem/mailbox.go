@@ -0,0 +1,207 @@
+package inmem
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/begizi/vch-server/tunnel"
+)
+
+/*
+InMemMailbox
+------------
+
+InMemMailbox impliments the Mailbox interface in the memory
+of the process. Registered devices and their messages are
+lost when the process exits. Every Deposit sweeps out what
+has expired, including the devices that haven't registered
+within the TTL.
+
+THIS DOES NOT SCALE. A device only gets the messages kept
+by the vchd process it reconnects to.
+*/
+
+type InMemMailbox struct {
+	mtx     sync.Mutex
+	ttl     time.Duration
+	devices map[string]registration
+	boxes   map[string][]*tunnel.QueueMessage
+	failed  map[string][]*tunnel.FailedMessage
+
+	// when each message the device acked or failed is done with
+	done map[string]map[string]time.Time
+}
+
+// registration is a registered device and when it was registered.
+type registration struct {
+	device tunnel.Device
+	seen   time.Time
+}
+
+func NewInMemMailbox(ttl time.Duration) tunnel.Mailbox {
+	return &InMemMailbox{
+		ttl:     ttl,
+		devices: make(map[string]registration),
+		boxes:   make(map[string][]*tunnel.QueueMessage),
+		failed:  make(map[string][]*tunnel.FailedMessage),
+		done:    make(map[string]map[string]time.Time),
+	}
+}
+
+func (m *InMemMailbox) Register(device tunnel.Device) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.devices[device.ID] = registration{device, time.Now()}
+	return nil
+}
+
+func (m *InMemMailbox) Deposit(message *tunnel.QueueMessage) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.sweep()
+
+	for id, r := range m.devices {
+		if !message.Target.MatchesDevice(r.device) || m.find(id, message.ID) >= 0 {
+			continue
+		}
+		if _, ok := m.done[id][message.ID]; ok {
+			continue
+		}
+
+		box := append(m.boxes[id], message)
+		sort.SliceStable(box, func(i, j int) bool {
+			return box[i].Sent.Before(box[j].Sent)
+		})
+		m.boxes[id] = box
+	}
+	return nil
+}
+
+func (m *InMemMailbox) Pending(deviceID string, since string) ([]*tunnel.QueueMessage, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.expire(deviceID)
+
+	box := m.boxes[deviceID]
+	if i := m.find(deviceID, since); i >= 0 {
+		box = box[i+1:]
+	}
+	return append([]*tunnel.QueueMessage{}, box...), nil
+}
+
+func (m *InMemMailbox) Remove(deviceID string, id string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.remove(deviceID, id)
+	return nil
+}
+
+func (m *InMemMailbox) Fail(deviceID string, failed *tunnel.FailedMessage) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.remove(deviceID, failed.Message.ID)
+	m.failed[deviceID] = append(m.failed[deviceID], failed)
+	return nil
+}
+
+func (m *InMemMailbox) Failed(deviceID string) ([]*tunnel.FailedMessage, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.expire(deviceID)
+	return append([]*tunnel.FailedMessage{}, m.failed[deviceID]...), nil
+}
+
+// remove drops the message from the device's mailbox and keeps it from
+// being deposited again.
+func (m *InMemMailbox) remove(deviceID string, id string) {
+	if i := m.find(deviceID, id); i >= 0 {
+		box := m.boxes[deviceID]
+		m.boxes[deviceID] = append(box[:i:i], box[i+1:]...)
+	}
+	if m.done[deviceID] == nil {
+		m.done[deviceID] = make(map[string]time.Time)
+	}
+	m.done[deviceID][id] = time.Now()
+}
+
+// find returns the index of the message in the device's mailbox, or -1.
+func (m *InMemMailbox) find(deviceID string, id string) int {
+	for i, message := range m.boxes[deviceID] {
+		if message.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// expire drops everything older than the TTL kept for the device.
+func (m *InMemMailbox) expire(deviceID string) {
+	cutoff := time.Now().Add(-m.ttl)
+
+	box := m.boxes[deviceID]
+	i := 0
+	for i < len(box) && box[i].Sent.Before(cutoff) {
+		i++
+	}
+	if i == len(box) {
+		delete(m.boxes, deviceID)
+	} else {
+		m.boxes[deviceID] = box[i:]
+	}
+
+	failed := m.failed[deviceID]
+	i = 0
+	for i < len(failed) && failed[i].Failed.Before(cutoff) {
+		i++
+	}
+	if i == len(failed) {
+		delete(m.failed, deviceID)
+	} else {
+		m.failed[deviceID] = failed[i:]
+	}
+
+	for id, t := range m.done[deviceID] {
+		if t.Before(cutoff) {
+			delete(m.done[deviceID], id)
+		}
+	}
+	if len(m.done[deviceID]) == 0 {
+		delete(m.done, deviceID)
+	}
+}
+
+// sweep drops the devices that haven't registered within the TTL, along
+// with everything kept for them, and expires the rest.
+func (m *InMemMailbox) sweep() {
+	cutoff := time.Now().Add(-m.ttl)
+	for id, r := range m.devices {
+		if r.seen.Before(cutoff) {
+			delete(m.devices, id)
+		}
+	}
+
+	sweep := func(id string) {
+		if _, ok := m.devices[id]; ok {
+			m.expire(id)
+			return
+		}
+		delete(m.boxes, id)
+		delete(m.failed, id)
+		delete(m.done, id)
+	}
+	for id := range m.boxes {
+		sweep(id)
+	}
+	for id := range m.failed {
+		sweep(id)
+	}
+	for id := range m.done {
+		sweep(id)
+	}
+}
@@ -0,0 +1,48 @@
+package inmem
+
+import (
+	"testing"
+	"time"
+
+	"github.com/begizi/vch-server/tunnel"
+	"github.com/begizi/vch-server/tunnel/mailboxtest"
+)
+
+func TestInMemMailboxConformance(t *testing.T) {
+	mailboxtest.TestMailbox(t, func(t *testing.T, ttl time.Duration) tunnel.Mailbox {
+		return NewInMemMailbox(ttl)
+	})
+}
+
+func TestInMemMailboxSweep(t *testing.T) {
+	ttl := 100 * time.Millisecond
+	m := NewInMemMailbox(ttl).(*InMemMailbox)
+
+	m.Register(tunnel.Device{ID: "lamp-1"})
+	m.Register(tunnel.Device{ID: "lamp-2"})
+	for _, id := range []string{"m1", "m2", "m3"} {
+		message := tunnel.NewQueueMessage(tunnel.NLPResponse{}, tunnel.Target{})
+		message.ID = id
+		m.Deposit(message)
+	}
+	m.Remove("lamp-1", "m1")
+	m.Fail("lamp-1", &tunnel.FailedMessage{Message: &tunnel.QueueMessage{ID: "m2"}, Failed: time.Now()})
+	time.Sleep(2 * ttl)
+
+	// lamp-2 is still connected
+	m.Register(tunnel.Device{ID: "lamp-2"})
+	m.Deposit(tunnel.NewQueueMessage(tunnel.NLPResponse{}, tunnel.Target{DeviceID: "lamp-3"}))
+
+	if _, ok := m.devices["lamp-1"]; ok {
+		t.Error("lamp-1 is still registered")
+	}
+	for name, n := range map[string]int{
+		"mailboxes":       len(m.boxes),
+		"failed messages": len(m.failed),
+		"done messages":   len(m.done),
+	} {
+		if n != 0 {
+			t.Errorf("%d devices have %s, want everything expired", n, name)
+		}
+	}
+}
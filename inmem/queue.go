@@ -1,7 +1,10 @@
 package inmem
 
 import (
+	"sync"
+
 	"github.com/begizi/vch-server/tunnel"
+	"golang.org/x/net/context"
 )
 
 /*
@@ -14,6 +17,16 @@ within the same process. This makes testing much easier and
 allows the single vchd process to run without external
 dependencies.
 
+Every call to Listen subscribes a new buffered channel that
+gets its own copy of every message, so several tunnel
+servers can share one queue. Broadcast never blocks, when a
+subscriber's buffer is full the QueueConfig's overflow
+policy decides what gives:
+
+	drop-oldest  the oldest buffered message is dropped
+	drop-newest  the new message is dropped
+	disconnect   the subscriber is unsubscribed
+
 THIS DOES NOT SCALE. Only use for testing and single client
 setups.
 
@@ -22,21 +35,120 @@ a message, there is no guarantee that the message
 will go to the process that the client is connected to.
 */
 
+type QueueConfig struct {
+	// BufferSize is the most messages a subscriber can have waiting.
+	BufferSize int
+	Overflow   tunnel.OverflowPolicy
+}
+
+var DefaultQueueConfig = QueueConfig{
+	BufferSize: 64,
+	Overflow:   tunnel.DropOldest,
+}
+
 type InMemQueue struct {
-	receivec tunnel.ReceiveC
+	mtx         sync.Mutex
+	config      QueueConfig
+	subscribers map[tunnel.ReceiveC]struct{}
+
+	// closed once the queue is closed
+	closed chan struct{}
 }
 
-func NewInMemQueue() tunnel.Queue {
-	return InMemQueue{
-		receivec: make(tunnel.ReceiveC),
+func NewInMemQueue(config QueueConfig) tunnel.Queue {
+	return &InMemQueue{
+		config:      config,
+		subscribers: make(map[tunnel.ReceiveC]struct{}),
+		closed:      make(chan struct{}),
 	}
 }
 
-func (i InMemQueue) Broadcast(m *tunnel.QueueMessage) error {
-	i.receivec <- m
+func (i *InMemQueue) Broadcast(ctx context.Context, m *tunnel.QueueMessage) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	for c := range i.subscribers {
+		select {
+		case c <- m:
+			continue
+		default:
+		}
+
+		switch i.config.Overflow {
+		case tunnel.DropNewest:
+		case tunnel.Disconnect:
+			i.unsubscribe(c)
+		default:
+			// the subscriber may have caught up in the meantime
+			select {
+			case <-c:
+			default:
+			}
+			select {
+			case c <- m:
+			default:
+			}
+		}
+	}
 	return nil
 }
 
-func (i InMemQueue) Listen() (tunnel.ReceiveC, error) {
-	return i.receivec, nil
+// Listen subscribes a new channel to every message broadcast from now on,
+// until ctx is done.
+func (i *InMemQueue) Listen(ctx context.Context) (tunnel.ReceiveC, error) {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	c := make(tunnel.ReceiveC, i.config.BufferSize)
+	select {
+	case <-i.closed:
+		close(c)
+		return c, nil
+	default:
+	}
+	i.subscribers[c] = struct{}{}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-i.closed:
+		}
+
+		i.mtx.Lock()
+		defer i.mtx.Unlock()
+		i.unsubscribe(c)
+	}()
+
+	return c, nil
+}
+
+// unsubscribe stops sending messages to c and closes it.
+func (i *InMemQueue) unsubscribe(c tunnel.ReceiveC) {
+	if _, ok := i.subscribers[c]; !ok {
+		return
+	}
+	delete(i.subscribers, c)
+	close(c)
+}
+
+// Close unsubscribes every channel.
+func (i *InMemQueue) Close() error {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	select {
+	case <-i.closed:
+		return nil
+	default:
+	}
+	close(i.closed)
+
+	for c := range i.subscribers {
+		i.unsubscribe(c)
+	}
+	return nil
 }
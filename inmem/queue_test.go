@@ -0,0 +1,191 @@
+package inmem
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/begizi/vch-server/tunnel"
+	"github.com/begizi/vch-server/tunnel/queuetest"
+	"golang.org/x/net/context"
+)
+
+func TestInMemQueueConformance(t *testing.T) {
+	queuetest.TestQueue(t, func(t *testing.T) *queuetest.Backend {
+		// every process shares the one queue
+		q := NewInMemQueue(QueueConfig{
+			BufferSize: 1000,
+			Overflow:   tunnel.DropOldest,
+		})
+		return &queuetest.Backend{
+			NewQueue: func(t *testing.T) tunnel.Queue {
+				return q
+			},
+		}
+	})
+}
+
+func message(transcript string) *tunnel.QueueMessage {
+	return tunnel.NewQueueMessage(tunnel.NLPResponse{Transcript: transcript}, tunnel.Target{})
+}
+
+// buffered returns the transcripts waiting in c without blocking, and
+// whether c is still open.
+func buffered(c tunnel.ReceiveC) ([]string, bool) {
+	transcripts := []string{}
+	for {
+		select {
+		case m, ok := <-c:
+			if !ok {
+				return transcripts, false
+			}
+			transcripts = append(transcripts, m.NLPResponse.Transcript)
+		default:
+			return transcripts, true
+		}
+	}
+}
+
+// closedWithin waits for c to be closed, dropping what is buffered.
+func closedWithin(c tunnel.ReceiveC, d time.Duration) bool {
+	timeout := time.After(d)
+	for {
+		select {
+		case _, ok := <-c:
+			if !ok {
+				return true
+			}
+		case <-timeout:
+			return false
+		}
+	}
+}
+
+func TestInMemQueueOverflow(t *testing.T) {
+	for _, tc := range []struct {
+		policy tunnel.OverflowPolicy
+		want   []string
+		open   bool
+	}{
+		{tunnel.DropOldest, []string{"2", "3"}, true},
+		{tunnel.DropNewest, []string{"1", "2"}, true},
+		{tunnel.Disconnect, []string{"1", "2"}, false},
+	} {
+		t.Run(string(tc.policy), func(t *testing.T) {
+			q := NewInMemQueue(QueueConfig{BufferSize: 2, Overflow: tc.policy})
+			defer q.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			slow, err := q.Listen(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fast, err := q.Listen(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, transcript := range []string{"1", "2"} {
+				if err := q.Broadcast(ctx, message(transcript)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// fast keeps up, slow doesn't
+			if got, _ := buffered(fast); strings.Join(got, ",") != "1,2" {
+				t.Fatalf("fast subscriber got %v, want 1,2", got)
+			}
+			if err := q.Broadcast(ctx, message("3")); err != nil {
+				t.Fatal(err)
+			}
+
+			got, open := buffered(slow)
+			if strings.Join(got, ",") != strings.Join(tc.want, ",") || open != tc.open {
+				t.Errorf("slow subscriber got %v (open %v), want %v (open %v)", got, open, tc.want, tc.open)
+			}
+			// the others never lose a message to a slow subscriber
+			if got, open := buffered(fast); strings.Join(got, ",") != "3" || !open {
+				t.Errorf("fast subscriber got %v (open %v), want 3", got, open)
+			}
+
+			// a disconnected subscriber stays disconnected
+			if err := q.Broadcast(ctx, message("4")); err != nil {
+				t.Fatal(err)
+			}
+			if !tc.open {
+				if got, open := buffered(slow); len(got) != 0 || open {
+					t.Errorf("disconnected subscriber got %v (open %v)", got, open)
+				}
+			}
+		})
+	}
+}
+
+func TestInMemQueueUnsubscribe(t *testing.T) {
+	t.Run("context done", func(t *testing.T) {
+		q := NewInMemQueue(DefaultQueueConfig)
+		defer q.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		c, err := q.Listen(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := q.Listen(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cancel()
+		if !closedWithin(c, time.Second) {
+			t.Fatal("subscription outlived its context")
+		}
+
+		// the other subscribers are unaffected
+		if err := q.Broadcast(context.Background(), message("1")); err != nil {
+			t.Fatal(err)
+		}
+		if got, open := buffered(other); strings.Join(got, ",") != "1" || !open {
+			t.Errorf("other subscriber got %v (open %v), want 1", got, open)
+		}
+		if n := len(q.(*InMemQueue).subscribers); n != 1 {
+			t.Errorf("%d subscribers left, want 1", n)
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		q := NewInMemQueue(DefaultQueueConfig)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		subscriptions := []tunnel.ReceiveC{}
+		for i := 0; i < 3; i++ {
+			c, err := q.Listen(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			subscriptions = append(subscriptions, c)
+		}
+
+		if err := q.Close(); err != nil {
+			t.Fatal(err)
+		}
+		for i, c := range subscriptions {
+			if !closedWithin(c, time.Second) {
+				t.Errorf("subscription %d still open after Close", i)
+			}
+		}
+
+		// closing twice is fine, listening after Close gets a closed channel
+		if err := q.Close(); err != nil {
+			t.Errorf("second Close: %v", err)
+		}
+		c, err := q.Listen(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !closedWithin(c, time.Second) {
+			t.Error("Listen after Close returned an open channel")
+		}
+	})
+}
@@ -6,11 +6,17 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"time"
+
+	"golang.org/x/net/context"
 )
 
 // BASEURL is the base url for the luis api
 const BASEURL = "https://api.projectoxford.ai/luis/v2.0/apps"
 
+// healthTimeout is how long Health waits for the api to answer.
+const healthTimeout = 5 * time.Second
+
 type Client struct {
 	BaseURL         *url.URL
 	client          *http.Client
@@ -63,23 +69,26 @@ func NewClient(httpClient *http.Client, projectId, subscriptionKey string) *Clie
 	}
 }
 
-func (c *Client) Parse(query string) (*ParseResponse, error) {
+func (c *Client) Parse(ctx context.Context, query string) (*ParseResponse, error) {
 	params := url.Values{
 		"subscription-key": []string{c.subscriptionKey},
 		"q":                []string{query},
 	}
-	c.BaseURL.RawQuery = params.Encode()
+	// a copy, as the client is shared by concurrent requests
+	u := *c.BaseURL
+	u.RawQuery = params.Encode()
 
 	var buf io.ReadWriter
-	req, err := http.NewRequest("GET", c.BaseURL.String(), buf)
+	req, err := http.NewRequest("GET", u.String(), buf)
 	if err != nil {
 		return nil, err
 	}
 
-	resp, err := c.client.Do(req)
+	resp, err := c.client.Do(req.WithContext(ctx))
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 
 	parseResp := &ParseResponse{}
 	err = json.NewDecoder(resp.Body).Decode(parseResp)
@@ -90,3 +99,28 @@ func (c *Client) Parse(query string) (*ParseResponse, error) {
 	return parseResp, err
 
 }
+
+// Health reports why the api can't be reached, or nil when it answers.
+// The app isn't queried, queries count against the subscription's quota.
+func (c *Client) Health() error {
+	ctx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+	defer cancel()
+
+	u := *c.BaseURL
+	u.RawQuery = ""
+	req, err := http.NewRequest("HEAD", u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("LUIS Error: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("LUIS Error: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package luis
+
+import (
+	"github.com/begizi/vch-server/nlu"
+	"golang.org/x/net/context"
+)
+
+// Parser adapts a LUIS Client to the nlu.Parser interface.
+type Parser struct {
+	client *Client
+}
+
+func NewParser(client *Client) nlu.Parser {
+	return &Parser{client}
+}
+
+func (p *Parser) Parse(ctx context.Context, query string) (*nlu.Result, error) {
+	resp, err := p.client.Parse(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return toResult(resp), nil
+}
+
+func toIntent(i *Intent) *nlu.Intent {
+	if i == nil {
+		return nil
+	}
+	return &nlu.Intent{
+		Name:  i.Intent,
+		Score: i.Score,
+	}
+}
+
+// noneIntent is the intent LUIS scores highest when nothing matched.
+const noneIntent = "None"
+
+func toResult(resp *ParseResponse) *nlu.Result {
+	result := &nlu.Result{
+		Query:     resp.Query,
+		TopIntent: toIntent(resp.TopScoringIntent),
+	}
+	if result.TopIntent != nil && result.TopIntent.Name == noneIntent {
+		result.TopIntent = nil
+	}
+
+	for _, i := range resp.Intents {
+		result.Intents = append(result.Intents, toIntent(i))
+	}
+
+	for _, e := range resp.Entities {
+		result.Entities = append(result.Entities, &nlu.Entity{
+			Type:       e.Type,
+			Value:      e.Entity,
+			StartIndex: e.StartIndex,
+			EndIndex:   e.EndIndex,
+			Score:      e.Score,
+		})
+	}
+
+	for _, c := range resp.CompositeEntities {
+		composite := &nlu.CompositeEntity{
+			Type:  c.ParentType,
+			Value: c.Value,
+		}
+		for _, child := range c.Children {
+			composite.Children = append(composite.Children, &nlu.Entity{
+				Type:  child.Type,
+				Value: child.Value,
+			})
+		}
+		result.CompositeEntities = append(result.CompositeEntities, composite)
+	}
+
+	return result
+}
@@ -0,0 +1,115 @@
+package luis
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestToResult(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		resp   *ParseResponse
+		intent string
+	}{
+		{"top intent", &ParseResponse{TopScoringIntent: &Intent{Intent: "Power", Score: 0.9}}, "Power"},
+		{"none intent", &ParseResponse{TopScoringIntent: &Intent{Intent: "None", Score: 0.8}}, ""},
+		{"no top intent", &ParseResponse{}, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := toResult(tc.resp)
+			if tc.intent == "" {
+				if r.TopIntent != nil {
+					t.Errorf("TopIntent = %q, want nil", r.TopIntent.Name)
+				}
+				return
+			}
+			if r.TopIntent == nil {
+				t.Fatalf("TopIntent = nil, want %q", tc.intent)
+			}
+			if r.TopIntent.Name != tc.intent || r.TopIntent.Score != tc.resp.TopScoringIntent.Score {
+				t.Errorf("TopIntent = %+v, want %q scored %v", r.TopIntent, tc.intent, tc.resp.TopScoringIntent.Score)
+			}
+		})
+	}
+}
+
+func TestToResultEntities(t *testing.T) {
+	r := toResult(&ParseResponse{
+		Query:            "turn on the lamp in the kitchen",
+		TopScoringIntent: &Intent{Intent: "Power", Score: 0.9},
+		Intents:          []*Intent{{Intent: "Power", Score: 0.9}, {Intent: "None", Score: 0.1}},
+		Entities: []*Entity{
+			{Entity: "lamp", Type: "device", StartIndex: 12, EndIndex: 15, Score: 0.7},
+		},
+		CompositeEntities: []*CompositeEntity{{
+			ParentType: "target",
+			Value:      "lamp in the kitchen",
+			Children: []*CompositeEntityChild{
+				{Type: "device", Value: "lamp"},
+				{Type: "room", Value: "kitchen"},
+			},
+		}},
+	})
+
+	if r.Query != "turn on the lamp in the kitchen" {
+		t.Errorf("Query = %q", r.Query)
+	}
+	// the none intent is still ranked, only the top intent is dropped
+	if len(r.Intents) != 2 || r.Intents[1].Name != "None" {
+		t.Errorf("Intents = %+v, want Power and None", r.Intents)
+	}
+	if len(r.Entities) != 1 {
+		t.Fatalf("got %d entities, want 1", len(r.Entities))
+	}
+	e := r.Entities[0]
+	if e.Type != "device" || e.Value != "lamp" || e.StartIndex != 12 || e.EndIndex != 15 || e.Score != 0.7 {
+		t.Errorf("entity = %+v", e)
+	}
+	if len(r.CompositeEntities) != 1 {
+		t.Fatalf("got %d composite entities, want 1", len(r.CompositeEntities))
+	}
+	c := r.CompositeEntities[0]
+	if c.Type != "target" || c.Value != "lamp in the kitchen" || len(c.Children) != 2 {
+		t.Fatalf("composite entity = %+v", c)
+	}
+	if c.Children[1].Type != "room" || c.Children[1].Value != "kitchen" {
+		t.Errorf("child = %+v, want room kitchen", c.Children[1])
+	}
+}
+
+func TestParseContext(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+
+	client := NewClient(srv.Client(), "app", "key")
+	client.BaseURL, _ = url.Parse(srv.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := NewParser(client).Parse(ctx, "turn on the lamp")
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("Parse succeeded after its context expired")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Parse ignored its context")
+	}
+}
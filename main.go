@@ -1,65 +1,195 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/go-kit/kit/endpoint"
 	"github.com/go-kit/kit/log"
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 
+	"github.com/begizi/vch-server/asr"
+	"github.com/begizi/vch-server/config"
 	"github.com/begizi/vch-server/gcp"
+	"github.com/begizi/vch-server/grammar"
+	"github.com/begizi/vch-server/health"
+	"github.com/begizi/vch-server/inmem"
 	"github.com/begizi/vch-server/luis"
+	"github.com/begizi/vch-server/nlu"
 	"github.com/begizi/vch-server/pb"
 	"github.com/begizi/vch-server/redis"
+	"github.com/begizi/vch-server/tracing"
 	"github.com/begizi/vch-server/tunnel"
 	"github.com/begizi/vch-server/voice"
 )
 
-const (
-	port      = "PORT"
-	gRPCPort  = "GRPC_PORT"
-	redisAddr = "REDIS_ADDR"
-)
+// how long requests in flight get to finish on shutdown
+const shutdownTimeout = 30 * time.Second
+
+// how often the health of the dependencies is checked
+const healthInterval = 10 * time.Second
+
+// how often LUIS is checked, less often than the local components
+const luisHealthInterval = 5 * time.Minute
 
 func main() {
-	port := os.Getenv(port)
-	// default for port
-	if port == "" {
-		port = "8080"
+	cfg, err := config.Load(os.Args[1:], os.Getenv)
+	if err == flag.ErrHelp {
+		os.Exit(0)
 	}
-
-	gRPCPort := os.Getenv(gRPCPort)
-	// default for port
-	if gRPCPort == "" {
-		gRPCPort = "9001"
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
 
-	redisAddr := os.Getenv(redisAddr)
-	// default for redis
-	if redisAddr == "" {
-		redisAddr = ":6379"
+	// Logging domain.
+	var logger log.Logger
+	{
+		logger = log.NewLogfmtLogger(os.Stdout)
+		logger = log.NewContext(logger).With("ts", log.DefaultTimestampUTC)
+		logger = log.NewContext(logger).With("caller", log.DefaultCaller)
 	}
 
+	// Health checks, registered by each component as it is set up
+	checks := health.NewHealth(healthInterval, logger, "pb.VCH")
+
 	// Setup Queue
-	queue, err := redis.NewRedisQueue(redisAddr)
-	if err != nil {
-		panic(err)
+	var queue tunnel.Queue
+	switch cfg.Queue.Backend {
+	case "redis":
+		queue, err = redis.NewRedisQueue(cfg.RedisAddr)
+		if err != nil {
+			panic(err)
+		}
+	case "redis-streams":
+		streamConfig := redis.DefaultStreamConfig
+		// one consumer per group, named after it so it is as stable
+		streamConfig.Group = cfg.Queue.Group
+		streamConfig.Consumer = cfg.Queue.Group
+		streamConfig.MaxLen = cfg.Queue.MaxLen
+		queue, err = redis.NewRedisStreamQueue(cfg.RedisAddr, streamConfig)
+		if err != nil {
+			panic(err)
+		}
+	case "inmem":
+		queue = inmem.NewInMemQueue(inmem.DefaultQueueConfig)
+	}
+	if checker, ok := queue.(health.Checker); ok {
+		checks.Register("queue", checker)
 	}
 
-	// Setup GCP Speech
-	client, err := gcp.NewGCPSpeechConv()
-	if err != nil {
-		panic(err)
+	// Setup tunnel send queues
+	tunnelConfig := tunnel.Config{
+		QueueSize: cfg.Tunnel.QueueSize,
+		Overflow:  tunnel.OverflowPolicy(cfg.Tunnel.Overflow),
+
+		// keep the devices of open tunnels in the mailbox registry
+		RegisterInterval: time.Duration(cfg.Mailbox.TTL) / 4,
 	}
 
-	// Setup luis client
-	luisClient := luis.NewClient(nil, "fe4586e0-03a9-4fb3-b49a-be7e74b3fc15", "1de93e00db2e4d128168115876e5391e")
+	// Setup mailboxes for offline devices
+	var mailbox tunnel.Mailbox
+	switch cfg.Mailbox.Backend {
+	case "redis":
+		mailbox, err = redis.NewRedisMailbox(cfg.RedisAddr, time.Duration(cfg.Mailbox.TTL))
+		if err != nil {
+			panic(err)
+		}
+	case "inmem":
+		mailbox = inmem.NewInMemMailbox(time.Duration(cfg.Mailbox.TTL))
+	}
+	if checker, ok := mailbox.(health.Checker); ok {
+		checks.Register("mailbox", checker)
+	}
+
+	// Setup job store
+	var jobs voice.JobStore
+	switch cfg.JobStore {
+	case "redis":
+		jobs, err = redis.NewRedisJobStore(cfg.RedisAddr)
+		if err != nil {
+			panic(err)
+		}
+	case "inmem":
+		jobs = inmem.NewInMemJobStore()
+	}
+	if checker, ok := jobs.(health.Checker); ok {
+		checks.Register("jobs", checker)
+	}
+	// any process fails the jobs of the processes that died running them
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	go func() {
+		for {
+			if n, err := voice.FailOrphanedJobs(jobs); err != nil {
+				logger.Log("msg", "Orphaned jobs check failed", "err", err)
+			} else if n > 0 {
+				logger.Log("msg", "Failed orphaned jobs", "jobs", n)
+			}
+
+			select {
+			case <-time.After(voice.JobLease):
+			case <-jobsCtx.Done():
+				return
+			}
+		}
+	}()
+
+	// Setup speech recognizer
+	var speechRecognizer asr.Recognizer
+	switch cfg.Recognizer.Backend {
+	case "gcp":
+		client, err := gcp.NewGCPSpeechConv(cfg.Recognizer.CredentialsFile)
+		if err != nil {
+			panic(err)
+		}
+		speechRecognizer = client
+		checks.Register("recognizer", client)
+	case "fake":
+		speechRecognizer = asr.NewFakeRecognizer(cfg.Recognizer.FakeTranscript)
+	}
+
+	// Setup NLU parser, the grammar vocabulary doubles as recognition hints
+	var parser nlu.Parser
+	var phrases []string
+	switch cfg.NLU.Backend {
+	case "luis":
+		luisClient := luis.NewClient(nil, cfg.NLU.LUISAppID, cfg.NLU.LUISKey)
+		parser = luis.NewParser(luisClient)
+		// every check is a request to the API
+		checks.Register("nlu", health.Every(luisHealthInterval, luisClient))
+		if cfg.NLU.GrammarFile != "" {
+			g, err := grammar.Load(cfg.NLU.GrammarFile)
+			if err != nil {
+				panic(err)
+			}
+			phrases = g.Phrases()
+		}
+	case "grammar":
+		g, err := grammar.Load(cfg.NLU.GrammarFile)
+		if err != nil {
+			panic(err)
+		}
+		parser, err = grammar.NewParser(g)
+		if err != nil {
+			panic(err)
+		}
+		phrases = g.Phrases()
+	}
 
 	// Context
 	ctx := context.Background()
@@ -67,19 +197,102 @@ func main() {
 	// Error chan
 	errc := make(chan error)
 
-	// Logging domain.
-	var logger log.Logger
-	{
-		logger = log.NewLogfmtLogger(os.Stdout)
-		logger = log.NewContext(logger).With("ts", log.DefaultTimestampUTC)
-		logger = log.NewContext(logger).With("caller", log.DefaultCaller)
+	// Tracing domain.
+	shutdownTracing, err := tracing.Setup(ctx, cfg.Tracing)
+	if err != nil {
+		panic(err)
 	}
+	tracer := otel.Tracer("github.com/begizi/vch-server")
+
+	speechRecognizer = asr.TracingMiddleware(tracer)(speechRecognizer)
+	parser = nlu.TracingMiddleware(tracer)(parser)
+	tracedQueue := tunnel.QueueTracingMiddleware(tracer)(queue)
+
+	// Metrics domain.
+	var stageRequests, stageLatency = kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Namespace: "vch",
+		Subsystem: "voice",
+		Name:      "stage_requests_total",
+		Help:      "Number of requests through each stage of the voice pipeline.",
+	}, []string{"stage", "error"}), kitprometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+		Namespace: "vch",
+		Subsystem: "voice",
+		Name:      "stage_duration_seconds",
+		Help:      "Time spent in each stage of the voice pipeline.",
+	}, []string{"stage", "error"})
+
+	speechRecognizer = asr.InstrumentingMiddleware(
+		stageRequests.With("stage", "recognize"),
+		stageLatency.With("stage", "recognize"),
+	)(speechRecognizer)
+	parser = nlu.InstrumentingMiddleware(
+		stageRequests.With("stage", "nlu"),
+		stageLatency.With("stage", "nlu"),
+	)(parser)
+	decode := voice.ChainDecodeMiddleware(
+		voice.DecodeInstrumentingMiddleware(
+			stageRequests.With("stage", "decode"),
+			stageLatency.With("stage", "decode"),
+		),
+		voice.DecodeTracingMiddleware(tracer),
+	)
+
+	// the closers below still close the queue itself
+	instrumentedQueue := tunnel.QueueInstrumentingMiddleware(tunnel.QueueMetrics{
+		Published:      stageRequests.With("stage", "broadcast"),
+		PublishLatency: stageLatency.With("stage", "broadcast"),
+		Received: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "vch",
+			Subsystem: "queue",
+			Name:      "received_total",
+			Help:      "Number of messages received from the queue.",
+		}, nil),
+		Lag: kitprometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: "vch",
+			Subsystem: "queue",
+			Name:      "lag_seconds",
+			Help:      "Time between a message being sent and received.",
+		}, nil),
+	})(tracedQueue)
 
 	// Business domain.
 	var voiceService voice.Service
 	{
-		voiceService = voice.NewBasicService(client, queue, luisClient)
+		voiceService = voice.NewBasicService(speechRecognizer, instrumentedQueue, parser, jobs, voice.Config{
+			MinConfidence: float32(cfg.Voice.MinConfidence),
+			Language:      cfg.Voice.DefaultLocale,
+			Phrases:       phrases,
+			Alternatives:  cfg.Voice.MaxAlternatives,
+		})
 		voiceService = voice.ServiceLoggingMiddleware(logger)(voiceService)
+		voiceService = voice.ServiceInstrumentingMiddleware(
+			kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+				Namespace: "vch",
+				Subsystem: "voice",
+				Name:      "requests_total",
+				Help:      "Number of requests received.",
+			}, []string{"method", "error"}),
+			kitprometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+				Namespace: "vch",
+				Subsystem: "voice",
+				Name:      "request_duration_seconds",
+				Help:      "Total duration of requests.",
+			}, []string{"method", "error"}),
+			kitprometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+				Namespace: "vch",
+				Subsystem: "voice",
+				Name:      "audio_duration_seconds",
+				Help:      "Duration of uploaded audio.",
+				Buckets:   []float64{0.5, 1, 2, 5, 10, 30, 60, 300, 900},
+			}, []string{"method"}),
+			kitprometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+				Namespace: "vch",
+				Subsystem: "voice",
+				Name:      "audio_size_bytes",
+				Help:      "Size of uploaded audio.",
+				Buckets:   stdprometheus.ExponentialBuckets(16<<10, 4, 8),
+			}, []string{"method"}),
+		)(voiceService)
 	}
 
 	var voiceEndpoint endpoint.Endpoint
@@ -89,6 +302,42 @@ func main() {
 		voiceEndpoint = voice.EndpointLoggingMiddleware(voiceLogger)(voiceEndpoint)
 	}
 
+	var streamVoiceEndpoint endpoint.Endpoint
+	{
+		streamVoiceLogger := log.NewContext(logger).With("method", "StreamVoice")
+		streamVoiceEndpoint = voice.MakeStreamVoiceEndpoint(voiceService)
+		streamVoiceEndpoint = voice.EndpointLoggingMiddleware(streamVoiceLogger)(streamVoiceEndpoint)
+	}
+
+	var submitJobEndpoint endpoint.Endpoint
+	{
+		submitJobLogger := log.NewContext(logger).With("method", "SubmitJob")
+		submitJobEndpoint = voice.MakeSubmitJobEndpoint(voiceService)
+		submitJobEndpoint = voice.EndpointLoggingMiddleware(submitJobLogger)(submitJobEndpoint)
+	}
+
+	var jobEndpoint endpoint.Endpoint
+	{
+		jobLogger := log.NewContext(logger).With("method", "Job")
+		jobEndpoint = voice.MakeJobEndpoint(voiceService)
+		jobEndpoint = voice.EndpointLoggingMiddleware(jobLogger)(jobEndpoint)
+	}
+
+	var textEndpoint endpoint.Endpoint
+	{
+		textLogger := log.NewContext(logger).With("method", "Text")
+		textEndpoint = voice.MakeTextEndpoint(voiceService)
+		textEndpoint = voice.EndpointLoggingMiddleware(textLogger)(textEndpoint)
+	}
+
+	endpoints := voice.Endpoints{
+		VoiceEndpoint:       voiceEndpoint,
+		StreamVoiceEndpoint: streamVoiceEndpoint,
+		SubmitJobEndpoint:   submitJobEndpoint,
+		JobEndpoint:         jobEndpoint,
+		TextEndpoint:        textEndpoint,
+	}
+
 	// Interrupt handler
 	go func() {
 		c := make(chan os.Signal, 1)
@@ -96,56 +345,157 @@ func main() {
 		errc <- fmt.Errorf("%s", <-c)
 	}()
 
+	// Mechanical domain.
+	tunnelServer, err := tunnel.MakeTunnelServer(instrumentedQueue, mailbox, tunnelConfig, tunnel.Metrics{
+		QueueDepth: kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: "vch",
+			Subsystem: "tunnel",
+			Name:      "queue_depth",
+			Help:      "Number of responses waiting in all send queues.",
+		}, nil),
+		Dropped: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "vch",
+			Subsystem: "tunnel",
+			Name:      "dropped_messages_total",
+			Help:      "Number of responses that didn't fit in a send queue.",
+		}, []string{"policy"}),
+		Sessions: kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: "vch",
+			Subsystem: "tunnel",
+			Name:      "sessions",
+			Help:      "Number of open tunnels.",
+		}, nil),
+		SendErrors: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "vch",
+			Subsystem: "tunnel",
+			Name:      "send_errors_total",
+			Help:      "Number of responses that failed to send down a tunnel.",
+		}, nil),
+		FailedDeliveries: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "vch",
+			Subsystem: "tunnel",
+			Name:      "failed_deliveries_total",
+			Help:      "Number of responses that were never acked.",
+		}, []string{"reason"}),
+	}, tracer, logger)
+	if err != nil {
+		panic(err)
+	}
+
 	// HTTP transport
-	go func() {
+	var httpServer *http.Server
+	{
 		var voiceHandler http.Handler
 		{
-			endpoints := voice.Endpoints{
-				VoiceEndpoint: voiceEndpoint,
-			}
 			logger := log.NewContext(logger).With("transport", "HTTP")
-			voiceHandler = voice.MakeVoiceHTTPServer(ctx, endpoints, logger)
+			voiceHandler = voice.MakeVoiceHTTPServer(ctx, endpoints, decode, logger)
 		}
 
 		mux := http.NewServeMux()
 
 		fs := http.FileServer(http.Dir("static"))
 		mux.Handle("/", fs)
-		mux.Handle("/api/", accessControl(voiceHandler))
+		mux.Handle("/api/", otelhttp.NewHandler(accessControl(voiceHandler), "api",
+			otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+				return r.Method + " " + r.URL.Path
+			}),
+		))
+		mux.Handle("/metrics", promhttp.Handler())
+		mux.Handle("/healthz", checks.LiveHandler())
+		mux.Handle("/readyz", checks.ReadyHandler())
+
+		httpServer = &http.Server{Addr: ":" + cfg.Port, Handler: mux}
+	}
+	httpListener := checks.NewListener("http")
+	go func() {
+		lis, err := net.Listen("tcp", httpServer.Addr)
+		if err != nil {
+			errc <- err
+			return
+		}
+		httpListener.Up()
 
-		logger.Log("msg", "HTTP Server Started", "port", port)
-		errc <- http.ListenAndServe(":"+port, mux)
+		logger.Log("msg", "HTTP Server Started", "port", cfg.Port)
+		err = httpServer.Serve(lis)
+		httpListener.Down(err)
+		errc <- err
 	}()
 
 	// gRPC transport
+	grpcServer := grpc.NewServer(
+		grpc.UnaryInterceptor(otelgrpc.UnaryServerInterceptor()),
+		grpc.StreamInterceptor(otelgrpc.StreamServerInterceptor()),
+	)
+	{
+		logger := log.NewContext(logger).With("transport", "gRPC")
+		pb.RegisterVCHServer(grpcServer, vchServer{tunnelServer, voice.MakeVoiceGRPCServer(endpoints, logger)})
+		healthpb.RegisterHealthServer(grpcServer, checks.GRPCServer())
+	}
+	grpcListener := checks.NewListener("grpc")
 	go func() {
-		lis, err := net.Listen("tcp", ":"+gRPCPort)
+		lis, err := net.Listen("tcp", ":"+cfg.GRPCPort)
 		if err != nil {
 			errc <- err
 			return
 		}
 		defer lis.Close()
+		grpcListener.Up()
 
-		s := grpc.NewServer()
+		logger.Log("msg", "GRPC Server Started", "port", cfg.GRPCPort)
+		err = grpcServer.Serve(lis)
+		grpcListener.Down(err)
+		errc <- err
+	}()
 
-		// Mechanical domain.
-		var vch pb.VCHServer
-		{
-			t, err := tunnel.MakeTunnelServer(queue, logger)
-			if err != nil {
-				errc <- err
-				return
-			}
-			vch = t
-		}
+	healthCtx, stopHealth := context.WithCancel(ctx)
+	go checks.Run(healthCtx)
 
-		pb.RegisterVCHServer(s, vch)
+	logger.Log("exit", <-errc)
+
+	// Shut down in order. The server is reported as not ready first, then
+	// HTTP requests in flight are finished, then the tunnels are ended and
+	// the queue is no longer read, then gRPC requests in flight are
+	// finished. The queue and stores go last as the requests before may
+	// still be using them.
+	checks.Shutdown()
+	stopHealth()
+	stopJobs()
 
-		logger.Log("msg", "GRPC Server Started", "port", gRPCPort)
-		errc <- s.Serve(lis)
+	shutdownCtx, cancel := context.WithTimeout(ctx, shutdownTimeout)
+	defer cancel()
+
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		logger.Log("msg", "HTTP Server Shutdown", "err", err)
+	}
+
+	tunnelServer.Close()
+
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
 	}()
+	select {
+	case <-stopped:
+	case <-shutdownCtx.Done():
+		grpcServer.Stop()
+	}
 
-	logger.Log("exit", <-errc)
+	for _, c := range []interface{}{queue, mailbox, jobs} {
+		if closer, ok := c.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		logger.Log("msg", "Tracing Shutdown", "err", err)
+	}
+	logger.Log("msg", "Shutdown complete")
+}
+
+// vchServer serves the VCH service from the tunnel and voice domains.
+type vchServer struct {
+	*tunnel.VCHTunnelServer
+	*voice.VoiceServer
 }
 
 func accessControl(h http.Handler) http.Handler {
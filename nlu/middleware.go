@@ -0,0 +1,70 @@
+package nlu
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+)
+
+type Middleware func(Parser) Parser
+
+// InstrumentingMiddleware counts parsed utterances and measures how long
+// they take, labeled by whether they failed.
+func InstrumentingMiddleware(requests metrics.Counter, latency metrics.Histogram) Middleware {
+	return func(next Parser) Parser {
+		return instrumentingMiddleware{
+			requests: requests,
+			latency:  latency,
+			next:     next,
+		}
+	}
+}
+
+type instrumentingMiddleware struct {
+	requests metrics.Counter
+	latency  metrics.Histogram
+	next     Parser
+}
+
+func (mw instrumentingMiddleware) Parse(ctx context.Context, query string) (r *Result, err error) {
+	defer func(begin time.Time) {
+		lvs := []string{"error", fmt.Sprint(err != nil)}
+		mw.requests.With(lvs...).Add(1)
+		mw.latency.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+	return mw.next.Parse(ctx, query)
+}
+
+// TracingMiddleware traces parsed utterances.
+func TracingMiddleware(tracer trace.Tracer) Middleware {
+	return func(next Parser) Parser {
+		return tracingMiddleware{
+			tracer: tracer,
+			next:   next,
+		}
+	}
+}
+
+type tracingMiddleware struct {
+	tracer trace.Tracer
+	next   Parser
+}
+
+func (mw tracingMiddleware) Parse(ctx context.Context, query string) (r *Result, err error) {
+	ctx, span := mw.tracer.Start(ctx, "nlu.Parse")
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		} else if r != nil && r.TopIntent != nil {
+			span.SetAttributes(attribute.String("vch.intent", r.TopIntent.Name))
+		}
+		span.End()
+	}()
+	return mw.next.Parse(ctx, query)
+}
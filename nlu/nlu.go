@@ -0,0 +1,56 @@
+package nlu
+
+import (
+	"golang.org/x/net/context"
+)
+
+/*
+Parser Interface
+----------------
+
+The Parser interface describes a natural language
+understanding engine. It takes the text of an utterance
+and returns the intents it matched along with any entities
+it was able to pull out of the text.
+
+The result model is vendor neutral so the tunnel and the
+transport mapping code never depend on a specific engine.
+Engines live in their own packages (see luis) and adapt
+their responses to these types.
+*/
+
+type Intent struct {
+	Name  string  `json:"name"`
+	Score float64 `json:"score"`
+}
+
+type Entity struct {
+	Type       string  `json:"type"`
+	Value      string  `json:"value"`
+	StartIndex int     `json:"startIndex"`
+	EndIndex   int     `json:"endIndex"`
+	Score      float64 `json:"score"`
+}
+
+// CompositeEntity groups the entities that belong to a
+// single command, eg. a "Lights" command with a "state"
+// and a "room" child.
+type CompositeEntity struct {
+	Type     string    `json:"type"`
+	Value    string    `json:"value"`
+	Children []*Entity `json:"children"`
+}
+
+// Result is a parsed utterance. TopIntent is nil when the
+// engine couldn't match the utterance to any intent.
+type Result struct {
+	Query             string             `json:"query"`
+	TopIntent         *Intent            `json:"topIntent"`
+	Intents           []*Intent          `json:"intents"`
+	Entities          []*Entity          `json:"entities"`
+	CompositeEntities []*CompositeEntity `json:"compositeEntities"`
+}
+
+type Parser interface {
+	Parse(ctx context.Context, query string) (*Result, error)
+}
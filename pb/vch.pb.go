@@ -12,8 +12,16 @@ It has these top-level messages:
 	Entity
 	Intent
 	NLPResponse
+	Target
 	TunnelRequest
+	Ack
 	TunnelResponse
+	RecognitionConfig
+	RecognizeRequest
+	Transcript
+	RecognizeResponse
+	TextRequest
+	QueueEnvelope
 */
 package pb
 
@@ -37,6 +45,32 @@ var _ = math.Inf
 // proto package needs to be updated.
 const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
 
+type RecognitionConfig_Encoding int32
+
+const (
+	RecognitionConfig_LINEAR16 RecognitionConfig_Encoding = 0
+	RecognitionConfig_FLAC     RecognitionConfig_Encoding = 1
+	RecognitionConfig_MULAW    RecognitionConfig_Encoding = 2
+)
+
+var RecognitionConfig_Encoding_name = map[int32]string{
+	0: "LINEAR16",
+	1: "FLAC",
+	2: "MULAW",
+}
+var RecognitionConfig_Encoding_value = map[string]int32{
+	"LINEAR16": 0,
+	"FLAC":     1,
+	"MULAW":    2,
+}
+
+func (x RecognitionConfig_Encoding) String() string {
+	return proto.EnumName(RecognitionConfig_Encoding_name, int32(x))
+}
+func (RecognitionConfig_Encoding) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor0, []int{7, 0}
+}
+
 type Entity struct {
 	Type  string `protobuf:"bytes,1,opt,name=type" json:"type,omitempty"`
 	Value string `protobuf:"bytes,2,opt,name=value" json:"value,omitempty"`
@@ -87,6 +121,10 @@ func (m *Intent) GetEntities() []*Entity {
 
 type NLPResponse struct {
 	Intents []*Intent `protobuf:"bytes,1,rep,name=intents" json:"intents,omitempty"`
+	// transcript is what the recognizer heard and confidence how
+	// sure it was, between 0 and 1.
+	Transcript string  `protobuf:"bytes,2,opt,name=transcript" json:"transcript,omitempty"`
+	Confidence float32 `protobuf:"fixed32,3,opt,name=confidence" json:"confidence,omitempty"`
 }
 
 func (m *NLPResponse) Reset()                    { *m = NLPResponse{} }
@@ -101,24 +139,139 @@ func (m *NLPResponse) GetIntents() []*Intent {
 	return nil
 }
 
+func (m *NLPResponse) GetTranscript() string {
+	if m != nil {
+		return m.Transcript
+	}
+	return ""
+}
+
+func (m *NLPResponse) GetConfidence() float32 {
+	if m != nil {
+		return m.Confidence
+	}
+	return 0
+}
+
+// Target picks the tunnel sessions a result is delivered to. An
+// empty target delivers to every session.
+type Target struct {
+	DeviceId string `protobuf:"bytes,1,opt,name=device_id,json=deviceId" json:"device_id,omitempty"`
+	// labels selects the sessions that have all of these labels.
+	Labels map[string]string `protobuf:"bytes,2,rep,name=labels" json:"labels,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+}
+
+func (m *Target) Reset()                    { *m = Target{} }
+func (m *Target) String() string            { return proto.CompactTextString(m) }
+func (*Target) ProtoMessage()               {}
+func (*Target) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
+
+func (m *Target) GetDeviceId() string {
+	if m != nil {
+		return m.DeviceId
+	}
+	return ""
+}
+
+func (m *Target) GetLabels() map[string]string {
+	if m != nil {
+		return m.Labels
+	}
+	return nil
+}
+
+// TunnelRequest identifies the device opening the tunnel so results
+// can be targeted at it, eg. labels {"room": "kitchen", "owner": "ben"}.
 type TunnelRequest struct {
+	DeviceId string            `protobuf:"bytes,1,opt,name=device_id,json=deviceId" json:"device_id,omitempty"`
+	Labels   map[string]string `protobuf:"bytes,2,rep,name=labels" json:"labels,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Ack      *Ack              `protobuf:"bytes,3,opt,name=ack" json:"ack,omitempty"`
+	// last_id is the last response the device acked before it
+	// reconnected. Responses kept for it since are sent again.
+	LastId string `protobuf:"bytes,4,opt,name=last_id,json=lastId" json:"last_id,omitempty"`
 }
 
 func (m *TunnelRequest) Reset()                    { *m = TunnelRequest{} }
 func (m *TunnelRequest) String() string            { return proto.CompactTextString(m) }
 func (*TunnelRequest) ProtoMessage()               {}
-func (*TunnelRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
+func (*TunnelRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{4} }
+
+func (m *TunnelRequest) GetDeviceId() string {
+	if m != nil {
+		return m.DeviceId
+	}
+	return ""
+}
+
+func (m *TunnelRequest) GetLabels() map[string]string {
+	if m != nil {
+		return m.Labels
+	}
+	return nil
+}
+
+func (m *TunnelRequest) GetAck() *Ack {
+	if m != nil {
+		return m.Ack
+	}
+	return nil
+}
+
+func (m *TunnelRequest) GetLastId() string {
+	if m != nil {
+		return m.LastId
+	}
+	return ""
+}
+
+// Ack reports whether the device handled a response.
+type Ack struct {
+	Id      string `protobuf:"bytes,1,opt,name=id" json:"id,omitempty"`
+	Success bool   `protobuf:"varint,2,opt,name=success" json:"success,omitempty"`
+	Error   string `protobuf:"bytes,3,opt,name=error" json:"error,omitempty"`
+}
+
+func (m *Ack) Reset()                    { *m = Ack{} }
+func (m *Ack) String() string            { return proto.CompactTextString(m) }
+func (*Ack) ProtoMessage()               {}
+func (*Ack) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{5} }
+
+func (m *Ack) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *Ack) GetSuccess() bool {
+	if m != nil {
+		return m.Success
+	}
+	return false
+}
+
+func (m *Ack) GetError() string {
+	if m != nil {
+		return m.Error
+	}
+	return ""
+}
 
 type TunnelResponse struct {
 	// Types that are valid to be assigned to Event:
 	//	*TunnelResponse_Response
 	Event isTunnelResponse_Event `protobuf_oneof:"event"`
+	// id is acked by the device once it has handled the response.
+	Id string `protobuf:"bytes,2,opt,name=id" json:"id,omitempty"`
+	// trace_context is the W3C trace context of the delivery, eg.
+	// traceparent, for devices to continue the trace.
+	TraceContext map[string]string `protobuf:"bytes,3,rep,name=trace_context,json=traceContext" json:"trace_context,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
 }
 
 func (m *TunnelResponse) Reset()                    { *m = TunnelResponse{} }
 func (m *TunnelResponse) String() string            { return proto.CompactTextString(m) }
 func (*TunnelResponse) ProtoMessage()               {}
-func (*TunnelResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{4} }
+func (*TunnelResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{6} }
 
 type isTunnelResponse_Event interface {
 	isTunnelResponse_Event()
@@ -144,6 +297,20 @@ func (m *TunnelResponse) GetResponse() *NLPResponse {
 	return nil
 }
 
+func (m *TunnelResponse) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *TunnelResponse) GetTraceContext() map[string]string {
+	if m != nil {
+		return m.TraceContext
+	}
+	return nil
+}
+
 // XXX_OneofFuncs is for the internal use of the proto package.
 func (*TunnelResponse) XXX_OneofFuncs() (func(msg proto.Message, b *proto.Buffer) error, func(msg proto.Message, tag, wire int, b *proto.Buffer) (bool, error), func(msg proto.Message) (n int), []interface{}) {
 	return _TunnelResponse_OneofMarshaler, _TunnelResponse_OneofUnmarshaler, _TunnelResponse_OneofSizer, []interface{}{
@@ -199,12 +366,430 @@ func _TunnelResponse_OneofSizer(msg proto.Message) (n int) {
 	return n
 }
 
+type RecognitionConfig struct {
+	Encoding   RecognitionConfig_Encoding `protobuf:"varint,1,opt,name=encoding,enum=pb.RecognitionConfig_Encoding" json:"encoding,omitempty"`
+	SampleRate uint32                     `protobuf:"varint,2,opt,name=sample_rate,json=sampleRate" json:"sample_rate,omitempty"`
+	Target     *Target                    `protobuf:"bytes,3,opt,name=target" json:"target,omitempty"`
+}
+
+func (m *RecognitionConfig) Reset()                    { *m = RecognitionConfig{} }
+func (m *RecognitionConfig) String() string            { return proto.CompactTextString(m) }
+func (*RecognitionConfig) ProtoMessage()               {}
+func (*RecognitionConfig) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{7} }
+
+func (m *RecognitionConfig) GetEncoding() RecognitionConfig_Encoding {
+	if m != nil {
+		return m.Encoding
+	}
+	return RecognitionConfig_LINEAR16
+}
+
+func (m *RecognitionConfig) GetSampleRate() uint32 {
+	if m != nil {
+		return m.SampleRate
+	}
+	return 0
+}
+
+func (m *RecognitionConfig) GetTarget() *Target {
+	if m != nil {
+		return m.Target
+	}
+	return nil
+}
+
+type RecognizeRequest struct {
+	// Types that are valid to be assigned to Request:
+	//	*RecognizeRequest_Config
+	//	*RecognizeRequest_Audio
+	Request isRecognizeRequest_Request `protobuf_oneof:"request"`
+}
+
+func (m *RecognizeRequest) Reset()                    { *m = RecognizeRequest{} }
+func (m *RecognizeRequest) String() string            { return proto.CompactTextString(m) }
+func (*RecognizeRequest) ProtoMessage()               {}
+func (*RecognizeRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{8} }
+
+type isRecognizeRequest_Request interface {
+	isRecognizeRequest_Request()
+}
+
+type RecognizeRequest_Config struct {
+	Config *RecognitionConfig `protobuf:"bytes,1,opt,name=config,oneof"`
+}
+type RecognizeRequest_Audio struct {
+	Audio []byte `protobuf:"bytes,2,opt,name=audio,oneof"`
+}
+
+func (*RecognizeRequest_Config) isRecognizeRequest_Request() {}
+func (*RecognizeRequest_Audio) isRecognizeRequest_Request()  {}
+
+func (m *RecognizeRequest) GetRequest() isRecognizeRequest_Request {
+	if m != nil {
+		return m.Request
+	}
+	return nil
+}
+
+func (m *RecognizeRequest) GetConfig() *RecognitionConfig {
+	if x, ok := m.GetRequest().(*RecognizeRequest_Config); ok {
+		return x.Config
+	}
+	return nil
+}
+
+func (m *RecognizeRequest) GetAudio() []byte {
+	if x, ok := m.GetRequest().(*RecognizeRequest_Audio); ok {
+		return x.Audio
+	}
+	return nil
+}
+
+// XXX_OneofFuncs is for the internal use of the proto package.
+func (*RecognizeRequest) XXX_OneofFuncs() (func(msg proto.Message, b *proto.Buffer) error, func(msg proto.Message, tag, wire int, b *proto.Buffer) (bool, error), func(msg proto.Message) (n int), []interface{}) {
+	return _RecognizeRequest_OneofMarshaler, _RecognizeRequest_OneofUnmarshaler, _RecognizeRequest_OneofSizer, []interface{}{
+		(*RecognizeRequest_Config)(nil),
+		(*RecognizeRequest_Audio)(nil),
+	}
+}
+
+func _RecognizeRequest_OneofMarshaler(msg proto.Message, b *proto.Buffer) error {
+	m := msg.(*RecognizeRequest)
+	// request
+	switch x := m.Request.(type) {
+	case *RecognizeRequest_Config:
+		b.EncodeVarint(1<<3 | proto.WireBytes)
+		if err := b.EncodeMessage(x.Config); err != nil {
+			return err
+		}
+	case *RecognizeRequest_Audio:
+		b.EncodeVarint(2<<3 | proto.WireBytes)
+		b.EncodeRawBytes(x.Audio)
+	case nil:
+	default:
+		return fmt.Errorf("RecognizeRequest.Request has unexpected type %T", x)
+	}
+	return nil
+}
+
+func _RecognizeRequest_OneofUnmarshaler(msg proto.Message, tag, wire int, b *proto.Buffer) (bool, error) {
+	m := msg.(*RecognizeRequest)
+	switch tag {
+	case 1: // request.config
+		if wire != proto.WireBytes {
+			return true, proto.ErrInternalBadWireType
+		}
+		msg := new(RecognitionConfig)
+		err := b.DecodeMessage(msg)
+		m.Request = &RecognizeRequest_Config{msg}
+		return true, err
+	case 2: // request.audio
+		if wire != proto.WireBytes {
+			return true, proto.ErrInternalBadWireType
+		}
+		x, err := b.DecodeRawBytes(true)
+		m.Request = &RecognizeRequest_Audio{x}
+		return true, err
+	default:
+		return false, nil
+	}
+}
+
+func _RecognizeRequest_OneofSizer(msg proto.Message) (n int) {
+	m := msg.(*RecognizeRequest)
+	// request
+	switch x := m.Request.(type) {
+	case *RecognizeRequest_Config:
+		s := proto.Size(x.Config)
+		n += proto.SizeVarint(1<<3 | proto.WireBytes)
+		n += proto.SizeVarint(uint64(s))
+		n += s
+	case *RecognizeRequest_Audio:
+		n += proto.SizeVarint(2<<3 | proto.WireBytes)
+		n += proto.SizeVarint(uint64(len(x.Audio)))
+		n += len(x.Audio)
+	case nil:
+	default:
+		panic(fmt.Sprintf("proto: unexpected type %T in oneof", x))
+	}
+	return n
+}
+
+type Transcript struct {
+	Text       string  `protobuf:"bytes,1,opt,name=text" json:"text,omitempty"`
+	Confidence float32 `protobuf:"fixed32,2,opt,name=confidence" json:"confidence,omitempty"`
+	Final      bool    `protobuf:"varint,3,opt,name=final" json:"final,omitempty"`
+}
+
+func (m *Transcript) Reset()                    { *m = Transcript{} }
+func (m *Transcript) String() string            { return proto.CompactTextString(m) }
+func (*Transcript) ProtoMessage()               {}
+func (*Transcript) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{9} }
+
+func (m *Transcript) GetText() string {
+	if m != nil {
+		return m.Text
+	}
+	return ""
+}
+
+func (m *Transcript) GetConfidence() float32 {
+	if m != nil {
+		return m.Confidence
+	}
+	return 0
+}
+
+func (m *Transcript) GetFinal() bool {
+	if m != nil {
+		return m.Final
+	}
+	return false
+}
+
+type RecognizeResponse struct {
+	// Types that are valid to be assigned to Event:
+	//	*RecognizeResponse_Transcript
+	//	*RecognizeResponse_Response
+	Event isRecognizeResponse_Event `protobuf_oneof:"event"`
+}
+
+func (m *RecognizeResponse) Reset()                    { *m = RecognizeResponse{} }
+func (m *RecognizeResponse) String() string            { return proto.CompactTextString(m) }
+func (*RecognizeResponse) ProtoMessage()               {}
+func (*RecognizeResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{10} }
+
+type isRecognizeResponse_Event interface {
+	isRecognizeResponse_Event()
+}
+
+type RecognizeResponse_Transcript struct {
+	Transcript *Transcript `protobuf:"bytes,1,opt,name=transcript,oneof"`
+}
+type RecognizeResponse_Response struct {
+	Response *NLPResponse `protobuf:"bytes,2,opt,name=response,oneof"`
+}
+
+func (*RecognizeResponse_Transcript) isRecognizeResponse_Event() {}
+func (*RecognizeResponse_Response) isRecognizeResponse_Event()   {}
+
+func (m *RecognizeResponse) GetEvent() isRecognizeResponse_Event {
+	if m != nil {
+		return m.Event
+	}
+	return nil
+}
+
+func (m *RecognizeResponse) GetTranscript() *Transcript {
+	if x, ok := m.GetEvent().(*RecognizeResponse_Transcript); ok {
+		return x.Transcript
+	}
+	return nil
+}
+
+func (m *RecognizeResponse) GetResponse() *NLPResponse {
+	if x, ok := m.GetEvent().(*RecognizeResponse_Response); ok {
+		return x.Response
+	}
+	return nil
+}
+
+// XXX_OneofFuncs is for the internal use of the proto package.
+func (*RecognizeResponse) XXX_OneofFuncs() (func(msg proto.Message, b *proto.Buffer) error, func(msg proto.Message, tag, wire int, b *proto.Buffer) (bool, error), func(msg proto.Message) (n int), []interface{}) {
+	return _RecognizeResponse_OneofMarshaler, _RecognizeResponse_OneofUnmarshaler, _RecognizeResponse_OneofSizer, []interface{}{
+		(*RecognizeResponse_Transcript)(nil),
+		(*RecognizeResponse_Response)(nil),
+	}
+}
+
+func _RecognizeResponse_OneofMarshaler(msg proto.Message, b *proto.Buffer) error {
+	m := msg.(*RecognizeResponse)
+	// event
+	switch x := m.Event.(type) {
+	case *RecognizeResponse_Transcript:
+		b.EncodeVarint(1<<3 | proto.WireBytes)
+		if err := b.EncodeMessage(x.Transcript); err != nil {
+			return err
+		}
+	case *RecognizeResponse_Response:
+		b.EncodeVarint(2<<3 | proto.WireBytes)
+		if err := b.EncodeMessage(x.Response); err != nil {
+			return err
+		}
+	case nil:
+	default:
+		return fmt.Errorf("RecognizeResponse.Event has unexpected type %T", x)
+	}
+	return nil
+}
+
+func _RecognizeResponse_OneofUnmarshaler(msg proto.Message, tag, wire int, b *proto.Buffer) (bool, error) {
+	m := msg.(*RecognizeResponse)
+	switch tag {
+	case 1: // event.transcript
+		if wire != proto.WireBytes {
+			return true, proto.ErrInternalBadWireType
+		}
+		msg := new(Transcript)
+		err := b.DecodeMessage(msg)
+		m.Event = &RecognizeResponse_Transcript{msg}
+		return true, err
+	case 2: // event.response
+		if wire != proto.WireBytes {
+			return true, proto.ErrInternalBadWireType
+		}
+		msg := new(NLPResponse)
+		err := b.DecodeMessage(msg)
+		m.Event = &RecognizeResponse_Response{msg}
+		return true, err
+	default:
+		return false, nil
+	}
+}
+
+func _RecognizeResponse_OneofSizer(msg proto.Message) (n int) {
+	m := msg.(*RecognizeResponse)
+	// event
+	switch x := m.Event.(type) {
+	case *RecognizeResponse_Transcript:
+		s := proto.Size(x.Transcript)
+		n += proto.SizeVarint(1<<3 | proto.WireBytes)
+		n += proto.SizeVarint(uint64(s))
+		n += s
+	case *RecognizeResponse_Response:
+		s := proto.Size(x.Response)
+		n += proto.SizeVarint(2<<3 | proto.WireBytes)
+		n += proto.SizeVarint(uint64(s))
+		n += s
+	case nil:
+	default:
+		panic(fmt.Sprintf("proto: unexpected type %T in oneof", x))
+	}
+	return n
+}
+
+type TextRequest struct {
+	Text   string  `protobuf:"bytes,1,opt,name=text" json:"text,omitempty"`
+	Target *Target `protobuf:"bytes,2,opt,name=target" json:"target,omitempty"`
+}
+
+func (m *TextRequest) Reset()                    { *m = TextRequest{} }
+func (m *TextRequest) String() string            { return proto.CompactTextString(m) }
+func (*TextRequest) ProtoMessage()               {}
+func (*TextRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{11} }
+
+func (m *TextRequest) GetText() string {
+	if m != nil {
+		return m.Text
+	}
+	return ""
+}
+
+func (m *TextRequest) GetTarget() *Target {
+	if m != nil {
+		return m.Target
+	}
+	return nil
+}
+
+// QueueEnvelope carries a result between vchd processes on the
+// queue. version is always set, and is the first field on the
+// wire, so readers can tell envelopes from older encodings. A
+// reader must reject envelopes with a version it doesn't know.
+type QueueEnvelope struct {
+	Version uint32 `protobuf:"varint,1,opt,name=version" json:"version,omitempty"`
+	Id      string `protobuf:"bytes,2,opt,name=id" json:"id,omitempty"`
+	// sent is when the result was broadcast, in nanoseconds since
+	// the unix epoch.
+	Sent int64 `protobuf:"varint,3,opt,name=sent" json:"sent,omitempty"`
+	// origin is the vchd process that broadcast the result.
+	Origin string `protobuf:"bytes,4,opt,name=origin" json:"origin,omitempty"`
+	// tenant is reserved for the account the result belongs to,
+	// vchd leaves it empty.
+	Tenant   string       `protobuf:"bytes,5,opt,name=tenant" json:"tenant,omitempty"`
+	Target   *Target      `protobuf:"bytes,6,opt,name=target" json:"target,omitempty"`
+	Response *NLPResponse `protobuf:"bytes,7,opt,name=response" json:"response,omitempty"`
+	// trace_context is the W3C trace context of the broadcast, eg.
+	// traceparent.
+	TraceContext map[string]string `protobuf:"bytes,8,rep,name=trace_context,json=traceContext" json:"trace_context,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+}
+
+func (m *QueueEnvelope) Reset()                    { *m = QueueEnvelope{} }
+func (m *QueueEnvelope) String() string            { return proto.CompactTextString(m) }
+func (*QueueEnvelope) ProtoMessage()               {}
+func (*QueueEnvelope) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{12} }
+
+func (m *QueueEnvelope) GetVersion() uint32 {
+	if m != nil {
+		return m.Version
+	}
+	return 0
+}
+
+func (m *QueueEnvelope) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *QueueEnvelope) GetSent() int64 {
+	if m != nil {
+		return m.Sent
+	}
+	return 0
+}
+
+func (m *QueueEnvelope) GetOrigin() string {
+	if m != nil {
+		return m.Origin
+	}
+	return ""
+}
+
+func (m *QueueEnvelope) GetTenant() string {
+	if m != nil {
+		return m.Tenant
+	}
+	return ""
+}
+
+func (m *QueueEnvelope) GetTarget() *Target {
+	if m != nil {
+		return m.Target
+	}
+	return nil
+}
+
+func (m *QueueEnvelope) GetResponse() *NLPResponse {
+	if m != nil {
+		return m.Response
+	}
+	return nil
+}
+
+func (m *QueueEnvelope) GetTraceContext() map[string]string {
+	if m != nil {
+		return m.TraceContext
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*Entity)(nil), "pb.Entity")
 	proto.RegisterType((*Intent)(nil), "pb.Intent")
 	proto.RegisterType((*NLPResponse)(nil), "pb.NLPResponse")
+	proto.RegisterType((*Target)(nil), "pb.Target")
 	proto.RegisterType((*TunnelRequest)(nil), "pb.TunnelRequest")
+	proto.RegisterType((*Ack)(nil), "pb.Ack")
 	proto.RegisterType((*TunnelResponse)(nil), "pb.TunnelResponse")
+	proto.RegisterType((*RecognitionConfig)(nil), "pb.RecognitionConfig")
+	proto.RegisterType((*RecognizeRequest)(nil), "pb.RecognizeRequest")
+	proto.RegisterType((*Transcript)(nil), "pb.Transcript")
+	proto.RegisterType((*RecognizeResponse)(nil), "pb.RecognizeResponse")
+	proto.RegisterType((*TextRequest)(nil), "pb.TextRequest")
+	proto.RegisterType((*QueueEnvelope)(nil), "pb.QueueEnvelope")
+	proto.RegisterEnum("pb.RecognitionConfig_Encoding", RecognitionConfig_Encoding_name, RecognitionConfig_Encoding_value)
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -218,7 +803,17 @@ const _ = grpc.SupportPackageIsVersion4
 // Client API for VCH service
 
 type VCHClient interface {
-	Tunnel(ctx context.Context, in *TunnelRequest, opts ...grpc.CallOption) (VCH_TunnelClient, error)
+	// Tunnel delivers results to a device. The first request
+	// identifies the device, every request after that acks a
+	// response by its id. Unacked responses are sent again.
+	Tunnel(ctx context.Context, opts ...grpc.CallOption) (VCH_TunnelClient, error)
+	// Recognize streams audio to the speech recognizer. The first
+	// request must carry the config, every request after that
+	// carries a chunk of audio.
+	Recognize(ctx context.Context, opts ...grpc.CallOption) (VCH_RecognizeClient, error)
+	// Text runs a typed utterance through the same NLU and broadcast
+	// path as recognized speech.
+	Text(ctx context.Context, in *TextRequest, opts ...grpc.CallOption) (*NLPResponse, error)
 }
 
 type vCHClient struct {
@@ -229,22 +824,17 @@ func NewVCHClient(cc *grpc.ClientConn) VCHClient {
 	return &vCHClient{cc}
 }
 
-func (c *vCHClient) Tunnel(ctx context.Context, in *TunnelRequest, opts ...grpc.CallOption) (VCH_TunnelClient, error) {
+func (c *vCHClient) Tunnel(ctx context.Context, opts ...grpc.CallOption) (VCH_TunnelClient, error) {
 	stream, err := grpc.NewClientStream(ctx, &_VCH_serviceDesc.Streams[0], c.cc, "/pb.VCH/Tunnel", opts...)
 	if err != nil {
 		return nil, err
 	}
 	x := &vCHTunnelClient{stream}
-	if err := x.ClientStream.SendMsg(in); err != nil {
-		return nil, err
-	}
-	if err := x.ClientStream.CloseSend(); err != nil {
-		return nil, err
-	}
 	return x, nil
 }
 
 type VCH_TunnelClient interface {
+	Send(*TunnelRequest) error
 	Recv() (*TunnelResponse, error)
 	grpc.ClientStream
 }
@@ -253,6 +843,10 @@ type vCHTunnelClient struct {
 	grpc.ClientStream
 }
 
+func (x *vCHTunnelClient) Send(m *TunnelRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
 func (x *vCHTunnelClient) Recv() (*TunnelResponse, error) {
 	m := new(TunnelResponse)
 	if err := x.ClientStream.RecvMsg(m); err != nil {
@@ -261,10 +855,60 @@ func (x *vCHTunnelClient) Recv() (*TunnelResponse, error) {
 	return m, nil
 }
 
+func (c *vCHClient) Recognize(ctx context.Context, opts ...grpc.CallOption) (VCH_RecognizeClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_VCH_serviceDesc.Streams[1], c.cc, "/pb.VCH/Recognize", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &vCHRecognizeClient{stream}
+	return x, nil
+}
+
+type VCH_RecognizeClient interface {
+	Send(*RecognizeRequest) error
+	Recv() (*RecognizeResponse, error)
+	grpc.ClientStream
+}
+
+type vCHRecognizeClient struct {
+	grpc.ClientStream
+}
+
+func (x *vCHRecognizeClient) Send(m *RecognizeRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *vCHRecognizeClient) Recv() (*RecognizeResponse, error) {
+	m := new(RecognizeResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *vCHClient) Text(ctx context.Context, in *TextRequest, opts ...grpc.CallOption) (*NLPResponse, error) {
+	out := new(NLPResponse)
+	err := grpc.Invoke(ctx, "/pb.VCH/Text", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // Server API for VCH service
 
 type VCHServer interface {
-	Tunnel(*TunnelRequest, VCH_TunnelServer) error
+	// Tunnel delivers results to a device. The first request
+	// identifies the device, every request after that acks a
+	// response by its id. Unacked responses are sent again.
+	Tunnel(VCH_TunnelServer) error
+	// Recognize streams audio to the speech recognizer. The first
+	// request must carry the config, every request after that
+	// carries a chunk of audio.
+	Recognize(VCH_RecognizeServer) error
+	// Text runs a typed utterance through the same NLU and broadcast
+	// path as recognized speech.
+	Text(context.Context, *TextRequest) (*NLPResponse, error)
 }
 
 func RegisterVCHServer(s *grpc.Server, srv VCHServer) {
@@ -272,15 +916,12 @@ func RegisterVCHServer(s *grpc.Server, srv VCHServer) {
 }
 
 func _VCH_Tunnel_Handler(srv interface{}, stream grpc.ServerStream) error {
-	m := new(TunnelRequest)
-	if err := stream.RecvMsg(m); err != nil {
-		return err
-	}
-	return srv.(VCHServer).Tunnel(m, &vCHTunnelServer{stream})
+	return srv.(VCHServer).Tunnel(&vCHTunnelServer{stream})
 }
 
 type VCH_TunnelServer interface {
 	Send(*TunnelResponse) error
+	Recv() (*TunnelRequest, error)
 	grpc.ServerStream
 }
 
@@ -292,15 +933,79 @@ func (x *vCHTunnelServer) Send(m *TunnelResponse) error {
 	return x.ServerStream.SendMsg(m)
 }
 
+func (x *vCHTunnelServer) Recv() (*TunnelRequest, error) {
+	m := new(TunnelRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _VCH_Recognize_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(VCHServer).Recognize(&vCHRecognizeServer{stream})
+}
+
+type VCH_RecognizeServer interface {
+	Send(*RecognizeResponse) error
+	Recv() (*RecognizeRequest, error)
+	grpc.ServerStream
+}
+
+type vCHRecognizeServer struct {
+	grpc.ServerStream
+}
+
+func (x *vCHRecognizeServer) Send(m *RecognizeResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *vCHRecognizeServer) Recv() (*RecognizeRequest, error) {
+	m := new(RecognizeRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _VCH_Text_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TextRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VCHServer).Text(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.VCH/Text",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VCHServer).Text(ctx, req.(*TextRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _VCH_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "pb.VCH",
 	HandlerType: (*VCHServer)(nil),
-	Methods:     []grpc.MethodDesc{},
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Text",
+			Handler:    _VCH_Text_Handler,
+		},
+	},
 	Streams: []grpc.StreamDesc{
 		{
 			StreamName:    "Tunnel",
 			Handler:       _VCH_Tunnel_Handler,
 			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Recognize",
+			Handler:       _VCH_Recognize_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
 		},
 	},
 	Metadata: "vch.proto",
@@ -309,20 +1014,58 @@ var _VCH_serviceDesc = grpc.ServiceDesc{
 func init() { proto.RegisterFile("vch.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 237 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x6c, 0x90, 0xcf, 0x4b, 0xc3, 0x30,
-	0x14, 0xc7, 0xd7, 0xce, 0x65, 0xdb, 0x2b, 0x3a, 0x7c, 0x78, 0x08, 0x9e, 0x46, 0x10, 0xd9, 0xc5,
-	0x22, 0xe9, 0xcd, 0xa3, 0x3f, 0xa0, 0x82, 0x88, 0x04, 0xf1, 0x6e, 0xe5, 0x81, 0x85, 0x91, 0xc6,
-	0xe5, 0xb5, 0xb0, 0xff, 0x5e, 0x9a, 0x6c, 0xb3, 0xc2, 0x6e, 0x2f, 0xdf, 0x97, 0xef, 0xe7, 0x13,
-	0x02, 0xf3, 0xee, 0xeb, 0x3b, 0x77, 0x9b, 0x86, 0x1b, 0x4c, 0x5d, 0xa5, 0x34, 0x88, 0x27, 0xcb,
-	0x35, 0x6f, 0x11, 0xe1, 0x84, 0xb7, 0x8e, 0x64, 0xb2, 0x4c, 0x56, 0x73, 0x13, 0x66, 0xbc, 0x80,
-	0x49, 0xf7, 0xb9, 0x6e, 0x49, 0xa6, 0x21, 0x8c, 0x07, 0xf5, 0x08, 0xe2, 0xd9, 0x32, 0x59, 0x3e,
-	0xda, 0xb9, 0x86, 0x19, 0xf5, 0xc4, 0x9a, 0xbc, 0x4c, 0x97, 0xe3, 0x55, 0xa6, 0x21, 0x77, 0x55,
-	0x1e, 0x2d, 0xe6, 0xb0, 0x53, 0x05, 0x64, 0xaf, 0x2f, 0x6f, 0x86, 0xbc, 0x6b, 0xac, 0x27, 0xbc,
-	0x82, 0x69, 0x1d, 0xa0, 0x5e, 0x26, 0x7f, 0xad, 0xe8, 0x31, 0xfb, 0x95, 0x5a, 0xc0, 0xe9, 0x7b,
-	0x6b, 0x2d, 0xad, 0x0d, 0xfd, 0xb4, 0xe4, 0x59, 0x95, 0x70, 0xb6, 0x0f, 0x76, 0xa0, 0x1b, 0x98,
-	0x6d, 0x76, 0x73, 0x78, 0x57, 0xa6, 0x17, 0x3d, 0x69, 0xe0, 0x2a, 0x47, 0xe6, 0x70, 0xe5, 0x7e,
-	0x0a, 0x13, 0xea, 0xc8, 0xb2, 0xbe, 0x83, 0xf1, 0xc7, 0x43, 0x89, 0x05, 0x88, 0x08, 0xc4, 0xf3,
-	0xbe, 0xf6, 0xcf, 0x76, 0x89, 0xc3, 0x28, 0x02, 0xd4, 0xe8, 0x36, 0xa9, 0x44, 0xf8, 0xd0, 0xe2,
-	0x37, 0x00, 0x00, 0xff, 0xff, 0x08, 0x07, 0x44, 0xb0, 0x5d, 0x01, 0x00, 0x00,
+	// 839 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0xb4, 0x55, 0x5d, 0x8e, 0xe3, 0x44,
+	0x10, 0x8e, 0xed, 0xc4, 0x71, 0x2a, 0x93, 0x21, 0xd3, 0xda, 0x1d, 0x4c, 0x10, 0xcb, 0xc8, 0xac,
+	0xd0, 0x08, 0xb4, 0x61, 0x09, 0x02, 0xc1, 0x3e, 0x80, 0xb2, 0x21, 0x28, 0x91, 0xc2, 0x0a, 0x5a,
+	0x61, 0x79, 0x1c, 0x39, 0x76, 0x4d, 0x68, 0xc5, 0xb4, 0x8d, 0xdd, 0x89, 0x26, 0x48, 0xdc, 0x81,
+	0x63, 0x70, 0x0f, 0x6e, 0xc0, 0x1b, 0xef, 0x1c, 0x04, 0x75, 0xb7, 0xed, 0x38, 0x3f, 0xab, 0x11,
+	0x42, 0xfb, 0xe6, 0xaa, 0xae, 0xaa, 0xfe, 0xea, 0xeb, 0xaf, 0xca, 0xd0, 0xda, 0x04, 0x3f, 0xf5,
+	0x93, 0x34, 0x16, 0x31, 0x31, 0x93, 0x85, 0x37, 0x00, 0x7b, 0xcc, 0x05, 0x13, 0x5b, 0x42, 0xa0,
+	0x2e, 0xb6, 0x09, 0xba, 0xc6, 0x95, 0x71, 0xdd, 0xa2, 0xea, 0x9b, 0x3c, 0x80, 0xc6, 0xc6, 0x8f,
+	0xd6, 0xe8, 0x9a, 0xca, 0xa9, 0x0d, 0xef, 0x6b, 0xb0, 0xa7, 0x5c, 0x20, 0x17, 0x27, 0x73, 0xde,
+	0x07, 0x07, 0x65, 0x45, 0x86, 0x99, 0x6b, 0x5e, 0x59, 0xd7, 0xed, 0x01, 0xf4, 0x93, 0x45, 0x5f,
+	0xdf, 0x42, 0xcb, 0x33, 0x2f, 0x83, 0xf6, 0x8b, 0xd9, 0x77, 0x14, 0xb3, 0x24, 0xe6, 0x19, 0x92,
+	0xc7, 0xd0, 0x64, 0xaa, 0x68, 0xe6, 0x1a, 0xbb, 0x2c, 0x7d, 0x0f, 0x2d, 0x8e, 0xc8, 0x23, 0x00,
+	0x91, 0xfa, 0x3c, 0x0b, 0x52, 0x96, 0x88, 0x1c, 0x55, 0xc5, 0x23, 0xcf, 0x83, 0x98, 0xdf, 0xb2,
+	0x10, 0x79, 0x80, 0xae, 0x75, 0x65, 0x5c, 0x9b, 0xb4, 0xe2, 0xf1, 0x7e, 0x37, 0xc0, 0x9e, 0xfb,
+	0xe9, 0x12, 0x05, 0x79, 0x1b, 0x5a, 0x21, 0x6e, 0x58, 0x80, 0x37, 0x2c, 0xcc, 0x1b, 0x70, 0xb4,
+	0x63, 0x1a, 0x92, 0x3e, 0xd8, 0x91, 0xbf, 0xc0, 0xa8, 0x68, 0xe1, 0x52, 0x82, 0xd1, 0x89, 0xfd,
+	0x99, 0x3a, 0x18, 0x73, 0x91, 0x6e, 0x69, 0x1e, 0xd5, 0xfb, 0x02, 0xda, 0x15, 0x37, 0xe9, 0x82,
+	0xb5, 0xc2, 0x6d, 0x5e, 0x55, 0x7e, 0x9e, 0x66, 0xf2, 0x99, 0xf9, 0xb9, 0xe1, 0xfd, 0x65, 0x40,
+	0x67, 0xbe, 0xe6, 0x1c, 0x23, 0x8a, 0xbf, 0xac, 0x31, 0xbb, 0x07, 0xd9, 0xa7, 0x07, 0xc8, 0xde,
+	0x51, 0xc8, 0xaa, 0xf9, 0xa7, 0x00, 0x92, 0xb7, 0xc0, 0xf2, 0x83, 0x95, 0x62, 0xa4, 0x3d, 0x68,
+	0xca, 0x9c, 0x61, 0xb0, 0xa2, 0xd2, 0x47, 0xde, 0x84, 0x66, 0xe4, 0x67, 0x42, 0x5e, 0x56, 0x57,
+	0x97, 0xd9, 0xd2, 0x9c, 0x86, 0xff, 0xa7, 0xa9, 0x31, 0x58, 0xc3, 0x60, 0x45, 0xce, 0xc1, 0x2c,
+	0x5b, 0x30, 0x59, 0x48, 0x5c, 0x68, 0x66, 0xeb, 0x20, 0xc0, 0x2c, 0x53, 0x29, 0x0e, 0x2d, 0x4c,
+	0x59, 0x0a, 0xd3, 0x34, 0x4e, 0x15, 0xc2, 0x16, 0xd5, 0x86, 0xf7, 0x8f, 0x01, 0xe7, 0x45, 0x6f,
+	0xb9, 0x4e, 0x9e, 0x80, 0x93, 0xe6, 0xdf, 0xaa, 0x70, 0x7b, 0xf0, 0x86, 0xec, 0xa6, 0x22, 0xa5,
+	0x49, 0x8d, 0x96, 0x21, 0x39, 0x02, 0xb3, 0x44, 0x30, 0x85, 0x8e, 0x48, 0xfd, 0x00, 0x6f, 0x82,
+	0x98, 0x0b, 0xbc, 0x13, 0xae, 0xa5, 0x58, 0x7c, 0x5c, 0x65, 0x51, 0xa7, 0xf6, 0xe7, 0x32, 0x6e,
+	0xa4, 0xc3, 0x34, 0x99, 0x67, 0xa2, 0xe2, 0xea, 0x7d, 0x05, 0x17, 0x47, 0x21, 0xff, 0x85, 0xa4,
+	0xe7, 0x4d, 0x68, 0xe0, 0x06, 0xb9, 0xf0, 0xfe, 0x34, 0xe0, 0x82, 0x62, 0x10, 0x2f, 0x39, 0x13,
+	0x2c, 0xe6, 0x23, 0xa9, 0xd7, 0x25, 0x79, 0x26, 0x07, 0x29, 0x88, 0x43, 0xc6, 0x97, 0xaa, 0xde,
+	0xf9, 0xe0, 0x91, 0x44, 0x79, 0x14, 0xd8, 0x1f, 0xe7, 0x51, 0xb4, 0x8c, 0x27, 0xef, 0x42, 0x3b,
+	0xf3, 0x7f, 0x4e, 0x22, 0xbc, 0x49, 0x7d, 0xa1, 0xaf, 0xee, 0x50, 0xd0, 0x2e, 0xea, 0x0b, 0x24,
+	0x1e, 0xd8, 0x42, 0xc9, 0x39, 0x97, 0x04, 0xec, 0x04, 0x4e, 0xf3, 0x13, 0xef, 0x09, 0x38, 0x45,
+	0x69, 0x72, 0x06, 0xce, 0x6c, 0xfa, 0x62, 0x3c, 0xa4, 0x1f, 0x7f, 0xd6, 0xad, 0x11, 0x07, 0xea,
+	0xdf, 0xcc, 0x86, 0xa3, 0xae, 0x41, 0x5a, 0xd0, 0xf8, 0xf6, 0x87, 0xd9, 0xf0, 0xc7, 0xae, 0xe9,
+	0xdd, 0x42, 0x37, 0xc7, 0xf6, 0x2b, 0x16, 0x52, 0xfe, 0x08, 0x6c, 0x35, 0x7d, 0xcb, 0xfc, 0xad,
+	0x1e, 0x9e, 0xec, 0x60, 0x52, 0xa3, 0x79, 0x18, 0xb9, 0x84, 0x86, 0xbf, 0x0e, 0x59, 0xac, 0x20,
+	0x9f, 0x4d, 0x6a, 0x54, 0x9b, 0xcf, 0x5b, 0xd0, 0x4c, 0x75, 0x4d, 0xef, 0x25, 0xc0, 0x7c, 0x37,
+	0xf1, 0x72, 0x05, 0xc9, 0x77, 0x2c, 0x56, 0x10, 0xde, 0x1d, 0x6e, 0x01, 0xf3, 0x70, 0x0b, 0xc8,
+	0x27, 0xb9, 0x65, 0xdc, 0x8f, 0x54, 0xef, 0x0e, 0xd5, 0x86, 0xf7, 0x1b, 0x5c, 0x54, 0xf0, 0xe7,
+	0xfa, 0x79, 0xba, 0xb7, 0x70, 0x74, 0x13, 0xe7, 0x8a, 0xab, 0xd2, 0x3b, 0xa9, 0xed, 0xad, 0xa0,
+	0xaa, 0x40, 0xcd, 0x7b, 0x05, 0xba, 0x13, 0xc1, 0x18, 0xda, 0x73, 0xbc, 0x13, 0x05, 0x73, 0xa7,
+	0xfa, 0xda, 0x3d, 0x9a, 0xf9, 0xca, 0x47, 0xfb, 0xdb, 0x84, 0xce, 0xf7, 0x6b, 0x5c, 0xe3, 0x98,
+	0x6f, 0x30, 0x8a, 0x13, 0x94, 0x43, 0xb7, 0xc1, 0x34, 0x63, 0x31, 0x57, 0xc5, 0x3a, 0xb4, 0x30,
+	0x8f, 0x86, 0x83, 0x40, 0x3d, 0x43, 0xae, 0x25, 0x61, 0x51, 0xf5, 0x4d, 0x2e, 0xc1, 0x8e, 0x53,
+	0xb6, 0x64, 0xbc, 0x58, 0x0e, 0xda, 0x92, 0x7e, 0x81, 0xdc, 0xe7, 0xc2, 0x6d, 0x68, 0xbf, 0xb6,
+	0x2a, 0x18, 0xed, 0x57, 0x61, 0x24, 0x1f, 0x56, 0x28, 0x6a, 0x9e, 0xa4, 0xa8, 0x32, 0xc1, 0x93,
+	0xc3, 0x89, 0x75, 0xd4, 0xc4, 0xbe, 0x27, 0x33, 0xf6, 0x1a, 0x7d, 0xed, 0x03, 0x3b, 0xf8, 0xc3,
+	0x00, 0xeb, 0xe5, 0x68, 0x22, 0x77, 0xb0, 0xde, 0x15, 0xe4, 0xe2, 0x68, 0xfb, 0xf6, 0xc8, 0xf1,
+	0x2a, 0xf1, 0x6a, 0xd7, 0xc6, 0x53, 0x83, 0x7c, 0x09, 0xad, 0x52, 0x60, 0xe4, 0x41, 0x65, 0x12,
+	0xca, 0x79, 0xe9, 0x3d, 0x3c, 0xf0, 0xee, 0xe5, 0x7f, 0x00, 0x75, 0xa9, 0x10, 0xa2, 0xc8, 0xaa,
+	0x68, 0xa5, 0x77, 0xc8, 0x9e, 0x57, 0x5b, 0xd8, 0xea, 0x17, 0xff, 0xc9, 0xbf, 0x03, 0x00, 0x0e,
+	0x8a, 0x4e, 0x26, 0xef, 0x07, 0x00, 0x00,
 }
@@ -0,0 +1,123 @@
+package redis
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/begizi/vch-server/voice"
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	JobKeyPrefix      = "JOB:"
+	UnfinishedJobsKey = JobKeyPrefix + "UNFINISHED"
+
+	// finished jobs are forgotten after a day
+	jobTTL = 24 * time.Hour
+)
+
+// RedisJobStore impliments voice.JobStore by keeping every job as JSON
+// under its own key, so all vchd processes see the same jobs. The IDs
+// of the jobs that haven't finished are kept in a set.
+type RedisJobStore struct {
+	pool *redis.Pool
+}
+
+func NewRedisJobStore(address string) (voice.JobStore, error) {
+	s := &RedisJobStore{
+		pool: newPool(address),
+	}
+
+	// ensure redis connection is up
+	if err := pingRedis(s.pool); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *RedisJobStore) Close() error {
+	return s.pool.Close()
+}
+
+// Health reports why redis can't be reached, or nil when it can.
+func (s *RedisJobStore) Health() error {
+	return checkRedis(s.pool)
+}
+
+// storedJob keeps the lease the API doesn't show along with the job.
+type storedJob struct {
+	*voice.Job
+	Lease time.Time `json:"lease"`
+}
+
+func (s *RedisJobStore) Save(job *voice.Job) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	data, err := json.Marshal(storedJob{job, job.Lease})
+	if err != nil {
+		return err
+	}
+
+	conn.Send("MULTI")
+	conn.Send("SET", JobKeyPrefix+job.ID, data, "EX", int(jobTTL.Seconds()))
+	if job.Finished() {
+		conn.Send("SREM", UnfinishedJobsKey, job.ID)
+	} else {
+		conn.Send("SADD", UnfinishedJobsKey, job.ID)
+	}
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func (s *RedisJobStore) Get(id string) (*voice.Job, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	return getJob(conn, id)
+}
+
+func getJob(conn redis.Conn, id string) (*voice.Job, error) {
+	data, err := redis.Bytes(conn.Do("GET", JobKeyPrefix+id))
+	if err == redis.ErrNil {
+		return nil, voice.ErrJobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	job := storedJob{Job: &voice.Job{}}
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, err
+	}
+	job.Job.Lease = job.Lease
+	return job.Job, nil
+}
+
+func (s *RedisJobStore) Unfinished() ([]*voice.Job, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	ids, err := redis.Strings(conn.Do("SMEMBERS", UnfinishedJobsKey))
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := []*voice.Job{}
+	for _, id := range ids {
+		job, err := getJob(conn, id)
+		if err == voice.ErrJobNotFound {
+			// the job expired before it was saved as finished
+			conn.Do("SREM", UnfinishedJobsKey, id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !job.Finished() {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs, nil
+}
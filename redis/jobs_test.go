@@ -0,0 +1,104 @@
+package redis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/begizi/vch-server/voice"
+)
+
+func newTestJobStore(t *testing.T) (*RedisJobStore, *miniredis.Miniredis) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+
+	jobs, err := NewRedisJobStore(s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { jobs.(*RedisJobStore).Close() })
+	return jobs.(*RedisJobStore), s
+}
+
+func unfinishedIDs(t *testing.T, jobs *RedisJobStore) []string {
+	unfinished, err := jobs.Unfinished()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, job := range unfinished {
+		ids = append(ids, job.ID)
+	}
+	return ids
+}
+
+func TestRedisJobStore(t *testing.T) {
+	jobs, s := newTestJobStore(t)
+
+	if _, err := jobs.Get("missing"); err != voice.ErrJobNotFound {
+		t.Errorf("err = %v, want ErrJobNotFound", err)
+	}
+
+	now := time.Now().Truncate(time.Millisecond)
+	job := &voice.Job{ID: "1", Status: voice.JobRunning, Created: now, Updated: now, Lease: now.Add(time.Minute)}
+	if err := jobs.Save(job); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := jobs.Get("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != voice.JobRunning || !got.Lease.Equal(now.Add(time.Minute)) || !got.Created.Equal(now) {
+		t.Errorf("got %+v, want the running job", got)
+	}
+	if ttl := s.TTL(JobKeyPrefix + "1"); ttl != jobTTL {
+		t.Errorf("TTL = %v, want %v", ttl, jobTTL)
+	}
+	if ids := unfinishedIDs(t, jobs); len(ids) != 1 || ids[0] != "1" {
+		t.Errorf("unfinished = %v, want the running job", ids)
+	}
+
+	job.Status = voice.JobDone
+	job.Result = &voice.VoiceResponse{Transcript: "turn on the lights"}
+	if err := jobs.Save(job); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := jobs.Get("1"); got.Result == nil || got.Result.Transcript != "turn on the lights" {
+		t.Errorf("got %+v, want the result", got)
+	}
+	if ids := unfinishedIDs(t, jobs); len(ids) != 0 {
+		t.Errorf("unfinished = %v, want none once done", ids)
+	}
+}
+
+func TestRedisJobStoreExpiredUnfinished(t *testing.T) {
+	jobs, s := newTestJobStore(t)
+
+	if err := jobs.Save(&voice.Job{ID: "1", Status: voice.JobPending}); err != nil {
+		t.Fatal(err)
+	}
+	s.FastForward(jobTTL + time.Second)
+
+	if ids := unfinishedIDs(t, jobs); len(ids) != 0 {
+		t.Errorf("unfinished = %v, want the expired job dropped", ids)
+	}
+	if s.Exists(UnfinishedJobsKey) {
+		t.Error("the expired job is still in the unfinished set")
+	}
+}
+
+func TestRedisJobStoreHealth(t *testing.T) {
+	jobs, s := newTestJobStore(t)
+
+	if err := jobs.Health(); err != nil {
+		t.Fatalf("Health() = %v, want nil", err)
+	}
+	s.Close()
+	if err := jobs.Health(); err == nil {
+		t.Error("Health() = nil with redis down")
+	}
+}
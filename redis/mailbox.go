@@ -0,0 +1,293 @@
+package redis
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/begizi/vch-server/tunnel"
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	MailboxKeyPrefix  = "MAILBOX:"
+	MailboxDevicesKey = MailboxKeyPrefix + "DEVICES"
+)
+
+// RedisMailbox impliments tunnel.Mailbox so a device gets its messages
+// whichever vchd process it reconnects to. Every mailbox is a sorted set
+// of message IDs by the millisecond they were sent, next to a hash
+// holding the messages themselves. Messages sent in the same millisecond
+// are ordered by ID. Acked and failed messages leave a key behind for
+// the TTL, so the deposit of a slower process can't bring them back.
+type RedisMailbox struct {
+	pool *redis.Pool
+	ttl  time.Duration
+}
+
+func NewRedisMailbox(address string, ttl time.Duration) (tunnel.Mailbox, error) {
+	m := &RedisMailbox{
+		pool: newPool(address),
+		ttl:  ttl,
+	}
+
+	// ensure redis connection is up
+	if err := pingRedis(m.pool); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m *RedisMailbox) Close() error {
+	return m.pool.Close()
+}
+
+// Health reports why redis can't be reached, or nil when it can.
+func (m *RedisMailbox) Health() error {
+	return checkRedis(m.pool)
+}
+
+func mailboxKey(deviceID string) string {
+	return MailboxKeyPrefix + deviceID
+}
+
+func messagesKey(deviceID string) string {
+	return MailboxKeyPrefix + deviceID + ":MESSAGES"
+}
+
+func failedKey(deviceID string) string {
+	return MailboxKeyPrefix + deviceID + ":FAILED"
+}
+
+func doneKey(deviceID string, id string) string {
+	return MailboxKeyPrefix + deviceID + ":DONE:" + id
+}
+
+// score is the mailbox score of a message sent at t. Scores are float64,
+// which hold milliseconds exactly but not nanoseconds.
+func score(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// registration is a device as kept in the registry, with when it was
+// last registered.
+type registration struct {
+	tunnel.Device
+	Seen time.Time `json:"seen"`
+}
+
+// depositScript keeps a message for a device unless the device is done
+// with it.
+//
+//	KEYS: mailbox, messages, done
+//	ARGV: sent, message ID, message, TTL in milliseconds
+var depositScript = redis.NewScript(3, `
+if redis.call("EXISTS", KEYS[3]) == 1 then
+	return 0
+end
+redis.call("ZADD", KEYS[1], "NX", ARGV[1], ARGV[2])
+redis.call("HSETNX", KEYS[2], ARGV[2], ARGV[3])
+redis.call("PEXPIRE", KEYS[1], ARGV[4])
+redis.call("PEXPIRE", KEYS[2], ARGV[4])
+return 1
+`)
+
+// failedRecord is a failed message as kept in the device's list of them.
+type failedRecord struct {
+	Message []byte    `json:"message"`
+	Reason  string    `json:"reason"`
+	Failed  time.Time `json:"failed"`
+}
+
+func (m *RedisMailbox) Register(device tunnel.Device) error {
+	conn := m.pool.Get()
+	defer conn.Close()
+
+	data, err := json.Marshal(registration{device, time.Now()})
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("HSET", MailboxDevicesKey, device.ID, data)
+	return err
+}
+
+func (m *RedisMailbox) Deposit(message *tunnel.QueueMessage) error {
+	conn := m.pool.Get()
+	defer conn.Close()
+
+	devices, err := redis.StringMap(conn.Do("HGETALL", MailboxDevicesKey))
+	if err != nil {
+		return err
+	}
+
+	data, err := marshalMessage(message)
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-m.ttl)
+	for id, d := range devices {
+		r := registration{}
+		if err := json.Unmarshal([]byte(d), &r); err != nil {
+			continue
+		}
+
+		// forget the devices that haven't registered within the TTL,
+		// their mailboxes expire on their own
+		if r.Seen.Before(cutoff) {
+			if _, err := conn.Do("HDEL", MailboxDevicesKey, id); err != nil {
+				return err
+			}
+			continue
+		}
+		if !message.Target.MatchesDevice(r.Device) {
+			continue
+		}
+
+		// every process deposits the same message, NX keeps the first
+		_, err := depositScript.Do(conn, mailboxKey(id), messagesKey(id), doneKey(id, message.ID),
+			score(message.Sent), message.ID, data, m.ttl.Milliseconds())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *RedisMailbox) Pending(deviceID string, since string) ([]*tunnel.QueueMessage, error) {
+	conn := m.pool.Get()
+	defer conn.Close()
+
+	// drop the expired messages first
+	cutoff := score(time.Now().Add(-m.ttl))
+	expired, err := redis.Strings(conn.Do("ZRANGEBYSCORE", mailboxKey(deviceID), "-inf", cutoff))
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range expired {
+		if err := m.remove(conn, deviceID, id); err != nil {
+			return nil, err
+		}
+	}
+
+	start := 0
+	if since != "" {
+		rank, err := redis.Int(conn.Do("ZRANK", mailboxKey(deviceID), since))
+		if err != nil && err != redis.ErrNil {
+			return nil, err
+		}
+		if err == nil {
+			start = rank + 1
+		}
+	}
+
+	ids, err := redis.Strings(conn.Do("ZRANGE", mailboxKey(deviceID), start, -1))
+	if err != nil || len(ids) == 0 {
+		return []*tunnel.QueueMessage{}, err
+	}
+
+	args := redis.Args{}.Add(messagesKey(deviceID)).AddFlat(ids)
+	values, err := redis.ByteSlices(conn.Do("HMGET", args...))
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []*tunnel.QueueMessage{}
+	for _, data := range values {
+		if data == nil {
+			continue
+		}
+		message, err := unmarshalMessage(data)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+func (m *RedisMailbox) Remove(deviceID string, id string) error {
+	conn := m.pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("ZREM", mailboxKey(deviceID), id)
+	conn.Send("HDEL", messagesKey(deviceID), id)
+	conn.Send("SET", doneKey(deviceID, id), 1, "PX", m.ttl.Milliseconds())
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+func (m *RedisMailbox) remove(conn redis.Conn, deviceID string, id string) error {
+	conn.Send("ZREM", mailboxKey(deviceID), id)
+	conn.Send("HDEL", messagesKey(deviceID), id)
+	_, err := conn.Do("")
+	return err
+}
+
+func (m *RedisMailbox) Fail(deviceID string, failed *tunnel.FailedMessage) error {
+	conn := m.pool.Get()
+	defer conn.Close()
+
+	message, err := marshalMessage(failed.Message)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(failedRecord{message, failed.Reason, failed.Failed})
+	if err != nil {
+		return err
+	}
+
+	conn.Send("MULTI")
+	conn.Send("ZREM", mailboxKey(deviceID), failed.Message.ID)
+	conn.Send("HDEL", messagesKey(deviceID), failed.Message.ID)
+	conn.Send("SET", doneKey(deviceID, failed.Message.ID), 1, "PX", m.ttl.Milliseconds())
+	conn.Send("RPUSH", failedKey(deviceID), data)
+	conn.Send("PEXPIRE", failedKey(deviceID), m.ttl.Milliseconds())
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func (m *RedisMailbox) Failed(deviceID string) ([]*tunnel.FailedMessage, error) {
+	conn := m.pool.Get()
+	defer conn.Close()
+
+	values, err := redis.ByteSlices(conn.Do("LRANGE", failedKey(deviceID), 0, -1))
+	if err != nil {
+		return nil, err
+	}
+
+	// the list is in the order the messages failed, drop the expired
+	// ones from its head
+	cutoff := time.Now().Add(-m.ttl)
+	expired := 0
+	failed := []*tunnel.FailedMessage{}
+	for _, data := range values {
+		record := failedRecord{}
+		if err := json.Unmarshal(data, &record); err != nil {
+			return nil, err
+		}
+		if record.Failed.Before(cutoff) {
+			expired++
+			continue
+		}
+
+		message, err := unmarshalMessage(record.Message)
+		if err != nil {
+			return nil, err
+		}
+		failed = append(failed, &tunnel.FailedMessage{
+			Message: message,
+			Reason:  record.Reason,
+			Failed:  record.Failed,
+		})
+	}
+
+	if expired > 0 {
+		if _, err := conn.Do("LTRIM", failedKey(deviceID), expired, -1); err != nil {
+			return nil, err
+		}
+	}
+	return failed, nil
+}
@@ -0,0 +1,152 @@
+package redis
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/begizi/vch-server/tunnel"
+	"github.com/begizi/vch-server/tunnel/mailboxtest"
+)
+
+func newTestMailbox(t *testing.T, ttl time.Duration) (*RedisMailbox, *miniredis.Miniredis) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+
+	m, err := NewRedisMailbox(s.Addr(), ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.(*RedisMailbox).Close() })
+	return m.(*RedisMailbox), s
+}
+
+func TestRedisMailboxConformance(t *testing.T) {
+	mailboxtest.TestMailbox(t, func(t *testing.T, ttl time.Duration) tunnel.Mailbox {
+		m, _ := newTestMailbox(t, ttl)
+		return m
+	})
+}
+
+func TestRedisMailboxProcesses(t *testing.T) {
+	// two processes sharing the one redis
+	m1, s := newTestMailbox(t, time.Hour)
+	other, err := NewRedisMailbox(s.Addr(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.(*RedisMailbox).Close()
+
+	m1.Register(tunnel.Device{ID: "lamp-1"})
+	message := tunnel.NewQueueMessage(tunnel.NLPResponse{}, tunnel.Target{DeviceID: "lamp-1"})
+	if err := m1.Deposit(message); err != nil {
+		t.Fatal(err)
+	}
+	if err := m1.Remove("lamp-1", message.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Deposit(message); err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := other.Pending("lamp-1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("pending %d messages, want the acked message kept out", len(pending))
+	}
+	if ttl := s.TTL(doneKey("lamp-1", message.ID)); ttl != time.Hour {
+		t.Errorf("acked message kept out for %v, want an hour", ttl)
+	}
+}
+
+func TestRedisMailboxRegistry(t *testing.T) {
+	ttl := 100 * time.Millisecond
+	m, s := newTestMailbox(t, ttl)
+
+	m.Register(tunnel.Device{ID: "lamp-1"})
+	m.Register(tunnel.Device{ID: "lamp-2"})
+	time.Sleep(2 * ttl)
+
+	// lamp-2 is still connected
+	m.Register(tunnel.Device{ID: "lamp-2"})
+	if err := m.Deposit(tunnel.NewQueueMessage(tunnel.NLPResponse{}, tunnel.Target{})); err != nil {
+		t.Fatal(err)
+	}
+
+	devices, err := s.HKeys(MailboxDevicesKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 || devices[0] != "lamp-2" {
+		t.Errorf("registered %v, want only lamp-2", devices)
+	}
+}
+
+func TestRedisMailboxOrder(t *testing.T) {
+	m, s := newTestMailbox(t, time.Hour)
+	m.Register(tunnel.Device{ID: "lamp-1"})
+
+	// nanoseconds apart, which a float64 score can't tell apart this far
+	// from the epoch, and deposited out of order
+	sent := time.Now().Truncate(time.Millisecond)
+	messages := []*tunnel.QueueMessage{}
+	for i, id := range []string{"c", "a", "b"} {
+		message := tunnel.NewQueueMessage(tunnel.NLPResponse{}, tunnel.Target{DeviceID: "lamp-1"})
+		message.ID = id
+		message.Sent = sent.Add(time.Duration(i))
+		messages = append(messages, message)
+	}
+	later := tunnel.NewQueueMessage(tunnel.NLPResponse{}, tunnel.Target{DeviceID: "lamp-1"})
+	later.ID = "0"
+	later.Sent = sent.Add(time.Millisecond)
+
+	for _, message := range append([]*tunnel.QueueMessage{later}, messages...) {
+		if err := m.Deposit(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got, err := s.ZScore(mailboxKey("lamp-1"), "c"); err != nil || got != float64(score(sent)) {
+		t.Errorf("score = %v (%v), want %d", got, err, score(sent))
+	}
+
+	// the same millisecond is ordered by ID
+	pending, err := m.Pending("lamp-1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, message := range pending {
+		ids = append(ids, message.ID)
+	}
+	if strings.Join(ids, ",") != "a,b,c,0" {
+		t.Errorf("pending %v, want a,b,c,0", ids)
+	}
+
+	// and resumes after the last message seen
+	pending, err = m.Pending("lamp-1", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 || pending[0].ID != "c" || pending[1].ID != "0" {
+		t.Errorf("pending %d messages after b, want c and 0", len(pending))
+	}
+}
+
+func TestRedisMailboxHealth(t *testing.T) {
+	m, s := newTestMailbox(t, time.Minute)
+
+	if err := m.Health(); err != nil {
+		t.Fatalf("Health() = %v, want nil", err)
+	}
+	s.Close()
+	if err := m.Health(); err == nil {
+		t.Error("Health() = nil with redis down")
+	}
+}
@@ -4,28 +4,37 @@ import (
 	"bytes"
 	"encoding/gob"
 	"fmt"
+	"sync"
 	"time"
 
+	"github.com/begizi/vch-server/pb"
 	"github.com/begizi/vch-server/tunnel"
 	"github.com/cenkalti/backoff"
 	"github.com/garyburd/redigo/redis"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
 )
 
 const SubscriberRoomName = "VOICE"
 
 type RedisQueue struct {
-	pool     *redis.Pool
-	receivec tunnel.ReceiveC
+	pool      *redis.Pool
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// mtx guards err, the reason the subscription is down
+	mtx sync.Mutex
+	err error
 }
 
 func NewRedisQueue(address string) (tunnel.Queue, error) {
 	q := &RedisQueue{
-		pool:     newPool(address),
-		receivec: make(tunnel.ReceiveC),
+		pool:   newPool(address),
+		closed: make(chan struct{}),
 	}
 
 	// ensure redis connection is up
-	if err := q.pingRedis(); err != nil {
+	if err := pingRedis(q.pool); err != nil {
 		return nil, err
 	}
 
@@ -50,9 +59,20 @@ func newPool(address string) *redis.Pool {
 	}
 }
 
-func (i *RedisQueue) pingRedis() error {
+// checkRedis reports why redis can't be reached, or nil when it answers.
+func checkRedis(pool *redis.Pool) error {
+	conn := pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("PING"); err != nil {
+		return fmt.Errorf("Redis Error: %v", err)
+	}
+	return nil
+}
+
+func pingRedis(pool *redis.Pool) error {
 	return backoff.Retry(func() error {
-		con := i.pool.Get()
+		con := pool.Get()
 		defer con.Close()
 
 		_, err := con.Do("PING")
@@ -66,14 +86,48 @@ func (i *RedisQueue) pingRedis() error {
 	}, backoff.NewExponentialBackOff())
 }
 
+// an envelope always starts with its version field, which tells it apart
+// from the gob encoded messages of older processes
+const envelopeTag = 0x08
+
+// do runs the command on conn, giving up once ctx is done.
+func do(ctx context.Context, conn redis.Conn, cmd string, args ...interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		return redis.DoWithTimeout(conn, time.Until(deadline), cmd, args...)
+	}
+	return conn.Do(cmd, args...)
+}
+
+// stopOnClose returns a context that is also done once closed is closed.
+func stopOnClose(ctx context.Context, closed chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
 func marshalMessage(m *tunnel.QueueMessage) ([]byte, error) {
-	buf := new(bytes.Buffer)
-	enc := gob.NewEncoder(buf)
-	err := enc.Encode(m)
-	return buf.Bytes(), err
+	return proto.Marshal(tunnel.QueueMessageToEnvelope(m))
 }
 
 func unmarshalMessage(b []byte) (*tunnel.QueueMessage, error) {
+	if len(b) > 0 && b[0] == envelopeTag {
+		envelope := &pb.QueueEnvelope{}
+		if err := proto.Unmarshal(b, envelope); err != nil {
+			return nil, err
+		}
+		return tunnel.QueueMessageFromEnvelope(envelope)
+	}
+
+	// read gob while processes from before the envelope are still running
 	m := &tunnel.QueueMessage{}
 	buf := bytes.NewBuffer(b)
 	dec := gob.NewDecoder(buf)
@@ -81,58 +135,148 @@ func unmarshalMessage(b []byte) (*tunnel.QueueMessage, error) {
 	return m, err
 }
 
+// Close stops the listeners of the queue and closes its connections.
 func (i *RedisQueue) Close() error {
+	i.closeOnce.Do(func() {
+		close(i.closed)
+	})
 	return i.pool.Close()
 }
 
-func (i RedisQueue) Broadcast(m *tunnel.QueueMessage) error {
+// Health reports why the queue isn't receiving messages, or nil while it
+// is subscribed. Messages broadcast while the subscription is down are
+// not received, see RedisStreamQueue for a queue that keeps them.
+func (i *RedisQueue) Health() error {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	return i.err
+}
+
+func (i *RedisQueue) setHealth(err error) {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	i.err = err
+}
+
+func (i *RedisQueue) Broadcast(ctx context.Context, m *tunnel.QueueMessage) error {
 	conn := i.pool.Get()
+	defer conn.Close()
+
 	data, err := marshalMessage(m)
 	if err != nil {
 		return err
 	}
 
-	_, err = conn.Do("PUBLISH", SubscriberRoomName, data)
+	_, err = do(ctx, conn, "PUBLISH", SubscriberRoomName, data)
 	return err
 }
 
-func (i RedisQueue) Listen() (tunnel.ReceiveC, error) {
-	// subscribe and send messages
-	c := make(tunnel.ReceiveC)
-
-	conn := i.pool.Get()
+func (i *RedisQueue) subscribe() (*redis.PubSubConn, error) {
+	psc := &redis.PubSubConn{Conn: i.pool.Get()}
+	if err := psc.Subscribe(SubscriberRoomName); err != nil {
+		psc.Close()
+		return nil, err
+	}
+	return psc, nil
+}
 
-	psc := redis.PubSubConn{conn}
+// Listen subscribes to the channel and sends its messages to the returned
+// channel. When the subscription drops it is made again with a backoff,
+// until ctx is done or the queue is closed.
+func (i *RedisQueue) Listen(ctx context.Context) (tunnel.ReceiveC, error) {
+	c := make(tunnel.ReceiveC)
 
-	err := psc.Subscribe(SubscriberRoomName)
+	// the first subscription fails straight away
+	psc, err := i.subscribe()
 	if err != nil {
 		close(c)
 		return c, err
 	}
 
-	go func(c tunnel.ReceiveC) {
-		defer conn.Close()
+	ctx, cancel := stopOnClose(ctx, i.closed)
+
+	go func() {
+		defer cancel()
 		defer close(c)
 
+		b := backoff.NewExponentialBackOff()
+		b.MaxElapsedTime = 0
+
 		for {
-			switch v := psc.Receive().(type) {
-			case redis.Message:
-				msg, err := unmarshalMessage(v.Data)
-				if err != nil {
-					fmt.Printf("[redis] Failed to decode message. %v\n", err)
-					continue
-				}
-				c <- msg
-			case redis.Subscription:
-				fmt.Printf("[redis] Subscribed to channel: %s\n", v.Channel)
-			case error:
-				fmt.Printf("[redis] Error processing messages. Closing channel. %v\n", err)
+			err := i.receive(ctx, c, psc)
+			psc.Close()
+			if err == nil {
 				return
-			default:
-				fmt.Printf("[redis] Received unknown message. Ignored: %#v\n", v)
 			}
+			i.setHealth(fmt.Errorf("Redis Subscription Error: %v", err))
+
+			for {
+				wait := b.NextBackOff()
+				fmt.Printf("[redis] Subscription lost, resubscribing in %v. %v\n", wait, err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(wait):
+				}
+
+				psc, err = i.subscribe()
+				if err == nil {
+					break
+				}
+				i.setHealth(fmt.Errorf("Redis Subscription Error: %v", err))
+			}
+
+			b.Reset()
+			i.setHealth(nil)
 		}
-	}(c)
+	}()
 
 	return c, nil
 }
+
+// receive sends the messages of the subscription to c until it fails, or
+// until ctx is done in which case it unsubscribes and returns nil.
+func (i *RedisQueue) receive(ctx context.Context, c tunnel.ReceiveC, psc *redis.PubSubConn) error {
+	// Receive blocks until the unsubscribe is confirmed
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		select {
+		case <-ctx.Done():
+			psc.Unsubscribe()
+		case <-stop:
+		}
+	}()
+	defer wg.Wait()
+	defer close(stop)
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			msg, err := unmarshalMessage(v.Data)
+			if err != nil {
+				fmt.Printf("[redis] Failed to decode message. %v\n", err)
+				continue
+			}
+			select {
+			case c <- msg:
+			case <-ctx.Done():
+				return nil
+			}
+		case redis.Subscription:
+			if v.Kind == "unsubscribe" && ctx.Err() != nil {
+				return nil
+			}
+			fmt.Printf("[redis] Subscribed to channel: %s\n", v.Channel)
+		case error:
+			if ctx.Err() != nil {
+				return nil
+			}
+			return v
+		default:
+			fmt.Printf("[redis] Received unknown message. Ignored: %#v\n", v)
+		}
+	}
+}
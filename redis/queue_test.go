@@ -0,0 +1,278 @@
+package redis
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/begizi/vch-server/nlu"
+	"github.com/begizi/vch-server/tunnel"
+	"github.com/begizi/vch-server/tunnel/queuetest"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+)
+
+func newTestQueue(t *testing.T) (*RedisQueue, *miniredis.Miniredis) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := NewRedisQueue(s.Addr())
+	if err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+	return q.(*RedisQueue), s
+}
+
+func receive(t *testing.T, c tunnel.ReceiveC) *tunnel.QueueMessage {
+	select {
+	case m, ok := <-c:
+		if !ok {
+			t.Fatal("receive channel closed")
+		}
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a message")
+	}
+	return nil
+}
+
+// waitFor polls cond until it holds or the test times out.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitForSubscriber waits until the queue has subscribed to the channel.
+func waitForSubscriber(t *testing.T, s *miniredis.Miniredis) {
+	waitFor(t, "the subscription", func() bool {
+		return s.PubSubNumSub(SubscriberRoomName)[SubscriberRoomName] > 0
+	})
+}
+
+// newTestBackend runs the conformance suite on an in-process fake redis.
+func newTestBackend(t *testing.T, newQueue func(address string) (tunnel.Queue, error)) *queuetest.Backend {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &queuetest.Backend{
+		NewQueue: func(t *testing.T) tunnel.Queue {
+			q, err := newQueue(s.Addr())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return q
+		},
+		// a new server on the same address, as blocked commands hang
+		// on a restarted one
+		Restart: func(t *testing.T) {
+			address := s.Addr()
+			s.Close()
+			s = miniredis.NewMiniRedis()
+			if err := s.StartAddr(address); err != nil {
+				t.Fatal(err)
+			}
+		},
+		Close: func() {
+			s.Close()
+		},
+	}
+}
+
+func TestRedisQueueConformance(t *testing.T) {
+	queuetest.TestQueue(t, func(t *testing.T) *queuetest.Backend {
+		return newTestBackend(t, NewRedisQueue)
+	})
+}
+
+func TestRedisQueueBroadcast(t *testing.T) {
+	q, s := newTestQueue(t)
+	defer s.Close()
+	defer q.Close()
+
+	c, err := q.Listen(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForSubscriber(t, s)
+
+	sent := tunnel.NewQueueMessage(tunnel.NLPResponse{Transcript: "turn on the lights"}, tunnel.Target{DeviceID: "kitchen"})
+	if err := q.Broadcast(context.Background(), sent); err != nil {
+		t.Fatal(err)
+	}
+
+	got := receive(t, c)
+	if got.ID != sent.ID || got.NLPResponse.Transcript != sent.NLPResponse.Transcript || got.Target.DeviceID != "kitchen" {
+		t.Errorf("received %+v, want %+v", got, sent)
+	}
+}
+
+func TestRedisQueueBroadcastReturnsConnection(t *testing.T) {
+	q, s := newTestQueue(t)
+	defer s.Close()
+	defer q.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := q.Broadcast(context.Background(), tunnel.NewQueueMessage(tunnel.NLPResponse{}, tunnel.Target{})); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if active := q.pool.ActiveCount(); active > 1 {
+		t.Errorf("%d connections active after broadcasting, want at most 1", active)
+	}
+}
+
+func TestRedisQueueResubscribes(t *testing.T) {
+	q, s := newTestQueue(t)
+	defer s.Close()
+	defer q.Close()
+
+	c, err := q.Listen(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForSubscriber(t, s)
+
+	if err := q.Health(); err != nil {
+		t.Fatalf("unhealthy while subscribed: %v", err)
+	}
+
+	s.Close()
+	waitFor(t, "the queue to report the lost subscription", func() bool {
+		return q.Health() != nil
+	})
+
+	if err := s.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the queue to resubscribe", func() bool {
+		return q.Health() == nil
+	})
+	waitForSubscriber(t, s)
+
+	sent := tunnel.NewQueueMessage(tunnel.NLPResponse{Transcript: "still here"}, tunnel.Target{})
+	if err := q.Broadcast(context.Background(), sent); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, c); got.ID != sent.ID {
+		t.Errorf("received message %s, want %s", got.ID, sent.ID)
+	}
+}
+
+func TestRedisQueueCloseStopsListening(t *testing.T) {
+	q, s := newTestQueue(t)
+	defer s.Close()
+
+	c, err := q.Listen(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForSubscriber(t, s)
+
+	// the subscription drops and the queue is closed while it waits to
+	// resubscribe
+	s.Close()
+	waitFor(t, "the queue to report the lost subscription", func() bool {
+		return q.Health() != nil
+	})
+	q.Close()
+
+	select {
+	case _, ok := <-c:
+		if ok {
+			t.Fatal("received a message after closing")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("receive channel not closed")
+	}
+}
+
+func TestRedisQueueListenStopsWithContext(t *testing.T) {
+	q, s := newTestQueue(t)
+	defer s.Close()
+	defer q.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c, err := q.Listen(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForSubscriber(t, s)
+
+	cancel()
+	select {
+	case _, ok := <-c:
+		if ok {
+			t.Fatal("received a message after cancelling")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("receive channel not closed")
+	}
+	waitFor(t, "the queue to unsubscribe", func() bool {
+		return s.PubSubNumSub(SubscriberRoomName)[SubscriberRoomName] == 0
+	})
+}
+
+func TestMessageEncoding(t *testing.T) {
+	sent := tunnel.NewQueueMessage(tunnel.NLPResponse{
+		Intents: []*nlu.CompositeEntity{{
+			Type:     "Lights",
+			Children: []*nlu.Entity{{Type: "state", Value: "on"}},
+		}},
+		Transcript: "turn on the lights",
+		Confidence: 0.9,
+	}, tunnel.Target{Labels: map[string]string{"room": "kitchen"}})
+	sent.Tenant = "ben"
+
+	// gob is what processes from before the envelope broadcast
+	legacy := new(bytes.Buffer)
+	if err := gob.NewEncoder(legacy).Encode(sent); err != nil {
+		t.Fatal(err)
+	}
+	envelope, err := marshalMessage(sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range map[string][]byte{"envelope": envelope, "gob": legacy.Bytes()} {
+		got, err := unmarshalMessage(data)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if got.ID != sent.ID || !got.Sent.Equal(sent.Sent) || got.Origin != sent.Origin || got.Tenant != "ben" {
+			t.Errorf("%s: got %+v, want %+v", name, got, sent)
+		}
+		if got.Target.Labels["room"] != "kitchen" || got.NLPResponse.Transcript != sent.NLPResponse.Transcript {
+			t.Errorf("%s: got %+v, want %+v", name, got, sent)
+		}
+		if len(got.NLPResponse.Intents) != 1 || got.NLPResponse.Intents[0].Children[0].Value != "on" {
+			t.Errorf("%s: got intents %+v", name, got.NLPResponse.Intents)
+		}
+	}
+}
+
+func TestMessageEncodingRejectsNewerVersions(t *testing.T) {
+	envelope := tunnel.QueueMessageToEnvelope(tunnel.NewQueueMessage(tunnel.NLPResponse{}, tunnel.Target{}))
+	envelope.Version = tunnel.EnvelopeVersion + 1
+
+	data, err := proto.Marshal(envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unmarshalMessage(data); err == nil {
+		t.Error("decoded an envelope with an unknown version")
+	}
+}
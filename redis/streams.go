@@ -0,0 +1,560 @@
+package redis
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/begizi/vch-server/tunnel"
+	"github.com/cenkalti/backoff"
+	"github.com/garyburd/redigo/redis"
+	"golang.org/x/net/context"
+)
+
+/*
+RedisStreamQueue
+----------------
+
+RedisStreamQueue impliments the Queue interface on a redis
+stream instead of pub/sub, so messages broadcast while a
+process is restarting or reconnecting are not lost.
+
+Every vchd process has to see every message, so each one
+reads the stream through its own consumer group, with a
+single consumer in it. The group stores how far the process
+has read and the consumer the messages it read but never
+acked, so both must keep their names across restarts for
+the process to pick up where it left off. The ordinal name
+of a StatefulSet pod does. Messages are acked once they
+have been handed to the listeners. Messages left unacked by
+another consumer of the group, eg. one named by an older
+version, are claimed once they have been idle for ClaimIdle.
+
+All the listeners of a process share the one consumer, so
+a single reader reads the stream and hands every message to
+each of them. Separate readers would split the messages
+between them instead. A group lost with a redis that didn't
+persist the stream is created again.
+
+On start a process deletes the consumers of its group that
+have nothing pending, and destroys the groups that have left
+messages unread for longer than GroupIdle, since their
+process is gone, eg. after the StatefulSet was scaled down.
+
+The stream is capped at roughly MaxLen messages, older
+messages are trimmed as new ones are added.
+*/
+
+const StreamName = "VOICE:STREAM"
+
+// the field of a stream entry holding the message
+const streamField = "message"
+
+type StreamConfig struct {
+	// Stream is the key of the stream.
+	Stream string
+
+	// Group is the consumer group of this process. It has to be unique
+	// to the process and stable across restarts, eg. the name of its
+	// StatefulSet pod.
+	Group string
+
+	// Consumer names the process within its group, it has to be stable
+	// across restarts too.
+	Consumer string
+
+	// MaxLen is roughly how many messages the stream retains.
+	MaxLen int
+
+	// Block is how long a read waits for new messages.
+	Block time.Duration
+
+	// ClaimIdle is how long a message can go unacked before it is
+	// claimed from the consumer it was read by.
+	ClaimIdle time.Duration
+
+	// GroupIdle is how long a group can leave a message unread before
+	// it is destroyed as abandoned by its process.
+	GroupIdle time.Duration
+}
+
+var DefaultStreamConfig = StreamConfig{
+	Stream:    StreamName,
+	MaxLen:    10000,
+	Block:     5 * time.Second,
+	ClaimIdle: time.Minute,
+	GroupIdle: 24 * time.Hour,
+}
+
+type RedisStreamQueue struct {
+	pool      *redis.Pool
+	config    StreamConfig
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// mtx guards the listeners the stream is read for, a single reader
+	// is started by the first of them and woken by the others
+	mtx       sync.Mutex
+	listeners map[*streamListener]struct{}
+	reading   bool
+	wake      chan struct{}
+
+	// err is why the stream can't be read, also guarded by mtx
+	err error
+}
+
+// how many messages a listener can fall behind before it holds up the
+// other listeners of the queue
+const listenerBuffer = 64
+
+type streamListener struct {
+	in chan *tunnel.QueueMessage
+
+	// closed once the listener is gone
+	done chan struct{}
+}
+
+func NewRedisStreamQueue(address string, config StreamConfig) (tunnel.Queue, error) {
+	if config.Group == "" || config.Consumer == "" {
+		return nil, fmt.Errorf("Redis Stream Error: a group and consumer name are required")
+	}
+
+	q := &RedisStreamQueue{
+		pool:      newPool(address),
+		config:    config,
+		closed:    make(chan struct{}),
+		listeners: make(map[*streamListener]struct{}),
+		wake:      make(chan struct{}, 1),
+	}
+
+	// ensure redis connection is up
+	if err := pingRedis(q.pool); err != nil {
+		return nil, err
+	}
+
+	if err := q.createGroup(); err != nil {
+		return nil, err
+	}
+
+	if err := q.cleanup(); err != nil {
+		fmt.Printf("[redis] Failed to clean up the stream groups. %v\n", err)
+	}
+
+	return q, nil
+}
+
+// createGroup creates the consumer group of the process unless it already
+// exists. A new group only reads messages added after it was created.
+func (q *RedisStreamQueue) createGroup() error {
+	conn := q.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("XGROUP", "CREATE", q.config.Stream, q.config.Group, "$", "MKSTREAM")
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("Redis Stream Error: %v", err)
+	}
+	return nil
+}
+
+// cleanup deletes the other consumers of the group that have nothing
+// pending, and destroys the other groups that have left a message unread
+// for longer than GroupIdle.
+func (q *RedisStreamQueue) cleanup() error {
+	conn := q.pool.Get()
+	defer conn.Close()
+
+	consumers, err := redis.Values(conn.Do("XINFO", "CONSUMERS", q.config.Stream, q.config.Group))
+	if err != nil {
+		return err
+	}
+	for _, c := range consumers {
+		info, err := xinfo(c)
+		if err != nil {
+			return err
+		}
+		name, _ := redis.String(info["name"], nil)
+		pending, _ := redis.Int64(info["pending"], nil)
+		if name == q.config.Consumer || pending > 0 {
+			continue
+		}
+		if _, err := conn.Do("XGROUP", "DELCONSUMER", q.config.Stream, q.config.Group, name); err != nil {
+			return err
+		}
+	}
+
+	groups, err := redis.Values(conn.Do("XINFO", "GROUPS", q.config.Stream))
+	if err != nil {
+		return err
+	}
+	for _, g := range groups {
+		info, err := xinfo(g)
+		if err != nil {
+			return err
+		}
+		name, _ := redis.String(info["name"], nil)
+		lastID, _ := redis.String(info["last-delivered-id"], nil)
+		if name == q.config.Group {
+			continue
+		}
+
+		abandoned, err := q.abandoned(conn, lastID)
+		if err != nil {
+			return err
+		}
+		if !abandoned {
+			continue
+		}
+		if _, err := conn.Do("XGROUP", "DESTROY", q.config.Stream, name); err != nil {
+			return err
+		}
+		fmt.Printf("[redis] Destroyed abandoned stream group %s.\n", name)
+	}
+	return nil
+}
+
+// parseStreamID splits an entry ID into its time in milliseconds and its
+// sequence number, which may be left out.
+func parseStreamID(id string) (ms uint64, seq uint64, err error) {
+	parts := strings.SplitN(id, "-", 2)
+	ms, err = strconv.ParseUint(parts[0], 10, 64)
+	if err == nil && len(parts) == 2 {
+		seq, err = strconv.ParseUint(parts[1], 10, 64)
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("unexpected stream ID %q", id)
+	}
+	return ms, seq, nil
+}
+
+// xinfo reads the fields of a group or consumer listed by XINFO.
+func xinfo(reply interface{}) (map[string]interface{}, error) {
+	values, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+	info := make(map[string]interface{}, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		key, err := redis.String(values[i], nil)
+		if err != nil {
+			return nil, err
+		}
+		info[key] = values[i+1]
+	}
+	return info, nil
+}
+
+// abandoned reports whether the first entry after the last one delivered
+// to a group was added longer than GroupIdle ago.
+func (q *RedisStreamQueue) abandoned(conn redis.Conn, lastID string) (bool, error) {
+	ms, seq, err := parseStreamID(lastID)
+	if err != nil {
+		return false, err
+	}
+
+	next := fmt.Sprintf("%d-%d", ms, seq+1)
+	entries, err := redis.Values(conn.Do("XRANGE", q.config.Stream, next, "+", "COUNT", 1))
+	if err != nil || len(entries) == 0 {
+		return false, err
+	}
+	entry, err := redis.Values(entries[0], nil)
+	if err != nil || len(entry) == 0 {
+		return false, err
+	}
+	id, err := redis.String(entry[0], nil)
+	if err != nil {
+		return false, err
+	}
+	if ms, _, err = parseStreamID(id); err != nil {
+		return false, err
+	}
+
+	added := time.Unix(0, int64(ms)*int64(time.Millisecond))
+	return time.Since(added) > q.config.GroupIdle, nil
+}
+
+// Close stops the listeners of the queue and closes its connections.
+func (q *RedisStreamQueue) Close() error {
+	q.closeOnce.Do(func() {
+		close(q.closed)
+	})
+	return q.pool.Close()
+}
+
+func (q *RedisStreamQueue) Broadcast(ctx context.Context, m *tunnel.QueueMessage) error {
+	conn := q.pool.Get()
+	defer conn.Close()
+
+	data, err := marshalMessage(m)
+	if err != nil {
+		return err
+	}
+
+	_, err = do(ctx, conn, "XADD", q.config.Stream, "MAXLEN", "~", q.config.MaxLen, "*", streamField, data)
+	return err
+}
+
+// Listen returns a channel of the messages read from the stream, until
+// ctx is done or the queue is closed. Every listener of the queue gets
+// every message. Messages read while nobody listens are dropped.
+func (q *RedisStreamQueue) Listen(ctx context.Context) (tunnel.ReceiveC, error) {
+	c := make(tunnel.ReceiveC)
+	ctx, cancel := stopOnClose(ctx, q.closed)
+
+	l := &streamListener{
+		in:   make(chan *tunnel.QueueMessage, listenerBuffer),
+		done: make(chan struct{}),
+	}
+
+	q.mtx.Lock()
+	q.listeners[l] = struct{}{}
+	if !q.reading {
+		q.reading = true
+		go q.read()
+	}
+	q.mtx.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	go func() {
+		defer cancel()
+		defer close(c)
+		defer func() {
+			q.mtx.Lock()
+			delete(q.listeners, l)
+			q.mtx.Unlock()
+			close(l.done)
+		}()
+
+		for {
+			select {
+			case msg := <-l.in:
+				select {
+				case c <- msg:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return c, nil
+}
+
+func (q *RedisStreamQueue) currentListeners() []*streamListener {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	listeners := make([]*streamListener, 0, len(q.listeners))
+	for l := range q.listeners {
+		listeners = append(listeners, l)
+	}
+	return listeners
+}
+
+// read reads the stream for the listeners until the queue is closed.
+func (q *RedisStreamQueue) read() {
+	ctx, cancel := stopOnClose(context.Background(), q.closed)
+	defer cancel()
+
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = 0
+
+	// messages this consumer read but didn't ack, before a restart or
+	// an error, are sent first
+	pending := true
+	lastClaim := time.Time{}
+
+	for ctx.Err() == nil {
+		if len(q.currentListeners()) == 0 {
+			select {
+			case <-q.wake:
+			case <-ctx.Done():
+			}
+			continue
+		}
+
+		var err error
+		switch {
+		case pending:
+			pending, err = q.readGroup(ctx, "0")
+		case time.Since(lastClaim) >= q.config.ClaimIdle:
+			err = q.claim(ctx)
+			lastClaim = time.Now()
+		default:
+			_, err = q.readGroup(ctx, ">")
+		}
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			// the group is gone when redis restarted without persisting
+			// the stream
+			if strings.HasPrefix(err.Error(), "NOGROUP") {
+				if err := q.createGroup(); err == nil {
+					pending = true
+					continue
+				}
+			}
+
+			pending = true
+			q.setHealth(fmt.Errorf("Redis Stream Error: %v", err))
+			wait := b.NextBackOff()
+			fmt.Printf("[redis] Error reading stream, retrying in %v. %v\n", wait, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+			continue
+		}
+		b.Reset()
+		q.setHealth(nil)
+	}
+}
+
+// Health reports why the stream can't be read, or nil while it can.
+// Messages broadcast in the meantime are read once it is back.
+func (q *RedisStreamQueue) Health() error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return q.err
+}
+
+func (q *RedisStreamQueue) setHealth(err error) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.err = err
+}
+
+// readGroup sends the entries of the group from id on, either ">" for new
+// entries or "0" for the entries pending on this consumer. It reports
+// whether any entries were read.
+func (q *RedisStreamQueue) readGroup(ctx context.Context, id string) (bool, error) {
+	conn := q.pool.Get()
+	defer conn.Close()
+
+	args := redis.Args{"GROUP", q.config.Group, q.config.Consumer, "COUNT", 10}
+	if id == ">" {
+		args = args.Add("BLOCK", int(q.config.Block/time.Millisecond))
+	}
+	args = args.Add("STREAMS", q.config.Stream, id)
+
+	reply, err := conn.Do("XREADGROUP", args...)
+	if err != nil {
+		return false, err
+	}
+	// the read timed out
+	if reply == nil {
+		return false, nil
+	}
+
+	streams, err := redis.Values(reply, nil)
+	if err != nil || len(streams) == 0 {
+		return false, err
+	}
+	stream, err := redis.Values(streams[0], nil)
+	if err != nil || len(stream) != 2 {
+		return false, fmt.Errorf("unexpected XREADGROUP reply %v", reply)
+	}
+	entries, err := redis.Values(stream[1], nil)
+	if err != nil {
+		return false, err
+	}
+
+	return len(entries) > 0, q.send(ctx, conn, entries)
+}
+
+// claim takes over the entries other consumers of the group have left
+// unacked for longer than ClaimIdle. The entries pending on this consumer
+// are read again by readGroup instead.
+func (q *RedisStreamQueue) claim(ctx context.Context) error {
+	conn := q.pool.Get()
+	defer conn.Close()
+
+	pending, err := redis.Values(conn.Do("XPENDING", q.config.Stream, q.config.Group, "-", "+", 100))
+	if err == redis.ErrNil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	idle := int64(q.config.ClaimIdle / time.Millisecond)
+	ids := []interface{}{}
+	for _, p := range pending {
+		// id, consumer, idle time and deliveries
+		var id, consumer string
+		var elapsed int64
+		if _, err := redis.Scan(p.([]interface{}), &id, &consumer, &elapsed); err != nil {
+			return err
+		}
+		if consumer != q.config.Consumer && elapsed >= idle {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	args := redis.Args{q.config.Stream, q.config.Group, q.config.Consumer, idle}.Add(ids...)
+	entries, err := redis.Values(conn.Do("XCLAIM", args...))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("[redis] Claimed %d unacked messages.\n", len(entries))
+	return q.send(ctx, conn, entries)
+}
+
+// send decodes the entries, sends them to every listener and acks them.
+func (q *RedisStreamQueue) send(ctx context.Context, conn redis.Conn, entries []interface{}) error {
+	for _, e := range entries {
+		// entries deleted by trimming are claimed as nil
+		entry, ok := e.([]interface{})
+		if !ok || len(entry) != 2 {
+			continue
+		}
+		id, err := redis.String(entry[0], nil)
+		if err != nil {
+			return err
+		}
+
+		// trimmed entries are read back without fields
+		fields := map[string]string{}
+		if entry[1] != nil {
+			fields, err = redis.StringMap(entry[1], nil)
+			if err != nil {
+				return err
+			}
+		}
+		if data, ok := fields[streamField]; ok {
+			msg, err := unmarshalMessage([]byte(data))
+			if err != nil {
+				fmt.Printf("[redis] Failed to decode message %s. %v\n", id, err)
+			} else {
+				for _, l := range q.currentListeners() {
+					select {
+					case l.in <- msg:
+					case <-l.done:
+					case <-ctx.Done():
+						return nil
+					}
+				}
+			}
+		}
+
+		if _, err := conn.Do("XACK", q.config.Stream, q.config.Group, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package redis
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/begizi/vch-server/nlu"
+	"github.com/begizi/vch-server/tunnel"
+	"github.com/begizi/vch-server/tunnel/queuetest"
+	"github.com/garyburd/redigo/redis"
+	"golang.org/x/net/context"
+)
+
+func testStreamConfig(group string) StreamConfig {
+	config := DefaultStreamConfig
+	config.Group = group
+	config.Consumer = group
+	config.Block = 100 * time.Millisecond
+	return config
+}
+
+func newTestStreamQueue(t *testing.T, s *miniredis.Miniredis, group string) *RedisStreamQueue {
+	q, err := NewRedisStreamQueue(s.Addr(), testStreamConfig(group))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { q.Close() })
+	return q.(*RedisStreamQueue)
+}
+
+// dial connects to redis the way another client would.
+func dial(t *testing.T, s *miniredis.Miniredis) redis.Conn {
+	conn, err := redis.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func listen(t *testing.T, q tunnel.Queue) tunnel.ReceiveC {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	c, err := q.Listen(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func broadcast(t *testing.T, q tunnel.Queue, transcript string) {
+	m := tunnel.NewQueueMessage(tunnel.NLPResponse{Transcript: transcript}, tunnel.Target{})
+	if err := q.Broadcast(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// names lists the names of the groups or consumers listed by XINFO.
+func names(t *testing.T, conn redis.Conn, args ...interface{}) []string {
+	values, err := redis.Values(conn.Do("XINFO", args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, v := range values {
+		info, err := xinfo(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name, _ := redis.String(info["name"], nil)
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestRedisStreamQueueConformance(t *testing.T) {
+	queuetest.TestQueue(t, func(t *testing.T) *queuetest.Backend {
+		// every queue is a separate process with its own group
+		processes := 0
+		return newTestBackend(t, func(address string) (tunnel.Queue, error) {
+			processes++
+			return NewRedisStreamQueue(address, testStreamConfig(fmt.Sprintf("vchd-%d", processes)))
+		})
+	})
+}
+
+func TestRedisStreamQueueListeners(t *testing.T) {
+	s := miniredis.RunT(t)
+	q := newTestStreamQueue(t, s, "vchd-0")
+
+	// the listeners share the process' consumer, and still get every
+	// message
+	listeners := []tunnel.ReceiveC{listen(t, q), listen(t, q)}
+	broadcast(t, q, "turn on the lights")
+	broadcast(t, q, "turn off the lights")
+
+	for i, c := range listeners {
+		for _, want := range []string{"turn on the lights", "turn off the lights"} {
+			if m := receive(t, c); m.NLPResponse.Transcript != want {
+				t.Errorf("listener %d got %q, want %q", i, m.NLPResponse.Transcript, want)
+			}
+		}
+	}
+}
+
+func TestRedisStreamQueuePending(t *testing.T) {
+	s := miniredis.RunT(t)
+	q := newTestStreamQueue(t, s, "vchd-0")
+	broadcast(t, q, "turn on the lights")
+
+	// the process crashes after reading the message, before acking it
+	conn := dial(t, s)
+	if _, err := conn.Do("XREADGROUP", "GROUP", "vchd-0", "vchd-0", "COUNT", 1, "STREAMS", StreamName, ">"); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	// and comes back with the same group and consumer
+	restarted := newTestStreamQueue(t, s, "vchd-0")
+	if m := receive(t, listen(t, restarted)); m.NLPResponse.Transcript != "turn on the lights" {
+		t.Errorf("got %q, want the unacked message", m.NLPResponse.Transcript)
+	}
+
+	waitFor(t, "the message to be acked", func() bool {
+		pending, err := redis.Values(conn.Do("XPENDING", StreamName, "vchd-0"))
+		return err == nil && len(pending) > 0 && pending[0] == int64(0)
+	})
+}
+
+func TestRedisStreamQueueNoGroup(t *testing.T) {
+	s := miniredis.RunT(t)
+	q := newTestStreamQueue(t, s, "vchd-0")
+	c := listen(t, q)
+
+	// redis lost the group, eg. restarting without persistence
+	if _, err := dial(t, s).Do("XGROUP", "DESTROY", StreamName, "vchd-0"); err != nil {
+		t.Fatal(err)
+	}
+
+	// messages broadcast before the group is back are lost
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		broadcast(t, q, "turn on the lights")
+		select {
+		case m := <-c:
+			if m.NLPResponse.Transcript != "turn on the lights" {
+				t.Errorf("got %q, want the message", m.NLPResponse.Transcript)
+			}
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the group was never created again")
+		}
+	}
+}
+
+func TestRedisStreamQueueCleanup(t *testing.T) {
+	s := miniredis.RunT(t)
+	conn := dial(t, s)
+	data, err := marshalMessage(tunnel.NewQueueMessage(tunnel.NLPResponse{Intents: []*nlu.CompositeEntity{}}, tunnel.Target{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range [][]interface{}{
+		// a process that is gone left the first message unread
+		{"XADD", StreamName, "1000-0", streamField, data},
+		{"XGROUP", "CREATE", StreamName, "vchd-2", "0"},
+		// a process that is still up has read every message so far
+		{"XADD", StreamName, "*", streamField, data},
+		{"XGROUP", "CREATE", StreamName, "vchd-1", "$"},
+		// consumers of this process' group named by an older version,
+		// one of which crashed before acking a message
+		{"XGROUP", "CREATE", StreamName, "vchd-0", "$"},
+		{"XGROUP", "CREATECONSUMER", StreamName, "vchd-0", "5a3c0f"},
+		{"XADD", StreamName, "*", streamField, data},
+		{"XREADGROUP", "GROUP", "vchd-0", "9e1b7d", "COUNT", 1, "STREAMS", StreamName, ">"},
+	} {
+		if _, err := conn.Do(cmd[0].(string), cmd[1:]...); err != nil {
+			t.Fatalf("%v: %v", cmd, err)
+		}
+	}
+
+	newTestStreamQueue(t, s, "vchd-0")
+
+	groups := names(t, conn, "GROUPS", StreamName)
+	if fmt.Sprint(groups) != "[vchd-0 vchd-1]" {
+		t.Errorf("groups = %v, want the abandoned group destroyed", groups)
+	}
+	consumers := names(t, conn, "CONSUMERS", StreamName, "vchd-0")
+	if fmt.Sprint(consumers) != "[9e1b7d]" {
+		t.Errorf("consumers = %v, want only the one with a pending message kept", consumers)
+	}
+}
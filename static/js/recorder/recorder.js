@@ -31,6 +31,7 @@
         command: 'record',
         buffer: buffer
       });
+      if (config.onData) config.onData(buffer);
     };
 
     this.configure = function(cfg){
@@ -19,6 +19,8 @@ navigator.getUserMedia = navigator.getUserMedia ||
 
 var recorder;
 var audioContext;
+var socket;
+var pending = [];
 
 function createAudioContext() {
   try {
@@ -34,13 +36,79 @@ function createRecorder() {
     { audio: true },
     function(stream) {
       var input = audioContext.createMediaStreamSource(stream);
-      recorder = new Recorder(input);
+      recorder = new Recorder(input, { onData: streamAudio });
     }, function() {
       alert('This app is unable to work without microphone access.');
     }
   );
 };
 
+function streamURL() {
+  var protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
+  return `${protocol}//${window.location.host}${API_URL}/speech/stream`;
+};
+
+// Converts recorded float samples to 16-bit PCM and sends them to the server.
+function streamAudio(buffer) {
+  if (!socket) return;
+
+  var samples = buffer[0];
+  var pcm = new Int16Array(samples.length);
+  for (var i = 0; i < samples.length; i++) {
+    var s = Math.max(-1, Math.min(1, samples[i]));
+    pcm[i] = s < 0 ? s * 0x8000 : s * 0x7FFF;
+  }
+
+  // Hold on to audio recorded while the socket is still connecting.
+  if (socket.readyState === WebSocket.CONNECTING) {
+    pending.push(pcm.buffer);
+  } else if (socket.readyState === WebSocket.OPEN) {
+    socket.send(pcm.buffer);
+  }
+};
+
+function openStream() {
+  try {
+    socket = new WebSocket(streamURL());
+  } catch (e) {
+    socket = null;
+    return;
+  }
+  socket.binaryType = 'arraybuffer';
+  pending = [];
+
+  socket.onopen = function() {
+    socket.send(JSON.stringify({
+      type: 'config',
+      encoding: 'linear16',
+      sampleRate: audioContext.sampleRate,
+      channels: 1
+    }));
+    pending.forEach(function(pcm) { socket.send(pcm); });
+    pending = [];
+  };
+
+  socket.onmessage = function(e) {
+    var message = JSON.parse(e.data);
+    if (message.type === 'result' || message.type === 'error') {
+      socket.close();
+      doneLoading();
+    }
+  };
+
+  // Don't leave the button spinning if the server goes away mid request.
+  socket.onclose = function() {
+    if (!speak.classList.contains('speak__listen')) doneLoading();
+  };
+};
+
+function doneLoading() {
+  recorder.clear();
+  speak.classList.remove('speak__loading');
+  speak.classList.remove('speak__waiting');
+  speak.removeEventListener('animationend', loadingAnimation, false);
+};
+
 function loadingAnimation() {
   speak.classList.remove('speak__loading')
   speak.classList.add('speak__waiting')
@@ -51,6 +119,7 @@ var Speaking = {
     e.returnValue = false;
 
     speak.classList.add('speak__listen');
+    openStream();
     recorder.record();
   },
   finish: function() {
@@ -58,6 +127,23 @@ var Speaking = {
     speak.classList.add('speak__loading');
 
     recorder.stop();
+
+    // Add animation end transition
+    speak.addEventListener('animationend', loadingAnimation, false);
+
+    // The audio was already streamed, just wait for the result.
+    if (socket && socket.readyState === WebSocket.OPEN) {
+      socket.send(JSON.stringify({ type: 'end' }));
+      return;
+    }
+
+    // Fall back to uploading the whole clip.
+    if (socket) {
+      socket.onclose = null;
+      socket.close();
+      socket = null;
+    }
+
     recorder.exportWAV(function(audio) {
       audio.lastModifiedDate = new Date();
       audio.name = 'file';
@@ -65,9 +151,6 @@ var Speaking = {
       var data = new FormData();
       data.append('file', audio);
 
-      // Add animation end transition
-      speak.addEventListener('animationend', loadingAnimation, false);
-
       $.ajax({
         url: `${API_URL}/speech`,
         data,
@@ -75,18 +158,8 @@ var Speaking = {
         contentType: false,
         processData: false,
         type: 'POST',
-        success: function() {
-          recorder.clear();
-          speak.classList.remove('speak__loading');
-          speak.classList.remove('speak__waiting');
-          speak.removeEventListener('animationend', loadingAnimation, false);
-        },
-        failure: function() {
-          recorder.clear();
-          speak.classList.remove('speak__loading');
-          speak.classList.remove('speak__waiting');
-          speak.removeEventListener('animationend', loadingAnimation, false);
-        }
+        success: doneLoading,
+        failure: doneLoading
       });
     });
   },
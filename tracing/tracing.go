@@ -0,0 +1,91 @@
+package tracing
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/begizi/vch-server/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"golang.org/x/net/context"
+)
+
+/*
+Tracing
+-------
+
+A command is traced from the HTTP or gRPC request through
+decoding, recognition, NLU and the broadcast, then on the
+process holding the device's tunnel through to the ack.
+The W3C trace context crosses the queue inside the
+QueueMessage and is sent to the device with the response.
+
+Traces are exported to an OTLP collector, or printed to
+stdout for local use. With no exporter the trace context is
+still passed along, so traces started by callers continue
+through vchd.
+*/
+
+// Setup installs the global tracer provider and propagator. The returned
+// function flushes the spans not exported yet and stops the exporter.
+func Setup(ctx context.Context, c config.TracingConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch c.Exporter {
+	case "otlp":
+		exporter, err = otlptracegrpc.New(ctx, otlpOptions(c.Endpoint)...)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return func(context.Context) error { return nil }, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Tracing Error: %v", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", c.ServiceName),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("Tracing Error: %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// otlpOptions accepts the collector as host:port or as a URL, where http
+// is sent in plaintext.
+func otlpOptions(endpoint string) []otlptracegrpc.Option {
+	if endpoint == "" {
+		return nil
+	}
+	if !strings.Contains(endpoint, "://") {
+		return []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(endpoint)}
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(endpoint)}
+	}
+	options := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(u.Host)}
+	if u.Scheme == "http" {
+		options = append(options, otlptracegrpc.WithInsecure())
+	}
+	return options
+}
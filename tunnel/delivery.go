@@ -0,0 +1,198 @@
+package tunnel
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/begizi/vch-server/pb"
+	"github.com/cenkalti/backoff"
+	"github.com/satori/go.uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+)
+
+/*
+Delivery
+--------
+
+Every response sent down a tunnel gets an ID that the device
+acks once it has handled the response. Responses that aren't
+acked in time are sent again with an exponential backoff,
+until MaxDeliveryAttempts is reached and the delivery is
+recorded as failed. A device acking with an error fails the
+delivery straight away, as it did receive the response.
+Failed deliveries are counted by their reason and moved to
+the device's failed messages in the mailbox. Deliveries cut
+short by the session closing are counted too, but stay in
+the mailbox to be replayed.
+
+The ID of a response is the ID of its QueueMessage. Devices
+may see a response more than once, eg. when it is replayed
+from their mailbox, and should ignore IDs they have already
+handled.
+
+Each delivery is traced from the first attempt until it is
+acked or fails, and the response carries the trace context
+so devices can continue the trace.
+*/
+
+const MaxDeliveryAttempts = 5
+
+// Reasons a delivery fails
+const (
+	failRejected     = "rejected"
+	failUnacked      = "unacked"
+	failDisconnected = "disconnected"
+)
+
+// delivery is a response waiting to be acked by a session.
+type delivery struct {
+	id       string
+	message  *QueueMessage
+	response *pb.TunnelResponse
+	attempts int
+	backoff  backoff.BackOff
+	timer    *time.Timer
+
+	// span ends once the delivery is acked or failed
+	span trace.Span
+}
+
+func newDelivery(ctx context.Context, message *QueueMessage, ackTimeout time.Duration) *delivery {
+	id := message.ID
+	// messages from before IDs were added
+	if id == "" {
+		id = uuid.NewV4().String()
+	}
+
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = ackTimeout
+	b.MaxInterval = 30 * time.Second
+	b.MaxElapsedTime = 0
+	b.Reset()
+
+	return &delivery{
+		id:      id,
+		message: message,
+		response: &pb.TunnelResponse{
+			Id: id,
+			Event: &pb.TunnelResponse_Response{
+				Response: NLPResponseToTransport(message.NLPResponse),
+			},
+			TraceContext: injectTrace(ctx),
+		},
+		backoff: b,
+		span:    trace.SpanFromContext(ctx),
+	}
+}
+
+// deliver sends the message to the session and keeps resending it
+// until the session acks it. The delivery is traced as part of ctx.
+func (s *VCHTunnelServer) deliver(ctx context.Context, session *Session, message *QueueMessage) {
+	ctx, span := s.tracer.Start(ctx, "tunnel.Deliver", trace.WithAttributes(
+		attribute.String("vch.message_id", message.ID),
+		attribute.String("vch.session_id", string(session.Id)),
+		attribute.String("vch.device_id", session.DeviceId),
+	))
+
+	d := newDelivery(ctx, message, s.config.AckTimeout)
+	if !session.track(d) {
+		span.SetAttributes(attribute.Bool("vch.duplicate", true))
+		span.End()
+		return
+	}
+	s.attempt(session, d)
+}
+
+func (s *VCHTunnelServer) attempt(session *Session, d *delivery) {
+	d.span.AddEvent("attempt", trace.WithAttributes(attribute.Int("vch.attempt", d.attempts+1)))
+	err := session.send(d.response)
+	if err == ErrSlowConsumer {
+		s.logger.Log("msg", "Disconnecting slow session", "sessionId", session.Id, "deviceId", session.DeviceId)
+		session.disconnect()
+		return
+	}
+
+	session.pendingMtx.Lock()
+	defer session.pendingMtx.Unlock()
+
+	// the session may have acked or closed in the meantime
+	if _, ok := session.pending[d.id]; !ok {
+		return
+	}
+	d.attempts++
+	d.timer = time.AfterFunc(d.backoff.NextBackOff(), func() {
+		s.retry(session, d)
+	})
+}
+
+func (s *VCHTunnelServer) retry(session *Session, d *delivery) {
+	session.pendingMtx.Lock()
+	_, ok := session.pending[d.id]
+	exhausted := ok && d.attempts >= MaxDeliveryAttempts
+	if exhausted {
+		delete(session.pending, d.id)
+	}
+	session.pendingMtx.Unlock()
+
+	if !ok {
+		return
+	}
+	if exhausted {
+		s.failed(session, d, failUnacked, fmt.Sprintf("no ack after %d attempts", d.attempts))
+		return
+	}
+	s.attempt(session, d)
+}
+
+func (s *VCHTunnelServer) ack(session *Session, ack *pb.Ack) {
+	// acked either way, the device did get the message
+	if s.mailbox != nil && session.DeviceId != "" {
+		if err := s.mailbox.Remove(session.DeviceId, ack.Id); err != nil {
+			s.logger.Log("msg", "Failed to remove message from mailbox", "messageId", ack.Id, "deviceId", session.DeviceId, "err", err)
+		}
+	}
+
+	d, ok := session.untrack(ack.Id)
+	if !ok {
+		s.logger.Log("msg", "Ack for unknown message", "messageId", ack.Id, "sessionId", session.Id)
+		return
+	}
+
+	if !ack.Success {
+		s.failed(session, d, failRejected, ack.Error)
+		return
+	}
+	s.logger.Log("msg", "Message delivered", "messageId", d.id, "sessionId", session.Id, "attempts", d.attempts)
+	d.span.End()
+}
+
+// failed records a delivery that will not be attempted again.
+func (s *VCHTunnelServer) failed(session *Session, d *delivery, reason string, detail string) {
+	s.logger.Log(
+		"msg", "Message delivery failed",
+		"messageId", d.id,
+		"sessionId", session.Id,
+		"deviceId", session.DeviceId,
+		"attempts", d.attempts,
+		"reason", reason,
+		"err", detail,
+	)
+	s.metrics.FailedDeliveries.With("reason", reason).Add(1)
+
+	if reason != failDisconnected && s.mailbox != nil && session.DeviceId != "" {
+		err := s.mailbox.Fail(session.DeviceId, &FailedMessage{
+			Message: d.message,
+			Reason:  detail,
+			Failed:  time.Now(),
+		})
+		if err != nil {
+			s.logger.Log("msg", "Failed to record failed message", "messageId", d.id, "deviceId", session.DeviceId, "err", err)
+		}
+	}
+
+	d.span.SetStatus(codes.Error, detail)
+	d.span.End()
+}
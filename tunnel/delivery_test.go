@@ -0,0 +1,322 @@
+package tunnel
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/begizi/vch-server/pb"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// fakeStream is the device end of a tunnel.
+type fakeStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	recv chan *pb.TunnelRequest
+	sent chan *pb.TunnelResponse
+}
+
+func (s *fakeStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *fakeStream) Send(response *pb.TunnelResponse) error {
+	s.sent <- response
+	return nil
+}
+
+func (s *fakeStream) Recv() (*pb.TunnelRequest, error) {
+	select {
+	case req := <-s.recv:
+		return req, nil
+	case <-s.ctx.Done():
+		return nil, io.EOF
+	}
+}
+
+func (s *fakeStream) ack(id string, success bool, reason string) {
+	s.recv <- &pb.TunnelRequest{Ack: &pb.Ack{Id: id, Success: success, Error: reason}}
+}
+
+// next waits for the next response sent down the tunnel.
+func (s *fakeStream) next(t *testing.T) *pb.TunnelResponse {
+	t.Helper()
+	select {
+	case response := <-s.sent:
+		return response
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a response")
+		return nil
+	}
+}
+
+// quiet checks that nothing is sent for a while.
+func (s *fakeStream) quiet(t *testing.T) {
+	t.Helper()
+	select {
+	case response := <-s.sent:
+		t.Fatalf("sent %q again", response.Id)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// stubQueue only hands the tunnel server a channel that is never sent on.
+type stubQueue struct{ c ReceiveC }
+
+func (q *stubQueue) Broadcast(context.Context, *QueueMessage) error { return nil }
+func (q *stubQueue) Listen(context.Context) (ReceiveC, error)       { return q.c, nil }
+func (q *stubQueue) Close() error                                   { close(q.c); return nil }
+
+// recordingMailbox records the messages removed from and failed in it.
+type recordingMailbox struct {
+	mtx     sync.Mutex
+	removed []string
+	failed  []*FailedMessage
+}
+
+func (m *recordingMailbox) Register(Device) error                           { return nil }
+func (m *recordingMailbox) Deposit(*QueueMessage) error                     { return nil }
+func (m *recordingMailbox) Pending(string, string) ([]*QueueMessage, error) { return nil, nil }
+
+func (m *recordingMailbox) Remove(deviceID string, id string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.removed = append(m.removed, id)
+	return nil
+}
+
+func (m *recordingMailbox) removedIDs() []string {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return append([]string{}, m.removed...)
+}
+
+func (m *recordingMailbox) Fail(deviceID string, failed *FailedMessage) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.failed = append(m.failed, failed)
+	return nil
+}
+
+func (m *recordingMailbox) Failed(deviceID string) ([]*FailedMessage, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return append([]*FailedMessage{}, m.failed...), nil
+}
+
+// counter tallies a counter by its label values.
+type counter struct {
+	mtx    *sync.Mutex
+	counts map[string]float64
+	labels string
+}
+
+func newCounter() *counter {
+	return &counter{mtx: &sync.Mutex{}, counts: make(map[string]float64)}
+}
+
+func (c *counter) With(labelValues ...string) metrics.Counter {
+	return &counter{c.mtx, c.counts, strings.Join(labelValues, "=")}
+}
+
+func (c *counter) Add(delta float64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.counts[c.labels] += delta
+}
+
+func (c *counter) value(labels string) float64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.counts[labels]
+}
+
+type testTunnel struct {
+	server   *VCHTunnelServer
+	mailbox  *recordingMailbox
+	failures *counter
+	depth    *gauge
+	sessions *gauge
+}
+
+func newTestTunnel(t *testing.T, ackTimeout time.Duration) *testTunnel {
+	tt := &testTunnel{mailbox: &recordingMailbox{}, failures: newCounter(), depth: &gauge{}, sessions: &gauge{}}
+
+	config := DefaultConfig
+	config.AckTimeout = ackTimeout
+	server, err := MakeTunnelServer(&stubQueue{make(ReceiveC)}, tt.mailbox, config, Metrics{
+		QueueDepth:       tt.depth,
+		Dropped:          discard.NewCounter(),
+		Sessions:         tt.sessions,
+		SendErrors:       discard.NewCounter(),
+		FailedDeliveries: tt.failures,
+	}, trace.NewNoopTracerProvider().Tracer(""), log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tt.server = server
+	return tt
+}
+
+// open connects a device and returns its end of the tunnel along with
+// a func that closes it.
+func (tt *testTunnel) open(t *testing.T, deviceID string) (*fakeStream, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := &fakeStream{
+		ctx:  ctx,
+		recv: make(chan *pb.TunnelRequest),
+		sent: make(chan *pb.TunnelResponse, 2*MaxDeliveryAttempts),
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tt.server.Tunnel(stream)
+	}()
+	stream.recv <- &pb.TunnelRequest{DeviceId: deviceID}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if sessions, _ := tt.server.sessions.List(); len(sessions) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the session")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	closed := false
+	disconnect := func() {
+		if !closed {
+			closed = true
+			cancel()
+			<-done
+		}
+	}
+	t.Cleanup(disconnect)
+	return stream, disconnect
+}
+
+func (tt *testTunnel) send(id string) {
+	tt.server.SendToStream(&QueueMessage{
+		ID:          id,
+		Sent:        time.Now(),
+		NLPResponse: NLPResponse{Transcript: "turn on the lights"},
+		Target:      Target{DeviceID: "lamp-1"},
+	})
+}
+
+func (tt *testTunnel) failed() []*FailedMessage {
+	failed, _ := tt.mailbox.Failed("lamp-1")
+	return failed
+}
+
+func TestDeliveryAcked(t *testing.T) {
+	tt := newTestTunnel(t, 5*time.Millisecond)
+	stream, _ := tt.open(t, "lamp-1")
+
+	tt.send("m1")
+	response := stream.next(t)
+	if response.Id != "m1" || response.GetResponse().Transcript != "turn on the lights" {
+		t.Fatalf("sent %v, want m1", response)
+	}
+	stream.ack("m1", true, "")
+
+	stream.quiet(t)
+	if n := tt.failures.value("reason=" + failUnacked); n != 0 {
+		t.Errorf("%v unacked deliveries, want none", n)
+	}
+	if len(tt.failed()) != 0 {
+		t.Errorf("failed %v, want nothing failed", tt.failed())
+	}
+	if removed := tt.mailbox.removedIDs(); len(removed) != 1 || removed[0] != "m1" {
+		t.Errorf("removed %v from the mailbox, want m1", removed)
+	}
+}
+
+func TestDeliveryRejected(t *testing.T) {
+	tt := newTestTunnel(t, 5*time.Millisecond)
+	stream, _ := tt.open(t, "lamp-1")
+
+	tt.send("m1")
+	stream.next(t)
+	stream.ack("m1", false, "no such light")
+
+	stream.quiet(t)
+	if n := tt.failures.value("reason=" + failRejected); n != 1 {
+		t.Errorf("%v rejected deliveries, want 1", n)
+	}
+	failed := tt.failed()
+	if len(failed) != 1 || failed[0].Message.ID != "m1" || failed[0].Reason != "no such light" {
+		t.Errorf("failed %v, want m1 failed with the device's error", failed)
+	}
+}
+
+func TestDeliveryRetried(t *testing.T) {
+	// long enough to ack the second attempt before a third
+	tt := newTestTunnel(t, 50*time.Millisecond)
+	stream, _ := tt.open(t, "lamp-1")
+
+	tt.send("m1")
+	stream.next(t)
+	if response := stream.next(t); response.Id != "m1" {
+		t.Fatalf("sent %q, want m1 again", response.Id)
+	}
+	stream.ack("m1", true, "")
+
+	stream.quiet(t)
+	if len(tt.failed()) != 0 {
+		t.Errorf("failed %v, want nothing failed", tt.failed())
+	}
+}
+
+func TestDeliveryGivenUp(t *testing.T) {
+	tt := newTestTunnel(t, 5*time.Millisecond)
+	stream, _ := tt.open(t, "lamp-1")
+
+	tt.send("m1")
+	for i := 0; i < MaxDeliveryAttempts; i++ {
+		if response := stream.next(t); response.Id != "m1" {
+			t.Fatalf("attempt %d sent %q, want m1", i+1, response.Id)
+		}
+	}
+	stream.quiet(t)
+
+	if n := tt.failures.value("reason=" + failUnacked); n != 1 {
+		t.Errorf("%v unacked deliveries, want 1", n)
+	}
+	failed := tt.failed()
+	if len(failed) != 1 || failed[0].Message.ID != "m1" {
+		t.Errorf("failed %v, want m1 failed", failed)
+	}
+
+	// a late ack is for a message no longer being delivered
+	stream.ack("m1", true, "")
+	stream.quiet(t)
+}
+
+func TestDeliveryDisconnected(t *testing.T) {
+	tt := newTestTunnel(t, 5*time.Millisecond)
+	stream, disconnect := tt.open(t, "lamp-1")
+
+	tt.send("m1")
+	stream.next(t)
+	disconnect()
+
+	if n := tt.failures.value("reason=" + failDisconnected); n != 1 {
+		t.Errorf("%v disconnected deliveries, want 1", n)
+	}
+	// the message stays in the mailbox to be replayed
+	if len(tt.failed()) != 0 {
+		t.Errorf("failed %v, want it kept for the device", tt.failed())
+	}
+}
@@ -0,0 +1,62 @@
+package tunnel
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/begizi/vch-server/pb"
+)
+
+/*
+Queue Envelope
+--------------
+
+Messages cross the queue as a pb.QueueEnvelope so processes
+running different builds, or written in other languages,
+can read them. Envelope changes that older readers would
+misread bump EnvelopeVersion, and readers reject versions
+newer than their own.
+
+Only what a device is sent survives the envelope: intents
+keep their type and the type and value of their entities.
+The trace context travels along so the delivery continues
+the trace of the broadcast. The tenant is reserved, vchd
+leaves it empty and passes it through as it was read.
+*/
+
+const EnvelopeVersion = 1
+
+func QueueMessageToEnvelope(message *QueueMessage) *pb.QueueEnvelope {
+	envelope := &pb.QueueEnvelope{
+		Version:      EnvelopeVersion,
+		Id:           message.ID,
+		Origin:       message.Origin,
+		Tenant:       message.Tenant,
+		Target:       TargetToTransport(message.Target),
+		Response:     NLPResponseToTransport(message.NLPResponse),
+		TraceContext: message.TraceContext,
+	}
+	if !message.Sent.IsZero() {
+		envelope.Sent = message.Sent.UnixNano()
+	}
+	return envelope
+}
+
+func QueueMessageFromEnvelope(envelope *pb.QueueEnvelope) (*QueueMessage, error) {
+	if envelope.Version == 0 || envelope.Version > EnvelopeVersion {
+		return nil, fmt.Errorf("unsupported envelope version %d", envelope.Version)
+	}
+
+	message := &QueueMessage{
+		ID:           envelope.Id,
+		Origin:       envelope.Origin,
+		Tenant:       envelope.Tenant,
+		NLPResponse:  NLPResponseFromTransport(envelope.Response),
+		Target:       TargetFromTransport(envelope.Target),
+		TraceContext: envelope.TraceContext,
+	}
+	if envelope.Sent != 0 {
+		message.Sent = time.Unix(0, envelope.Sent)
+	}
+	return message, nil
+}
@@ -0,0 +1,70 @@
+package tunnel
+
+import (
+	"time"
+)
+
+/*
+Mailbox Interface
+-----------------
+
+The Mailbox interface describes a store and forward system
+for devices that are offline when a message is broadcast.
+Every device that has opened a tunnel is registered, and
+every message is kept in the mailbox of each registered
+device it targets until the device acks it or the message
+expires.
+
+When a device reconnects the tunnel replays its mailbox,
+starting after the last message the device says it acked.
+Every vchd process deposits the messages it receives, so
+deposits must be idempotent on the message ID, and must not
+bring back a message the device has already acked or failed.
+
+A device stays registered for the TTL of the mailbox. Open
+tunnels register their devices again every RegisterInterval
+and when they close, so a device is forgotten once it has
+been gone for longer than the TTL.
+
+A message the device rejects, or never acks however often
+it is sent, is moved out of the mailbox and kept with the
+device's failed messages until it expires.
+*/
+
+// Device is a device that has opened a tunnel.
+type Device struct {
+	ID     string            `json:"id"`
+	Labels map[string]string `json:"labels"`
+}
+
+// FailedMessage is a message that could not be delivered to a device.
+type FailedMessage struct {
+	Message *QueueMessage
+	Reason  string
+	Failed  time.Time
+}
+
+type Mailbox interface {
+	// Register keeps messages for the device until the TTL has passed.
+	Register(device Device) error
+
+	// Deposit keeps the message for every registered device it targets.
+	Deposit(message *QueueMessage) error
+
+	// Pending lists the unexpired messages kept for the device, oldest
+	// first. When since is a kept message only the messages after it
+	// are listed.
+	Pending(deviceID string, since string) ([]*QueueMessage, error)
+
+	// Remove drops a message the device has acked, it is not kept
+	// again when it is deposited by another process.
+	Remove(deviceID string, id string) error
+
+	// Fail moves the message out of the device's mailbox and keeps it
+	// with the device's failed messages.
+	Fail(deviceID string, failed *FailedMessage) error
+
+	// Failed lists the unexpired failed messages of the device, oldest
+	// first.
+	Failed(deviceID string) ([]*FailedMessage, error)
+}
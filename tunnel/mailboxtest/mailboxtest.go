@@ -0,0 +1,219 @@
+package mailboxtest
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/begizi/vch-server/tunnel"
+)
+
+/*
+Mailbox Conformance
+-------------------
+
+Package mailboxtest checks that a tunnel.Mailbox keeps and
+forgets messages the way the tunnel server expects, whatever
+the backend behind it. Every backend runs the suite from its
+own tests:
+
+	func TestMailboxConformance(t *testing.T) {
+		mailboxtest.TestMailbox(t, func(t *testing.T, ttl time.Duration) tunnel.Mailbox {
+			...
+		})
+	}
+*/
+
+// TestMailbox runs the conformance suite, with a new mailbox keeping
+// messages for ttl for each test.
+func TestMailbox(t *testing.T, newMailbox func(t *testing.T, ttl time.Duration) tunnel.Mailbox) {
+	tests := []struct {
+		name string
+		ttl  time.Duration
+		test func(s *suite)
+	}{
+		{"Pending", time.Hour, testPending},
+		{"Idempotent", time.Hour, testIdempotent},
+		{"Removed", time.Hour, testRemoved},
+		{"Failed", time.Hour, testFailed},
+		{"Expired", time.Hour, testExpired},
+		{"Forgotten", forgetTTL, testForgotten},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.test(&suite{T: t, mailbox: newMailbox(t, test.ttl)})
+		})
+	}
+}
+
+// forgetTTL is short enough for a device to be forgotten during a test.
+const forgetTTL = 500 * time.Millisecond
+
+type suite struct {
+	*testing.T
+	mailbox tunnel.Mailbox
+}
+
+func (s *suite) register(id string, labels map[string]string) {
+	s.Helper()
+	if err := s.mailbox.Register(tunnel.Device{ID: id, Labels: labels}); err != nil {
+		s.Fatalf("Register: %v", err)
+	}
+}
+
+func (s *suite) deposit(messages ...*tunnel.QueueMessage) {
+	s.Helper()
+	for _, m := range messages {
+		if err := s.mailbox.Deposit(m); err != nil {
+			s.Fatalf("Deposit: %v", err)
+		}
+	}
+}
+
+// pending checks the IDs of the messages pending for the device.
+func (s *suite) pending(deviceID string, since string, want ...string) {
+	s.Helper()
+	messages, err := s.mailbox.Pending(deviceID, since)
+	if err != nil {
+		s.Fatalf("Pending: %v", err)
+	}
+	got := []string{}
+	for _, m := range messages {
+		got = append(got, m.ID)
+	}
+	if want == nil {
+		want = []string{}
+	}
+	if !reflect.DeepEqual(got, want) {
+		s.Errorf("pending for %s since %q = %v, want %v", deviceID, since, got, want)
+	}
+}
+
+// message is sent ago before now to the target.
+func message(id string, ago time.Duration, target tunnel.Target) *tunnel.QueueMessage {
+	m := tunnel.NewQueueMessage(tunnel.NLPResponse{Transcript: "message " + id}, target)
+	m.ID = id
+	m.Sent = time.Now().Add(-ago)
+	return m
+}
+
+func toDevice(id string) tunnel.Target {
+	return tunnel.Target{DeviceID: id}
+}
+
+func testPending(s *suite) {
+	s.register("lamp-1", map[string]string{"room": "kitchen"})
+	s.register("lamp-2", map[string]string{"room": "hall"})
+
+	// deposited out of the order they were sent in
+	s.deposit(
+		message("m2", 2*time.Second, tunnel.Target{Labels: map[string]string{"room": "kitchen"}}),
+		message("m1", 3*time.Second, toDevice("lamp-1")),
+		message("m3", time.Second, tunnel.Target{Labels: map[string]string{"room": "hall"}}),
+		message("m4", 0, toDevice("lamp-3")),
+	)
+
+	s.pending("lamp-1", "", "m1", "m2")
+	s.pending("lamp-1", "m1", "m2")
+	s.pending("lamp-1", "m2")
+	s.pending("lamp-1", "unknown", "m1", "m2")
+	s.pending("lamp-2", "", "m3")
+	// lamp-3 never registered
+	s.pending("lamp-3", "")
+
+	m, err := s.mailbox.Pending("lamp-1", "m1")
+	if err != nil {
+		s.Fatal(err)
+	}
+	if len(m) != 1 || m[0].NLPResponse.Transcript != "message m2" {
+		s.Errorf("pending %v, want m2 as deposited", m)
+	}
+}
+
+func testIdempotent(s *suite) {
+	s.register("lamp-1", nil)
+
+	// every process deposits the messages it receives
+	m := message("m1", 0, toDevice("lamp-1"))
+	s.deposit(m, m, m)
+	s.pending("lamp-1", "", "m1")
+}
+
+func testRemoved(s *suite) {
+	s.register("lamp-1", nil)
+
+	m1, m2 := message("m1", time.Second, toDevice("lamp-1")), message("m2", 0, toDevice("lamp-1"))
+	s.deposit(m1, m2)
+	if err := s.mailbox.Remove("lamp-1", "m1"); err != nil {
+		s.Fatal(err)
+	}
+	s.pending("lamp-1", "", "m2")
+
+	// a slower process deposits the acked message after the ack
+	s.deposit(m1)
+	s.pending("lamp-1", "", "m2")
+}
+
+func testFailed(s *suite) {
+	s.register("lamp-1", nil)
+
+	m := message("m1", 0, toDevice("lamp-1"))
+	s.deposit(m)
+	err := s.mailbox.Fail("lamp-1", &tunnel.FailedMessage{Message: m, Reason: "no such light", Failed: time.Now()})
+	if err != nil {
+		s.Fatal(err)
+	}
+	s.pending("lamp-1", "")
+
+	s.deposit(m)
+	s.pending("lamp-1", "")
+
+	failed, err := s.mailbox.Failed("lamp-1")
+	if err != nil {
+		s.Fatal(err)
+	}
+	if len(failed) != 1 || failed[0].Message.ID != "m1" || failed[0].Reason != "no such light" {
+		s.Errorf("failed %v, want m1 failed with its reason", failed)
+	}
+}
+
+func testExpired(s *suite) {
+	s.register("lamp-1", nil)
+
+	old, m := message("old", 2*time.Hour, toDevice("lamp-1")), message("m1", 0, toDevice("lamp-1"))
+	s.deposit(old, m)
+	s.pending("lamp-1", "", "m1")
+
+	err := s.mailbox.Fail("lamp-1", &tunnel.FailedMessage{Message: old, Reason: "unacked", Failed: time.Now().Add(-2 * time.Hour)})
+	if err != nil {
+		s.Fatal(err)
+	}
+	failed, err := s.mailbox.Failed("lamp-1")
+	if err != nil {
+		s.Fatal(err)
+	}
+	if len(failed) != 0 {
+		s.Errorf("failed %v, want the expired failure dropped", failed)
+	}
+}
+
+func testForgotten(s *suite) {
+	s.register("lamp-1", nil)
+	s.register("lamp-2", nil)
+	time.Sleep(forgetTTL / 2)
+
+	// lamp-2 is still connected and registers again
+	s.register("lamp-2", nil)
+	time.Sleep(forgetTTL/2 + 100*time.Millisecond)
+
+	s.deposit(message("m1", 0, tunnel.Target{}))
+	s.pending("lamp-1", "")
+	s.pending("lamp-2", "", "m1")
+
+	// until it registers again
+	s.register("lamp-1", nil)
+	s.deposit(message("m2", 0, tunnel.Target{}))
+	s.pending("lamp-1", "", "m2")
+}
@@ -0,0 +1,116 @@
+package tunnel
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/begizi/vch-server/pb"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+)
+
+// gauge is an unlabeled gauge that keeps the last value set.
+type gauge struct {
+	mtx sync.Mutex
+	v   float64
+}
+
+func (g *gauge) With(...string) metrics.Gauge { return g }
+
+func (g *gauge) Set(value float64) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.v = value
+}
+
+func (g *gauge) value() float64 {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	return g.v
+}
+
+// eventually waits for the gauge to read want.
+func (g *gauge) eventually(t *testing.T, name string, want float64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for g.value() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s = %v, want %v", name, g.value(), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSendQueueMetrics(t *testing.T) {
+	for _, policy := range []OverflowPolicy{DropOldest, DropNewest, Disconnect} {
+		t.Run(string(policy), func(t *testing.T) {
+			dropped, depth := newCounter(), &gauge{}
+			m := &queueMetrics{Metrics: Metrics{
+				QueueDepth: depth,
+				Dropped:    dropped,
+				Sessions:   discard.NewGauge(),
+				SendErrors: discard.NewCounter(),
+			}}
+
+			// the depth is of every session's queue together
+			full, err := newSendQueue(Config{QueueSize: 2, Overflow: policy}, m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			other, err := newSendQueue(Config{QueueSize: 2, Overflow: policy}, m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, id := range []string{"m1", "m2", "m3"} {
+				full.push(&pb.TunnelResponse{Id: id})
+			}
+			other.push(&pb.TunnelResponse{Id: "m4"})
+
+			if n := dropped.value("policy=" + string(policy)); n != 1 {
+				t.Errorf("dropped %v, want 1 labeled %s", n, policy)
+			}
+			if depth.value() != 3 {
+				t.Errorf("depth = %v after a drop, want 3", depth.value())
+			}
+
+			other.pop()
+			if depth.value() != 2 {
+				t.Errorf("depth = %v after a send, want 2", depth.value())
+			}
+			// a closed session's responses no longer wait
+			full.close()
+			if depth.value() != 0 {
+				t.Errorf("depth = %v after closing, want 0", depth.value())
+			}
+		})
+	}
+}
+
+func TestTunnelMetrics(t *testing.T) {
+	tt := newTestTunnel(t, 5*time.Millisecond)
+
+	stream, disconnect := tt.open(t, "lamp-1")
+	_, disconnectOther := tt.open(t, "lamp-2")
+	tt.sessions.eventually(t, "sessions", 2)
+
+	tt.send("m1")
+	stream.next(t)
+	tt.depth.eventually(t, "depth", 0)
+	stream.ack("m1", false, "no such light")
+	stream.quiet(t)
+
+	if n := tt.failures.value("reason=" + failRejected); n != 1 {
+		t.Errorf("%v rejected deliveries, want 1", n)
+	}
+	for _, reason := range []string{failUnacked, failDisconnected} {
+		if n := tt.failures.value("reason=" + reason); n != 0 {
+			t.Errorf("%v %s deliveries, want none", n, reason)
+		}
+	}
+
+	disconnect()
+	tt.sessions.eventually(t, "sessions", 1)
+	disconnectOther()
+	tt.sessions.eventually(t, "sessions", 0)
+}
@@ -0,0 +1,144 @@
+package tunnel
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+)
+
+type QueueMiddleware func(Queue) Queue
+
+// QueueMetrics measures the messages going through a queue.
+type QueueMetrics struct {
+	// Published counts broadcasts, labeled by whether they failed.
+	Published metrics.Counter
+
+	// PublishLatency is how long broadcasts take in seconds, labeled by
+	// whether they failed.
+	PublishLatency metrics.Histogram
+
+	// Received counts the messages handed to listeners.
+	Received metrics.Counter
+
+	// Lag is how long received messages took to arrive in seconds,
+	// from when they were sent.
+	Lag metrics.Histogram
+}
+
+// QueueInstrumentingMiddleware measures the messages broadcast and
+// received through the queue.
+func QueueInstrumentingMiddleware(m QueueMetrics) QueueMiddleware {
+	return func(next Queue) Queue {
+		return queueInstrumentingMiddleware{
+			metrics: m,
+			next:    next,
+		}
+	}
+}
+
+type queueInstrumentingMiddleware struct {
+	metrics QueueMetrics
+	next    Queue
+}
+
+func (mw queueInstrumentingMiddleware) Broadcast(ctx context.Context, m *QueueMessage) (err error) {
+	defer func(begin time.Time) {
+		lvs := []string{"error", fmt.Sprint(err != nil)}
+		mw.metrics.Published.With(lvs...).Add(1)
+		mw.metrics.PublishLatency.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+	return mw.next.Broadcast(ctx, m)
+}
+
+func (mw queueInstrumentingMiddleware) Listen(ctx context.Context) (ReceiveC, error) {
+	in, err := mw.next.Listen(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(ReceiveC)
+	go func() {
+		defer close(out)
+		for m := range in {
+			mw.metrics.Received.Add(1)
+			if !m.Sent.IsZero() {
+				mw.metrics.Lag.Observe(time.Since(m.Sent).Seconds())
+			}
+
+			select {
+			case out <- m:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (mw queueInstrumentingMiddleware) Close() error {
+	return mw.next.Close()
+}
+
+// QueueTracingMiddleware traces broadcasts and puts their trace context in
+// the message, for the process delivering it to continue the trace.
+func QueueTracingMiddleware(tracer trace.Tracer) QueueMiddleware {
+	return func(next Queue) Queue {
+		return queueTracingMiddleware{
+			tracer: tracer,
+			next:   next,
+		}
+	}
+}
+
+type queueTracingMiddleware struct {
+	tracer trace.Tracer
+	next   Queue
+}
+
+func (mw queueTracingMiddleware) Broadcast(ctx context.Context, m *QueueMessage) error {
+	ctx, span := mw.tracer.Start(ctx, "queue.Broadcast",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("vch.message_id", m.ID)),
+	)
+	defer span.End()
+
+	traced := *m
+	traced.TraceContext = injectTrace(ctx)
+	err := mw.next.Broadcast(ctx, &traced)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+func (mw queueTracingMiddleware) Listen(ctx context.Context) (ReceiveC, error) {
+	return mw.next.Listen(ctx)
+}
+
+func (mw queueTracingMiddleware) Close() error {
+	return mw.next.Close()
+}
+
+// injectTrace returns the trace context of ctx, or nil when it isn't
+// traced.
+func injectTrace(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// extractTrace returns ctx as part of the trace in carrier.
+func extractTrace(ctx context.Context, carrier map[string]string) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(carrier))
+}
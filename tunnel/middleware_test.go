@@ -0,0 +1,139 @@
+package tunnel_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/begizi/vch-server/inmem"
+	"github.com/begizi/vch-server/pb"
+	"github.com/begizi/vch-server/tunnel"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/golang/protobuf/proto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+)
+
+// useTraceContext propagates W3C trace context for the length of the test,
+// as tracing.Setup does.
+func useTraceContext(t *testing.T) {
+	previous := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTextMapPropagator(previous) })
+}
+
+// ended waits for the span called name to end.
+func ended(t *testing.T, recorder *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, span := range recorder.Ended() {
+			if span.Name() == name {
+				return span
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("span %q never ended", name)
+	return nil
+}
+
+func TestQueueTracing(t *testing.T) {
+	useTraceContext(t)
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+
+	queue := tunnel.QueueTracingMiddleware(tracer)(inmem.NewInMemQueue(inmem.DefaultQueueConfig))
+	defer queue.Close()
+	server, err := tunnel.MakeTunnelServer(queue, nil, tunnel.DefaultConfig, tunnel.Metrics{
+		QueueDepth:       discard.NewGauge(),
+		Dropped:          discard.NewCounter(),
+		Sessions:         discard.NewGauge(),
+		SendErrors:       discard.NewCounter(),
+		FailedDeliveries: discard.NewCounter(),
+	}, tracer, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	ctx, request := tracer.Start(context.Background(), "request")
+	err = queue.Broadcast(ctx, tunnel.NewQueueMessage(tunnel.NLPResponse{Transcript: "turn on the lights"}, tunnel.Target{}))
+	request.End()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broadcast := ended(t, recorder, "queue.Broadcast")
+	delivery := ended(t, recorder, "tunnel.SendToStream")
+
+	// the listener continues the broadcaster's trace
+	traceID := request.SpanContext().TraceID()
+	if broadcast.SpanContext().TraceID() != traceID {
+		t.Errorf("broadcast trace = %v, want the request's %v", broadcast.SpanContext().TraceID(), traceID)
+	}
+	if delivery.SpanContext().TraceID() != traceID {
+		t.Errorf("delivery trace = %v, want the broadcaster's %v", delivery.SpanContext().TraceID(), traceID)
+	}
+	if delivery.Parent().SpanID() != broadcast.SpanContext().SpanID() {
+		t.Errorf("delivery parent = %v, want the broadcast span %v", delivery.Parent().SpanID(), broadcast.SpanContext().SpanID())
+	}
+	if !delivery.Parent().IsRemote() {
+		t.Error("delivery parent isn't remote, the trace didn't cross the queue")
+	}
+	if delivery.SpanKind() != trace.SpanKindConsumer || broadcast.SpanKind() != trace.SpanKindProducer {
+		t.Errorf("kinds = %v and %v, want producer and consumer", broadcast.SpanKind(), delivery.SpanKind())
+	}
+}
+
+func TestEnvelopeTraceContext(t *testing.T) {
+	useTraceContext(t)
+	tracer := sdktrace.NewTracerProvider().Tracer("test")
+
+	ctx, span := tracer.Start(context.Background(), "request")
+	defer span.End()
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+
+	for _, tc := range []struct {
+		name  string
+		trace map[string]string
+	}{
+		{"traced", carrier},
+		{"untraced", nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			message := tunnel.NewQueueMessage(tunnel.NLPResponse{}, tunnel.Target{})
+			message.TraceContext = tc.trace
+
+			data, err := proto.Marshal(tunnel.QueueMessageToEnvelope(message))
+			if err != nil {
+				t.Fatal(err)
+			}
+			envelope := &pb.QueueEnvelope{}
+			if err := proto.Unmarshal(data, envelope); err != nil {
+				t.Fatal(err)
+			}
+			got, err := tunnel.QueueMessageFromEnvelope(envelope)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(got.TraceContext) != len(tc.trace) || (len(tc.trace) > 0 && !reflect.DeepEqual(got.TraceContext, tc.trace)) {
+				t.Fatalf("trace context = %v, want %v", got.TraceContext, tc.trace)
+			}
+			extracted := trace.SpanContextFromContext(otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(got.TraceContext)))
+			if tc.trace != nil && extracted.TraceID() != span.SpanContext().TraceID() {
+				t.Errorf("extracted trace = %v, want %v", extracted.TraceID(), span.SpanContext().TraceID())
+			}
+			if tc.trace == nil && extracted.IsValid() {
+				t.Errorf("extracted trace %v from an untraced message", extracted.TraceID())
+			}
+		})
+	}
+}
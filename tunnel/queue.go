@@ -1,7 +1,12 @@
 package tunnel
 
 import (
-	"github.com/begizi/vch-server/luis"
+	"os"
+	"time"
+
+	"github.com/begizi/vch-server/nlu"
+	"github.com/satori/go.uuid"
+	"golang.org/x/net/context"
 )
 
 /*
@@ -17,16 +22,89 @@ sending the message down to the client.
 */
 
 type NLPResponse struct {
-	Intents []*luis.CompositeEntity `json:"intents"`
+	Intents    []*nlu.CompositeEntity `json:"intents"`
+	Transcript string                 `json:"transcript"`
+	Confidence float32                `json:"confidence"`
 }
 
+// Target picks the tunnel sessions a message is delivered to. The
+// zero Target delivers to every session.
+type Target struct {
+	// DeviceID delivers to the sessions of a single device.
+	DeviceID string `json:"deviceId,omitempty"`
+
+	// Labels delivers to the sessions that have all of these labels,
+	// eg. {"room": "kitchen"}.
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// Matches reports whether the session should receive messages sent to
+// the target.
+func (t Target) Matches(session *Session) bool {
+	return t.MatchesDevice(Device{session.DeviceId, session.Labels})
+}
+
+// MatchesDevice reports whether the device should receive messages sent
+// to the target.
+func (t Target) MatchesDevice(device Device) bool {
+	if t.DeviceID != "" && t.DeviceID != device.ID {
+		return false
+	}
+	for key, value := range t.Labels {
+		if label, ok := device.Labels[key]; !ok || label != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Origin names this process in the messages it broadcasts.
+var Origin, _ = os.Hostname()
+
+// QueueMessage is broadcast to every vchd process, each of which
+// delivers it to its own sessions that match the Target.
 type QueueMessage struct {
+	// ID is shared by every process, devices ack the message with it.
+	ID   string
+	Sent time.Time
+
+	// Origin is the process that broadcast the message.
+	Origin string
+
+	// Tenant is reserved for the account the message belongs to. vchd
+	// has no accounts yet, so it is always empty, but it crosses the
+	// queue for readers that do.
+	Tenant string
+
 	NLPResponse NLPResponse
+	Target      Target
+
+	// TraceContext carries the trace of the broadcast to the process
+	// delivering the message, eg. {"traceparent": "00-..."}.
+	TraceContext map[string]string
+}
+
+func NewQueueMessage(response NLPResponse, target Target) *QueueMessage {
+	return &QueueMessage{
+		ID:          uuid.NewV4().String(),
+		Sent:        time.Now(),
+		Origin:      Origin,
+		NLPResponse: response,
+		Target:      target,
+	}
 }
 
 type ReceiveC chan *QueueMessage
 
 type Queue interface {
-	Broadcast(message *QueueMessage) error
-	Listen() (ReceiveC, error)
+	// Broadcast sends the message to every listening process. It gives
+	// up once ctx is done.
+	Broadcast(ctx context.Context, message *QueueMessage) error
+
+	// Listen returns a channel of the messages broadcast from now on.
+	// The channel is closed once ctx is done or the queue is closed.
+	Listen(ctx context.Context) (ReceiveC, error)
+
+	// Close stops every listener and releases the queue's connections.
+	Close() error
 }
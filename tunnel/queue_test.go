@@ -0,0 +1,35 @@
+package tunnel
+
+import "testing"
+
+func TestTargetMatches(t *testing.T) {
+	kitchenLamp := &Session{DeviceId: "lamp-1", Labels: map[string]string{"room": "kitchen", "kind": "lamp"}}
+	unlabelled := &Session{DeviceId: "lamp-2"}
+
+	for _, tc := range []struct {
+		name    string
+		target  Target
+		session *Session
+		want    bool
+	}{
+		{"empty target", Target{}, kitchenLamp, true},
+		{"empty target without labels", Target{}, unlabelled, true},
+		{"device", Target{DeviceID: "lamp-1"}, kitchenLamp, true},
+		{"other device", Target{DeviceID: "lamp-2"}, kitchenLamp, false},
+		{"label", Target{Labels: map[string]string{"room": "kitchen"}}, kitchenLamp, true},
+		{"all labels", Target{Labels: map[string]string{"room": "kitchen", "kind": "lamp"}}, kitchenLamp, true},
+		{"label with another value", Target{Labels: map[string]string{"room": "hall"}}, kitchenLamp, false},
+		{"one of the labels missing", Target{Labels: map[string]string{"room": "kitchen", "floor": "1"}}, kitchenLamp, false},
+		{"label on an unlabelled session", Target{Labels: map[string]string{"room": "kitchen"}}, unlabelled, false},
+		{"empty label value", Target{Labels: map[string]string{"room": ""}}, unlabelled, false},
+		{"device and labels", Target{DeviceID: "lamp-1", Labels: map[string]string{"room": "kitchen"}}, kitchenLamp, true},
+		{"device and other labels", Target{DeviceID: "lamp-1", Labels: map[string]string{"room": "hall"}}, kitchenLamp, false},
+		{"labels and other device", Target{DeviceID: "lamp-2", Labels: map[string]string{"room": "kitchen"}}, kitchenLamp, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.target.Matches(tc.session); got != tc.want {
+				t.Errorf("Matches = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,446 @@
+package queuetest
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/begizi/vch-server/nlu"
+	"github.com/begizi/vch-server/tunnel"
+	"golang.org/x/net/context"
+)
+
+/*
+Queue Conformance
+-----------------
+
+Package queuetest checks that a tunnel.Queue behaves the way
+the tunnel server expects, whatever the backend behind it.
+Every backend runs the suite from its own tests:
+
+	func TestQueueConformance(t *testing.T) {
+		queuetest.TestQueue(t, func(t *testing.T) *queuetest.Backend {
+			...
+		})
+	}
+
+Queues returned by the same Backend stand in for separate
+vchd processes sharing the backend. Listeners are only
+expected to get the messages broadcast after they are
+subscribed, backends that keep messages for longer pass too.
+*/
+
+// Timeout is how long the suite waits for a message.
+var Timeout = 10 * time.Second
+
+// Backend is a fresh backend for a single test.
+type Backend struct {
+	// NewQueue returns a queue on the backend.
+	NewQueue func(t *testing.T) tunnel.Queue
+
+	// Restart drops every connection to the backend and brings it back
+	// up. The reconnect test is skipped when it is nil.
+	Restart func(t *testing.T)
+
+	// Close stops the backend once the test is done, may be nil.
+	Close func()
+}
+
+// TestQueue runs the conformance suite, with a new backend for each test.
+func TestQueue(t *testing.T, newBackend func(t *testing.T) *Backend) {
+	tests := []struct {
+		name string
+		test func(s *suite)
+	}{
+		{"Ordering", testOrdering},
+		{"FanOut", testFanOut},
+		{"NoListener", testNoListener},
+		{"CancelListener", testCancelListener},
+		{"Close", testClose},
+		{"LargePayload", testLargePayload},
+		{"ConcurrentPublishers", testConcurrentPublishers},
+		{"Reconnect", testReconnect},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			s := &suite{T: t, backend: newBackend(t)}
+			defer s.close()
+			test.test(s)
+		})
+	}
+}
+
+type suite struct {
+	*testing.T
+	backend *Backend
+	queues  []tunnel.Queue
+}
+
+func (s *suite) newQueue() tunnel.Queue {
+	q := s.backend.NewQueue(s.T)
+	s.queues = append(s.queues, q)
+	return q
+}
+
+func (s *suite) close() {
+	for _, q := range s.queues {
+		q.Close()
+	}
+	if s.backend.Close != nil {
+		s.backend.Close()
+	}
+}
+
+func (s *suite) listen(q tunnel.Queue) (tunnel.ReceiveC, context.CancelFunc) {
+	s.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c, err := q.Listen(ctx)
+	if err != nil {
+		cancel()
+		s.Fatalf("Listen: %v", err)
+	}
+	return c, cancel
+}
+
+func (s *suite) broadcast(q tunnel.Queue, m *tunnel.QueueMessage) {
+	s.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+	if err := q.Broadcast(ctx, m); err != nil {
+		s.Fatalf("Broadcast: %v", err)
+	}
+}
+
+// sync messages are broadcast until every listener has one, after which
+// the listeners are known to be subscribed. Receivers skip them.
+const syncPrefix = "sync-"
+
+func (s *suite) sync(q tunnel.Queue, listeners ...tunnel.ReceiveC) {
+	s.Helper()
+
+	synced := make([]bool, len(listeners))
+	deadline := time.Now().Add(Timeout)
+	for remaining := len(listeners); remaining > 0; {
+		if time.Now().After(deadline) {
+			s.Fatalf("%d of %d listeners never subscribed", remaining, len(listeners))
+		}
+
+		m := tunnel.NewQueueMessage(tunnel.NLPResponse{}, tunnel.Target{})
+		m.ID = syncPrefix + m.ID
+		// broadcasts can fail while a backend is coming back up
+		ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+		q.Broadcast(ctx, m)
+		cancel()
+
+		for i, c := range listeners {
+			if synced[i] {
+				continue
+			}
+			select {
+			case m, ok := <-c:
+				if !ok {
+					s.Fatal("listener closed while subscribing")
+				}
+				if strings.HasPrefix(m.ID, syncPrefix) {
+					synced[i] = true
+					remaining--
+				}
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+	}
+}
+
+// next returns the next message that isn't a sync message.
+func (s *suite) next(c tunnel.ReceiveC) *tunnel.QueueMessage {
+	s.Helper()
+
+	timeout := time.After(Timeout)
+	for {
+		select {
+		case m, ok := <-c:
+			if !ok {
+				s.Fatal("listener closed while waiting for a message")
+			}
+			if strings.HasPrefix(m.ID, syncPrefix) {
+				continue
+			}
+			return m
+		case <-timeout:
+			s.Fatal("timed out waiting for a message")
+		}
+	}
+}
+
+// closed waits for the listener to be closed, skipping its messages.
+func (s *suite) closed(c tunnel.ReceiveC) {
+	s.Helper()
+
+	timeout := time.After(Timeout)
+	for {
+		select {
+		case _, ok := <-c:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			s.Fatal("listener not closed")
+		}
+	}
+}
+
+func message(i int) *tunnel.QueueMessage {
+	return tunnel.NewQueueMessage(tunnel.NLPResponse{
+		Transcript: fmt.Sprintf("message %d", i),
+	}, tunnel.Target{})
+}
+
+func testOrdering(s *suite) {
+	q := s.newQueue()
+	c, cancel := s.listen(q)
+	defer cancel()
+	s.sync(q, c)
+
+	sent := []*tunnel.QueueMessage{}
+	for i := 0; i < 100; i++ {
+		m := message(i)
+		sent = append(sent, m)
+		s.broadcast(q, m)
+	}
+
+	for i, m := range sent {
+		if got := s.next(c); got.ID != m.ID {
+			s.Fatalf("message %d: got %q, want %q", i, got.NLPResponse.Transcript, m.NLPResponse.Transcript)
+		}
+	}
+}
+
+func testFanOut(s *suite) {
+	publisher := s.newQueue()
+
+	listeners := []tunnel.ReceiveC{}
+	for i := 0; i < 3; i++ {
+		c, cancel := s.listen(s.newQueue())
+		defer cancel()
+		listeners = append(listeners, c)
+	}
+	// two listeners on the same queue each get every message too
+	c, cancel := s.listen(s.queues[len(s.queues)-1])
+	defer cancel()
+	listeners = append(listeners, c)
+
+	s.sync(publisher, listeners...)
+
+	sent := []*tunnel.QueueMessage{}
+	for i := 0; i < 10; i++ {
+		m := message(i)
+		sent = append(sent, m)
+		s.broadcast(publisher, m)
+	}
+
+	for l, c := range listeners {
+		for i, m := range sent {
+			if got := s.next(c); got.ID != m.ID {
+				s.Fatalf("listener %d, message %d: got %q, want %q", l, i, got.NLPResponse.Transcript, m.NLPResponse.Transcript)
+			}
+		}
+	}
+}
+
+func testNoListener(s *suite) {
+	q := s.newQueue()
+
+	// nobody is listening, which must neither block nor fail
+	done := make(chan error, 1)
+	go func() {
+		done <- q.Broadcast(context.Background(), message(0))
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			s.Fatalf("Broadcast without listeners: %v", err)
+		}
+	case <-time.After(Timeout):
+		s.Fatal("Broadcast without listeners blocked")
+	}
+
+	// the queue still works once someone listens
+	c, cancel := s.listen(s.newQueue())
+	defer cancel()
+	s.sync(q, c)
+
+	m := message(1)
+	s.broadcast(q, m)
+	for {
+		got := s.next(c)
+		// backends that keep messages may deliver the first one
+		if got.ID == m.ID {
+			return
+		}
+	}
+}
+
+func testCancelListener(s *suite) {
+	q := s.newQueue()
+	cancelled, cancel := s.listen(q)
+	other, cancelOther := s.listen(q)
+	defer cancelOther()
+	s.sync(q, cancelled, other)
+
+	cancel()
+	s.closed(cancelled)
+
+	m := message(0)
+	s.broadcast(q, m)
+	if got := s.next(other); got.ID != m.ID {
+		s.Fatalf("got %q, want %q", got.NLPResponse.Transcript, m.NLPResponse.Transcript)
+	}
+}
+
+func testClose(s *suite) {
+	q := s.newQueue()
+	c, cancel := s.listen(q)
+	defer cancel()
+	s.sync(q, c)
+
+	if err := q.Close(); err != nil {
+		s.Fatalf("Close: %v", err)
+	}
+	s.closed(c)
+}
+
+func testLargePayload(s *suite) {
+	q := s.newQueue()
+	c, cancel := s.listen(q)
+	defer cancel()
+	s.sync(q, c)
+
+	intents := []*nlu.CompositeEntity{}
+	for i := 0; i < 1000; i++ {
+		intents = append(intents, &nlu.CompositeEntity{
+			Type: fmt.Sprintf("Intent%d", i),
+			Children: []*nlu.Entity{
+				{Type: "room", Value: strings.Repeat("kitchen ", 10)},
+			},
+		})
+	}
+	m := tunnel.NewQueueMessage(tunnel.NLPResponse{
+		Intents:    intents,
+		Transcript: strings.Repeat("turn on the lights ", 50000),
+		Confidence: 0.5,
+	}, tunnel.Target{Labels: map[string]string{"room": "kitchen"}})
+	s.broadcast(q, m)
+
+	got := s.next(c)
+	if got.ID != m.ID || got.NLPResponse.Transcript != m.NLPResponse.Transcript || got.Target.Labels["room"] != "kitchen" {
+		s.Fatal("large message changed on the way")
+	}
+	if len(got.NLPResponse.Intents) != len(intents) {
+		s.Fatalf("got %d intents, want %d", len(got.NLPResponse.Intents), len(intents))
+	}
+	for i, intent := range got.NLPResponse.Intents {
+		if intent.Type != intents[i].Type || intent.Children[0].Value != intents[i].Children[0].Value {
+			s.Fatalf("intent %d: got %+v, want %+v", i, intent, intents[i])
+		}
+	}
+}
+
+func testConcurrentPublishers(s *suite) {
+	const publishers, messages = 8, 50
+
+	q := s.newQueue()
+	c, cancel := s.listen(q)
+	defer cancel()
+	s.sync(q, c)
+
+	// half of the publishers share the listener's queue
+	queues := make([]tunnel.Queue, publishers)
+	for p := range queues {
+		queues[p] = q
+		if p%2 == 1 {
+			queues[p] = s.newQueue()
+		}
+	}
+
+	var wg sync.WaitGroup
+	for p, q := range queues {
+		wg.Add(1)
+		go func(p int, q tunnel.Queue) {
+			defer wg.Done()
+			for i := 0; i < messages; i++ {
+				m := tunnel.NewQueueMessage(tunnel.NLPResponse{
+					Transcript: fmt.Sprintf("%d %d", p, i),
+				}, tunnel.Target{})
+				if err := q.Broadcast(context.Background(), m); err != nil {
+					s.Errorf("publisher %d: %v", p, err)
+					return
+				}
+			}
+		}(p, q)
+	}
+	wg.Wait()
+	if s.Failed() {
+		return
+	}
+
+	// every message arrives once, in the order its publisher sent it
+	last := make([]int, publishers)
+	for p := range last {
+		last[p] = -1
+	}
+	for n := 0; n < publishers*messages; n++ {
+		var p, i int
+		got := s.next(c)
+		if _, err := fmt.Sscanf(got.NLPResponse.Transcript, "%d %d", &p, &i); err != nil {
+			s.Fatalf("unexpected message %q", got.NLPResponse.Transcript)
+		}
+		if i != last[p]+1 {
+			s.Fatalf("publisher %d: got message %d after %d", p, i, last[p])
+		}
+		last[p] = i
+	}
+}
+
+func testReconnect(s *suite) {
+	if s.backend.Restart == nil {
+		s.Skip("backend can't be restarted")
+	}
+
+	q := s.newQueue()
+	c, cancel := s.listen(q)
+	defer cancel()
+	s.sync(q, c)
+
+	s.backend.Restart(s.T)
+
+	// messages broadcast while the listener reconnects may be lost, so
+	// keep broadcasting until one gets through
+	m := message(0)
+	deadline := time.Now().Add(Timeout)
+	for {
+		ctx, cancelBroadcast := context.WithTimeout(context.Background(), time.Second)
+		q.Broadcast(ctx, m)
+		cancelBroadcast()
+
+		select {
+		case got, ok := <-c:
+			if !ok {
+				s.Fatal("listener closed by the restart")
+			}
+			if got.ID == m.ID {
+				return
+			}
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		if time.Now().After(deadline) {
+			s.Fatal("listener never reconnected")
+		}
+	}
+}
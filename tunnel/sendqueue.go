@@ -0,0 +1,188 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/begizi/vch-server/pb"
+	"github.com/go-kit/kit/metrics"
+)
+
+/*
+Send Queues
+-----------
+
+Every session has its own bounded queue of responses and a
+writer goroutine that sends them down the stream, so a
+stalled device never holds up delivery to the others. When
+a queue is full the OverflowPolicy decides what gives:
+
+	drop-oldest  the oldest queued response is dropped
+	drop-newest  the new response is dropped
+	disconnect   the session is disconnected
+
+Dropped responses are still waiting on an ack and will be
+sent again with the next retry.
+*/
+
+type OverflowPolicy string
+
+const (
+	DropOldest OverflowPolicy = "drop-oldest"
+	DropNewest OverflowPolicy = "drop-newest"
+	Disconnect OverflowPolicy = "disconnect"
+)
+
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch p := OverflowPolicy(s); p {
+	case DropOldest, DropNewest, Disconnect:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown overflow policy %q", s)
+	}
+}
+
+var ErrSlowConsumer = errors.New("session is not keeping up with its messages")
+
+var errQueueSize = errors.New("tunnel queue size must be positive")
+
+type Config struct {
+	// QueueSize is the most responses a session can have waiting to
+	// be sent.
+	QueueSize int
+	Overflow  OverflowPolicy
+
+	// AckTimeout is how long a device has to ack a response before it
+	// is sent again, growing with every attempt.
+	AckTimeout time.Duration
+
+	// RegisterInterval is how often the devices of open tunnels are
+	// registered with the mailbox again, it has to be well under the
+	// mailbox TTL.
+	RegisterInterval time.Duration
+}
+
+var DefaultConfig = Config{
+	QueueSize:        64,
+	Overflow:         DropOldest,
+	AckTimeout:       2 * time.Second,
+	RegisterInterval: time.Hour,
+}
+
+type Metrics struct {
+	// QueueDepth is the number of responses waiting in all send queues.
+	QueueDepth metrics.Gauge
+
+	// Dropped counts the responses that didn't fit in a send queue,
+	// labeled by the overflow policy.
+	Dropped metrics.Counter
+
+	// Sessions is the number of open tunnels.
+	Sessions metrics.Gauge
+
+	// SendErrors counts the responses that failed to send down a
+	// tunnel. It has no device label, which would be unbounded, the
+	// log names the device instead.
+	SendErrors metrics.Counter
+
+	// FailedDeliveries counts the responses that were never acked,
+	// labeled by the reason: rejected, unacked or disconnected.
+	FailedDeliveries metrics.Counter
+}
+
+// queueMetrics is shared by the send queues of all sessions.
+type queueMetrics struct {
+	Metrics
+	depth    int64
+	sessions int64
+}
+
+func (m *queueMetrics) add(delta int) {
+	m.QueueDepth.Set(float64(atomic.AddInt64(&m.depth, int64(delta))))
+}
+
+func (m *queueMetrics) addSession(delta int) {
+	m.Sessions.Set(float64(atomic.AddInt64(&m.sessions, int64(delta))))
+}
+
+type sendQueue struct {
+	mtx       sync.Mutex
+	responses []*pb.TunnelResponse
+	closed    bool
+
+	config  Config
+	metrics *queueMetrics
+
+	// notify wakes the writer once responses are queued
+	notify chan struct{}
+}
+
+func newSendQueue(config Config, metrics *queueMetrics) (*sendQueue, error) {
+	// an empty queue would have nothing to drop when it overflows
+	if config.QueueSize <= 0 {
+		return nil, errQueueSize
+	}
+	return &sendQueue{
+		config:  config,
+		metrics: metrics,
+		notify:  make(chan struct{}, 1),
+	}, nil
+}
+
+func (q *sendQueue) push(response *pb.TunnelResponse) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if q.closed {
+		return nil
+	}
+
+	if len(q.responses) >= q.config.QueueSize {
+		q.metrics.Dropped.With("policy", string(q.config.Overflow)).Add(1)
+		switch q.config.Overflow {
+		case DropNewest:
+			return nil
+		case Disconnect:
+			return ErrSlowConsumer
+		default:
+			q.responses = q.responses[1:]
+			q.metrics.add(-1)
+		}
+	}
+
+	q.responses = append(q.responses, response)
+	q.metrics.add(1)
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (q *sendQueue) pop() (*pb.TunnelResponse, bool) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if len(q.responses) == 0 {
+		return nil, false
+	}
+	response := q.responses[0]
+	q.responses[0] = nil
+	q.responses = q.responses[1:]
+	q.metrics.add(-1)
+	return response, true
+}
+
+// close drops every queued response and refuses new ones.
+func (q *sendQueue) close() {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	q.metrics.add(-len(q.responses))
+	q.responses = nil
+	q.closed = true
+}
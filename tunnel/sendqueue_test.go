@@ -0,0 +1,154 @@
+package tunnel
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/begizi/vch-server/pb"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics/discard"
+	"golang.org/x/net/context"
+)
+
+func testQueueMetrics() *queueMetrics {
+	return &queueMetrics{Metrics: Metrics{
+		QueueDepth: discard.NewGauge(),
+		Dropped:    discard.NewCounter(),
+		Sessions:   discard.NewGauge(),
+		SendErrors: discard.NewCounter(),
+	}}
+}
+
+func TestSendQueueSize(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		config := DefaultConfig
+		config.QueueSize = size
+		if _, err := newSendQueue(config, testQueueMetrics()); err != errQueueSize {
+			t.Errorf("queue size %d: err = %v, want errQueueSize", size, err)
+		}
+		if _, err := MakeTunnelServer(&stubQueue{make(ReceiveC)}, nil, config, Metrics{}, nil, log.NewNopLogger()); err != errQueueSize {
+			t.Errorf("queue size %d: MakeTunnelServer err = %v, want errQueueSize", size, err)
+		}
+	}
+}
+
+func TestSendQueueOverflow(t *testing.T) {
+	for _, tc := range []struct {
+		policy OverflowPolicy
+		err    error
+		want   []string
+	}{
+		{DropOldest, nil, []string{"m2", "m3"}},
+		{DropNewest, nil, []string{"m1", "m2"}},
+		{Disconnect, ErrSlowConsumer, []string{"m1", "m2"}},
+	} {
+		t.Run(string(tc.policy), func(t *testing.T) {
+			q, err := newSendQueue(Config{QueueSize: 2, Overflow: tc.policy}, testQueueMetrics())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, id := range []string{"m1", "m2"} {
+				if err := q.push(&pb.TunnelResponse{Id: id}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := q.push(&pb.TunnelResponse{Id: "m3"}); err != tc.err {
+				t.Errorf("err = %v, want %v", err, tc.err)
+			}
+
+			var got []string
+			for {
+				response, ok := q.pop()
+				if !ok {
+					break
+				}
+				got = append(got, response.Id)
+			}
+			if len(got) != len(tc.want) || got[0] != tc.want[0] || got[1] != tc.want[1] {
+				t.Errorf("queued %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// blockingStream holds every send until it is released.
+type blockingStream struct {
+	*fakeStream
+	sending chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStream) Send(response *pb.TunnelResponse) error {
+	s.sending <- struct{}{}
+	<-s.release
+	return nil
+}
+
+func TestSessionCloseWaitsForWriter(t *testing.T) {
+	q, err := newSendQueue(DefaultConfig, testQueueMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := &blockingStream{
+		fakeStream: &fakeStream{ctx: context.Background()},
+		sending:    make(chan struct{}),
+		release:    make(chan struct{}),
+	}
+	session := newSession("s1", stream, "lamp-1", nil, q)
+	go session.write(log.NewNopLogger())
+
+	session.send(&pb.TunnelResponse{Id: "m1"})
+	<-stream.sending
+	closed := make(chan struct{})
+	go func() {
+		session.close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+		t.Fatal("close returned while the writer was sending")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(stream.release)
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close didn't return once the writer was done")
+	}
+}
+
+// failingStream fails every send.
+type failingStream struct {
+	*fakeStream
+	sends chan struct{}
+}
+
+func (s *failingStream) Send(response *pb.TunnelResponse) error {
+	s.sends <- struct{}{}
+	return errors.New("transport is closing")
+}
+
+func TestSessionSendErrors(t *testing.T) {
+	sendErrors := newCounter()
+	metrics := testQueueMetrics()
+	metrics.SendErrors = sendErrors
+	q, err := newSendQueue(DefaultConfig, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := &failingStream{fakeStream: &fakeStream{ctx: context.Background()}, sends: make(chan struct{})}
+	session := newSession("s1", stream, "lamp-1", nil, q)
+	go session.write(log.NewNopLogger())
+
+	session.send(&pb.TunnelResponse{Id: "m1"})
+	<-stream.sends
+	session.close()
+
+	// counted without any labels
+	if n := sendErrors.value(""); n != 1 {
+		t.Errorf("%v send errors, want 1", n)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/begizi/vch-server/pb"
+	"github.com/go-kit/kit/log"
 )
 
 type SessionId string
@@ -14,6 +15,135 @@ type Session struct {
 	Id     SessionId
 	Start  time.Time
 	Stream pb.VCH_TunnelServer
+
+	// DeviceId and Labels identify the device that opened the tunnel.
+	DeviceId string
+	Labels   map[string]string
+
+	// responses waiting for the writer, which is the only goroutine
+	// that sends on the stream
+	queue *sendQueue
+	stop  chan struct{}
+
+	// closed by the writer once it has returned
+	done chan struct{}
+
+	// closed when the session has to be disconnected
+	kicked   chan struct{}
+	kickOnce sync.Once
+
+	// deliveries waiting to be acked, nil once the session is closed
+	pendingMtx sync.Mutex
+	pending    map[string]*delivery
+}
+
+func newSession(id SessionId, stream pb.VCH_TunnelServer, deviceId string, labels map[string]string, queue *sendQueue) *Session {
+	return &Session{
+		Id:       id,
+		Start:    time.Now(),
+		Stream:   stream,
+		DeviceId: deviceId,
+		Labels:   labels,
+		queue:    queue,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		kicked:   make(chan struct{}),
+		pending:  make(map[string]*delivery),
+	}
+}
+
+// send queues the response for the writer.
+func (s *Session) send(response *pb.TunnelResponse) error {
+	return s.queue.push(response)
+}
+
+// write sends queued responses down the stream until the session is
+// closed.
+func (s *Session) write(logger log.Logger) {
+	defer close(s.done)
+	for {
+		select {
+		case <-s.queue.notify:
+			for {
+				response, ok := s.queue.pop()
+				if !ok {
+					break
+				}
+				if err := s.Stream.Send(response); err != nil {
+					logger.Log("msg", "Failed to send message", "messageId", response.Id, "sessionId", s.Id, "deviceId", s.DeviceId, "err", err)
+					s.queue.metrics.SendErrors.Add(1)
+				}
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// disconnect ends the session, eg. when it can't keep up.
+func (s *Session) disconnect() {
+	s.kickOnce.Do(func() {
+		close(s.kicked)
+	})
+}
+
+// track waits for the delivery to be acked. It reports false once the
+// session is closed or when the message is already being delivered.
+func (s *Session) track(d *delivery) bool {
+	s.pendingMtx.Lock()
+	defer s.pendingMtx.Unlock()
+	if s.pending == nil {
+		return false
+	}
+	if _, ok := s.pending[d.id]; ok {
+		return false
+	}
+	s.pending[d.id] = d
+	return true
+}
+
+// untrack stops waiting on an acked delivery.
+func (s *Session) untrack(id string) (*delivery, bool) {
+	s.pendingMtx.Lock()
+	defer s.pendingMtx.Unlock()
+	d, ok := s.pending[id]
+	if ok {
+		delete(s.pending, id)
+		if d.timer != nil {
+			d.timer.Stop()
+		}
+	}
+	return d, ok
+}
+
+// writerTimeout is how long close waits for a writer that is stuck
+// sending to a stalled device. Its send fails once the handler has
+// returned and the stream is cancelled.
+const writerTimeout = 5 * time.Second
+
+// close stops the writer and all retries and returns the deliveries
+// that were never acked. The writer is waited on so the stream isn't
+// sent on after the handler is done, which gRPC doesn't allow.
+func (s *Session) close() []*delivery {
+	s.queue.close()
+	close(s.stop)
+	select {
+	case <-s.done:
+	case <-time.After(writerTimeout):
+	}
+
+	s.pendingMtx.Lock()
+	defer s.pendingMtx.Unlock()
+
+	unacked := []*delivery{}
+	for _, d := range s.pending {
+		if d.timer != nil {
+			d.timer.Stop()
+		}
+		unacked = append(unacked, d)
+	}
+	s.pending = nil
+	return unacked
 }
 
 type SessionStore struct {
@@ -56,6 +186,21 @@ func (s *SessionStore) FindBySessionId(id SessionId) (*Session, error) {
 	return nil, errors.New("Not Found")
 }
 
+// Match lists the sessions that match the target.
+func (s *SessionStore) Match(target Target) ([]*Session, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	sessions := []*Session{}
+	for _, session := range s.sessions {
+		if target.Matches(session) {
+			sessions = append(sessions, session)
+		}
+	}
+
+	return sessions, nil
+}
+
 func (s *SessionStore) List() ([]*Session, error) {
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
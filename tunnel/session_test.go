@@ -0,0 +1,55 @@
+package tunnel
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSessionStoreMatch(t *testing.T) {
+	store := NewSessionStore()
+	for _, s := range []*Session{
+		{Id: "1", DeviceId: "lamp-1", Labels: map[string]string{"room": "kitchen"}},
+		{Id: "2", DeviceId: "lamp-1", Labels: map[string]string{"room": "kitchen"}},
+		{Id: "3", DeviceId: "lamp-2", Labels: map[string]string{"room": "hall"}},
+		{Id: "4", DeviceId: "fan-1", Labels: map[string]string{"room": "kitchen", "kind": "fan"}},
+		{Id: "5", DeviceId: "speaker-1"},
+	} {
+		store.Add(s)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		target Target
+		want   string
+	}{
+		{"every session", Target{}, "1,2,3,4,5"},
+		{"every session of a device", Target{DeviceID: "lamp-1"}, "1,2"},
+		{"label", Target{Labels: map[string]string{"room": "kitchen"}}, "1,2,4"},
+		{"labels", Target{Labels: map[string]string{"room": "kitchen", "kind": "fan"}}, "4"},
+		{"device and label", Target{DeviceID: "lamp-2", Labels: map[string]string{"room": "hall"}}, "3"},
+		{"unknown device", Target{DeviceID: "lamp-3"}, ""},
+		{"unknown label", Target{Labels: map[string]string{"room": "attic"}}, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sessions, err := store.Match(tc.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := []string{}
+			for _, s := range sessions {
+				ids = append(ids, string(s.Id))
+			}
+			sort.Strings(ids)
+			if got := strings.Join(ids, ","); got != tc.want {
+				t.Errorf("matched %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	// removed sessions no longer match
+	store.Remove("2")
+	if sessions, _ := store.Match(Target{DeviceID: "lamp-1"}); len(sessions) != 1 || sessions[0].Id != "1" {
+		t.Errorf("matched %d sessions after removing one, want session 1", len(sessions))
+	}
+}
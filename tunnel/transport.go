@@ -1,24 +1,52 @@
 package tunnel
 
 import (
-	"github.com/begizi/vch-server/luis"
+	"sync"
+	"time"
+
+	"github.com/begizi/vch-server/nlu"
 	"github.com/begizi/vch-server/pb"
 	"github.com/go-kit/kit/log"
 	"github.com/satori/go.uuid"
-	"time"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 )
 
 type VCHTunnelServer struct {
 	queue Queue
 
+	// Mailbox keeping messages for offline devices, may be nil
+	mailbox Mailbox
+
 	// Session Store for adding new sessions
 	sessions *SessionStore
 
+	// Send queue settings for new sessions
+	config  Config
+	metrics *queueMetrics
+
 	// Message logger
 	logger log.Logger
+
+	// Traces messages from the queue to the devices
+	tracer trace.Tracer
+
+	// stopListening stops the queue listener, which closes listening
+	// once it has exited
+	stopListening context.CancelFunc
+	listening     chan struct{}
+
+	// closed ends every tunnel
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
-func entitiesToTransport(entities []*luis.CompositeEntityChild) []*pb.Entity {
+var errShuttingDown = grpc.Errorf(codes.Unavailable, "server is shutting down")
+
+func entitiesToTransport(entities []*nlu.Entity) []*pb.Entity {
 	var transportEntities []*pb.Entity
 	for _, e := range entities {
 		transportEntities = append(transportEntities, &pb.Entity{
@@ -29,96 +57,302 @@ func entitiesToTransport(entities []*luis.CompositeEntityChild) []*pb.Entity {
 	return transportEntities
 }
 
-func intentsToTransport(intents []*luis.CompositeEntity) []*pb.Intent {
+func IntentsToTransport(intents []*nlu.CompositeEntity) []*pb.Intent {
 	var transportIntents []*pb.Intent
 	for _, i := range intents {
 		transportIntents = append(transportIntents, &pb.Intent{
-			Type:     i.ParentType,
+			Type:     i.Type,
 			Entities: entitiesToTransport(i.Children),
 		})
 	}
 	return transportIntents
 }
 
-func (s VCHTunnelServer) SendToStream(message NLPResponse) error {
-	sessions, err := s.sessions.List()
+func NLPResponseToTransport(message NLPResponse) *pb.NLPResponse {
+	return &pb.NLPResponse{
+		Intents:    IntentsToTransport(message.Intents),
+		Transcript: message.Transcript,
+		Confidence: message.Confidence,
+	}
+}
+
+func entitiesFromTransport(entities []*pb.Entity) []*nlu.Entity {
+	var e []*nlu.Entity
+	for _, transportEntity := range entities {
+		e = append(e, &nlu.Entity{
+			Type:  transportEntity.Type,
+			Value: transportEntity.Value,
+		})
+	}
+	return e
+}
+
+func IntentsFromTransport(intents []*pb.Intent) []*nlu.CompositeEntity {
+	var i []*nlu.CompositeEntity
+	for _, transportIntent := range intents {
+		i = append(i, &nlu.CompositeEntity{
+			Type:     transportIntent.Type,
+			Children: entitiesFromTransport(transportIntent.Entities),
+		})
+	}
+	return i
+}
+
+// NLPResponseFromTransport converts a transport response, nil is the
+// empty response.
+func NLPResponseFromTransport(message *pb.NLPResponse) NLPResponse {
+	if message == nil {
+		return NLPResponse{}
+	}
+	return NLPResponse{
+		Intents:    IntentsFromTransport(message.Intents),
+		Transcript: message.Transcript,
+		Confidence: message.Confidence,
+	}
+}
+
+func TargetToTransport(target Target) *pb.Target {
+	return &pb.Target{
+		DeviceId: target.DeviceID,
+		Labels:   target.Labels,
+	}
+}
+
+// TargetFromTransport converts a transport target, nil targets every
+// session.
+func TargetFromTransport(target *pb.Target) Target {
+	if target == nil {
+		return Target{}
+	}
+	return Target{
+		DeviceID: target.DeviceId,
+		Labels:   target.Labels,
+	}
+}
+
+// SendToStream delivers the message to the sessions of this process
+// that match its target, and keeps it for the devices that are offline.
+func (s *VCHTunnelServer) SendToStream(message *QueueMessage) error {
+	// continue the trace of the broadcast
+	ctx, span := s.tracer.Start(extractTrace(context.Background(), message.TraceContext), "tunnel.SendToStream",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attribute.String("vch.message_id", message.ID)),
+	)
+	defer span.End()
+
+	if s.mailbox != nil && message.ID != "" {
+		if err := s.mailbox.Deposit(message); err != nil {
+			s.logger.Log("msg", "Failed to deposit message", "messageId", message.ID, "err", err)
+			span.RecordError(err)
+		}
+	}
+
+	sessions, err := s.sessions.Match(message.Target)
 	if err != nil {
 		return err
 	}
+	span.SetAttributes(attribute.Int("vch.sessions", len(sessions)))
 
 	for _, session := range sessions {
-		session.Stream.Send(&pb.TunnelResponse{
-			Event: &pb.TunnelResponse_Response{
-				Response: &pb.NLPResponse{
-					Intents: intentsToTransport(message.Intents),
-				},
-			},
-		})
+		s.deliver(ctx, session, message)
 	}
 
 	return nil
 }
 
-// Tunnel transport handler
-func (s *VCHTunnelServer) Tunnel(req *pb.TunnelRequest, stream pb.VCH_TunnelServer) error {
-	streamCtx := stream.Context()
+// replay delivers the messages kept for the session's device while it
+// was offline.
+func (s *VCHTunnelServer) replay(session *Session, lastID string) error {
+	if s.mailbox == nil || session.DeviceId == "" {
+		return nil
+	}
 
-	id := uuid.NewV4()
-	newSession := &Session{
-		Id:     SessionId(id.String()),
-		Start:  time.Now(),
-		Stream: stream,
+	if err := s.register(session); err != nil {
+		return err
 	}
 
-	err := s.sessions.Add(newSession)
+	messages, err := s.mailbox.Pending(session.DeviceId, lastID)
 	if err != nil {
 		return err
 	}
-	s.logger.Log("msg", "Added stream to list", "streamId", newSession.Id)
+
+	if len(messages) > 0 {
+		s.logger.Log("msg", "Replaying mailbox", "deviceId", session.DeviceId, "messages", len(messages))
+	}
+	for _, message := range messages {
+		s.deliver(extractTrace(context.Background(), message.TraceContext), session, message)
+	}
+	return nil
+}
+
+// register keeps the session's device registered with the mailbox.
+func (s *VCHTunnelServer) register(session *Session) error {
+	return s.mailbox.Register(Device{ID: session.DeviceId, Labels: session.Labels})
+}
+
+// reregister registers the devices of the open tunnels again every
+// RegisterInterval, until the server is closed.
+func (s *VCHTunnelServer) reregister() {
+	ticker := time.NewTicker(s.config.RegisterInterval)
+	defer ticker.Stop()
 
 	for {
 		select {
-		case <-streamCtx.Done():
-			err := streamCtx.Err()
-			s.logger.Log("msg", "Stream done", "sessionId", newSession.Id, "err", err)
-			return s.sessions.Remove(newSession.Id)
+		case <-ticker.C:
+			sessions, _ := s.sessions.List()
+			for _, session := range sessions {
+				if session.DeviceId == "" {
+					continue
+				}
+				if err := s.register(session); err != nil {
+					s.logger.Log("msg", "Failed to register device", "deviceId", session.DeviceId, "err", err)
+				}
+			}
+		case <-s.closed:
+			return
 		}
+	}
+}
+
+// Tunnel transport handler
+func (s *VCHTunnelServer) Tunnel(stream pb.VCH_TunnelServer) error {
+	streamCtx := stream.Context()
+
+	select {
+	case <-s.closed:
+		return errShuttingDown
+	default:
+	}
+
+	// the first request identifies the device
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	queue, err := newSendQueue(s.config, s.metrics)
+	if err != nil {
+		return grpc.Errorf(codes.Internal, "%v", err)
+	}
+	id := uuid.NewV4()
+	newSession := newSession(SessionId(id.String()), stream, req.DeviceId, req.Labels, queue)
 
+	err = s.sessions.Add(newSession)
+	if err != nil {
+		return err
 	}
+	s.logger.Log("msg", "Added stream to list", "streamId", newSession.Id, "deviceId", newSession.DeviceId)
+	s.metrics.addSession(1)
+
+	go newSession.write(s.logger)
+
+	if err := s.replay(newSession, req.LastId); err != nil {
+		s.logger.Log("msg", "Failed to replay mailbox", "deviceId", newSession.DeviceId, "err", err)
+	}
+
+	// read acks until the device closes its side of the stream
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			if ack := req.GetAck(); ack != nil {
+				s.ack(newSession, ack)
+			}
+		}
+	}()
+
+	select {
+	case <-streamCtx.Done():
+		err = streamCtx.Err()
+	case <-newSession.kicked:
+		err = grpc.Errorf(codes.ResourceExhausted, "%v", ErrSlowConsumer)
+	case <-s.closed:
+		err = errShuttingDown
+	}
+	s.logger.Log("msg", "Stream done", "sessionId", newSession.Id, "err", err)
+
+	s.sessions.Remove(newSession.Id)
+	s.metrics.addSession(-1)
+	for _, d := range newSession.close() {
+		s.failed(newSession, d, failDisconnected, "session closed")
+	}
+
+	// the device is kept registered for the TTL from when it left
+	if s.mailbox != nil && newSession.DeviceId != "" {
+		if err := s.register(newSession); err != nil {
+			s.logger.Log("msg", "Failed to register device", "deviceId", newSession.DeviceId, "err", err)
+		}
+	}
+
+	// a cancelled stream has nobody left to return an error to
+	if streamCtx.Err() != nil {
+		return nil
+	}
+	return err
 }
 
-func MakeTunnelServer(q Queue, logger log.Logger) (*VCHTunnelServer, error) {
-	queuec, err := q.Listen()
+func MakeTunnelServer(q Queue, mailbox Mailbox, config Config, m Metrics, tracer trace.Tracer, logger log.Logger) (*VCHTunnelServer, error) {
+	if config.QueueSize <= 0 {
+		return nil, errQueueSize
+	}
+
+	ctx, stopListening := context.WithCancel(context.Background())
+	queuec, err := q.Listen(ctx)
 	if err != nil {
+		stopListening()
 		return nil, err
 	}
 
 	sessions := NewSessionStore()
+	if config.AckTimeout <= 0 {
+		config.AckTimeout = DefaultConfig.AckTimeout
+	}
+	if config.RegisterInterval <= 0 {
+		config.RegisterInterval = DefaultConfig.RegisterInterval
+	}
 
 	server := &VCHTunnelServer{
-		logger:   logger,
-		queue:    q,
-		sessions: sessions,
+		logger:        logger,
+		tracer:        tracer,
+		queue:         q,
+		mailbox:       mailbox,
+		sessions:      sessions,
+		config:        config,
+		metrics:       &queueMetrics{Metrics: m},
+		stopListening: stopListening,
+		listening:     make(chan struct{}),
+		closed:        make(chan struct{}),
 	}
 
-	// Process for handling queue messages
+	// Process for handling queue messages, until the queue is closed or
+	// the server stops listening.
 	go func() {
-		for {
-			select {
-
-			// process incoming messages from RedisPubSub, and send messages.
-			case msg := <-queuec:
-				if msg == nil {
-					logger.Log("msg", "Message Channel has closed. Exiting.")
-					return
-				}
-
-				logger.Log("msg", "Sending a new message to all sessions")
-				server.SendToStream(msg.NLPResponse)
-			}
+		defer close(server.listening)
 
+		for msg := range queuec {
+			logger.Log("msg", "Sending a new message to matching sessions", "deviceId", msg.Target.DeviceID)
+			server.SendToStream(msg)
 		}
+		logger.Log("msg", "Message Channel has closed. Exiting.")
 	}()
 
+	if mailbox != nil {
+		go server.reregister()
+	}
+
 	return server, nil
 }
+
+// Close stops listening to the queue, once the message being sent is done,
+// and then ends every tunnel so the devices reconnect to another process.
+// Their unacked messages are kept in their mailboxes.
+func (s *VCHTunnelServer) Close() error {
+	s.closeOnce.Do(func() {
+		s.stopListening()
+		<-s.listening
+		close(s.closed)
+	})
+	return nil
+}
@@ -6,13 +6,56 @@ import (
 )
 
 type Endpoints struct {
-	VoiceEndpoint endpoint.Endpoint
+	VoiceEndpoint       endpoint.Endpoint
+	StreamVoiceEndpoint endpoint.Endpoint
+	SubmitJobEndpoint   endpoint.Endpoint
+	JobEndpoint         endpoint.Endpoint
+	TextEndpoint        endpoint.Endpoint
 }
 
 // Voice Endpoint
 func (e Endpoints) Voice(ctx context.Context, voice VoiceRequest) (*VoiceResponse, error) {
 	response, err := e.VoiceEndpoint(ctx, voice)
-	return response.(*VoiceResponse), err
+	if err != nil {
+		return nil, err
+	}
+	return response.(*VoiceResponse), nil
+}
+
+// StreamVoice Endpoint
+func (e Endpoints) StreamVoice(ctx context.Context, voice StreamVoiceRequest) (*VoiceResponse, error) {
+	response, err := e.StreamVoiceEndpoint(ctx, voice)
+	if err != nil {
+		return nil, err
+	}
+	return response.(*VoiceResponse), nil
+}
+
+// SubmitJob Endpoint
+func (e Endpoints) SubmitJob(ctx context.Context, job JobRequest) (*Job, error) {
+	response, err := e.SubmitJobEndpoint(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+	return response.(*Job), nil
+}
+
+// Job Endpoint
+func (e Endpoints) Job(ctx context.Context, id string) (*Job, error) {
+	response, err := e.JobEndpoint(ctx, JobStatusRequest{ID: id})
+	if err != nil {
+		return nil, err
+	}
+	return response.(*Job), nil
+}
+
+// Text Endpoint
+func (e Endpoints) Text(ctx context.Context, text TextRequest) (*VoiceResponse, error) {
+	response, err := e.TextEndpoint(ctx, text)
+	if err != nil {
+		return nil, err
+	}
+	return response.(*VoiceResponse), nil
 }
 
 func MakeVoiceEndpoint(s Service) endpoint.Endpoint {
@@ -21,3 +64,31 @@ func MakeVoiceEndpoint(s Service) endpoint.Endpoint {
 		return s.Voice(ctx, request)
 	}
 }
+
+func MakeStreamVoiceEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, req interface{}) (response interface{}, err error) {
+		request := req.(StreamVoiceRequest)
+		return s.StreamVoice(ctx, request)
+	}
+}
+
+func MakeSubmitJobEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, req interface{}) (response interface{}, err error) {
+		request := req.(JobRequest)
+		return s.SubmitJob(ctx, request)
+	}
+}
+
+func MakeJobEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, req interface{}) (response interface{}, err error) {
+		request := req.(JobStatusRequest)
+		return s.Job(ctx, request.ID)
+	}
+}
+
+func MakeTextEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, req interface{}) (response interface{}, err error) {
+		request := req.(TextRequest)
+		return s.Text(ctx, request)
+	}
+}
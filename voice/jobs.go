@@ -0,0 +1,105 @@
+package voice
+
+import (
+	"errors"
+	"time"
+)
+
+/*
+Job Store Interface
+-------------------
+
+Audio that is too long to recognize while the client waits
+is recognized by an asynchronous job instead. The JobStore
+interface describes where the state of those jobs is kept
+so the client can poll for the result.
+
+Any vchd process can be asked about a job, so when running
+more than one process the store has to be shared between
+them (see redis). The inmem store only works for a single
+process.
+*/
+
+var ErrJobNotFound = errors.New("job not found")
+
+// ErrAudioTooLong is returned for a job with more audio than the
+// recognizer accepts.
+var ErrAudioTooLong = errors.New("audio is too long to recognize")
+
+type JobStatus string
+
+const (
+	JobPending JobStatus = "pending"
+	JobRunning JobStatus = "running"
+	JobDone    JobStatus = "done"
+	JobFailed  JobStatus = "failed"
+)
+
+type Job struct {
+	ID      string    `json:"id"`
+	Status  JobStatus `json:"status"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+
+	// Result is set once the job is done and Error once it has failed.
+	Result *VoiceResponse `json:"result,omitempty"`
+	Error  string         `json:"error,omitempty"`
+
+	// Lease is renewed by the process running the job, a job whose
+	// lease ran out died with that process.
+	Lease time.Time `json:"-"`
+}
+
+// JobLease is how long a job is leased to the process running it. The
+// lease is renewed every third of it.
+const JobLease = time.Minute
+
+// Finished reports whether the job is done or has failed.
+func (j *Job) Finished() bool {
+	return j.Status == JobDone || j.Status == JobFailed
+}
+
+type JobStore interface {
+	Save(job *Job) error
+	Get(id string) (*Job, error)
+
+	// Unfinished returns every job that is still pending or running.
+	Unfinished() ([]*Job, error)
+}
+
+// FailOrphanedJobs marks the jobs that will never finish as failed,
+// those whose lease has run out. It returns how many jobs it failed.
+func FailOrphanedJobs(jobs JobStore) (int, error) {
+	unfinished, err := jobs.Unfinished()
+	if err != nil {
+		return 0, err
+	}
+
+	failed := 0
+	for _, job := range unfinished {
+		if time.Now().Before(job.Lease) {
+			continue
+		}
+
+		job.Status = JobFailed
+		job.Error = "the server stopped before the job finished"
+		job.Updated = time.Now()
+		if err := jobs.Save(job); err != nil {
+			return failed, err
+		}
+		failed++
+	}
+	return failed, nil
+}
+
+type JobRequest struct {
+	Voice VoiceRequest
+
+	// Broadcast sends the result through the tunnel once the job is
+	// done. Otherwise the result is only kept for polling.
+	Broadcast bool
+}
+
+type JobStatusRequest struct {
+	ID string
+}
@@ -1,10 +1,17 @@
 package voice
 
 import (
+	"fmt"
+	"net/http"
 	"time"
 
 	"github.com/go-kit/kit/endpoint"
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/net/context"
 )
 
@@ -47,3 +54,175 @@ func (mw serviceLoggingMiddleware) Voice(ctx context.Context, voice VoiceRequest
 	}(time.Now())
 	return mw.next.Voice(ctx, voice)
 }
+
+func (mw serviceLoggingMiddleware) StreamVoice(ctx context.Context, voice StreamVoiceRequest) (v *VoiceResponse, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "StreamVoice",
+			"layer", "service",
+			"error", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.StreamVoice(ctx, voice)
+}
+
+func (mw serviceLoggingMiddleware) SubmitJob(ctx context.Context, job JobRequest) (j *Job, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "SubmitJob",
+			"layer", "service",
+			"error", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.SubmitJob(ctx, job)
+}
+
+func (mw serviceLoggingMiddleware) Job(ctx context.Context, id string) (j *Job, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "Job",
+			"layer", "service",
+			"id", id,
+			"error", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.Job(ctx, id)
+}
+
+func (mw serviceLoggingMiddleware) Text(ctx context.Context, text TextRequest) (v *VoiceResponse, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "Text",
+			"layer", "service",
+			"error", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.Text(ctx, text)
+}
+
+// ServiceInstrumentingMiddleware counts requests and measures how long they
+// take, labeled by the method and whether they failed. The duration in
+// seconds and size in bytes of uploaded audio are observed too, labeled
+// by the method. Streamed audio isn't measured, it is only read once by
+// the recognizer.
+func ServiceInstrumentingMiddleware(requests metrics.Counter, latency metrics.Histogram, audioDuration metrics.Histogram, audioSize metrics.Histogram) Middleware {
+	return func(next Service) Service {
+		return serviceInstrumentingMiddleware{
+			requests:      requests,
+			latency:       latency,
+			audioDuration: audioDuration,
+			audioSize:     audioSize,
+			next:          next,
+		}
+	}
+}
+
+type serviceInstrumentingMiddleware struct {
+	requests      metrics.Counter
+	latency       metrics.Histogram
+	audioDuration metrics.Histogram
+	audioSize     metrics.Histogram
+	next          Service
+}
+
+func (mw serviceInstrumentingMiddleware) observe(method string, begin time.Time, err error) {
+	lvs := []string{"method", method, "error", fmt.Sprint(err != nil)}
+	mw.requests.With(lvs...).Add(1)
+	mw.latency.With(lvs...).Observe(time.Since(begin).Seconds())
+}
+
+func (mw serviceInstrumentingMiddleware) observeAudio(method string, voice VoiceRequest) {
+	// samples are 16-bit
+	mw.audioSize.With("method", method).Observe(float64(len(voice.Samples) * 2))
+	if voice.SampleRate > 0 {
+		mw.audioDuration.With("method", method).Observe(float64(len(voice.Samples)) / float64(voice.SampleRate))
+	}
+}
+
+func (mw serviceInstrumentingMiddleware) Voice(ctx context.Context, voice VoiceRequest) (v *VoiceResponse, err error) {
+	defer func(begin time.Time) {
+		mw.observe("Voice", begin, err)
+	}(time.Now())
+	mw.observeAudio("Voice", voice)
+	return mw.next.Voice(ctx, voice)
+}
+
+func (mw serviceInstrumentingMiddleware) StreamVoice(ctx context.Context, voice StreamVoiceRequest) (v *VoiceResponse, err error) {
+	defer func(begin time.Time) {
+		mw.observe("StreamVoice", begin, err)
+	}(time.Now())
+	return mw.next.StreamVoice(ctx, voice)
+}
+
+func (mw serviceInstrumentingMiddleware) SubmitJob(ctx context.Context, job JobRequest) (j *Job, err error) {
+	defer func(begin time.Time) {
+		mw.observe("SubmitJob", begin, err)
+	}(time.Now())
+	mw.observeAudio("SubmitJob", job.Voice)
+	return mw.next.SubmitJob(ctx, job)
+}
+
+func (mw serviceInstrumentingMiddleware) Job(ctx context.Context, id string) (j *Job, err error) {
+	defer func(begin time.Time) {
+		mw.observe("Job", begin, err)
+	}(time.Now())
+	return mw.next.Job(ctx, id)
+}
+
+func (mw serviceInstrumentingMiddleware) Text(ctx context.Context, text TextRequest) (v *VoiceResponse, err error) {
+	defer func(begin time.Time) {
+		mw.observe("Text", begin, err)
+	}(time.Now())
+	return mw.next.Text(ctx, text)
+}
+
+type DecodeMiddleware func(httptransport.DecodeRequestFunc) httptransport.DecodeRequestFunc
+
+// DecodeInstrumentingMiddleware counts decoded audio uploads and measures
+// how long decoding takes, labeled by whether it failed.
+func DecodeInstrumentingMiddleware(requests metrics.Counter, latency metrics.Histogram) DecodeMiddleware {
+	return func(next httptransport.DecodeRequestFunc) httptransport.DecodeRequestFunc {
+		return func(ctx context.Context, r *http.Request) (request interface{}, err error) {
+			defer func(begin time.Time) {
+				lvs := []string{"error", fmt.Sprint(err != nil)}
+				requests.With(lvs...).Add(1)
+				latency.With(lvs...).Observe(time.Since(begin).Seconds())
+			}(time.Now())
+			return next(ctx, r)
+		}
+	}
+}
+
+// DecodeTracingMiddleware traces decoding audio uploads.
+func DecodeTracingMiddleware(tracer trace.Tracer) DecodeMiddleware {
+	return func(next httptransport.DecodeRequestFunc) httptransport.DecodeRequestFunc {
+		return func(ctx context.Context, r *http.Request) (request interface{}, err error) {
+			_, span := tracer.Start(ctx, "voice.Decode", trace.WithAttributes(
+				attribute.String("http.content_type", r.Header.Get("Content-Type")),
+				attribute.Int64("http.request_content_length", r.ContentLength),
+			))
+			defer func() {
+				if err != nil {
+					span.RecordError(err)
+					span.SetStatus(codes.Error, err.Error())
+				}
+				span.End()
+			}()
+			return next(ctx, r)
+		}
+	}
+}
+
+// ChainDecodeMiddleware composes decode middlewares, outer runs first.
+func ChainDecodeMiddleware(outer DecodeMiddleware, others ...DecodeMiddleware) DecodeMiddleware {
+	return func(next httptransport.DecodeRequestFunc) httptransport.DecodeRequestFunc {
+		for i := len(others) - 1; i >= 0; i-- {
+			next = others[i](next)
+		}
+		return outer(next)
+	}
+}
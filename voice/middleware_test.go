@@ -0,0 +1,152 @@
+package voice
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/kit/metrics"
+	"golang.org/x/net/context"
+)
+
+// observations records what is counted or observed, by label values
+// joined as "name=value,name=value".
+type observations struct {
+	mtx    *sync.Mutex
+	values map[string][]float64
+	labels string
+}
+
+func newObservations() *observations {
+	return &observations{mtx: &sync.Mutex{}, values: make(map[string][]float64)}
+}
+
+func (o *observations) with(labelValues []string) *observations {
+	pairs := []string{}
+	for i := 0; i+1 < len(labelValues); i += 2 {
+		pairs = append(pairs, labelValues[i]+"="+labelValues[i+1])
+	}
+	return &observations{o.mtx, o.values, strings.Join(pairs, ",")}
+}
+
+func (o *observations) record(value float64) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	o.values[o.labels] = append(o.values[o.labels], value)
+}
+
+func (o *observations) get(labels string) []float64 {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	return o.values[labels]
+}
+
+// count is the number of observations with labels.
+func (o *observations) count(labels string) int {
+	return len(o.get(labels))
+}
+
+type counter struct{ *observations }
+
+func (c counter) With(labelValues ...string) metrics.Counter { return counter{c.with(labelValues)} }
+func (c counter) Add(delta float64)                          { c.record(delta) }
+
+type histogram struct{ *observations }
+
+func (h histogram) With(labelValues ...string) metrics.Histogram {
+	return histogram{h.with(labelValues)}
+}
+func (h histogram) Observe(value float64) { h.record(value) }
+
+// stubService answers every request with err.
+type stubService struct{ err error }
+
+func (s stubService) Voice(context.Context, VoiceRequest) (*VoiceResponse, error) {
+	return &VoiceResponse{}, s.err
+}
+func (s stubService) StreamVoice(context.Context, StreamVoiceRequest) (*VoiceResponse, error) {
+	return &VoiceResponse{}, s.err
+}
+func (s stubService) Text(context.Context, TextRequest) (*VoiceResponse, error) {
+	return &VoiceResponse{}, s.err
+}
+func (s stubService) SubmitJob(context.Context, JobRequest) (*Job, error) { return &Job{}, s.err }
+func (s stubService) Job(context.Context, string) (*Job, error)           { return &Job{}, s.err }
+
+func TestServiceInstrumentingMiddleware(t *testing.T) {
+	requests, latency := newObservations(), newObservations()
+	duration, size := newObservations(), newObservations()
+	instrument := ServiceInstrumentingMiddleware(counter{requests}, histogram{latency}, histogram{duration}, histogram{size})
+
+	ctx := context.Background()
+	// half a second of 16kHz audio
+	voice := VoiceRequest{Samples: make([]int16, 8000), SampleRate: 16000}
+	ok, failing := instrument(stubService{}), instrument(stubService{errors.New("NLU Error")})
+
+	ok.Voice(ctx, voice)
+	ok.Voice(ctx, voice)
+	failing.Voice(ctx, voice)
+	ok.SubmitJob(ctx, JobRequest{Voice: voice})
+	ok.StreamVoice(ctx, StreamVoiceRequest{})
+	failing.Text(ctx, TextRequest{Text: "turn on the lights"})
+
+	for labels, want := range map[string]int{
+		"method=Voice,error=false":       2,
+		"method=Voice,error=true":        1,
+		"method=SubmitJob,error=false":   1,
+		"method=StreamVoice,error=false": 1,
+		"method=Text,error=true":         1,
+		"method=Text,error=false":        0,
+	} {
+		if n := requests.count(labels); n != want {
+			t.Errorf("requests{%s} = %d, want %d", labels, n, want)
+		}
+		if n := latency.count(labels); n != want {
+			t.Errorf("latency{%s} observed %d times, want %d", labels, n, want)
+		}
+	}
+
+	// uploaded audio is measured, streamed audio isn't
+	for labels, want := range map[string]int{
+		"method=Voice":       3,
+		"method=SubmitJob":   1,
+		"method=StreamVoice": 0,
+	} {
+		if n := duration.count(labels); n != want {
+			t.Errorf("audio duration{%s} observed %d times, want %d", labels, n, want)
+		}
+		if n := size.count(labels); n != want {
+			t.Errorf("audio size{%s} observed %d times, want %d", labels, n, want)
+		}
+	}
+	if d := duration.get("method=Voice"); len(d) > 0 && d[0] != 0.5 {
+		t.Errorf("audio duration = %vs, want 0.5s", d[0])
+	}
+	if s := size.get("method=Voice"); len(s) > 0 && s[0] != 16000 {
+		t.Errorf("audio size = %v bytes, want 16000", s[0])
+	}
+}
+
+func TestDecodeInstrumentingMiddleware(t *testing.T) {
+	requests, latency := newObservations(), newObservations()
+	instrument := DecodeInstrumentingMiddleware(counter{requests}, histogram{latency})
+
+	ok := instrument(func(context.Context, *http.Request) (interface{}, error) { return VoiceRequest{}, nil })
+	failing := instrument(func(context.Context, *http.Request) (interface{}, error) { return nil, errors.New("Audio Error") })
+	r := httptest.NewRequest("POST", "/api/speech", nil)
+	ok(context.Background(), r)
+	failing(context.Background(), r)
+	failing(context.Background(), r)
+
+	for labels, want := range map[string]int{"error=false": 1, "error=true": 2} {
+		if n := requests.count(labels); n != want {
+			t.Errorf("requests{%s} = %d, want %d", labels, n, want)
+		}
+		if n := latency.count(labels); n != want {
+			t.Errorf("latency{%s} observed %d times, want %d", labels, n, want)
+		}
+	}
+}
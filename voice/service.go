@@ -2,53 +2,448 @@ package voice
 
 import (
 	"fmt"
-	"github.com/begizi/vch-server/gcp"
-	"github.com/begizi/vch-server/luis"
+	"github.com/begizi/vch-server/asr"
+	"github.com/begizi/vch-server/audio"
+	"github.com/begizi/vch-server/nlu"
 	"github.com/begizi/vch-server/tunnel"
+	"github.com/satori/go.uuid"
 	"golang.org/x/net/context"
+	"io"
+	"strings"
+	"time"
 )
 
 type Service interface {
 	Voice(ctx context.Context, voice VoiceRequest) (*VoiceResponse, error)
+	StreamVoice(ctx context.Context, voice StreamVoiceRequest) (*VoiceResponse, error)
+	Text(ctx context.Context, text TextRequest) (*VoiceResponse, error)
+	SubmitJob(ctx context.Context, job JobRequest) (*Job, error)
+	Job(ctx context.Context, id string) (*Job, error)
 }
 
-func NewBasicService(client *gcp.GCPSpeechConv, queue tunnel.Queue, luis *luis.Client) Service {
+// jobTimeout bounds how long a job may take, recognizing an hour of
+// audio takes a fraction of that.
+const jobTimeout = time.Hour
+
+type Config struct {
+	// MinConfidence is the least sure the recognizer can be of a
+	// transcript for it to be acted on. Transcripts it didn't score
+	// are acted on.
+	MinConfidence float32
+
+	// Language is recognized when a request doesn't ask for one.
+	Language string
+
+	// Phrases are sent to the recognizer as hints with every request,
+	// eg. the device and room names of the grammar.
+	Phrases []string
+
+	// Alternatives is how many transcripts the recognizer is asked for,
+	// runner ups are parsed when the most likely one isn't understood.
+	Alternatives int
+}
+
+func NewBasicService(recognizer asr.Recognizer, queue tunnel.Queue, parser nlu.Parser, jobs JobStore, config Config) Service {
 	return &basicService{
-		queue: queue,
-		gcp:   client,
-		luis:  luis,
+		queue:      queue,
+		recognizer: recognizer,
+		parser:     parser,
+		jobs:       jobs,
+		vad:        audio.DefaultVAD,
+		config:     config,
 	}
 }
 
 type basicService struct {
-	queue tunnel.Queue
-	gcp   *gcp.GCPSpeechConv
-	luis  *luis.Client
+	queue      tunnel.Queue
+	recognizer asr.Recognizer
+	parser     nlu.Parser
+	jobs       JobStore
+	vad        audio.VAD
+	config     Config
 }
 
-func processMissingEntities(intents []*luis.CompositeEntity) []*luis.CompositeEntity {
+func processMissingEntities(intents []*nlu.CompositeEntity) []*nlu.CompositeEntity {
 	return intents
 }
 
-func (s basicService) Voice(_ context.Context, voice VoiceRequest) (*VoiceResponse, error) {
-	transcript, err := s.gcp.Convert(voice.Audio, voice.SampleCount)
+func (s basicService) Voice(ctx context.Context, voice VoiceRequest) (*VoiceResponse, error) {
+	clip, err := s.prepare(&audio.Clip{Samples: voice.Samples, SampleRate: voice.SampleRate})
 	if err != nil {
 		return nil, err
 	}
 
-	resp, err := s.luis.Parse(transcript)
+	transcripts, err := s.recognizer.Recognize(ctx, audio.Linear16(clip.Samples), s.format(asr.Format{
+		Encoding:   asr.LINEAR16,
+		SampleRate: clip.SampleRate,
+		Language:   voice.Language,
+	}))
 	if err != nil {
-		return nil, fmt.Errorf("Luis Error: %v", err)
+		return nil, err
 	}
 
-	// Broadcast message with the data
-	err = s.queue.Broadcast(&tunnel.QueueMessage{
-		NLPResponse: tunnel.NLPResponse{
-			Intents: processMissingEntities(resp.CompositeEntities),
-		},
+	return s.command(ctx, transcripts, true, voice.Target)
+}
+
+func (s basicService) StreamVoice(ctx context.Context, voice StreamVoiceRequest) (*VoiceResponse, error) {
+	defer close(voice.Results)
+
+	voice.Format = s.format(voice.Format)
+
+	recognizer, ok := s.recognizer.(asr.StreamingRecognizer)
+	if !ok {
+		return s.bufferVoice(ctx, voice)
+	}
+
+	// silent streams never reach the recognizer. Only LINEAR16 can be
+	// checked without decoding, other encodings are sent as they come.
+	var held [][]byte
+	if voice.Format.Encoding == asr.LINEAR16 && voice.Format.SampleRate > 0 {
+		var err error
+		held, err = s.awaitSpeech(ctx, voice.Audio, voice.Format.SampleRate)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	stream, err := recognizer.StreamRecognize(ctx, voice.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	// send audio to the recognizer while reading results back
+	sendc := make(chan error, 1)
+	go func() {
+		for _, chunk := range held {
+			if err := stream.Send(chunk); err != nil {
+				sendc <- err
+				return
+			}
+		}
+		for chunk := range voice.Audio {
+			if err := stream.Send(chunk); err != nil {
+				sendc <- err
+				return
+			}
+		}
+		sendc <- stream.CloseSend()
+	}()
+
+	// long utterances are recognized as several final segments
+	var segments []asr.Transcript
+	for {
+		result, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if result.Final && len(result.Transcripts) > 0 {
+			segments = append(segments, result.Transcripts[0])
+		}
+		voice.Results <- *result
+	}
+
+	if err := <-sendc; err != nil {
+		return nil, err
+	}
+
+	return s.command(ctx, joinSegments(segments), true, voice.Target)
+}
+
+// Text handles a typed utterance as a transcript the recognizer is
+// completely sure of.
+func (s basicService) Text(ctx context.Context, text TextRequest) (*VoiceResponse, error) {
+	return s.command(ctx, []asr.Transcript{{Text: text.Text, Confidence: 1}}, true, text.Target)
+}
+
+func (s basicService) SubmitJob(ctx context.Context, job JobRequest) (*Job, error) {
+	// reject clips without speech before accepting the job
+	clip, err := s.prepare(&audio.Clip{Samples: job.Voice.Samples, SampleRate: job.Voice.SampleRate})
+	if err != nil {
+		return nil, err
+	}
+
+	// the long recognition gets the whole clip in one request
+	if limiter, ok := s.recognizer.(asr.AudioLimiter); ok && 2*len(clip.Samples) > limiter.MaxAudioSize() {
+		return nil, ErrAudioTooLong
+	}
+
+	now := time.Now()
+	j := &Job{
+		ID:      uuid.NewV4().String(),
+		Status:  JobPending,
+		Created: now,
+		Updated: now,
+		Lease:   now.Add(JobLease),
+	}
+	if err := s.jobs.Save(j); err != nil {
+		return nil, err
+	}
+
+	go s.runJob(*j, clip, job)
+
+	return j, nil
+}
+
+func (s basicService) Job(_ context.Context, id string) (*Job, error) {
+	return s.jobs.Get(id)
+}
+
+// runJob recognizes the clip of a submitted job and records the result.
+func (s basicService) runJob(job Job, clip *audio.Clip, req JobRequest) {
+	// the job outlives the request that submitted it
+	ctx, cancel := context.WithTimeout(context.Background(), jobTimeout)
+	defer cancel()
+
+	job.Status = JobRunning
+	job.Updated = time.Now()
+	job.Lease = job.Updated.Add(JobLease)
+	s.jobs.Save(&job)
+
+	type result struct {
+		resp *VoiceResponse
+		err  error
+	}
+	resultc := make(chan result, 1)
+	go func() {
+		resp, err := s.longVoice(ctx, clip, req)
+		resultc <- result{resp, err}
+	}()
+
+	// keep the job leased for as long as it runs
+	renew := time.NewTicker(JobLease / 3)
+	defer renew.Stop()
+	var r result
+	for running := true; running; {
+		select {
+		case r = <-resultc:
+			running = false
+		case <-renew.C:
+			job.Lease = time.Now().Add(JobLease)
+			s.jobs.Save(&job)
+		}
+	}
+
+	if r.err != nil {
+		job.Status = JobFailed
+		job.Error = r.err.Error()
+	} else {
+		job.Status = JobDone
+		job.Result = r.resp
+	}
+
+	// nobody is waiting on the job to report a store failure to, the
+	// job will be failed once its lease runs out
+	job.Updated = time.Now()
+	s.jobs.Save(&job)
+}
+
+func (s basicService) longVoice(ctx context.Context, clip *audio.Clip, req JobRequest) (*VoiceResponse, error) {
+	data := audio.Linear16(clip.Samples)
+	format := s.format(asr.Format{
+		Encoding:   asr.LINEAR16,
+		SampleRate: clip.SampleRate,
+		Language:   req.Voice.Language,
 	})
+
+	var transcripts []asr.Transcript
+	var err error
+	if recognizer, ok := s.recognizer.(asr.LongRecognizer); ok {
+		transcripts, err = recognizer.LongRecognize(ctx, data, format)
+	} else {
+		transcripts, err = s.recognizer.Recognize(ctx, data, format)
+	}
 	if err != nil {
 		return nil, err
 	}
-	return &VoiceResponse{200, resp.CompositeEntities}, nil
+
+	return s.command(ctx, transcripts, req.Broadcast, req.Voice.Target)
+}
+
+// joinSegments combines the final segments of a stream into a single
+// transcript, only as confident as its least confident segment.
+func joinSegments(segments []asr.Transcript) []asr.Transcript {
+	if len(segments) == 0 {
+		return nil
+	}
+
+	texts := []string{}
+	confidence := segments[0].Confidence
+	for _, segment := range segments {
+		texts = append(texts, segment.Text)
+		if segment.Confidence < confidence {
+			confidence = segment.Confidence
+		}
+	}
+
+	return []asr.Transcript{{
+		Text:       strings.Join(texts, " "),
+		Confidence: confidence,
+	}}
+}
+
+// maxLeadingSilence is how long a stream may go without speech before
+// it is rejected.
+const maxLeadingSilence = 10 * time.Second
+
+// awaitSpeech holds back the LINEAR16 audio of a stream until the VAD
+// hears speech in it, and returns the chunks held. Streams that end or
+// run past maxLeadingSilence without speech are rejected.
+func (s basicService) awaitSpeech(ctx context.Context, audioc <-chan []byte, rate uint32) ([][]byte, error) {
+	var held [][]byte
+	var data []byte
+	for {
+		select {
+		case chunk, ok := <-audioc:
+			if !ok {
+				return nil, ErrNoSpeech
+			}
+			held = append(held, chunk)
+			data = append(data, chunk...)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		clip := &audio.Clip{Samples: audio.Samples(data), SampleRate: rate}
+		if _, ok := s.vad.Trim(clip); ok {
+			return held, nil
+		}
+		if clip.Duration() > maxLeadingSilence.Seconds() {
+			return nil, ErrNoSpeech
+		}
+	}
+}
+
+// bufferVoice handles streamed audio for recognizers that can only
+// recognize a complete clip.
+func (s basicService) bufferVoice(ctx context.Context, voice StreamVoiceRequest) (*VoiceResponse, error) {
+	var data []byte
+	for chunk := range voice.Audio {
+		data = append(data, chunk...)
+	}
+
+	format := voice.Format
+	if format.Encoding == asr.LINEAR16 {
+		clip, err := s.prepare(&audio.Clip{Samples: audio.Samples(data), SampleRate: format.SampleRate})
+		if err != nil {
+			return nil, err
+		}
+		data = audio.Linear16(clip.Samples)
+		format.SampleRate = clip.SampleRate
+	}
+
+	transcripts, err := s.recognizer.Recognize(ctx, data, format)
+	if err != nil {
+		return nil, err
+	}
+	voice.Results <- asr.StreamResult{Transcripts: transcripts, Final: true}
+
+	return s.command(ctx, transcripts, true, voice.Target)
+}
+
+// format fills in the server defaults for a recognition.
+func (s basicService) format(format asr.Format) asr.Format {
+	if format.Language == "" {
+		format.Language = s.config.Language
+	}
+	format.Phrases = append(format.Phrases, s.config.Phrases...)
+	if format.Alternatives == 0 {
+		format.Alternatives = s.config.Alternatives
+	}
+	return format
+}
+
+// prepare trims the silence from a clip and converts it to the rate
+// the recognizer wants. Clips without speech are rejected.
+func (s basicService) prepare(clip *audio.Clip) (*audio.Clip, error) {
+	clip, ok := s.vad.Trim(clip)
+	if !ok {
+		return nil, ErrNoSpeech
+	}
+
+	// give the recognizer the rate it was trained on
+	if rater, ok := s.recognizer.(asr.SampleRater); ok && rater.SampleRate() != clip.SampleRate {
+		clip = clip.Resample(rater.SampleRate())
+	}
+
+	return clip, nil
+}
+
+// command parses the most likely transcript and, when broadcast is set,
+// broadcasts the result to the target's tunnel sessions. Runner up transcripts are parsed
+// when the top one doesn't match an intent, eg. "turn of the lights" for
+// "turn off the lights".
+func (s basicService) command(ctx context.Context, transcripts []asr.Transcript, broadcast bool, target tunnel.Target) (*VoiceResponse, error) {
+	// never act on a request the caller has given up on
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// the recognizer heard nothing it could make words of
+	heard := []asr.Transcript{}
+	for _, t := range transcripts {
+		if strings.TrimSpace(t.Text) != "" {
+			heard = append(heard, t)
+		}
+	}
+	if len(heard) == 0 {
+		return nil, ErrNoSpeech
+	}
+
+	// transcripts without a confidence just weren't scored
+	unsure := func(t asr.Transcript) bool {
+		return t.Confidence != 0 && t.Confidence < s.config.MinConfidence
+	}
+
+	top := heard[0]
+	if unsure(top) {
+		return &VoiceResponse{
+			Code:       200,
+			Transcript: top.Text,
+			Confidence: top.Confidence,
+			Message:    NotUnderstood,
+		}, nil
+	}
+
+	var transcript asr.Transcript
+	var resp *nlu.Result
+	for _, t := range heard {
+		// transcripts are ranked, so the rest are even less likely
+		if unsure(t) {
+			break
+		}
+
+		result, err := s.parser.Parse(ctx, t.Text)
+		if err != nil {
+			return nil, fmt.Errorf("NLU Error: %v", err)
+		}
+
+		if resp == nil || result.TopIntent != nil {
+			transcript, resp = t, result
+		}
+		if result.TopIntent != nil {
+			break
+		}
+	}
+
+	// Broadcast message with the data
+	if broadcast {
+		err := s.queue.Broadcast(ctx, tunnel.NewQueueMessage(tunnel.NLPResponse{
+			Intents:    processMissingEntities(resp.CompositeEntities),
+			Transcript: transcript.Text,
+			Confidence: transcript.Confidence,
+		}, target))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &VoiceResponse{
+		Code:       200,
+		Transcript: transcript.Text,
+		Confidence: transcript.Confidence,
+		Body:       resp.CompositeEntities,
+	}, nil
 }
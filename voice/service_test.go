@@ -0,0 +1,622 @@
+package voice_test
+
+import (
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/begizi/vch-server/asr"
+	"github.com/begizi/vch-server/audio"
+	"github.com/begizi/vch-server/inmem"
+	"github.com/begizi/vch-server/nlu"
+	"github.com/begizi/vch-server/tunnel"
+	"github.com/begizi/vch-server/voice"
+	"golang.org/x/net/context"
+)
+
+// recognizerFunc returns transcripts with their confidences as given,
+// unlike the fake recognizer.
+type recognizerFunc func() ([]asr.Transcript, error)
+
+func (f recognizerFunc) Recognize(_ context.Context, _ []byte, _ asr.Format) ([]asr.Transcript, error) {
+	return f()
+}
+
+func transcripts(ts ...asr.Transcript) recognizerFunc {
+	return func() ([]asr.Transcript, error) { return ts, nil }
+}
+
+func heard(text string, confidence float32) asr.Transcript {
+	return asr.Transcript{Text: text, Confidence: confidence}
+}
+
+// stubParser understands the utterances in intents and records every
+// utterance it is asked to parse.
+type stubParser struct {
+	intents map[string]string
+	parsed  []string
+}
+
+func (p *stubParser) Parse(_ context.Context, query string) (*nlu.Result, error) {
+	p.parsed = append(p.parsed, query)
+
+	result := &nlu.Result{Query: query}
+	if name, ok := p.intents[query]; ok {
+		result.TopIntent = &nlu.Intent{Name: name, Score: 1}
+		result.CompositeEntities = []*nlu.CompositeEntity{{Type: name, Value: query}}
+	}
+	return result, nil
+}
+
+func lights() *stubParser {
+	return &stubParser{intents: map[string]string{
+		"turn on the lights":  "TurnOn",
+		"turn off the lights": "TurnOff",
+	}}
+}
+
+// newService returns the service along with the messages it broadcasts.
+func newService(t *testing.T, recognizer asr.Recognizer, parser nlu.Parser) (voice.Service, tunnel.ReceiveC) {
+	queue := inmem.NewInMemQueue(inmem.DefaultQueueConfig)
+	t.Cleanup(func() { queue.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	broadcasts, err := queue.Listen(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := voice.NewBasicService(recognizer, queue, parser, inmem.NewInMemJobStore(), voice.Config{
+		MinConfidence: 0.5,
+		Language:      "en-US",
+		Alternatives:  3,
+	})
+	return s, broadcasts
+}
+
+// utterance is half a second of tone between half seconds of silence.
+func utterance() voice.VoiceRequest {
+	samples := make([]int16, 24000)
+	for i := 8000; i < 16000; i++ {
+		samples[i] = int16(8000 * math.Sin(2*math.Pi*300*float64(i)/16000))
+	}
+	return voice.VoiceRequest{Samples: samples, SampleRate: 16000}
+}
+
+func broadcast(t *testing.T, broadcasts tunnel.ReceiveC) *tunnel.QueueMessage {
+	t.Helper()
+	select {
+	case m := <-broadcasts:
+		return m
+	case <-time.After(time.Second):
+		t.Fatal("nothing was broadcast")
+		return nil
+	}
+}
+
+func noBroadcast(t *testing.T, broadcasts tunnel.ReceiveC) {
+	t.Helper()
+	select {
+	case m := <-broadcasts:
+		t.Errorf("broadcast %+v, want nothing broadcast", m.NLPResponse)
+	default:
+	}
+}
+
+func TestVoice(t *testing.T) {
+	parser := lights()
+	s, broadcasts := newService(t, asr.NewFakeRecognizer("turn on the lights", "turn of the lights"), parser)
+
+	req := utterance()
+	req.Target = tunnel.Target{DeviceID: "lamp-1"}
+	resp, err := s.Voice(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the most likely transcript is parsed
+	if len(parser.parsed) != 1 || parser.parsed[0] != "turn on the lights" {
+		t.Errorf("parsed %q, want the top transcript", parser.parsed)
+	}
+	if resp.Code != 200 || len(resp.Body) != 1 || resp.Body[0].Type != "TurnOn" {
+		t.Errorf("got %+v, want the TurnOn entities", resp)
+	}
+	if resp.Transcript != "turn on the lights" || resp.Confidence != 1 || resp.Message != "" {
+		t.Errorf("got %+v, want the transcript understood", resp)
+	}
+
+	m := broadcast(t, broadcasts)
+	if len(m.NLPResponse.Intents) != 1 || m.NLPResponse.Intents[0].Type != "TurnOn" {
+		t.Errorf("broadcast %+v, want the TurnOn entities", m.NLPResponse)
+	}
+	if m.NLPResponse.Transcript != "turn on the lights" || m.NLPResponse.Confidence != 1 {
+		t.Errorf("broadcast %+v, want the transcript", m.NLPResponse)
+	}
+	if m.Target.DeviceID != "lamp-1" {
+		t.Errorf("broadcast to %+v, want lamp-1", m.Target)
+	}
+}
+
+func TestVoiceRecognizerError(t *testing.T) {
+	failed := errors.New("recognizer unavailable")
+	parser := lights()
+	s, broadcasts := newService(t, recognizerFunc(func() ([]asr.Transcript, error) {
+		return nil, failed
+	}), parser)
+
+	if _, err := s.Voice(context.Background(), utterance()); err != failed {
+		t.Errorf("err = %v, want %v", err, failed)
+	}
+	if len(parser.parsed) > 0 {
+		t.Errorf("parsed %q after the recognizer failed", parser.parsed)
+	}
+	noBroadcast(t, broadcasts)
+}
+
+func TestText(t *testing.T) {
+	parser := lights()
+	s, broadcasts := newService(t, asr.NewFakeRecognizer(), parser)
+
+	resp, err := s.Text(context.Background(), voice.TextRequest{
+		Text:   "turn off the lights",
+		Target: tunnel.Target{Labels: map[string]string{"room": "kitchen"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parser.parsed) != 1 || parser.parsed[0] != "turn off the lights" {
+		t.Errorf("parsed %q, want the text", parser.parsed)
+	}
+	if resp.Transcript != "turn off the lights" || resp.Confidence != 1 {
+		t.Errorf("got %+v, want the text with full confidence", resp)
+	}
+	if len(resp.Body) != 1 || resp.Body[0].Type != "TurnOff" {
+		t.Errorf("body = %v, want the TurnOff entities", resp.Body)
+	}
+
+	m := broadcast(t, broadcasts)
+	if m.NLPResponse.Transcript != "turn off the lights" {
+		t.Errorf("broadcast %+v, want the text", m.NLPResponse)
+	}
+	if m.Target.Labels["room"] != "kitchen" {
+		t.Errorf("broadcast to %+v, want the kitchen", m.Target)
+	}
+}
+
+func TestNoSpeech(t *testing.T) {
+	t.Run("silence", func(t *testing.T) {
+		recognized := false
+		recognizer := recognizerFunc(func() ([]asr.Transcript, error) {
+			recognized = true
+			return nil, nil
+		})
+		s, broadcasts := newService(t, recognizer, lights())
+
+		_, err := s.Voice(context.Background(), voice.VoiceRequest{Samples: make([]int16, 16000), SampleRate: 16000})
+		if err != voice.ErrNoSpeech {
+			t.Errorf("err = %v, want ErrNoSpeech", err)
+		}
+		if recognized {
+			t.Error("silence was sent to the recognizer")
+		}
+		noBroadcast(t, broadcasts)
+	})
+
+	for _, tc := range []struct {
+		name       string
+		recognizer asr.Recognizer
+	}{
+		{"no transcripts", transcripts()},
+		{"empty transcripts", transcripts(heard("", 0.9), heard("  ", 0))},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, broadcasts := newService(t, tc.recognizer, lights())
+
+			if _, err := s.Voice(context.Background(), utterance()); err != voice.ErrNoSpeech {
+				t.Errorf("err = %v, want ErrNoSpeech", err)
+			}
+			noBroadcast(t, broadcasts)
+		})
+	}
+}
+
+func TestFakeRecognizer(t *testing.T) {
+	transcripts, err := asr.NewFakeRecognizer("turn on the lights", "turn of the lights").Recognize(context.Background(), nil, asr.Format{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transcripts) != 2 || transcripts[0].Text != "turn on the lights" || transcripts[1].Text != "turn of the lights" {
+		t.Fatalf("got %+v, want the transcripts in order", transcripts)
+	}
+	if transcripts[0].Confidence != 1 || transcripts[1].Confidence != 0.9 {
+		t.Errorf("confidences %v and %v, want 1 and 0.9", transcripts[0].Confidence, transcripts[1].Confidence)
+	}
+}
+
+func TestMinConfidence(t *testing.T) {
+	parser := lights()
+	s, broadcasts := newService(t, transcripts(heard("turn on the lights", 0.3)), parser)
+
+	resp, err := s.Voice(context.Background(), utterance())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Message != voice.NotUnderstood {
+		t.Errorf("message = %q, want %q", resp.Message, voice.NotUnderstood)
+	}
+	if resp.Transcript != "turn on the lights" || resp.Confidence != 0.3 {
+		t.Errorf("got %+v, want what was heard", resp)
+	}
+	if len(parser.parsed) > 0 {
+		t.Errorf("parsed %q, want nothing acted on", parser.parsed)
+	}
+	noBroadcast(t, broadcasts)
+}
+
+func TestRunnerUp(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		recognizer asr.Recognizer
+		transcript string
+		confidence float32
+		parsed     int
+	}{
+		{
+			name:       "top understood",
+			recognizer: asr.NewFakeRecognizer("turn on the lights", "turn off the lights"),
+			transcript: "turn on the lights",
+			confidence: 1,
+			parsed:     1,
+		},
+		{
+			name:       "runner up understood",
+			recognizer: asr.NewFakeRecognizer("turn of the lights", "turn off the lights"),
+			transcript: "turn off the lights",
+			confidence: 0.9,
+			parsed:     2,
+		},
+		{
+			name:       "unscored runner up",
+			recognizer: transcripts(heard("turn of the lights", 0.8), heard("turn of the light", 0), heard("turn off the lights", 0)),
+			transcript: "turn off the lights",
+			confidence: 0,
+			parsed:     3,
+		},
+		{
+			name:       "unscored top",
+			recognizer: transcripts(heard("turn on the lights", 0), heard("turn of the lights", 0)),
+			transcript: "turn on the lights",
+			confidence: 0,
+			parsed:     1,
+		},
+		{
+			name:       "unscored top not understood",
+			recognizer: transcripts(heard("turn of the lights", 0), heard("turn off the lights", 0)),
+			transcript: "turn off the lights",
+			confidence: 0,
+			parsed:     2,
+		},
+		{
+			name:       "runner up below the minimum",
+			recognizer: transcripts(heard("turn of the lights", 0.8), heard("turn off the lights", 0.4)),
+			transcript: "turn of the lights",
+			confidence: 0.8,
+			parsed:     1,
+		},
+		{
+			name:       "nothing understood",
+			recognizer: asr.NewFakeRecognizer("turn of the lights", "turn of the light"),
+			transcript: "turn of the lights",
+			confidence: 1,
+			parsed:     2,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			parser := lights()
+			s, broadcasts := newService(t, tc.recognizer, parser)
+
+			resp, err := s.Voice(context.Background(), utterance())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Transcript != tc.transcript || resp.Confidence != tc.confidence {
+				t.Errorf("got %q (%v), want %q (%v)", resp.Transcript, resp.Confidence, tc.transcript, tc.confidence)
+			}
+			if len(parser.parsed) != tc.parsed {
+				t.Errorf("parsed %q, want %d transcripts parsed", parser.parsed, tc.parsed)
+			}
+
+			// the best guess is broadcast even when it isn't understood
+			if m := broadcast(t, broadcasts); m.NLPResponse.Transcript != tc.transcript {
+				t.Errorf("broadcast %q, want %q", m.NLPResponse.Transcript, tc.transcript)
+			}
+		})
+	}
+}
+
+// streamRecognizer plays results to every stream once it has read all
+// of the audio, and records how much audio it was sent.
+type streamRecognizer struct {
+	asr.Recognizer
+	results []asr.StreamResult
+	opened  int
+	sent    int
+}
+
+func (r *streamRecognizer) StreamRecognize(_ context.Context, _ asr.Format) (asr.Stream, error) {
+	r.opened++
+	return &recognizerStream{r, make(chan struct{}), r.results}, nil
+}
+
+type recognizerStream struct {
+	recognizer *streamRecognizer
+	closed     chan struct{}
+	results    []asr.StreamResult
+}
+
+func (s *recognizerStream) Send(audio []byte) error {
+	s.recognizer.sent += len(audio)
+	return nil
+}
+
+func (s *recognizerStream) CloseSend() error {
+	close(s.closed)
+	return nil
+}
+
+func (s *recognizerStream) Recv() (*asr.StreamResult, error) {
+	<-s.closed
+	if len(s.results) == 0 {
+		return nil, io.EOF
+	}
+	result := s.results[0]
+	s.results = s.results[1:]
+	return &result, nil
+}
+
+// streamSamples streams samples in 100ms chunks and collects the results
+// sent back.
+func streamSamples(s voice.Service, samples []int16) (*voice.VoiceResponse, []asr.StreamResult, error) {
+	audioc := make(chan []byte)
+	go func() {
+		defer close(audioc)
+		for i := 0; i < len(samples); i += 1600 {
+			audioc <- audio.Linear16(samples[i : i+1600])
+		}
+	}()
+	return streamAudio(s, audioc)
+}
+
+func streamAudio(s voice.Service, audioc <-chan []byte) (*voice.VoiceResponse, []asr.StreamResult, error) {
+	resultc := make(chan asr.StreamResult)
+
+	resultsc := make(chan []asr.StreamResult)
+	go func() {
+		results := []asr.StreamResult{}
+		for result := range resultc {
+			results = append(results, result)
+		}
+		resultsc <- results
+	}()
+
+	resp, err := s.StreamVoice(context.Background(), voice.StreamVoiceRequest{
+		Format:  asr.Format{Encoding: asr.LINEAR16, SampleRate: 16000},
+		Audio:   audioc,
+		Results: resultc,
+	})
+	return resp, <-resultsc, err
+}
+
+func TestStreamVoice(t *testing.T) {
+	results := []asr.StreamResult{
+		{Transcripts: []asr.Transcript{heard("turn", 0)}},
+		{Transcripts: []asr.Transcript{heard("turn on", 0.9)}, Final: true},
+		{Transcripts: []asr.Transcript{heard("the", 0)}},
+		{Transcripts: []asr.Transcript{heard("the lights", 0.7), heard("the light", 0)}, Final: true},
+	}
+	recognizer := &streamRecognizer{Recognizer: asr.NewFakeRecognizer(), results: results}
+	parser := lights()
+	s, broadcasts := newService(t, recognizer, parser)
+
+	resp, sent, err := streamSamples(s, utterance().Samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// segments are joined, as sure as the least sure of them
+	if resp.Transcript != "turn on the lights" || resp.Confidence != 0.7 {
+		t.Errorf("got %q (%v), want %q (0.7)", resp.Transcript, resp.Confidence, "turn on the lights")
+	}
+	if len(parser.parsed) != 1 || parser.parsed[0] != "turn on the lights" {
+		t.Errorf("parsed %q, want the joined transcript", parser.parsed)
+	}
+	if len(resp.Body) != 1 || resp.Body[0].Type != "TurnOn" {
+		t.Errorf("body = %v, want the TurnOn entities", resp.Body)
+	}
+	if !reflect.DeepEqual(sent, results) {
+		t.Errorf("sent results %v, want the interim and final results %v", sent, results)
+	}
+	if recognizer.sent != 2*len(utterance().Samples) {
+		t.Errorf("recognizer was sent %d bytes, want the whole utterance", recognizer.sent)
+	}
+	if m := broadcast(t, broadcasts); m.NLPResponse.Transcript != "turn on the lights" {
+		t.Errorf("broadcast %q, want the joined transcript", m.NLPResponse.Transcript)
+	}
+}
+
+func TestStreamVoiceSilence(t *testing.T) {
+	t.Run("silent stream", func(t *testing.T) {
+		recognizer := &streamRecognizer{Recognizer: asr.NewFakeRecognizer()}
+		s, broadcasts := newService(t, recognizer, lights())
+
+		_, sent, err := streamSamples(s, make([]int16, 48000))
+		if err != voice.ErrNoSpeech {
+			t.Errorf("err = %v, want ErrNoSpeech", err)
+		}
+		if recognizer.opened != 0 {
+			t.Error("silence was streamed to the recognizer")
+		}
+		if len(sent) != 0 {
+			t.Errorf("sent results %v for silence", sent)
+		}
+		noBroadcast(t, broadcasts)
+	})
+
+	t.Run("endless silence", func(t *testing.T) {
+		recognizer := &streamRecognizer{Recognizer: asr.NewFakeRecognizer()}
+		s, _ := newService(t, recognizer, lights())
+
+		// the client never stops sending, the service gives up on it
+		stop := make(chan struct{})
+		defer close(stop)
+		audioc := make(chan []byte)
+		go func() {
+			for {
+				select {
+				case audioc <- make([]byte, 3200):
+				case <-stop:
+					return
+				}
+			}
+		}()
+
+		errc := make(chan error, 1)
+		go func() {
+			_, _, err := streamAudio(s, audioc)
+			errc <- err
+		}()
+		select {
+		case err := <-errc:
+			if err != voice.ErrNoSpeech {
+				t.Errorf("err = %v, want ErrNoSpeech", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the silent stream was never ended")
+		}
+		if recognizer.opened != 0 {
+			t.Error("silence was streamed to the recognizer")
+		}
+	})
+}
+
+// formatRecognizer records the format it was asked to recognize.
+type formatRecognizer struct {
+	asr.Recognizer
+	format asr.Format
+}
+
+func (r *formatRecognizer) Recognize(ctx context.Context, audio []byte, format asr.Format) ([]asr.Transcript, error) {
+	r.format = format
+	return r.Recognizer.Recognize(ctx, audio, format)
+}
+
+func TestDefaultLanguage(t *testing.T) {
+	for _, tc := range []struct {
+		language string
+		want     string
+	}{
+		{"", "en-US"},
+		{"fr-FR", "fr-FR"},
+	} {
+		recognizer := &formatRecognizer{Recognizer: asr.NewFakeRecognizer("turn on the lights")}
+		s, _ := newService(t, recognizer, lights())
+
+		req := utterance()
+		req.Language = tc.language
+		if _, err := s.Voice(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		if recognizer.format.Language != tc.want {
+			t.Errorf("asked for %q: recognized %q, want %q", tc.language, recognizer.format.Language, tc.want)
+		}
+	}
+}
+
+// limitedRecognizer only takes max bytes of audio.
+type limitedRecognizer struct {
+	asr.Recognizer
+	max int
+}
+
+func (r limitedRecognizer) MaxAudioSize() int {
+	return r.max
+}
+
+func TestSubmitJobTooLong(t *testing.T) {
+	// the trimmed utterance is 0.9 seconds, 28800 bytes of LINEAR16
+	for _, tc := range []struct {
+		max int
+		err error
+	}{
+		{28800, nil},
+		{28799, voice.ErrAudioTooLong},
+	} {
+		s, _ := newService(t, limitedRecognizer{asr.NewFakeRecognizer("turn on the lights"), tc.max}, lights())
+
+		_, err := s.SubmitJob(context.Background(), voice.JobRequest{Voice: utterance()})
+		if err != tc.err {
+			t.Errorf("limit of %d bytes: err = %v, want %v", tc.max, err, tc.err)
+		}
+	}
+}
+
+func TestFailOrphanedJobs(t *testing.T) {
+	jobs := inmem.NewInMemJobStore()
+	now := time.Now()
+	leased, expired := now.Add(time.Minute), now.Add(-time.Second)
+	for _, job := range []*voice.Job{
+		{ID: "leased", Status: voice.JobRunning, Updated: now.Add(-2 * time.Hour), Lease: leased},
+		{ID: "leased pending", Status: voice.JobPending, Updated: now, Lease: leased},
+		{ID: "expired", Status: voice.JobRunning, Updated: now, Lease: expired},
+		{ID: "expired pending", Status: voice.JobPending, Updated: now, Lease: expired},
+		{ID: "never leased", Status: voice.JobRunning, Updated: now},
+		{ID: "expired done", Status: voice.JobDone, Updated: now, Lease: expired},
+	} {
+		if err := jobs.Save(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := voice.FailOrphanedJobs(jobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("failed %d jobs, want 3", n)
+	}
+
+	for id, want := range map[string]voice.JobStatus{
+		"leased":          voice.JobRunning,
+		"leased pending":  voice.JobPending,
+		"expired":         voice.JobFailed,
+		"expired pending": voice.JobFailed,
+		"never leased":    voice.JobFailed,
+		"expired done":    voice.JobDone,
+	} {
+		job, err := jobs.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status != want {
+			t.Errorf("job %q is %s, want %s", id, job.Status, want)
+		}
+		if want == voice.JobFailed && job.Error == "" {
+			t.Errorf("job %q failed without an error", id)
+		}
+	}
+}
+
+func TestSubmitJobLease(t *testing.T) {
+	s, _ := newService(t, asr.NewFakeRecognizer("turn on the lights"), lights())
+
+	job, err := s.SubmitJob(context.Background(), voice.JobRequest{Voice: utterance()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !job.Lease.After(time.Now()) {
+		t.Errorf("lease = %v, want the job leased", job.Lease)
+	}
+}
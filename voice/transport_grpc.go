@@ -0,0 +1,164 @@
+package voice
+
+import (
+	"io"
+	"strings"
+
+	"github.com/begizi/vch-server/asr"
+	"github.com/begizi/vch-server/pb"
+	"github.com/begizi/vch-server/tunnel"
+	"github.com/go-kit/kit/log"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// VoiceServer handles the Recognize and Text RPCs of the VCH service.
+type VoiceServer struct {
+	endpoints Endpoints
+	logger    log.Logger
+}
+
+func MakeVoiceGRPCServer(endpoints Endpoints, logger log.Logger) *VoiceServer {
+	return &VoiceServer{
+		endpoints: endpoints,
+		logger:    logger,
+	}
+}
+
+func encodingFromTransport(e pb.RecognitionConfig_Encoding) asr.Encoding {
+	switch e {
+	case pb.RecognitionConfig_FLAC:
+		return asr.FLAC
+	case pb.RecognitionConfig_MULAW:
+		return asr.MULAW
+	default:
+		return asr.LINEAR16
+	}
+}
+
+func transcriptToTransport(result asr.StreamResult) *pb.Transcript {
+	transcript := &pb.Transcript{Final: result.Final}
+	if len(result.Transcripts) > 0 {
+		transcript.Text = result.Transcripts[0].Text
+		transcript.Confidence = result.Transcripts[0].Confidence
+	}
+	return transcript
+}
+
+// Recognize transport handler
+func (s *VoiceServer) Recognize(stream pb.VCH_RecognizeServer) error {
+	ctx := stream.Context()
+
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	config := req.GetConfig()
+	if config == nil {
+		return grpc.Errorf(codes.InvalidArgument, "first request must carry the recognition config")
+	}
+
+	// cancelled when the stream breaks before the client closes its side
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	audioc := make(chan []byte)
+	resultc := make(chan asr.StreamResult)
+
+	// read audio chunks until the client closes its side of the stream
+	readc := make(chan error, 1)
+	go func() {
+		defer close(audioc)
+		for {
+			req, err := stream.Recv()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				// never act on a partial utterance
+				readc <- err
+				cancel()
+				return
+			}
+			audio := req.GetAudio()
+			if len(audio) == 0 {
+				continue
+			}
+			select {
+			case audioc <- audio:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// send transcripts back while the service is still recognizing
+	sentc := make(chan struct{})
+	go func() {
+		defer close(sentc)
+		for result := range resultc {
+			err := stream.Send(&pb.RecognizeResponse{
+				Event: &pb.RecognizeResponse_Transcript{
+					Transcript: transcriptToTransport(result),
+				},
+			})
+			if err != nil {
+				s.logger.Log("msg", "Failed to send transcript", "err", err)
+			}
+		}
+	}()
+
+	resp, err := s.endpoints.StreamVoice(ctx, StreamVoiceRequest{
+		Format: asr.Format{
+			Encoding:   encodingFromTransport(config.Encoding),
+			SampleRate: config.SampleRate,
+		},
+		Audio:   audioc,
+		Results: resultc,
+		Target:  tunnel.TargetFromTransport(config.Target),
+	})
+	<-sentc
+	if err == ErrNoSpeech {
+		return grpc.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	if err != nil {
+		select {
+		case readErr := <-readc:
+			return readErr
+		default:
+		}
+		return err
+	}
+
+	return stream.Send(&pb.RecognizeResponse{
+		Event: &pb.RecognizeResponse_Response{
+			Response: tunnel.NLPResponseToTransport(tunnel.NLPResponse{
+				Intents:    resp.Body,
+				Transcript: resp.Transcript,
+				Confidence: resp.Confidence,
+			}),
+		},
+	})
+}
+
+// Text transport handler
+func (s *VoiceServer) Text(ctx context.Context, req *pb.TextRequest) (*pb.NLPResponse, error) {
+	if strings.TrimSpace(req.Text) == "" {
+		return nil, grpc.Errorf(codes.InvalidArgument, "text is required")
+	}
+
+	resp, err := s.endpoints.Text(ctx, TextRequest{
+		Text:   req.Text,
+		Target: tunnel.TargetFromTransport(req.Target),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return tunnel.NLPResponseToTransport(tunnel.NLPResponse{
+		Intents:    resp.Body,
+		Transcript: resp.Transcript,
+		Confidence: resp.Confidence,
+	}), nil
+}
@@ -0,0 +1,233 @@
+package voice_test
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/begizi/vch-server/asr"
+	"github.com/begizi/vch-server/audio"
+	"github.com/begizi/vch-server/pb"
+	"github.com/begizi/vch-server/tunnel"
+	"github.com/begizi/vch-server/voice"
+	"github.com/go-kit/kit/log"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// recognizeStream plays requests to the Recognize handler and records
+// its responses. Once the requests run out Recv returns err.
+type recognizeStream struct {
+	grpc.ServerStream
+	ctx      context.Context
+	requests []*pb.RecognizeRequest
+	err      error
+	sent     []*pb.RecognizeResponse
+}
+
+func (s *recognizeStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *recognizeStream) Recv() (*pb.RecognizeRequest, error) {
+	if len(s.requests) == 0 {
+		return nil, s.err
+	}
+	req := s.requests[0]
+	s.requests = s.requests[1:]
+	return req, nil
+}
+
+func (s *recognizeStream) Send(resp *pb.RecognizeResponse) error {
+	s.sent = append(s.sent, resp)
+	return nil
+}
+
+func configRequest(target *pb.Target) *pb.RecognizeRequest {
+	return &pb.RecognizeRequest{Request: &pb.RecognizeRequest_Config{Config: &pb.RecognitionConfig{
+		Encoding:   pb.RecognitionConfig_LINEAR16,
+		SampleRate: 16000,
+		Target:     target,
+	}}}
+}
+
+// audioRequests splits samples into 100ms audio requests.
+func audioRequests(samples []int16) []*pb.RecognizeRequest {
+	reqs := []*pb.RecognizeRequest{}
+	for len(samples) > 0 {
+		n := 1600
+		if n > len(samples) {
+			n = len(samples)
+		}
+		reqs = append(reqs, &pb.RecognizeRequest{Request: &pb.RecognizeRequest_Audio{Audio: audio.Linear16(samples[:n])}})
+		samples = samples[n:]
+	}
+	return reqs
+}
+
+func TestGRPCRecognize(t *testing.T) {
+	s, broadcasts := newService(t, asr.NewFakeRecognizer("turn on the lights"), lights())
+	server := voice.MakeVoiceGRPCServer(voice.Endpoints{
+		StreamVoiceEndpoint: voice.MakeStreamVoiceEndpoint(s),
+	}, log.NewNopLogger())
+
+	stream := &recognizeStream{
+		ctx:      context.Background(),
+		requests: append([]*pb.RecognizeRequest{configRequest(&pb.Target{DeviceId: "lamp-1"})}, audioRequests(utterance().Samples)...),
+		err:      io.EOF,
+	}
+	if err := server.Recognize(stream); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stream.sent) != 2 {
+		t.Fatalf("sent %d responses, want a transcript and the result", len(stream.sent))
+	}
+	transcript := stream.sent[0].GetTranscript()
+	if transcript == nil || !transcript.Final || transcript.Text != "turn on the lights" {
+		t.Errorf("transcript = %v, want the final transcript", transcript)
+	}
+	resp := stream.sent[1].GetResponse()
+	if resp == nil || resp.Transcript != "turn on the lights" || len(resp.Intents) != 1 {
+		t.Errorf("response = %v, want the parsed intent", resp)
+	}
+
+	m := broadcast(t, broadcasts)
+	if m.Target.DeviceID != "lamp-1" {
+		t.Errorf("broadcast to %q, want lamp-1", m.Target.DeviceID)
+	}
+}
+
+func TestGRPCRecognizeConfigFirst(t *testing.T) {
+	server := voice.MakeVoiceGRPCServer(voice.Endpoints{}, log.NewNopLogger())
+
+	stream := &recognizeStream{
+		ctx:      context.Background(),
+		requests: audioRequests(make([]int16, 1600)),
+		err:      io.EOF,
+	}
+	err := server.Recognize(stream)
+	if grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("err = %v, want InvalidArgument", err)
+	}
+}
+
+func TestGRPCRecognizeNoSpeech(t *testing.T) {
+	s, broadcasts := newService(t, asr.NewFakeRecognizer("turn on the lights"), lights())
+	server := voice.MakeVoiceGRPCServer(voice.Endpoints{
+		StreamVoiceEndpoint: voice.MakeStreamVoiceEndpoint(s),
+	}, log.NewNopLogger())
+
+	stream := &recognizeStream{
+		ctx:      context.Background(),
+		requests: append([]*pb.RecognizeRequest{configRequest(nil)}, audioRequests(make([]int16, 16000))...),
+		err:      io.EOF,
+	}
+	err := server.Recognize(stream)
+	if grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("err = %v, want InvalidArgument", err)
+	}
+	noBroadcast(t, broadcasts)
+}
+
+func TestGRPCRecognizeAbort(t *testing.T) {
+	broken := errors.New("connection reset")
+
+	for _, tc := range []struct {
+		name      string
+		err       error
+		cancelled bool
+	}{
+		{"client closes", io.EOF, false},
+		{"stream breaks", broken, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var chunks int
+			var cancelled bool
+			server := voice.MakeVoiceGRPCServer(voice.Endpoints{
+				StreamVoiceEndpoint: func(ctx context.Context, request interface{}) (interface{}, error) {
+					req := request.(voice.StreamVoiceRequest)
+					defer close(req.Results)
+
+					for range req.Audio {
+						chunks++
+					}
+					cancelled = ctx.Err() != nil
+					if err := ctx.Err(); err != nil {
+						return nil, err
+					}
+					return &voice.VoiceResponse{Code: 200, Transcript: "turn on the lights"}, nil
+				},
+			}, log.NewNopLogger())
+
+			stream := &recognizeStream{
+				ctx:      context.Background(),
+				requests: append([]*pb.RecognizeRequest{configRequest(nil)}, audioRequests(make([]int16, 3200))...),
+				err:      tc.err,
+			}
+			err := server.Recognize(stream)
+
+			if chunks != 2 {
+				t.Errorf("endpoint read %d chunks, want 2", chunks)
+			}
+			if cancelled != tc.cancelled {
+				t.Errorf("cancelled = %v, want %v", cancelled, tc.cancelled)
+			}
+			if tc.cancelled {
+				if err != broken {
+					t.Errorf("err = %v, want %v", err, broken)
+				}
+				if len(stream.sent) != 0 {
+					t.Errorf("sent %d responses for an aborted stream", len(stream.sent))
+				}
+			} else if err != nil {
+				t.Errorf("err = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestGRPCText(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		req    *pb.TextRequest
+		code   codes.Code
+		target tunnel.Target
+	}{
+		{"text", &pb.TextRequest{Text: "turn on the lights"}, codes.OK, tunnel.Target{}},
+		{"device", &pb.TextRequest{Text: "turn on the lights", Target: &pb.Target{DeviceId: "lamp-1"}}, codes.OK, tunnel.Target{DeviceID: "lamp-1"}},
+		{"labels", &pb.TextRequest{Text: "turn on the lights", Target: &pb.Target{Labels: map[string]string{"room": "kitchen"}}}, codes.OK, tunnel.Target{Labels: map[string]string{"room": "kitchen"}}},
+		{"empty text", &pb.TextRequest{}, codes.InvalidArgument, tunnel.Target{}},
+		{"blank text", &pb.TextRequest{Text: " \t"}, codes.InvalidArgument, tunnel.Target{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got *voice.TextRequest
+			server := voice.MakeVoiceGRPCServer(voice.Endpoints{
+				TextEndpoint: func(ctx context.Context, request interface{}) (interface{}, error) {
+					req := request.(voice.TextRequest)
+					got = &req
+					return &voice.VoiceResponse{Code: 200, Transcript: req.Text, Confidence: 1}, nil
+				},
+			}, log.NewNopLogger())
+
+			resp, err := server.Text(context.Background(), tc.req)
+			if grpc.Code(err) != tc.code {
+				t.Fatalf("err = %v, want %v", err, tc.code)
+			}
+			if tc.code != codes.OK {
+				if got != nil {
+					t.Errorf("endpoint called with %+v, want the request rejected", got)
+				}
+				return
+			}
+			if got == nil || got.Text != "turn on the lights" || !reflect.DeepEqual(got.Target, tc.target) {
+				t.Errorf("endpoint called with %+v, want the text for %+v", got, tc.target)
+			}
+			if resp.Transcript != "turn on the lights" || resp.Confidence != 1 {
+				t.Errorf("response = %v, want the transcript", resp)
+			}
+		})
+	}
+}
@@ -4,33 +4,68 @@ import (
 	"encoding/json"
 	"net/http"
 
-	"bytes"
 	"fmt"
-	"github.com/begizi/wav"
+	"github.com/begizi/vch-server/audio"
+	"github.com/begizi/vch-server/tunnel"
 	"github.com/go-kit/kit/log"
 	httptransport "github.com/go-kit/kit/transport/http"
 	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/net/context"
 	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
 )
 
-func MakeVoiceHTTPServer(ctx context.Context, endpoints Endpoints, logger log.Logger) http.Handler {
+// MakeVoiceHTTPServer serves the endpoints over HTTP, decoding uploaded
+// audio through decode.
+func MakeVoiceHTTPServer(ctx context.Context, endpoints Endpoints, decode DecodeMiddleware, logger log.Logger) http.Handler {
 	options := []httptransport.ServerOption{
 		httptransport.ServerErrorEncoder(errorEncoder),
 		httptransport.ServerErrorLogger(logger),
+		httptransport.ServerBefore(traceFromRequest),
 	}
 	m := mux.NewRouter()
 	transportHandleFunc := httptransport.NewServer(
 		ctx,
 		endpoints.VoiceEndpoint,
-		DecodeHTTPVoiceRequest,
+		decode(DecodeHTTPVoiceRequest),
 		EncodeHTTPVoiceResponse,
 		options...,
 	)
 	m.Handle("/api/speech", transportHandleFunc)
+	m.Handle("/api/speech/stream", MakeVoiceWebSocketHandler(endpoints, logger))
+	m.Handle("/api/speech/jobs", httptransport.NewServer(
+		ctx,
+		endpoints.SubmitJobEndpoint,
+		decode(DecodeHTTPJobRequest),
+		EncodeHTTPJobResponse,
+		options...,
+	)).Methods("POST")
+	m.Handle("/api/speech/jobs/{id}", httptransport.NewServer(
+		ctx,
+		endpoints.JobEndpoint,
+		DecodeHTTPJobStatusRequest,
+		EncodeHTTPVoiceResponse,
+		options...,
+	)).Methods("GET")
+	m.Handle("/api/text", httptransport.NewServer(
+		ctx,
+		endpoints.TextEndpoint,
+		DecodeHTTPTextRequest,
+		EncodeHTTPVoiceResponse,
+		options...,
+	)).Methods("POST")
 	return m
 }
 
+// traceFromRequest continues the trace of the request, the endpoints are
+// called with the server's context rather than the request's.
+func traceFromRequest(ctx context.Context, r *http.Request) context.Context {
+	return trace.ContextWithSpan(ctx, trace.SpanFromContext(r.Context()))
+}
+
 type errorWrapper struct {
 	Error string `json:"error"`
 }
@@ -47,6 +82,14 @@ func errorEncoder(_ context.Context, err error, w http.ResponseWriter) {
 
 		case httptransport.DomainDo:
 			code = http.StatusBadRequest
+			switch e.Err {
+			case ErrNoSpeech:
+				code = http.StatusUnprocessableEntity
+			case ErrJobNotFound:
+				code = http.StatusNotFound
+			case ErrAudioTooLong:
+				code = http.StatusRequestEntityTooLarge
+			}
 		}
 	}
 
@@ -54,8 +97,11 @@ func errorEncoder(_ context.Context, err error, w http.ResponseWriter) {
 	json.NewEncoder(w).Encode(errorWrapper{Error: msg})
 }
 
+// locales are BCP-47 language tags, eg. "en", "en-US" or "zh-Hans-CN"
+var locale = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+
 func DecodeHTTPVoiceRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
-	file, _, err := r.FormFile("file")
+	file, header, err := r.FormFile("file")
 	if err != nil {
 		return nil, err
 	}
@@ -66,19 +112,102 @@ func DecodeHTTPVoiceRequest(_ context.Context, r *http.Request) (request interfa
 		return nil, fmt.Errorf("Read Error: %v", err)
 	}
 
-	newReader := bytes.NewReader(b)
-	wavReader, _ := wav.NewReader(newReader, newReader.Size())
-	sampleCount := wavReader.ChunkFmt.SampleRate
-	if sampleCount == 0 {
-		sampleCount = 44100
+	// headerless µ-law can only be recognized by its content type
+	var clip *audio.Clip
+	if header.Header.Get("Content-Type") == "audio/basic" {
+		clip = audio.DecodeMulaw(b, 8000, 1)
+	} else {
+		clip, err = audio.Decode(b)
+		if err != nil {
+			return nil, fmt.Errorf("Audio Error: %v", err)
+		}
+	}
+
+	if len(clip.Samples) == 0 {
+		return nil, fmt.Errorf("Audio Error: file contains no audio")
+	}
+
+	// the locale can be a form field or in the query string
+	language := r.FormValue("locale")
+	if language != "" && !locale.MatchString(language) {
+		return nil, fmt.Errorf("Locale Error: %q is not a valid locale", language)
+	}
+
+	target, err := decodeHTTPTarget(r)
+	if err != nil {
+		return nil, err
 	}
 
 	return VoiceRequest{
-		Audio:       b,
-		SampleCount: sampleCount,
+		Samples:    clip.Samples,
+		SampleRate: clip.SampleRate,
+		Language:   language,
+		Target:     target,
+	}, nil
+}
+
+// decodeHTTPTarget reads the tunnel target from the "device" field and
+// any number of "label" fields, eg. label=room=kitchen.
+func decodeHTTPTarget(r *http.Request) (tunnel.Target, error) {
+	target := tunnel.Target{DeviceID: r.FormValue("device")}
+	for _, label := range r.Form["label"] {
+		i := strings.Index(label, "=")
+		if i < 1 {
+			return target, fmt.Errorf("Target Error: label %q is not key=value", label)
+		}
+		if target.Labels == nil {
+			target.Labels = make(map[string]string)
+		}
+		target.Labels[label[:i]] = label[i+1:]
+	}
+	return target, nil
+}
+
+func DecodeHTTPTextRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	text := TextRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&text); err != nil {
+		return nil, fmt.Errorf("Text Error: %v", err)
+	}
+	if strings.TrimSpace(text.Text) == "" {
+		return nil, fmt.Errorf("Text Error: text is required")
+	}
+	return text, nil
+}
+
+func DecodeHTTPJobRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	voice, err := DecodeHTTPVoiceRequest(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	broadcast := false
+	if b := r.FormValue("broadcast"); b != "" {
+		broadcast, err = strconv.ParseBool(b)
+		if err != nil {
+			return nil, fmt.Errorf("Broadcast Error: %q is not a boolean", b)
+		}
+	}
+
+	return JobRequest{
+		Voice:     voice.(VoiceRequest),
+		Broadcast: broadcast,
 	}, nil
 }
 
+func DecodeHTTPJobStatusRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	return JobStatusRequest{ID: mux.Vars(r)["id"]}, nil
+}
+
+// EncodeHTTPJobResponse accepts a submitted job and points the client
+// at where to poll it.
+func EncodeHTTPJobResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	job := response.(*Job)
+	w.Header().Add("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/speech/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	return json.NewEncoder(w).Encode(job)
+}
+
 func EncodeHTTPVoiceResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
 	w.Header().Add("Content-Type", "application/json")
 	return json.NewEncoder(w).Encode(response)
@@ -0,0 +1,253 @@
+package voice
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/begizi/vch-server/audio"
+	"github.com/begizi/vch-server/tunnel"
+	"github.com/go-kit/kit/log"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"golang.org/x/net/context"
+)
+
+func noDecodeMiddleware(decode httptransport.DecodeRequestFunc) httptransport.DecodeRequestFunc {
+	return decode
+}
+
+// newVoiceServer serves the HTTP transport with a voice endpoint that
+// returns err, or a canned response when it is nil.
+func newVoiceServer(t *testing.T, err error) *httptest.Server {
+	endpoints := Endpoints{
+		VoiceEndpoint: func(ctx context.Context, request interface{}) (interface{}, error) {
+			if err != nil {
+				return nil, err
+			}
+			return &VoiceResponse{Code: 200, Transcript: "turn on the lights"}, nil
+		},
+	}
+
+	s := httptest.NewServer(MakeVoiceHTTPServer(context.Background(), endpoints, noDecodeMiddleware, log.NewNopLogger()))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// postFile uploads data as the "file" field and decodes the error, if any.
+func postFile(t *testing.T, s *httptest.Server, data []byte) (int, string) {
+	return postFileQuery(t, s, "", data)
+}
+
+// postFileQuery is postFile with query appended to the URL.
+func postFileQuery(t *testing.T, s *httptest.Server, query string, data []byte) (int, string) {
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	part, err := form.CreateFormFile("file", "clip.wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	form.Close()
+
+	resp, err := http.Post(s.URL+"/api/speech"+query, form.FormDataContentType(), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	e := errorWrapper{}
+	json.NewDecoder(resp.Body).Decode(&e)
+	return resp.StatusCode, e.Error
+}
+
+// wavClip is a mono 16-bit WAV file of samples.
+func wavClip(samples []int16, rate uint32) []byte {
+	data := audio.Linear16(samples)
+	header := []byte("RIFF\x00\x00\x00\x00WAVEfmt \x10\x00\x00\x00\x01\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x10\x00data\x00\x00\x00\x00")
+	binary.LittleEndian.PutUint32(header[4:], uint32(36+len(data)))
+	binary.LittleEndian.PutUint32(header[24:], rate)
+	binary.LittleEndian.PutUint32(header[28:], rate*2)
+	binary.LittleEndian.PutUint32(header[40:], uint32(len(data)))
+	return append(header, data...)
+}
+
+func TestHTTPVoiceDecodeErrors(t *testing.T) {
+	valid := wavClip(make([]int16, 1600), 16000)
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"truncated header", valid[:30]},
+		{"malformed", append(append([]byte(nil), valid[:12]...), "fmt \xff\xff\xff\x00"...)},
+		{"no audio", valid[:44]},
+		{"unsupported format", []byte("ID3\x03\x00\x00\x00\x00\x00\x00")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newVoiceServer(t, nil)
+			code, msg := postFile(t, s, tc.data)
+			if code != http.StatusBadRequest {
+				t.Errorf("status = %d (%q), want %d", code, msg, http.StatusBadRequest)
+			}
+		})
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		s := newVoiceServer(t, nil)
+		if code, msg := postFile(t, s, valid); code != http.StatusOK {
+			t.Errorf("status = %d (%q), want %d", code, msg, http.StatusOK)
+		}
+	})
+}
+
+func TestHTTPVoiceEndpointErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		code int
+	}{
+		{"no speech", ErrNoSpeech, http.StatusUnprocessableEntity},
+		{"too long", ErrAudioTooLong, http.StatusRequestEntityTooLarge},
+		{"other", errors.New("NLU Error: unavailable"), http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newVoiceServer(t, tc.err)
+			code, msg := postFile(t, s, wavClip(make([]int16, 1600), 16000))
+			if code != tc.code {
+				t.Errorf("status = %d, want %d", code, tc.code)
+			}
+			if msg != tc.err.Error() {
+				t.Errorf("error = %q, want %q", msg, tc.err.Error())
+			}
+		})
+	}
+}
+
+func TestHTTPVoiceLocale(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  string
+		code  int
+	}{
+		{"", "", http.StatusOK},
+		{"?locale=en", "en", http.StatusOK},
+		{"?locale=en-US", "en-US", http.StatusOK},
+		{"?locale=zh-Hans-CN", "zh-Hans-CN", http.StatusOK},
+		{"?locale=en_US", "", http.StatusBadRequest},
+		{"?locale=e", "", http.StatusBadRequest},
+		{"?locale=english", "", http.StatusBadRequest},
+		{"?locale=en-", "", http.StatusBadRequest},
+		{"?locale=en-US%0A", "", http.StatusBadRequest},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			var language string
+			endpoints := Endpoints{
+				VoiceEndpoint: func(ctx context.Context, request interface{}) (interface{}, error) {
+					language = request.(VoiceRequest).Language
+					return &VoiceResponse{Code: 200}, nil
+				},
+			}
+			s := httptest.NewServer(MakeVoiceHTTPServer(context.Background(), endpoints, noDecodeMiddleware, log.NewNopLogger()))
+			defer s.Close()
+
+			code, msg := postFileQuery(t, s, tc.query, wavClip(make([]int16, 1600), 16000))
+			if code != tc.code {
+				t.Fatalf("status = %d (%q), want %d", code, msg, tc.code)
+			}
+			if language != tc.want {
+				t.Errorf("language = %q, want %q", language, tc.want)
+			}
+		})
+	}
+}
+
+func TestHTTPText(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		body   string
+		code   int
+		target tunnel.Target
+	}{
+		{"text", `{"text": "turn on the lights"}`, http.StatusOK, tunnel.Target{}},
+		{"device", `{"text": "turn on the lights", "target": {"deviceId": "lamp-1"}}`, http.StatusOK, tunnel.Target{DeviceID: "lamp-1"}},
+		{"labels", `{"text": "turn on the lights", "target": {"labels": {"room": "kitchen"}}}`, http.StatusOK, tunnel.Target{Labels: map[string]string{"room": "kitchen"}}},
+		{"empty text", `{"text": ""}`, http.StatusBadRequest, tunnel.Target{}},
+		{"blank text", `{"text": "  "}`, http.StatusBadRequest, tunnel.Target{}},
+		{"no text", `{}`, http.StatusBadRequest, tunnel.Target{}},
+		{"malformed", `turn on the lights`, http.StatusBadRequest, tunnel.Target{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got *TextRequest
+			endpoints := Endpoints{
+				TextEndpoint: func(ctx context.Context, request interface{}) (interface{}, error) {
+					req := request.(TextRequest)
+					got = &req
+					return &VoiceResponse{Code: 200, Transcript: req.Text}, nil
+				},
+			}
+			s := httptest.NewServer(MakeVoiceHTTPServer(context.Background(), endpoints, noDecodeMiddleware, log.NewNopLogger()))
+			defer s.Close()
+
+			resp, err := http.Post(s.URL+"/api/text", "application/json", strings.NewReader(tc.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tc.code {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tc.code)
+			}
+			if tc.code != http.StatusOK {
+				if got != nil {
+					t.Errorf("endpoint called with %+v, want the request rejected", got)
+				}
+				return
+			}
+			if got == nil || got.Text != "turn on the lights" || !reflect.DeepEqual(got.Target, tc.target) {
+				t.Errorf("endpoint called with %+v, want the text for %+v", got, tc.target)
+			}
+		})
+	}
+}
+
+func TestDecodeHTTPTarget(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  tunnel.Target
+	}{
+		{"", tunnel.Target{}},
+		{"device=lamp-1", tunnel.Target{DeviceID: "lamp-1"}},
+		{"label=room=kitchen", tunnel.Target{Labels: map[string]string{"room": "kitchen"}}},
+		{"label=room=kitchen&label=kind=lamp", tunnel.Target{Labels: map[string]string{"room": "kitchen", "kind": "lamp"}}},
+		{"label=note=a=b", tunnel.Target{Labels: map[string]string{"note": "a=b"}}},
+		{"label=room=", tunnel.Target{Labels: map[string]string{"room": ""}}},
+		{"device=lamp-1&label=room=kitchen", tunnel.Target{DeviceID: "lamp-1", Labels: map[string]string{"room": "kitchen"}}},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/speech?"+tc.query, nil)
+			got, err := decodeHTTPTarget(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("target = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+
+	for _, query := range []string{"label=room", "label==kitchen", "label="} {
+		t.Run(query, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/speech?"+query, nil)
+			if _, err := decodeHTTPTarget(r); err == nil {
+				t.Errorf("decoded a malformed label")
+			}
+		})
+	}
+}
@@ -0,0 +1,252 @@
+package voice
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/begizi/vch-server/asr"
+	"github.com/begizi/vch-server/audio"
+	"github.com/begizi/vch-server/tunnel"
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/context"
+)
+
+/*
+Voice WebSocket
+---------------
+
+Browsers stream audio to /api/speech/stream while the user
+is still speaking. The client first sends a text config
+message, then binary frames of audio:
+
+	{"type": "config", "encoding": "linear16", "sampleRate": 44100, "channels": 1, "locale": "en-US",
+	 "target": {"deviceId": "lamp-1", "labels": {"room": "kitchen"}}}
+
+"linear16" frames are 16-bit little-endian PCM and "opus"
+frames are single raw Opus packets. The locale is optional
+and defaults to the server's. Without a target the result
+goes to every tunnel session. The client sends
+{"type": "end"} once it is done, closing the connection
+normally ends the stream as well. A client that goes away
+any other way aborts the stream and nothing is broadcast.
+The server pushes back "transcript" messages while
+recognizing and finishes with a "result" or an "error"
+message. Messages are limited to maxMessageSize.
+*/
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 1024,
+	// the /api/ routes already allow any origin
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// maxMessageSize bounds a single message from the client, a second of
+// 48kHz stereo linear16 is under 200kB.
+const maxMessageSize = 1 << 20
+
+// errAborted is returned when the client goes away mid stream.
+var errAborted = errors.New("client aborted the stream")
+
+type wsClientMessage struct {
+	Type       string `json:"type"`
+	Encoding   string `json:"encoding"`
+	SampleRate uint32 `json:"sampleRate"`
+	Channels   int    `json:"channels"`
+	Locale     string `json:"locale"`
+
+	Target tunnel.Target `json:"target"`
+}
+
+type wsTranscript struct {
+	Text       string  `json:"text"`
+	Confidence float32 `json:"confidence"`
+	Final      bool    `json:"final"`
+}
+
+type wsServerMessage struct {
+	Type       string         `json:"type"`
+	Transcript *wsTranscript  `json:"transcript,omitempty"`
+	Result     *VoiceResponse `json:"result,omitempty"`
+	Error      string         `json:"error,omitempty"`
+}
+
+// MakeVoiceWebSocketHandler serves streamed audio. Recognition is
+// cancelled once the request is done or the client goes away.
+func MakeVoiceWebSocketHandler(endpoints Endpoints, logger log.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// the upgrader has already replied with an error
+			logger.Log("msg", "WebSocket upgrade failed", "err", err)
+			return
+		}
+		defer conn.Close()
+		conn.SetReadLimit(maxMessageSize)
+
+		resp, err := serveVoiceStream(r.Context(), endpoints, conn)
+		if err != nil {
+			logger.Log("msg", "Voice stream failed", "err", err)
+			conn.WriteJSON(wsServerMessage{Type: "error", Error: err.Error()})
+			return
+		}
+
+		conn.WriteJSON(wsServerMessage{Type: "result", Result: resp})
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	})
+}
+
+// frameDecoder turns a binary frame into mono 16-bit samples.
+type frameDecoder func(frame []byte) ([]int16, error)
+
+func newFrameDecoder(config wsClientMessage) (frameDecoder, error) {
+	channels := config.Channels
+	if channels < 1 {
+		channels = 1
+	}
+
+	switch config.Encoding {
+	case "", "linear16":
+		return func(frame []byte) ([]int16, error) {
+			return audio.Downmix(audio.Samples(frame), channels), nil
+		}, nil
+	case "opus":
+		decoder, err := audio.NewOpusDecoder(config.SampleRate, channels)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.Decode, nil
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q", config.Encoding)
+	}
+}
+
+func readConfig(conn *websocket.Conn) (wsClientMessage, error) {
+	config := wsClientMessage{}
+
+	messageType, data, err := conn.ReadMessage()
+	if err != nil {
+		return config, err
+	}
+	if messageType != websocket.TextMessage {
+		return config, errors.New("first message must be the config")
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("Config Error: %v", err)
+	}
+	if config.Type != "config" {
+		return config, errors.New("first message must be the config")
+	}
+	if config.SampleRate == 0 {
+		return config, errors.New("config is missing the sample rate")
+	}
+	if config.Locale != "" && !locale.MatchString(config.Locale) {
+		return config, fmt.Errorf("Locale Error: %q is not a valid locale", config.Locale)
+	}
+
+	return config, nil
+}
+
+func serveVoiceStream(ctx context.Context, endpoints Endpoints, conn *websocket.Conn) (*VoiceResponse, error) {
+	config, err := readConfig(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	decode, err := newFrameDecoder(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// cancelled when the client sends audio we can't decode or goes away
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	audioc := make(chan []byte)
+	resultc := make(chan asr.StreamResult)
+	done := make(chan struct{})
+	defer close(done)
+
+	// read audio until the client ends the stream or goes away
+	readc := make(chan error, 1)
+	go func() {
+		defer close(audioc)
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+					readc <- nil
+					return
+				}
+				// never act on a partial utterance
+				readc <- fmt.Errorf("%v: %v", errAborted, err)
+				cancel()
+				return
+			}
+
+			if messageType == websocket.TextMessage {
+				msg := wsClientMessage{}
+				if err := json.Unmarshal(data, &msg); err == nil && msg.Type == "end" {
+					readc <- nil
+					return
+				}
+				continue
+			}
+
+			samples, err := decode(data)
+			if err != nil {
+				readc <- err
+				cancel()
+				return
+			}
+
+			select {
+			case audioc <- audio.Linear16(samples):
+			case <-done:
+				readc <- nil
+				return
+			}
+		}
+	}()
+
+	// push transcripts back while the service is still recognizing
+	sentc := make(chan struct{})
+	go func() {
+		defer close(sentc)
+		for result := range resultc {
+			transcript := &wsTranscript{Final: result.Final}
+			if len(result.Transcripts) > 0 {
+				transcript.Text = result.Transcripts[0].Text
+				transcript.Confidence = result.Transcripts[0].Confidence
+			}
+			conn.WriteJSON(wsServerMessage{Type: "transcript", Transcript: transcript})
+		}
+	}()
+
+	resp, err := endpoints.StreamVoice(ctx, StreamVoiceRequest{
+		Format: asr.Format{
+			Encoding:   asr.LINEAR16,
+			SampleRate: config.SampleRate,
+			Language:   config.Locale,
+		},
+		Audio:   audioc,
+		Results: resultc,
+		Target:  config.Target,
+	})
+	<-sentc
+	if err != nil {
+		select {
+		case readErr := <-readc:
+			if readErr != nil {
+				return nil, readErr
+			}
+		default:
+		}
+		return nil, err
+	}
+
+	return resp, nil
+}
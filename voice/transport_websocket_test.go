@@ -0,0 +1,147 @@
+package voice
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/context"
+)
+
+// streamResult is what the stream endpoint saw of a stream.
+type streamResult struct {
+	chunks    int
+	cancelled bool
+}
+
+// newStreamServer serves the WebSocket handler with an endpoint that reads
+// the whole stream and reports what it saw.
+func newStreamServer(t *testing.T) (*httptest.Server, <-chan streamResult) {
+	seen := make(chan streamResult, 1)
+	endpoints := Endpoints{
+		StreamVoiceEndpoint: func(ctx context.Context, request interface{}) (interface{}, error) {
+			req := request.(StreamVoiceRequest)
+			defer close(req.Results)
+
+			result := streamResult{}
+			for range req.Audio {
+				result.chunks++
+			}
+			result.cancelled = ctx.Err() != nil
+			seen <- result
+
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			return &VoiceResponse{Code: 200, Transcript: "turn on the lights"}, nil
+		},
+	}
+
+	s := httptest.NewServer(MakeVoiceWebSocketHandler(endpoints, log.NewNopLogger()))
+	t.Cleanup(s.Close)
+	return s, seen
+}
+
+func dialStream(t *testing.T, s *httptest.Server) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	if err := conn.WriteJSON(wsClientMessage{Type: "config", SampleRate: 16000}); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, make([]byte, 320)); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func waitForStream(t *testing.T, seen <-chan streamResult) streamResult {
+	select {
+	case result := <-seen:
+		return result
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the stream to end")
+	}
+	return streamResult{}
+}
+
+func TestWebSocketEnd(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		end  func(conn *websocket.Conn) error
+	}{
+		{"end message", func(conn *websocket.Conn) error {
+			return conn.WriteJSON(wsClientMessage{Type: "end"})
+		}},
+		{"normal close", func(conn *websocket.Conn) error {
+			return conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, seen := newStreamServer(t)
+			conn := dialStream(t, s)
+			if err := tc.end(conn); err != nil {
+				t.Fatal(err)
+			}
+
+			result := waitForStream(t, seen)
+			if result.cancelled {
+				t.Error("stream was cancelled, want it recognized")
+			}
+			if result.chunks != 1 {
+				t.Errorf("endpoint got %d chunks, want 1", result.chunks)
+			}
+		})
+	}
+
+	t.Run("result", func(t *testing.T) {
+		s, _ := newStreamServer(t)
+		conn := dialStream(t, s)
+		if err := conn.WriteJSON(wsClientMessage{Type: "end"}); err != nil {
+			t.Fatal(err)
+		}
+
+		msg := wsServerMessage{}
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type != "result" || msg.Result == nil || msg.Result.Transcript != "turn on the lights" {
+			t.Errorf("got %+v, want the result", msg)
+		}
+	})
+}
+
+func TestWebSocketAbort(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		abort func(conn *websocket.Conn) error
+	}{
+		{"connection lost", func(conn *websocket.Conn) error {
+			return conn.UnderlyingConn().Close()
+		}},
+		{"going away", func(conn *websocket.Conn) error {
+			return conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+		}},
+		{"message too large", func(conn *websocket.Conn) error {
+			return conn.WriteMessage(websocket.BinaryMessage, make([]byte, maxMessageSize+1))
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, seen := newStreamServer(t)
+			conn := dialStream(t, s)
+			if err := tc.abort(conn); err != nil {
+				t.Fatal(err)
+			}
+
+			if result := waitForStream(t, seen); !result.cancelled {
+				t.Error("aborted stream was recognized, want it cancelled")
+			}
+		})
+	}
+}
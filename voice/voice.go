@@ -1,11 +1,60 @@
 package voice
 
+import (
+	"errors"
+
+	"github.com/begizi/vch-server/asr"
+	"github.com/begizi/vch-server/nlu"
+	"github.com/begizi/vch-server/tunnel"
+)
+
+// ErrNoSpeech is returned for audio that is only silence or noise,
+// which is never sent to the recognizer, and for audio the recognizer
+// couldn't make any words of.
+var ErrNoSpeech = errors.New("no speech detected")
+
+// VoiceRequest is a complete recording, already decoded to mono
+// 16-bit samples.
 type VoiceRequest struct {
-	Audio       []byte
-	SampleCount uint32
+	Samples    []int16
+	SampleRate uint32
+
+	// Language is the BCP-47 code of the spoken language, or empty
+	// for the server default.
+	Language string
+
+	// Target picks the tunnel sessions the result is delivered to.
+	Target tunnel.Target
+}
+
+// TextRequest is a typed utterance, handled as if it had been spoken.
+type TextRequest struct {
+	Text   string        `json:"text"`
+	Target tunnel.Target `json:"target"`
 }
 
+type StreamVoiceRequest struct {
+	Format asr.Format
+
+	// Audio is closed by the transport once the client stops sending.
+	Audio <-chan []byte
+
+	// Results receives interim and final transcripts as they are
+	// recognized. The service closes it before returning.
+	Results chan<- asr.StreamResult
+
+	// Target picks the tunnel sessions the result is delivered to.
+	Target tunnel.Target
+}
+
+// NotUnderstood is the message returned in place of a command when
+// the recognizer isn't confident enough in what it heard.
+const NotUnderstood = "Sorry, I didn't catch that"
+
 type VoiceResponse struct {
-	Code int         `json:"code"`
-	Body interface{} `json:"body"`
+	Code       int                    `json:"code"`
+	Transcript string                 `json:"transcript"`
+	Confidence float32                `json:"confidence"`
+	Message    string                 `json:"message,omitempty"`
+	Body       []*nlu.CompositeEntity `json:"body"`
 }